@@ -8,12 +8,19 @@ import (
 	"syscall"
 
 	"github.com/natsvr/natsvr/internal/agent"
+	"github.com/natsvr/natsvr/internal/protocol"
 )
 
 func main() {
-	serverURL := flag.String("server", "ws://localhost:8080/ws", "Cloud server WebSocket URL")
+	serverURL := flag.String("server", "ws://localhost:8080/ws", "Cloud server URL, ws://host:port/ws, wss://..., quic://host:port, tls://host:port or kcp://host:port")
 	token := flag.String("token", "", "Authentication token")
 	name := flag.String("name", "", "Agent name")
+	labels := flag.String("labels", "", "Agent labels, e.g. env=prod,region=eu")
+	stateDir := flag.String("state-dir", "", "Directory for the persistent agent identity (default: per-name directory in the user config dir)")
+	serverFingerprint := flag.String("server-fingerprint", "", "Accept the cloud certificate with this SHA-256 fingerprint (hex) instead of verifying it, for self-signed certificates")
+	serverCA := flag.String("server-ca", "", "Verify the cloud certificate against the CA certificates in this PEM file instead of the system roots")
+	peerKeys := flag.String("peer-keys", "", "Pin the identity keys of end-to-end encrypted tunnel peers, e.g. <agent-id>=<fingerprint>,... (other peers are pinned on first use)")
+	metricsAddr := flag.String("metrics-addr", "", "Serve /metrics and /status on this address, e.g. 127.0.0.1:9100 (disabled if empty)")
 	flag.Parse()
 
 	if *token == "" {
@@ -29,6 +36,12 @@ func main() {
 		ServerURL: *serverURL,
 		Token:     *token,
 		Name:      *name,
+		Labels:    protocol.ParseLabels(*labels),
+		StateDir:  *stateDir,
+
+		ServerFingerprint: *serverFingerprint,
+		ServerCAFile:      *serverCA,
+		PeerKeys:          protocol.ParseLabels(*peerKeys),
 	}
 
 	client, err := agent.NewClient(cfg)
@@ -47,6 +60,15 @@ func main() {
 		os.Exit(0)
 	}()
 
+	if *metricsAddr != "" {
+		go func() {
+			log.Printf("Serving metrics and status on %s", *metricsAddr)
+			if err := client.ServeStatus(*metricsAddr); err != nil {
+				log.Printf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+
 	log.Printf("Starting natsvr agent '%s', connecting to %s", *name, *serverURL)
 	client.Run()
 }
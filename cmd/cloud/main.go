@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/natsvr/natsvr/internal/cloud"
 	"gopkg.in/yaml.v3"
@@ -25,6 +26,40 @@ type ConfigFile struct {
 	AdminToken string `json:"admin_token" yaml:"admin_token"`
 	DBPath     string `json:"db" yaml:"db"`
 	DataDir    string `json:"data_dir" yaml:"data_dir"`
+	// AdminUsers maps dashboard usernames to passwords
+	AdminUsers map[string]string `json:"admin_users" yaml:"admin_users"`
+	// SessionTTL is the dashboard session lifetime, e.g. "12h"
+	SessionTTL string `json:"session_ttl" yaml:"session_ttl"`
+	// RendezvousAddr is the UDP address for direct agent-to-agent paths
+	RendezvousAddr string `json:"rendezvous_addr" yaml:"rendezvous_addr"`
+	// Listen lists extra agent transports, e.g. ["quic://:8443", "kcp://:8445"]
+	Listen        []string `json:"listen" yaml:"listen"`
+	TransportCert string   `json:"transport_cert" yaml:"transport_cert"`
+	TransportKey  string   `json:"transport_key" yaml:"transport_key"`
+	// AgentMTLS is "off", "optional" or "required"
+	AgentMTLS    string `json:"agent_mtls" yaml:"agent_mtls"`
+	ClientCACert string `json:"client_ca_cert" yaml:"client_ca_cert"`
+	ClientCAKey  string `json:"client_ca_key" yaml:"client_ca_key"`
+	// TLSCert and TLSKey serve HTTPS with a static certificate
+	TLSCert string `json:"tls_cert" yaml:"tls_cert"`
+	TLSKey  string `json:"tls_key" yaml:"tls_key"`
+	// ACME serves HTTPS with certificates from an ACME CA
+	ACME struct {
+		Domains   []string `json:"domains" yaml:"domains"`
+		Email     string   `json:"email" yaml:"email"`
+		Directory string   `json:"directory" yaml:"directory"`
+		CA        string   `json:"ca" yaml:"ca"`
+		CacheDir  string   `json:"cache_dir" yaml:"cache_dir"`
+		HTTPAddr  string   `json:"http_addr" yaml:"http_addr"`
+	} `json:"acme" yaml:"acme"`
+	// VHostAddr serves only http rules over plain HTTP, e.g. ":80"
+	VHostAddr string `json:"vhost_addr" yaml:"vhost_addr"`
+	// SNIAddr routes TLS connections of tls-sni rules, e.g. ":443"
+	SNIAddr string `json:"sni_addr" yaml:"sni_addr"`
+	// ProxyProtocolFrom lists load balancers sending PROXY headers, e.g. ["10.0.0.0/8"]
+	ProxyProtocolFrom []string `json:"proxy_protocol_from" yaml:"proxy_protocol_from"`
+	// GeoIPDB is a MaxMind DB file for the country filters of rules
+	GeoIPDB string `json:"geoip_db" yaml:"geoip_db"`
 }
 
 func main() {
@@ -36,15 +71,59 @@ func main() {
 	dbPath := flag.String("db", "natsvr.db", "SQLite database path")
 	devMode := flag.Bool("dev", false, "Enable development mode (proxy frontend to Vite dev server)")
 	devURL := flag.String("dev-url", "http://localhost:5173", "Vite dev server URL")
+	rendezvousAddr := flag.String("rendezvous-addr", "", "UDP address for direct agent-to-agent paths, e.g. :8081 (empty = relay only)")
+	listen := flag.String("listen", "", "Extra agent transports, comma separated, e.g. quic://:8443,tls://:8444,kcp://:8445 (empty = WebSocket only)")
+	transportCert := flag.String("transport-cert", "", "Certificate file of the -listen transports (default: self-signed transport-cert.pem next to the database)")
+	transportKey := flag.String("transport-key", "", "Private key file of the -listen transports (default: transport-key.pem next to the database)")
+	agentMTLS := flag.String("agent-mtls", "", "Agent client certificates: off, optional or required (default: off)")
+	clientCACert := flag.String("client-ca-cert", "", "CA certificate file issuing agent certificates (default: client-ca-cert.pem next to the database)")
+	clientCAKey := flag.String("client-ca-key", "", "CA private key file issuing agent certificates (default: client-ca-key.pem next to the database)")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS with this certificate file")
+	tlsKey := flag.String("tls-key", "", "Private key file of -tls-cert")
+	acmeDomains := flag.String("acme-domains", "", "Serve HTTPS with ACME certificates for these domains, comma separated")
+	acmeEmail := flag.String("acme-email", "", "Contact email of the ACME account")
+	acmeDirectory := flag.String("acme-directory", "", "ACME directory URL (default: Let's Encrypt)")
+	acmeCA := flag.String("acme-ca", "", "PEM file of the CA the ACME directory is served with, e.g. Pebble's")
+	acmeCacheDir := flag.String("acme-cache-dir", "", "Directory for the ACME account and certificates (default: acme next to the database)")
+	acmeHTTPAddr := flag.String("acme-http-addr", "", "Answer ACME HTTP-01 challenges on this address, e.g. :80 (default: TLS-ALPN-01 only)")
+	vhostAddr := flag.String("vhost-addr", "", "Serve http rules over plain HTTP on this address too, e.g. :80 (default: on -addr only)")
+	sniAddr := flag.String("sni-addr", "", "Route TLS connections of tls-sni rules by server name on this address, e.g. :443 (may equal -addr when serving HTTPS)")
+	proxyProtocolFrom := flag.String("proxy-protocol-from", "", "Accept PROXY protocol headers from these addresses or CIDRs, comma separated, e.g. 10.0.0.0/8 (empty = none)")
+	geoipDB := flag.String("geoip-db", "", "MaxMind DB file with the countries of addresses, e.g. GeoLite2-Country.mmdb, for country filters of rules")
 	flag.Parse()
 
 	// Start with defaults/flags
 	cfg := &cloud.Config{
-		Addr:    *addr,
-		Token:   *token,
-		DBPath:  *dbPath,
-		DevMode: *devMode,
-		DevURL:  *devURL,
+		Addr:              *addr,
+		Token:             *token,
+		DBPath:            *dbPath,
+		DevMode:           *devMode,
+		DevURL:            *devURL,
+		RendezvousAddr:    *rendezvousAddr,
+		TransportCertFile: *transportCert,
+		TransportKeyFile:  *transportKey,
+		AgentMTLS:         *agentMTLS,
+		ClientCACertFile:  *clientCACert,
+		ClientCAKeyFile:   *clientCAKey,
+		TLSCertFile:       *tlsCert,
+		TLSKeyFile:        *tlsKey,
+		ACMEEmail:         *acmeEmail,
+		ACMEDirectory:     *acmeDirectory,
+		ACMECAFile:        *acmeCA,
+		ACMECacheDir:      *acmeCacheDir,
+		ACMEHTTPAddr:      *acmeHTTPAddr,
+		VHostAddr:         *vhostAddr,
+		SNIAddr:           *sniAddr,
+		GeoIPDBFile:       *geoipDB,
+	}
+	if *listen != "" {
+		cfg.Listeners = strings.Split(*listen, ",")
+	}
+	if *acmeDomains != "" {
+		cfg.ACMEDomains = strings.Split(*acmeDomains, ",")
+	}
+	if *proxyProtocolFrom != "" {
+		cfg.ProxyProtocolFrom = strings.Split(*proxyProtocolFrom, ",")
 	}
 
 	// If config file is provided, load it (overrides defaults but not explicit flags)
@@ -73,6 +152,71 @@ func main() {
 		if configDB != "" && *dbPath == "natsvr.db" {
 			cfg.DBPath = configDB
 		}
+		cfg.AdminUsers = fileCfg.AdminUsers
+		if fileCfg.RendezvousAddr != "" && *rendezvousAddr == "" {
+			cfg.RendezvousAddr = fileCfg.RendezvousAddr
+		}
+		if len(fileCfg.Listen) > 0 && *listen == "" {
+			cfg.Listeners = fileCfg.Listen
+		}
+		if fileCfg.TransportCert != "" && *transportCert == "" {
+			cfg.TransportCertFile = fileCfg.TransportCert
+		}
+		if fileCfg.TransportKey != "" && *transportKey == "" {
+			cfg.TransportKeyFile = fileCfg.TransportKey
+		}
+		if fileCfg.AgentMTLS != "" && *agentMTLS == "" {
+			cfg.AgentMTLS = fileCfg.AgentMTLS
+		}
+		if fileCfg.ClientCACert != "" && *clientCACert == "" {
+			cfg.ClientCACertFile = fileCfg.ClientCACert
+		}
+		if fileCfg.ClientCAKey != "" && *clientCAKey == "" {
+			cfg.ClientCAKeyFile = fileCfg.ClientCAKey
+		}
+		if fileCfg.TLSCert != "" && *tlsCert == "" {
+			cfg.TLSCertFile = fileCfg.TLSCert
+		}
+		if fileCfg.TLSKey != "" && *tlsKey == "" {
+			cfg.TLSKeyFile = fileCfg.TLSKey
+		}
+		if len(fileCfg.ACME.Domains) > 0 && *acmeDomains == "" {
+			cfg.ACMEDomains = fileCfg.ACME.Domains
+		}
+		if fileCfg.ACME.Email != "" && *acmeEmail == "" {
+			cfg.ACMEEmail = fileCfg.ACME.Email
+		}
+		if fileCfg.ACME.Directory != "" && *acmeDirectory == "" {
+			cfg.ACMEDirectory = fileCfg.ACME.Directory
+		}
+		if fileCfg.ACME.CA != "" && *acmeCA == "" {
+			cfg.ACMECAFile = fileCfg.ACME.CA
+		}
+		if fileCfg.ACME.CacheDir != "" && *acmeCacheDir == "" {
+			cfg.ACMECacheDir = fileCfg.ACME.CacheDir
+		}
+		if fileCfg.ACME.HTTPAddr != "" && *acmeHTTPAddr == "" {
+			cfg.ACMEHTTPAddr = fileCfg.ACME.HTTPAddr
+		}
+		if fileCfg.VHostAddr != "" && *vhostAddr == "" {
+			cfg.VHostAddr = fileCfg.VHostAddr
+		}
+		if fileCfg.SNIAddr != "" && *sniAddr == "" {
+			cfg.SNIAddr = fileCfg.SNIAddr
+		}
+		if len(fileCfg.ProxyProtocolFrom) > 0 && *proxyProtocolFrom == "" {
+			cfg.ProxyProtocolFrom = fileCfg.ProxyProtocolFrom
+		}
+		if fileCfg.GeoIPDB != "" && *geoipDB == "" {
+			cfg.GeoIPDBFile = fileCfg.GeoIPDB
+		}
+		if fileCfg.SessionTTL != "" {
+			ttl, err := time.ParseDuration(fileCfg.SessionTTL)
+			if err != nil {
+				log.Fatalf("Invalid session_ttl: %v", err)
+			}
+			cfg.SessionTTL = ttl
+		}
 	}
 
 	if cfg.Token == "" {
@@ -2,14 +2,19 @@ package agent
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"log"
+	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/natsvr/natsvr/internal/protocol"
-	"github.com/natsvr/natsvr/pkg/utils"
+	"github.com/natsvr/natsvr/internal/transport"
+	"github.com/natsvr/natsvr/pkg/version"
 )
 
 // Config holds agent configuration
@@ -17,38 +22,68 @@ type Config struct {
 	ServerURL string
 	Token     string
 	Name      string
+	Labels    map[string]string // Reported to the cloud registry
+	StateDir  string            // Directory holding the agent identity, empty = DefaultStateDir(Name)
+	// ServerFingerprint pins the cloud's certificate by its hex SHA-256,
+	// for servers with self-signed certificates
+	ServerFingerprint string
+	// ServerCAFile holds the PEM CA certificates the cloud's certificate
+	// must chain to, instead of the system roots
+	ServerCAFile string
+	// PeerKeys pins the identity key fingerprints of end-to-end encrypted
+	// tunnel peers by agent ID; other peers are pinned on first use
+	PeerKeys map[string]string
 }
 
 // Client is the agent client
 type Client struct {
 	config            *Config
+	identity          *Identity
+	peers             *peerKeys
+	serverCAs         *x509.CertPool // nil = system roots
 	agentID           string
-	conn              *websocket.Conn // Main control connection
+	conn              transport.Conn // Main control connection
 	connMu            sync.Mutex
+	ruleAuthNonce     []byte // Issued on the main connection, signed by rule connections
 	tunnels           map[uint32]*TunnelHandler
 	tunnelsMu         sync.RWMutex
-	localProxies      map[string]*P2PProxy        // rule ID -> P2P proxy
+	localProxies      map[string]*P2PProxy // rule ID -> P2P proxy
 	localProxyMu      sync.RWMutex
 	agentCloudProxies map[string]*AgentCloudProxy // rule ID -> agent-cloud proxy
 	agentCloudProxyMu sync.RWMutex
+	streams           *protocol.Mux // Flow control of TCP tunnels, by global tunnel ID
 	ctx               context.Context
 	cancel            context.CancelFunc
 	connected         bool
 	// Rule-specific connections (per-rule isolation)
 	ruleConns   map[string]*RuleConnection // ruleID -> connection
 	ruleConnsMu sync.RWMutex
+	// Connection history reported by the status endpoint
+	statusMu      sync.Mutex
+	connectedAt   time.Time
+	lastConnErr   string
+	reconnects    int64                   // atomic
+	ruleTraffic   map[string]*ruleTraffic // ruleID -> bytes across rule connections
+	ruleTrafficMu sync.Mutex
+	// Direct paths to other agents, nil unless the cloud runs a rendezvous
+	direct   *directPaths
+	directMu sync.Mutex
 }
 
 // RuleConnection represents a rule-specific WebSocket connection
 type RuleConnection struct {
 	RuleID    string
-	Conn      *websocket.Conn
+	Conn      transport.Conn
 	connMu    sync.Mutex
 	tunnels   map[uint32]*TunnelHandler // Tunnels on this rule connection
 	tunnelsMu sync.RWMutex
 	ctx       context.Context
 	cancel    context.CancelFunc
 	connected bool
+	// Health reported by the status endpoint
+	connectedAt time.Time
+	lastRecv    int64 // atomic, unix nanoseconds
+	traffic     *ruleTraffic
 }
 
 // TunnelHandler handles a single tunnel
@@ -69,15 +104,45 @@ type TunnelProcessor interface {
 
 // NewClient creates a new agent client
 func NewClient(cfg *Config) (*Client, error) {
+	stateDir := cfg.StateDir
+	if stateDir == "" {
+		stateDir = DefaultStateDir(cfg.Name)
+	}
+	identity, err := LoadOrCreateIdentity(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("load agent identity: %w", err)
+	}
+	peers, err := loadPeerKeys(stateDir, cfg.PeerKeys)
+	if err != nil {
+		return nil, fmt.Errorf("load known peers: %w", err)
+	}
+
+	var serverCAs *x509.CertPool
+	if cfg.ServerCAFile != "" {
+		pem, err := os.ReadFile(cfg.ServerCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load server CA: %w", err)
+		}
+		serverCAs = x509.NewCertPool()
+		if !serverCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("load server CA: no certificates in %s", cfg.ServerCAFile)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Client{
 		config:            cfg,
-		agentID:           utils.GenerateID(16),
+		identity:          identity,
+		peers:             peers,
+		serverCAs:         serverCAs,
+		agentID:           identity.ID,
 		tunnels:           make(map[uint32]*TunnelHandler),
+		streams:           protocol.NewMux(),
 		localProxies:      make(map[string]*P2PProxy),
 		agentCloudProxies: make(map[string]*AgentCloudProxy),
 		ruleConns:         make(map[string]*RuleConnection),
+		ruleTraffic:       make(map[string]*ruleTraffic),
 		ctx:               ctx,
 		cancel:            cancel,
 	}, nil
@@ -85,19 +150,29 @@ func NewClient(cfg *Config) (*Client, error) {
 
 // Run starts the agent client
 func (c *Client) Run() {
-	for {
+	for attempt := 0; ; attempt++ {
 		select {
 		case <-c.ctx.Done():
 			return
 		default:
 		}
 
+		if attempt > 0 {
+			atomic.AddInt64(&c.reconnects, 1)
+		}
 		if err := c.connect(); err != nil {
+			c.statusMu.Lock()
+			c.lastConnErr = err.Error()
+			c.statusMu.Unlock()
 			log.Printf("Connection failed: %v, retrying in 5 seconds", err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
 
+		c.statusMu.Lock()
+		c.connectedAt = time.Now()
+		c.lastConnErr = ""
+		c.statusMu.Unlock()
 		c.connected = true
 		log.Printf("Connected to server")
 
@@ -114,6 +189,7 @@ func (c *Client) Run() {
 		c.cleanupTunnels()
 		c.cleanupLocalProxies()
 		c.cleanupAgentCloudProxies()
+		c.cleanupDirectPaths()
 
 		time.Sleep(2 * time.Second)
 	}
@@ -133,14 +209,21 @@ func (c *Client) Shutdown() {
 	c.cleanupLocalProxies()
 	c.cleanupAgentCloudProxies()
 	c.cleanupRuleConnections()
+	c.cleanupDirectPaths()
 }
 
-func (c *Client) connect() error {
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
-	}
+// dial opens a connection to the cloud, over the transport the server URL
+// selects
+func (c *Client) dial() (transport.Conn, error) {
+	return transport.Dial(c.config.ServerURL, &transport.DialOptions{
+		Fingerprint: c.config.ServerFingerprint,
+		RootCAs:     c.serverCAs,
+		Certificate: c.identity.ClientCertificate(),
+	})
+}
 
-	conn, _, err := dialer.Dial(c.config.ServerURL, nil)
+func (c *Client) connect() error {
+	conn, err := c.dial()
 	if err != nil {
 		return err
 	}
@@ -149,8 +232,23 @@ func (c *Client) connect() error {
 	c.conn = conn
 	c.connMu.Unlock()
 
-	// Send authentication
-	authMsg := protocol.NewAuthMessage(c.config.Token, c.config.Name, c.agentID)
+	// Send authentication, proving ownership of the agent ID
+	signature, timestamp := c.identity.SignAuth(c.config.Name)
+	authMsg := protocol.NewAuthMessage(&protocol.AuthPayload{
+		Token:     c.config.Token,
+		AgentName: c.config.Name,
+		AgentID:   c.agentID,
+		Version:   version.Version,
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Labels:    c.config.Labels,
+		PublicKey: c.identity.PublicKey(),
+		Signature: signature,
+		Timestamp: timestamp,
+
+		ProtocolVersion: protocol.ProtocolVersion,
+		Capabilities:    protocol.LocalCapabilities,
+	})
 	if err := c.sendMessage(authMsg); err != nil {
 		conn.Close()
 		return err
@@ -184,14 +282,34 @@ func (c *Client) connect() error {
 
 	if !authResp.Success {
 		conn.Close()
-		return err
+		return fmt.Errorf("authentication failed: %s", authResp.Error)
+	}
+
+	if err := protocol.CheckProtocolVersion(authResp.ProtocolVersion); err != nil {
+		conn.Close()
+		return fmt.Errorf("server: %w", err)
 	}
 
 	if authResp.AgentID != "" {
 		c.agentID = authResp.AgentID
 	}
 
-	log.Printf("Authenticated as agent %s", c.agentID)
+	c.connMu.Lock()
+	c.ruleAuthNonce = authResp.RuleAuthNonce
+	c.connMu.Unlock()
+
+	log.Printf("Authenticated as agent %s (server protocol %d, capabilities %s, key %s)",
+		c.agentID, authResp.ProtocolVersion, authResp.Capabilities, protocol.KeyFingerprint(c.identity.PublicKey()))
+
+	// The cloud issued a client certificate for the identity
+	if len(authResp.ClientCertificate) > 0 {
+		if err := c.identity.SetClientCertificate(authResp.ClientCertificate); err != nil {
+			log.Printf("Failed to save client certificate: %v", err)
+		} else {
+			log.Printf("Received client certificate, valid until %s",
+				c.identity.ClientCertificate().Leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
 
 	return nil
 }
@@ -236,6 +354,9 @@ func (c *Client) handleMessages() {
 		case protocol.MsgTypeData:
 			c.handleData(msg)
 
+		case protocol.MsgTypeWindowUpdate:
+			c.streams.HandleWindowUpdate(msg)
+
 		case protocol.MsgTypeUDPData:
 			c.handleUDPData(msg)
 
@@ -268,6 +389,15 @@ func (c *Client) handleMessages() {
 
 		case protocol.MsgTypeAgentCloudData:
 			c.handleAgentCloudData(msg)
+
+		case protocol.MsgTypeRendezvous:
+			c.handleRendezvous(msg)
+
+		case protocol.MsgTypePunch:
+			c.handlePunch(msg)
+
+		default:
+			log.Printf("Ignoring unknown message type %d", msg.Type)
 		}
 	}
 }
@@ -276,23 +406,45 @@ func (c *Client) handleConnect(msg *protocol.Message) {
 	payload, err := protocol.DecodeConnectPayload(msg.Payload)
 	if err != nil {
 		log.Printf("Failed to decode connect payload: %v", err)
-		c.sendConnectAck(msg.TunnelID, false, "Invalid payload")
+		c.sendConnectAck(msg.TunnelID, false, "Invalid payload", protocol.CompressionNone, nil)
 		return
 	}
 
 	log.Printf("Tunnel connect request: tunnelID=%d, protocol=%s, target=%s:%d",
 		msg.TunnelID, payload.Protocol, payload.TargetHost, payload.TargetPort)
 
+	answer, cipher, err := c.answerKeyExchange(msg.TunnelID, payload)
+	if err != nil {
+		log.Printf("Tunnel %d: end-to-end key exchange failed: %v", msg.TunnelID, err)
+		c.sendConnectAck(msg.TunnelID, false, err.Error(), protocol.CompressionNone, nil)
+		return
+	}
+
+	compression := protocol.CompressionNone
+	// Only a tunnel the cloud names the source's identity key for can be
+	// claimed on the direct path, others stay relayed
+	var direct *directPaths
+	if payload.Direct && len(payload.DirectPeerKey) > 0 && payload.Protocol == "tcp" {
+		direct = c.directPaths()
+	}
 	var processor TunnelProcessor
-	switch payload.Protocol {
-	case "tcp":
-		processor = NewTCPTunnel(c, msg.TunnelID, payload.TargetHost, payload.TargetPort)
-	case "udp":
+	switch {
+	case direct != nil:
+		// The data comes over the direct path, which is encrypted itself
+		tunnel := NewDirectTCPTunnel(c, direct, msg.TunnelID, payload.DirectPeerKey, payload.TargetHost, payload.TargetPort)
+		tunnel.proxy = newProxySource(payload)
+		processor = tunnel
+	case payload.Protocol == "tcp":
+		compression = acceptCompression(payload.Compression)
+		tunnel := NewTCPTunnel(c, msg.TunnelID, payload.TargetHost, payload.TargetPort, payload.Window, compression, cipher)
+		tunnel.proxy = newProxySource(payload)
+		processor = tunnel
+	case payload.Protocol == "udp":
 		processor = NewUDPTunnel(c, msg.TunnelID, payload.TargetHost, payload.TargetPort)
-	case "icmp":
+	case payload.Protocol == "icmp":
 		processor = NewICMPTunnel(c, msg.TunnelID, payload.TargetHost)
 	default:
-		c.sendConnectAck(msg.TunnelID, false, "Unknown protocol")
+		c.sendConnectAck(msg.TunnelID, false, "Unknown protocol", protocol.CompressionNone, nil)
 		return
 	}
 
@@ -300,7 +452,7 @@ func (c *Client) handleConnect(msg *protocol.Message) {
 
 	if err := processor.Start(); err != nil {
 		log.Printf("Tunnel %d: failed to connect to %s:%d: %v", msg.TunnelID, payload.TargetHost, payload.TargetPort, err)
-		c.sendConnectAck(msg.TunnelID, false, err.Error())
+		c.sendConnectAck(msg.TunnelID, false, err.Error(), protocol.CompressionNone, nil)
 		return
 	}
 
@@ -317,8 +469,10 @@ func (c *Client) handleConnect(msg *protocol.Message) {
 	c.tunnelsMu.Unlock()
 
 	log.Printf("Tunnel %d: connected successfully, sending ack", msg.TunnelID)
-	c.sendConnectAck(msg.TunnelID, true, "")
-	log.Printf("Tunnel %d established: %s -> %s:%d", msg.TunnelID, payload.Protocol, payload.TargetHost, payload.TargetPort)
+	ack := newConnectAck(msg.TunnelID, true, "", compression, answer)
+	ack.Direct = direct != nil
+	c.sendMessage(protocol.NewMessage(protocol.MsgTypeConnectAck, msg.TunnelID, protocol.EncodeConnectAckPayload(ack)))
+	log.Printf("Tunnel %d established: %s -> %s:%d (direct=%v)", msg.TunnelID, payload.Protocol, payload.TargetHost, payload.TargetPort, ack.Direct)
 }
 
 func (c *Client) handleData(msg *protocol.Message) {
@@ -401,14 +555,56 @@ func (c *Client) cleanupTunnels() {
 	c.tunnelsMu.Unlock()
 }
 
-func (c *Client) sendConnectAck(tunnelID uint32, success bool, errMsg string) {
-	payload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
+func (c *Client) sendConnectAck(tunnelID uint32, success bool, errMsg string, compression protocol.Compression, answer *protocol.KeyExchange) {
+	payload := protocol.EncodeConnectAckPayload(newConnectAck(tunnelID, success, errMsg, compression, answer))
+	msg := protocol.NewMessage(protocol.MsgTypeConnectAck, tunnelID, payload)
+	c.sendMessage(msg)
+}
+
+// newConnectAck creates a connect ack. If the tunnel was established it
+// grants the cloud a receive window, confirms the compression in use and
+// answers the end-to-end key exchange, if any.
+func newConnectAck(tunnelID uint32, success bool, errMsg string, compression protocol.Compression, answer *protocol.KeyExchange) *protocol.ConnectAckPayload {
+	ack := &protocol.ConnectAckPayload{
 		Success:  success,
 		TunnelID: tunnelID,
 		Error:    errMsg,
-	})
-	msg := protocol.NewMessage(protocol.MsgTypeConnectAck, tunnelID, payload)
-	c.sendMessage(msg)
+	}
+	if success {
+		ack.Window = protocol.DefaultWindowSize
+		ack.Compression = compression
+		ack.KeyExchange = answer
+	}
+	return ack
+}
+
+// answerKeyExchange answers the end-to-end key exchange a P2P source agent
+// offered for a tunnel, returning nils if it offered none
+func (c *Client) answerKeyExchange(tunnelID uint32, payload *protocol.ConnectPayload) (*protocol.KeyExchange, *protocol.E2ECipher, error) {
+	if payload.KeyExchange == nil {
+		return nil, nil, nil
+	}
+	if payload.Protocol != "tcp" {
+		return nil, nil, fmt.Errorf("end-to-end encryption is not supported for %s", payload.Protocol)
+	}
+	answer, cipher, err := protocol.AnswerE2E(c.identity.PrivateKey, payload.KeyExchange, payload.TargetHost, payload.TargetPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.peers.check(payload.KeyExchange); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Tunnel %d: end-to-end encrypted, peer key %s", tunnelID, payload.KeyExchange.Fingerprint())
+	return answer, cipher, nil
+}
+
+// acceptCompression returns the compression to use for a tunnel the cloud
+// requested compression for, none if this build doesn't support it
+func acceptCompression(requested protocol.Compression) protocol.Compression {
+	if !requested.Supported() {
+		return protocol.CompressionNone
+	}
+	return requested
 }
 
 func (c *Client) sendMessage(msg *protocol.Message) error {
@@ -466,20 +662,22 @@ func (c *Client) ConnectRuleConnection(ruleID string) (*RuleConnection, error) {
 	}
 	c.ruleConnsMu.Unlock()
 
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
-	}
-
-	conn, _, err := dialer.Dial(c.config.ServerURL, nil)
+	conn, err := c.dial()
 	if err != nil {
 		return nil, err
 	}
 
-	// Send rule auth
+	// Send rule auth, signed over the nonce of the main connection
+	c.connMu.Lock()
+	nonce := c.ruleAuthNonce
+	c.connMu.Unlock()
+	signature, timestamp := c.identity.SignRuleAuth(ruleID, nonce)
 	payload := protocol.EncodeRuleAuthPayload(&protocol.RuleAuthPayload{
-		Token:   c.config.Token,
-		AgentID: c.agentID,
-		RuleID:  ruleID,
+		Token:     c.config.Token,
+		AgentID:   c.agentID,
+		RuleID:    ruleID,
+		Timestamp: timestamp,
+		Signature: signature,
 	})
 	authMsg := protocol.NewMessage(protocol.MsgTypeRuleAuth, 0, payload)
 	data, err := authMsg.Encode()
@@ -525,12 +723,14 @@ func (c *Client) ConnectRuleConnection(ruleID string) (*RuleConnection, error) {
 
 	ctx, cancel := context.WithCancel(c.ctx)
 	ruleConn := &RuleConnection{
-		RuleID:    ruleID,
-		Conn:      conn,
-		tunnels:   make(map[uint32]*TunnelHandler),
-		ctx:       ctx,
-		cancel:    cancel,
-		connected: true,
+		RuleID:      ruleID,
+		Conn:        conn,
+		tunnels:     make(map[uint32]*TunnelHandler),
+		ctx:         ctx,
+		cancel:      cancel,
+		connected:   true,
+		connectedAt: time.Now(),
+		traffic:     c.ruleTrafficFor(ruleID),
 	}
 
 	c.ruleConnsMu.Lock()
@@ -584,6 +784,8 @@ func (c *Client) handleRuleMessages(rc *RuleConnection) {
 			}
 			return
 		}
+		atomic.StoreInt64(&rc.lastRecv, time.Now().UnixNano())
+		atomic.AddInt64(&rc.traffic.rxBytes, int64(len(data)))
 
 		msg, err := protocol.DecodeFromBytes(data)
 		if err != nil {
@@ -601,6 +803,9 @@ func (c *Client) handleRuleMessages(rc *RuleConnection) {
 		case protocol.MsgTypeData:
 			c.handleRuleData(rc, msg)
 
+		case protocol.MsgTypeWindowUpdate:
+			c.streams.HandleWindowUpdate(msg)
+
 		case protocol.MsgTypeUDPData:
 			c.handleRuleUDPData(rc, msg)
 
@@ -618,6 +823,9 @@ func (c *Client) handleRuleMessages(rc *RuleConnection) {
 
 		case protocol.MsgTypeAgentCloudData:
 			c.handleAgentCloudData(msg)
+
+		default:
+			log.Printf("Ignoring unknown message type %d on rule %s", msg.Type, rc.RuleID)
 		}
 	}
 }
@@ -627,27 +835,38 @@ func (c *Client) handleRuleConnect(rc *RuleConnection, msg *protocol.Message) {
 	payload, err := protocol.DecodeConnectPayload(msg.Payload)
 	if err != nil {
 		log.Printf("Failed to decode connect payload on rule %s: %v", rc.RuleID, err)
-		c.sendRuleConnectAck(rc, msg.TunnelID, false, "Invalid payload")
+		c.sendRuleConnectAck(rc, msg.TunnelID, false, "Invalid payload", protocol.CompressionNone, nil)
 		return
 	}
 
 	log.Printf("Rule %s tunnel connect: tunnelID=%d, protocol=%s, target=%s:%d",
 		rc.RuleID, msg.TunnelID, payload.Protocol, payload.TargetHost, payload.TargetPort)
 
+	answer, cipher, err := c.answerKeyExchange(msg.TunnelID, payload)
+	if err != nil {
+		log.Printf("Rule %s tunnel %d: end-to-end key exchange failed: %v", rc.RuleID, msg.TunnelID, err)
+		c.sendRuleConnectAck(rc, msg.TunnelID, false, err.Error(), protocol.CompressionNone, nil)
+		return
+	}
+
+	compression := protocol.CompressionNone
 	var processor TunnelProcessor
 	switch payload.Protocol {
 	case "tcp":
-		processor = NewRuleTCPTunnel(c, rc, msg.TunnelID, payload.TargetHost, payload.TargetPort)
+		compression = acceptCompression(payload.Compression)
+		tunnel := NewRuleTCPTunnel(c, rc, msg.TunnelID, payload.TargetHost, payload.TargetPort, payload.Window, compression, cipher)
+		tunnel.proxy = newProxySource(payload)
+		processor = tunnel
 	case "udp":
 		processor = NewRuleUDPTunnel(c, rc, msg.TunnelID, payload.TargetHost, payload.TargetPort)
 	default:
-		c.sendRuleConnectAck(rc, msg.TunnelID, false, "Unknown protocol")
+		c.sendRuleConnectAck(rc, msg.TunnelID, false, "Unknown protocol", protocol.CompressionNone, nil)
 		return
 	}
 
 	if err := processor.Start(); err != nil {
 		log.Printf("Rule %s tunnel %d: failed to connect: %v", rc.RuleID, msg.TunnelID, err)
-		c.sendRuleConnectAck(rc, msg.TunnelID, false, err.Error())
+		c.sendRuleConnectAck(rc, msg.TunnelID, false, err.Error(), protocol.CompressionNone, nil)
 		return
 	}
 
@@ -663,7 +882,7 @@ func (c *Client) handleRuleConnect(rc *RuleConnection, msg *protocol.Message) {
 	rc.tunnels[msg.TunnelID] = handler
 	rc.tunnelsMu.Unlock()
 
-	c.sendRuleConnectAck(rc, msg.TunnelID, true, "")
+	c.sendRuleConnectAck(rc, msg.TunnelID, true, "", compression, answer)
 	log.Printf("Rule %s tunnel %d established: %s -> %s:%d",
 		rc.RuleID, msg.TunnelID, payload.Protocol, payload.TargetHost, payload.TargetPort)
 }
@@ -720,12 +939,8 @@ func (c *Client) closeRuleTunnel(rc *RuleConnection, tunnelID uint32) {
 	}
 }
 
-func (c *Client) sendRuleConnectAck(rc *RuleConnection, tunnelID uint32, success bool, errMsg string) {
-	payload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
-		Success:  success,
-		TunnelID: tunnelID,
-		Error:    errMsg,
-	})
+func (c *Client) sendRuleConnectAck(rc *RuleConnection, tunnelID uint32, success bool, errMsg string, compression protocol.Compression, answer *protocol.KeyExchange) {
+	payload := protocol.EncodeConnectAckPayload(newConnectAck(tunnelID, success, errMsg, compression, answer))
 	msg := protocol.NewMessage(protocol.MsgTypeConnectAck, tunnelID, payload)
 	c.sendRuleMessage(rc, msg)
 }
@@ -743,7 +958,11 @@ func (c *Client) sendRuleMessage(rc *RuleConnection, msg *protocol.Message) erro
 		return fmt.Errorf("rule connection is nil")
 	}
 
-	return rc.Conn.WriteMessage(websocket.BinaryMessage, data)
+	if err := rc.Conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return err
+	}
+	atomic.AddInt64(&rc.traffic.txBytes, int64(len(data)))
+	return nil
 }
 
 // SendRuleData sends data on a rule connection
@@ -826,7 +1045,7 @@ func (c *Client) handleLocalProxyStart(msg *protocol.Message) {
 		_ = ruleConn // ruleConn is stored in c.ruleConns and used by proxy
 	}
 
-	proxy := NewP2PProxy(c, payload.RuleID, int(payload.ListenPort), payload.TargetAgentID, payload.TargetHost, int(payload.TargetPort), payload.Protocol)
+	proxy := NewP2PProxy(c, payload.RuleID, int(payload.ListenPort), payload.TargetAgentID, payload.TargetHost, int(payload.TargetPort), payload.Protocol, payload.Encrypted)
 	if err := proxy.Start(); err != nil {
 		log.Printf("Failed to start local proxy %s: %v", payload.RuleID, err)
 		return
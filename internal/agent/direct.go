@@ -0,0 +1,717 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// bindInterval is how often the agent registers its UDP endpoint with
+	// the rendezvous, keeping its NAT mapping open
+	bindInterval = 20 * time.Second
+	// punchTimeout bounds a hole punching attempt
+	punchTimeout = 10 * time.Second
+	// probeInterval is how often probes are sent while punching
+	probeInterval = 200 * time.Millisecond
+	// punchRetryInterval is the least time between punch requests for a peer
+	punchRetryInterval = 30 * time.Second
+	// directStreamTimeout bounds how long a target waits for the stream of
+	// a tunnel it accepted on the direct path
+	directStreamTimeout = 15 * time.Second
+)
+
+var directQUICConfig = &quic.Config{
+	HandshakeIdleTimeout: 5 * time.Second,
+	MaxIdleTimeout:       60 * time.Second,
+	KeepAlivePeriod:      15 * time.Second,
+	MaxIncomingStreams:   10000,
+}
+
+// directPaths holds the agent's UDP socket for hole punching and its direct
+// QUIC connections to other agents. A new one is started for every
+// connection to the cloud that offers a rendezvous.
+type directPaths struct {
+	client     *Client
+	udpConn    *net.UDPConn
+	transport  *quic.Transport
+	listener   *quic.Listener
+	rendezvous *net.UDPAddr
+	token      []byte
+	cert       tls.Certificate
+	bound      chan struct{} // Closed once the rendezvous answered a bind
+	boundOnce  sync.Once
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	mu        sync.Mutex
+	observed  string                           // Endpoint the rendezvous last observed
+	sessions  map[string]*punchSession         // By session ID
+	links     map[string]*quic.Conn            // Dialed connections, by peer agent ID as the rules name it
+	requested map[string]time.Time             // Last punch request, by peer
+	pending   map[directClaim]*DirectTCPTunnel // Accepted tunnels waiting for their stream
+}
+
+// directClaim identifies a tunnel waiting for its stream: only the peer
+// with the identity key the cloud named for it may claim it
+type directClaim struct {
+	peerKey  string
+	tunnelID uint32
+}
+
+// punchSession is a hole punching attempt towards one peer
+type punchSession struct {
+	*protocol.PunchPayload
+	peerAddr chan *net.UDPAddr // Receives the address of the first probe from the peer
+}
+
+// startDirectPaths opens the UDP socket and starts registering it with the
+// rendezvous the cloud announced
+func startDirectPaths(c *Client, payload *protocol.RendezvousPayload) (*directPaths, error) {
+	host, port, err := net.SplitHostPort(payload.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		// The rendezvous listens on the cloud's host
+		u, err := url.Parse(c.config.ServerURL)
+		if err != nil {
+			return nil, err
+		}
+		host = u.Hostname()
+	}
+	rendezvous, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := directCertificate(c.identity)
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	d := &directPaths{
+		client:     c,
+		udpConn:    udpConn,
+		transport:  &quic.Transport{Conn: udpConn},
+		rendezvous: rendezvous,
+		token:      payload.Token,
+		cert:       cert,
+		bound:      make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		sessions:   make(map[string]*punchSession),
+		links:      make(map[string]*quic.Conn),
+		requested:  make(map[string]time.Time),
+		pending:    make(map[directClaim]*DirectTCPTunnel),
+	}
+
+	d.listener, err = d.transport.Listen(&tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         []string{protocol.DirectALPN},
+		GetConfigForClient: d.serverConfig,
+	}, directQUICConfig)
+	if err != nil {
+		cancel()
+		udpConn.Close()
+		return nil, err
+	}
+
+	go d.readPackets()
+	go d.bindLoop()
+	go d.acceptLoop()
+
+	return d, nil
+}
+
+// Close closes the direct connections and the socket. Tunnels on them end.
+func (d *directPaths) Close() {
+	d.cancel()
+	d.listener.Close()
+	d.transport.Close()
+	d.udpConn.Close()
+
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[directClaim]*DirectTCPTunnel)
+	d.mu.Unlock()
+	for _, t := range pending {
+		t.Stop()
+	}
+}
+
+// directCertificate returns a self-signed certificate of the agent's
+// identity key. Peers check the key, not the certificate.
+func directCertificate(identity *Identity) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, identity.PublicKey(), identity.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: identity.PrivateKey}, nil
+}
+
+// verifyPeerKey returns a certificate check accepting only the given
+// identity key
+func verifyPeerKey(key []byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer sent no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		peer, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok || !bytes.Equal(peer, key) {
+			return errors.New("peer identity key does not match")
+		}
+		return nil
+	}
+}
+
+// serverConfig picks the peer key to expect from the session the dialer
+// names as server name
+func (d *directPaths) serverConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	d.mu.Lock()
+	session := d.sessions[hello.ServerName]
+	d.mu.Unlock()
+	if session == nil || session.Dial {
+		return nil, fmt.Errorf("unknown punch session %q", hello.ServerName)
+	}
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS13,
+		NextProtos:            []string{protocol.DirectALPN},
+		Certificates:          []tls.Certificate{d.cert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: verifyPeerKey(session.PeerKey),
+	}, nil
+}
+
+// localEndpoints returns the socket's address on each local interface, so
+// peers on the same network can reach it without going through the NAT
+func (d *directPaths) localEndpoints() []string {
+	port := d.udpConn.LocalAddr().(*net.UDPAddr).Port
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var endpoints []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		endpoints = append(endpoints, net.JoinHostPort(ipNet.IP.String(), fmt.Sprint(port)))
+	}
+	return endpoints
+}
+
+// bindLoop registers the socket with the rendezvous, quickly until it
+// answers and periodically after that
+func (d *directPaths) bindLoop() {
+	bind := protocol.EncodePunchPacket(&protocol.PunchPacket{
+		Type:      protocol.PunchBind,
+		Token:     d.token,
+		Endpoints: d.localEndpoints(),
+	})
+	for {
+		d.udpConn.WriteToUDP(bind, d.rendezvous)
+
+		interval := bindInterval
+		select {
+		case <-d.bound:
+		default:
+			interval = time.Second
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// readPackets handles the rendezvous' answers and peers' probes, the
+// packets on the socket that are not QUIC
+func (d *directPaths) readPackets() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := d.transport.ReadNonQUICPacket(d.ctx, buf)
+		if err != nil {
+			return
+		}
+		pkt, err := protocol.DecodePunchPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		switch pkt.Type {
+		case protocol.PunchBound:
+			if len(pkt.Endpoints) == 0 {
+				continue
+			}
+			d.mu.Lock()
+			changed := d.observed != pkt.Endpoints[0]
+			d.observed = pkt.Endpoints[0]
+			d.mu.Unlock()
+			if changed {
+				log.Printf("Direct paths: rendezvous sees this agent at %s", pkt.Endpoints[0])
+			}
+			d.boundOnce.Do(func() { close(d.bound) })
+
+		case protocol.PunchProbe:
+			d.mu.Lock()
+			session := d.sessions[pkt.Session]
+			d.mu.Unlock()
+			if session == nil {
+				continue
+			}
+			select {
+			case session.peerAddr <- udpAddr:
+				// First probe from the peer: answer so it learns the path too
+				d.udpConn.WriteToUDP(protocol.EncodePunchPacket(&protocol.PunchPacket{
+					Type:    protocol.PunchProbe,
+					Session: pkt.Session,
+				}), udpAddr)
+			default:
+			}
+		}
+	}
+}
+
+// acceptLoop accepts the direct connections peers dial
+func (d *directPaths) acceptLoop() {
+	for {
+		conn, err := d.listener.Accept(d.ctx)
+		if err != nil {
+			return
+		}
+
+		sessionID := conn.ConnectionState().TLS.ServerName
+		d.mu.Lock()
+		session := d.sessions[sessionID]
+		delete(d.sessions, sessionID)
+		d.mu.Unlock()
+		if session == nil {
+			conn.CloseWithError(0, "unknown session")
+			continue
+		}
+
+		log.Printf("Direct path from agent %s established via %s (peer key %s)",
+			session.PeerAgentID, conn.RemoteAddr(), protocol.KeyFingerprint(session.PeerKey))
+		go d.acceptStreams(conn, session.PeerAgentID, session.PeerKey)
+	}
+}
+
+// acceptStreams attaches the streams a peer opens to the tunnels waiting
+// for them. The handshake pinned the peer to peerKey, it can only claim
+// tunnels the cloud set up for that key.
+func (d *directPaths) acceptStreams(conn *quic.Conn, peer string, peerKey []byte) {
+	defer log.Printf("Direct path from agent %s closed", peer)
+
+	for {
+		stream, err := conn.AcceptStream(d.ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			stream.SetReadDeadline(time.Now().Add(directStreamTimeout))
+			tunnelID, err := protocol.ReadDirectStreamHeader(stream)
+			stream.SetReadDeadline(time.Time{})
+			if err != nil {
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+				return
+			}
+
+			tunnel := d.claim(peerKey, tunnelID)
+			if tunnel == nil {
+				log.Printf("Direct path from agent %s: no tunnel %d waiting for it", peer, tunnelID)
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+				return
+			}
+			tunnel.attach(stream)
+		}()
+	}
+}
+
+// claim takes the tunnel waiting for a stream from the peer with the
+// identity key, nil if there is none
+func (d *directPaths) claim(peerKey []byte, tunnelID uint32) *DirectTCPTunnel {
+	key := directClaim{peerKey: string(peerKey), tunnelID: tunnelID}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tunnel := d.pending[key]
+	delete(d.pending, key)
+	return tunnel
+}
+
+// handlePunch starts punching towards the peer the cloud introduced
+func (d *directPaths) handlePunch(payload *protocol.PunchPayload) {
+	if payload.Error != "" {
+		log.Printf("Direct path to agent %s unavailable, tunnels stay relayed: %s", payload.PeerAgentID, payload.Error)
+		return
+	}
+
+	var targets []*net.UDPAddr
+	for _, ep := range payload.Endpoints {
+		if addr, err := net.ResolveUDPAddr("udp", ep); err == nil {
+			targets = append(targets, addr)
+		}
+	}
+
+	session := &punchSession{PunchPayload: payload, peerAddr: make(chan *net.UDPAddr, 1)}
+	d.mu.Lock()
+	d.sessions[payload.Session] = session
+	d.mu.Unlock()
+
+	log.Printf("Punching towards agent %s at %v (session %s)", payload.PeerAgentID, payload.Endpoints, payload.Session)
+
+	ctx, cancel := context.WithTimeout(d.ctx, punchTimeout)
+	defer cancel()
+
+	// Probe every endpoint of the peer until the attempt ends. The probes
+	// open this side's NAT mapping for the peer's probes to come in.
+	go func() {
+		probe := protocol.EncodePunchPacket(&protocol.PunchPacket{Type: protocol.PunchProbe, Session: payload.Session})
+		ticker := time.NewTicker(probeInterval)
+		defer ticker.Stop()
+		for {
+			for _, addr := range targets {
+				d.udpConn.WriteToUDP(probe, addr)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	if !payload.Dial {
+		// The peer dials, acceptLoop takes the session from here
+		<-ctx.Done()
+		d.mu.Lock()
+		_, pending := d.sessions[payload.Session]
+		delete(d.sessions, payload.Session)
+		d.mu.Unlock()
+		if pending && d.ctx.Err() == nil {
+			log.Printf("Hole punching with agent %s failed, tunnels stay relayed", payload.PeerAgentID)
+		}
+		return
+	}
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.sessions, payload.Session)
+		d.mu.Unlock()
+	}()
+
+	var addr *net.UDPAddr
+	select {
+	case addr = <-session.peerAddr:
+	case <-ctx.Done():
+		log.Printf("Hole punching towards agent %s failed, tunnels stay relayed", payload.PeerAgentID)
+		return
+	}
+
+	conn, err := d.transport.Dial(ctx, addr, &tls.Config{
+		MinVersion:            tls.VersionTLS13,
+		NextProtos:            []string{protocol.DirectALPN},
+		ServerName:            payload.Session,
+		Certificates:          []tls.Certificate{d.cert},
+		InsecureSkipVerify:    true, // The peer's identity key is checked instead
+		VerifyPeerCertificate: verifyPeerKey(payload.PeerKey),
+	}, directQUICConfig)
+	if err != nil {
+		log.Printf("Direct connection to agent %s at %s failed, tunnels stay relayed: %v", payload.PeerAgentID, addr, err)
+		return
+	}
+
+	d.mu.Lock()
+	old := d.links[payload.PeerAgentID]
+	d.links[payload.PeerAgentID] = conn
+	d.mu.Unlock()
+	if old != nil {
+		old.CloseWithError(0, "replaced")
+	}
+
+	log.Printf("Direct path to agent %s established via %s (peer key %s)",
+		payload.PeerAgentID, addr, protocol.KeyFingerprint(payload.PeerKey))
+
+	go func() {
+		<-conn.Context().Done()
+		d.mu.Lock()
+		if d.links[payload.PeerAgentID] == conn {
+			delete(d.links, payload.PeerAgentID)
+		}
+		d.mu.Unlock()
+		log.Printf("Direct path to agent %s closed, new tunnels are relayed", payload.PeerAgentID)
+	}()
+}
+
+// link returns the direct connection to a peer, nil if there is none
+func (d *directPaths) link(peer string) *quic.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.links[peer]
+}
+
+// request asks the cloud to arrange a direct path to a rule's target
+// agent, unless one exists or was asked for recently
+func (d *directPaths) request(ruleID, peer string) {
+	d.mu.Lock()
+	if d.links[peer] != nil || time.Since(d.requested[peer]) < punchRetryInterval {
+		d.mu.Unlock()
+		return
+	}
+	d.requested[peer] = time.Now()
+	d.mu.Unlock()
+
+	// The cloud needs the endpoint it observed for this agent
+	select {
+	case <-d.bound:
+	case <-d.ctx.Done():
+		return
+	case <-time.After(punchTimeout):
+		log.Printf("Direct paths: rendezvous %s does not answer, tunnels stay relayed", d.rendezvous)
+		return
+	}
+
+	msg := protocol.NewMessage(protocol.MsgTypePunchRequest, 0, protocol.EncodePunchRequestPayload(&protocol.PunchRequestPayload{
+		RuleID:        ruleID,
+		TargetAgentID: peer,
+	}))
+	d.client.sendMessage(msg)
+}
+
+// expect registers a tunnel accepted on the direct path until its stream
+// arrives from the peer, closing it if the stream does not come in time
+func (d *directPaths) expect(t *DirectTCPTunnel) {
+	claim := directClaim{peerKey: string(t.peerKey), tunnelID: t.tunnelID}
+	d.mu.Lock()
+	d.pending[claim] = t
+	d.mu.Unlock()
+
+	time.AfterFunc(directStreamTimeout, func() {
+		d.mu.Lock()
+		waiting := d.pending[claim] == t
+		if waiting {
+			delete(d.pending, claim)
+		}
+		d.mu.Unlock()
+		if waiting {
+			log.Printf("Tunnel %d: no stream on the direct path, closing", t.tunnelID)
+			t.client.closeTunnel(t.tunnelID)
+			t.client.SendClose(t.tunnelID)
+		}
+	})
+}
+
+func (d *directPaths) status() []DirectPathStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	paths := make([]DirectPathStatus, 0, len(d.links))
+	for peer, conn := range d.links {
+		paths = append(paths, DirectPathStatus{Peer: peer, RemoteAddr: conn.RemoteAddr().String()})
+	}
+	return paths
+}
+
+// pipeDirect copies data between a connection and its tunnel's stream
+// until both directions end. An end of data is passed on as such, so
+// either side may half-close.
+func pipeDirect(conn net.Conn, stream *quic.Stream) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(stream, conn); err != nil {
+			stream.CancelWrite(0)
+			return
+		}
+		stream.Close()
+	}()
+
+	_, err := io.Copy(conn, stream)
+	if tcp, ok := conn.(*net.TCPConn); ok && err == nil {
+		tcp.CloseWrite()
+	} else {
+		stream.CancelRead(0)
+		conn.Close()
+	}
+	<-done
+	stream.CancelRead(0)
+	conn.Close()
+}
+
+// DirectTCPTunnel is the target end of a TCP tunnel on a direct path. Its
+// data goes over the QUIC stream the source opens, not through the cloud.
+type DirectTCPTunnel struct {
+	client     *Client
+	direct     *directPaths
+	tunnelID   uint32
+	peerKey    []byte // Identity key of the source, whose stream the tunnel takes
+	targetHost string
+	targetPort uint16
+	proxy      proxySource // Client the target hears about in a PROXY header
+	conn       net.Conn
+	stream     *quic.Stream
+	connMu     sync.Mutex
+	closed     bool
+}
+
+// NewDirectTCPTunnel creates a direct TCP tunnel
+func NewDirectTCPTunnel(client *Client, direct *directPaths, tunnelID uint32, peerKey []byte, targetHost string, targetPort uint16) *DirectTCPTunnel {
+	return &DirectTCPTunnel{
+		client:     client,
+		direct:     direct,
+		tunnelID:   tunnelID,
+		peerKey:    peerKey,
+		targetHost: targetHost,
+		targetPort: targetPort,
+	}
+}
+
+// Start connects to the target and waits for the source's stream
+func (t *DirectTCPTunnel) Start() error {
+	conn, err := t.proxy.dial(t.targetHost, t.targetPort)
+	if err != nil {
+		return err
+	}
+
+	t.connMu.Lock()
+	t.conn = conn
+	t.connMu.Unlock()
+
+	t.direct.expect(t)
+	return nil
+}
+
+// Stop closes the tunnel
+func (t *DirectTCPTunnel) Stop() {
+	t.connMu.Lock()
+	t.closed = true
+	conn, stream := t.conn, t.stream
+	t.connMu.Unlock()
+
+	if stream != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// HandleData rejects data relayed by the cloud, the tunnel's data comes
+// over the direct path
+func (t *DirectTCPTunnel) HandleData(data []byte) error {
+	return fmt.Errorf("tunnel %d is on the direct path", t.tunnelID)
+}
+
+// attach forwards between the target and the source's stream until the
+// tunnel ends, then tells the cloud
+func (t *DirectTCPTunnel) attach(stream *quic.Stream) {
+	t.connMu.Lock()
+	if t.closed {
+		t.connMu.Unlock()
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		return
+	}
+	t.stream = stream
+	conn := t.conn
+	t.connMu.Unlock()
+
+	log.Printf("Tunnel %d: forwarding over the direct path", t.tunnelID)
+	pipeDirect(conn, stream)
+
+	t.client.closeTunnel(t.tunnelID)
+	t.client.SendClose(t.tunnelID)
+}
+
+// directPaths returns the agent's direct paths, nil if the cloud runs no
+// rendezvous
+func (c *Client) directPaths() *directPaths {
+	c.directMu.Lock()
+	defer c.directMu.Unlock()
+	return c.direct
+}
+
+// handleRendezvous starts direct paths with the rendezvous the cloud
+// announced after authentication
+func (c *Client) handleRendezvous(msg *protocol.Message) {
+	payload, err := protocol.DecodeRendezvousPayload(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode rendezvous payload: %v", err)
+		return
+	}
+
+	d, err := startDirectPaths(c, payload)
+	if err != nil {
+		log.Printf("Direct paths disabled, tunnels stay relayed: %v", err)
+		return
+	}
+
+	c.directMu.Lock()
+	old := c.direct
+	c.direct = d
+	c.directMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	log.Printf("Direct paths enabled, UDP socket %s, rendezvous %s", d.udpConn.LocalAddr(), d.rendezvous)
+}
+
+// handlePunch starts punching towards the peer the cloud introduced
+func (c *Client) handlePunch(msg *protocol.Message) {
+	payload, err := protocol.DecodePunchPayload(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode punch payload: %v", err)
+		return
+	}
+	if d := c.directPaths(); d != nil {
+		go d.handlePunch(payload)
+	}
+}
+
+func (c *Client) cleanupDirectPaths() {
+	c.directMu.Lock()
+	d := c.direct
+	c.direct = nil
+	c.directMu.Unlock()
+	if d != nil {
+		d.Close()
+	}
+}
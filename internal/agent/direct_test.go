@@ -0,0 +1,29 @@
+package agent
+
+import "testing"
+
+func TestDirectClaim(t *testing.T) {
+	d := &directPaths{pending: make(map[directClaim]*DirectTCPTunnel)}
+	source, other := []byte("source identity key"), []byte("other identity key")
+	tunnel := NewDirectTCPTunnel(nil, d, 7, source, "127.0.0.1", 22)
+	d.expect(tunnel)
+
+	// Another peer can't claim the tunnel, whatever tunnel ID it names
+	if got := d.claim(other, 7); got != nil {
+		t.Fatal("tunnel claimed by another peer")
+	}
+	if got := d.claim(nil, 7); got != nil {
+		t.Fatal("tunnel claimed without an identity key")
+	}
+	if got := d.claim(source, 8); got != nil {
+		t.Fatal("tunnel claimed under another ID")
+	}
+
+	// The source claims it once
+	if got := d.claim(source, 7); got != tunnel {
+		t.Fatalf("source claimed %v", got)
+	}
+	if got := d.claim(source, 7); got != nil {
+		t.Fatal("tunnel claimed twice")
+	}
+}
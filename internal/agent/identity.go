@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+	"github.com/natsvr/natsvr/pkg/utils"
+)
+
+const (
+	identityFile   = "identity.json"
+	clientCertFile = "client-cert.pem"
+)
+
+// Identity is the persistent identity of an agent. The cloud enrolls the
+// public key the first time the ID connects and only accepts that key for
+// the ID afterwards. A cloud with mTLS enabled also issues a client
+// certificate for the key.
+type Identity struct {
+	ID         string
+	PrivateKey ed25519.PrivateKey
+
+	dir    string
+	cert   *tls.Certificate
+	certMu sync.Mutex
+}
+
+type identityJSON struct {
+	ID   string `json:"id"`
+	Seed []byte `json:"seed"` // ed25519 private key seed
+}
+
+// DefaultStateDir returns the default state directory of the named agent.
+// Each name gets its own directory so several agents can share a host.
+func DefaultStateDir(name string) string {
+	base := ".natsvr-agent"
+	if dir, err := os.UserConfigDir(); err == nil {
+		base = filepath.Join(dir, "natsvr-agent")
+	}
+	return filepath.Join(base, sanitizeName(name))
+}
+
+// sanitizeName makes an agent name safe to use as a directory name
+func sanitizeName(name string) string {
+	safe := []rune(name)
+	for i, r := range safe {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' && r != '.' {
+			safe[i] = '_'
+		}
+	}
+	if len(safe) == 0 || string(safe) == "." || string(safe) == ".." {
+		return "default"
+	}
+	return string(safe)
+}
+
+// LoadOrCreateIdentity loads the identity stored in dir, creating and
+// saving a new one if none exists yet
+func LoadOrCreateIdentity(dir string) (*Identity, error) {
+	path := filepath.Join(dir, identityFile)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var stored identityJSON
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if stored.ID == "" || len(stored.Seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid identity in %s", path)
+		}
+		identity := &Identity{
+			ID:         stored.ID,
+			PrivateKey: ed25519.NewKeyFromSeed(stored.Seed),
+			dir:        dir,
+		}
+		if err := identity.loadClientCertificate(); err != nil {
+			log.Printf("Ignoring client certificate: %v", err)
+		}
+		return identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	identity := &Identity{
+		ID:         utils.GenerateID(16),
+		PrivateKey: priv,
+		dir:        dir,
+	}
+
+	data, err = json.MarshalIndent(identityJSON{ID: identity.ID, Seed: priv.Seed()}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// PublicKey returns the identity's public key
+func (i *Identity) PublicKey() ed25519.PublicKey {
+	return i.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// SignAuth signs the auth message for the given agent name
+func (i *Identity) SignAuth(agentName string) (signature []byte, timestamp int64) {
+	timestamp = time.Now().Unix()
+	msg := protocol.AuthSigningMessage(i.ID, agentName, timestamp)
+	return ed25519.Sign(i.PrivateKey, msg), timestamp
+}
+
+// SignRuleAuth signs the auth message of a rule connection over the nonce
+// the cloud issued on the main connection
+func (i *Identity) SignRuleAuth(ruleID string, nonce []byte) (signature []byte, timestamp int64) {
+	timestamp = time.Now().Unix()
+	msg := protocol.RuleAuthSigningMessage(i.ID, ruleID, nonce, timestamp)
+	return ed25519.Sign(i.PrivateKey, msg), timestamp
+}
+
+// ClientCertificate returns the client certificate the cloud issued for
+// the identity, or nil if there is none or it expired
+func (i *Identity) ClientCertificate() *tls.Certificate {
+	i.certMu.Lock()
+	defer i.certMu.Unlock()
+	if i.cert == nil || time.Now().After(i.cert.Leaf.NotAfter) {
+		return nil
+	}
+	return i.cert
+}
+
+// SetClientCertificate stores a DER certificate the cloud issued for the
+// identity and uses it from the next connection on
+func (i *Identity) SetClientCertificate(der []byte) error {
+	cert, err := i.parseClientCertificate(der)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(i.dir, clientCertFile), data, 0600); err != nil {
+		return err
+	}
+
+	i.certMu.Lock()
+	i.cert = cert
+	i.certMu.Unlock()
+	return nil
+}
+
+func (i *Identity) loadClientCertificate() error {
+	data, err := os.ReadFile(filepath.Join(i.dir, clientCertFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("no certificate in %s", clientCertFile)
+	}
+	i.cert, err = i.parseClientCertificate(block.Bytes)
+	return err
+}
+
+// parseClientCertificate checks that a certificate is for the identity key
+func (i *Identity) parseClientCertificate(der []byte) (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := leaf.PublicKey.(ed25519.PublicKey)
+	if !ok || !key.Equal(i.PublicKey()) {
+		return nil, errors.New("client certificate is not for the identity key")
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  i.PrivateKey,
+		Leaf:        leaf,
+	}, nil
+}
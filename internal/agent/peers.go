@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+const knownPeersFile = "known-peers.json"
+
+// Peer key errors, failing the key exchange of an end-to-end encrypted tunnel
+var (
+	ErrPeerKeyMismatch = errors.New("peer identity key does not match the pinned key")
+	ErrPeerUnnamed     = errors.New("key exchange names no peer agent")
+)
+
+// peerKeys pins the identity keys of the agents at the other end of
+// end-to-end encrypted tunnels, so that the cloud relaying the key exchange
+// can't substitute its own. Peers with a configured fingerprint are pinned
+// to it; others are trusted on first use and their key is kept in
+// known-peers.json in the state directory.
+type peerKeys struct {
+	path       string
+	configured map[string]string // Agent ID -> key fingerprint
+	known      map[string][]byte // Agent ID -> identity key first seen
+	mu         sync.Mutex
+}
+
+// loadPeerKeys loads the peer keys pinned in dir
+func loadPeerKeys(dir string, configured map[string]string) (*peerKeys, error) {
+	k := &peerKeys{
+		path:       filepath.Join(dir, knownPeersFile),
+		configured: configured,
+		known:      make(map[string][]byte),
+	}
+	data, err := os.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &k.known); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", k.path, err)
+	}
+	return k, nil
+}
+
+// check checks the identity key of a verified key exchange against the key
+// pinned for its agent, pinning it if the agent is new
+func (k *peerKeys) check(exchange *protocol.KeyExchange) error {
+	id := exchange.AgentID
+	if id == "" {
+		return ErrPeerUnnamed
+	}
+	if want, ok := k.configured[id]; ok {
+		if !strings.EqualFold(want, exchange.Fingerprint()) {
+			return fmt.Errorf("%w: agent %s presented %s, configured %s", ErrPeerKeyMismatch, id, exchange.Fingerprint(), want)
+		}
+		return nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if pinned, ok := k.known[id]; ok {
+		if !bytes.Equal(pinned, exchange.IdentityKey) {
+			return fmt.Errorf("%w: agent %s presented %s, pinned %s", ErrPeerKeyMismatch, id, exchange.Fingerprint(), protocol.KeyFingerprint(pinned))
+		}
+		return nil
+	}
+
+	k.known[id] = exchange.IdentityKey
+	data, err := json.MarshalIndent(k.known, "", "  ")
+	if err == nil {
+		err = os.WriteFile(k.path, data, 0600)
+	}
+	if err != nil {
+		delete(k.known, id)
+		return fmt.Errorf("save %s: %w", k.path, err)
+	}
+	log.Printf("Pinned identity key %s of peer agent %s", exchange.Fingerprint(), id)
+	return nil
+}
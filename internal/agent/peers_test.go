@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+// newTestKey returns a new identity key
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testOffer returns the source half of a key exchange as the cloud passes
+// it on, naming the signer's key and agent ID
+func testOffer(t *testing.T, key ed25519.PrivateKey, agentID string) *protocol.ConnectPayload {
+	t.Helper()
+	offer, err := protocol.NewE2EOffer(key, "127.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer.Exchange.IdentityKey = key.Public().(ed25519.PublicKey)
+	offer.Exchange.AgentID = agentID
+	return &protocol.ConnectPayload{Protocol: "tcp", TargetHost: "127.0.0.1", TargetPort: 22, KeyExchange: offer.Exchange}
+}
+
+func TestPeerKeySubstituted(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewClient(&Config{Name: "db", StateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, cloud := newTestKey(t), newTestKey(t)
+
+	// The first key seen for the source is pinned
+	if _, _, err := c.answerKeyExchange(1, testOffer(t, source, "agent-1")); err != nil {
+		t.Fatal(err)
+	}
+	// A cloud that substitutes its own key for the source's is refused
+	if _, _, err := c.answerKeyExchange(2, testOffer(t, cloud, "agent-1")); !errors.Is(err, ErrPeerKeyMismatch) {
+		t.Fatalf("substituted source key: %v, want ErrPeerKeyMismatch", err)
+	}
+	if _, _, err := c.answerKeyExchange(3, testOffer(t, cloud, "")); !errors.Is(err, ErrPeerUnnamed) {
+		t.Fatalf("key exchange without an agent ID: %v, want ErrPeerUnnamed", err)
+	}
+
+	// The pin outlives the agent
+	c, err = NewClient(&Config{Name: "db", StateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.answerKeyExchange(4, testOffer(t, cloud, "agent-1")); !errors.Is(err, ErrPeerKeyMismatch) {
+		t.Fatalf("substituted source key after a restart: %v, want ErrPeerKeyMismatch", err)
+	}
+	if _, _, err := c.answerKeyExchange(5, testOffer(t, source, "agent-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source checks the target's answer the same way
+	offer, err := protocol.NewE2EOffer(c.identity.PrivateKey, "127.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer.Exchange.IdentityKey = c.identity.PublicKey()
+	answer, _, err := protocol.AnswerE2E(cloud, offer.Exchange, "127.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer.IdentityKey, answer.AgentID = cloud.Public().(ed25519.PublicKey), "agent-1"
+	if _, err := offer.Finish(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.peers.check(answer); !errors.Is(err, ErrPeerKeyMismatch) {
+		t.Fatalf("substituted target key: %v, want ErrPeerKeyMismatch", err)
+	}
+}
+
+func TestPeerKeyConfigured(t *testing.T) {
+	target, cloud := newTestKey(t), newTestKey(t)
+	fingerprint := protocol.KeyFingerprint(target.Public().(ed25519.PublicKey))
+	c, err := NewClient(&Config{Name: "web", StateDir: t.TempDir(), PeerKeys: map[string]string{"agent-2": fingerprint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Even the first key seen must match the configured fingerprint
+	if _, _, err := c.answerKeyExchange(1, testOffer(t, cloud, "agent-2")); !errors.Is(err, ErrPeerKeyMismatch) {
+		t.Fatalf("key other than the configured one: %v, want ErrPeerKeyMismatch", err)
+	}
+	if _, _, err := c.answerKeyExchange(2, testOffer(t, target, "agent-2")); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.peers.known) != 0 {
+		t.Fatalf("configured peer also pinned on first use: %v", c.peers.known)
+	}
+}
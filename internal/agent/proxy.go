@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/natsvr/natsvr/internal/protocol"
+	"github.com/quic-go/quic-go"
 )
 
 // LocalProxy manages local port forwarding
@@ -219,6 +221,7 @@ type P2PProxy struct {
 	targetHost    string
 	targetPort    int
 	protocol      string
+	encrypted     bool // Encrypt tunnels end to end with the target agent
 	listener      net.Listener
 	udpConn       *net.UDPConn
 	running       bool
@@ -237,6 +240,8 @@ type P2PTunnelConn struct {
 	LocalTunnelID  uint32   // Local tunnel ID (generated by this agent)
 	GlobalTunnelID uint32   // Global tunnel ID (assigned by cloud)
 	ClientConn     net.Conn
+	stream         *protocol.Stream
+	directStream   *quic.Stream // Set instead of stream for tunnels on the direct path
 }
 
 // RemoteTunnelConn represents a remote tunnel connection
@@ -332,7 +337,7 @@ func (p *RemoteProxy) HandleClose(tunnelID uint32) {
 }
 
 // NewP2PProxy creates a new P2P proxy
-func NewP2PProxy(client *Client, ruleID string, listenPort int, targetAgentID, targetHost string, targetPort int, proto string) *P2PProxy {
+func NewP2PProxy(client *Client, ruleID string, listenPort int, targetAgentID, targetHost string, targetPort int, proto string, encrypted bool) *P2PProxy {
 	return &P2PProxy{
 		client:        client,
 		ruleID:        ruleID,
@@ -341,6 +346,7 @@ func NewP2PProxy(client *Client, ruleID string, listenPort int, targetAgentID, t
 		targetHost:    targetHost,
 		targetPort:    targetPort,
 		protocol:      proto,
+		encrypted:     encrypted,
 		tunnels:       make(map[uint32]*P2PTunnelConn),
 		pendingAcks:   make(map[uint32]chan *protocol.ConnectAckPayload),
 		localToGlobal: make(map[uint32]uint32),
@@ -381,6 +387,11 @@ func (p *P2PProxy) Start() error {
 	p.running = true
 	log.Printf("P2P proxy started on :%d -> %s:%s:%d", p.listenPort, p.targetAgentID, p.targetHost, p.targetPort)
 
+	// Ask for a direct path to the target agent ahead of the first tunnel
+	if d := p.client.directPaths(); d != nil && p.protocol == "tcp" {
+		go d.request(p.ruleID, p.targetAgentID)
+	}
+
 	return nil
 }
 
@@ -400,6 +411,13 @@ func (p *P2PProxy) Stop() {
 	// Close all tunnel connections
 	p.tunnelsMu.Lock()
 	for _, tunnel := range p.tunnels {
+		if tunnel.stream != nil {
+			tunnel.stream.Close()
+		}
+		if tunnel.directStream != nil {
+			tunnel.directStream.CancelRead(0)
+			tunnel.directStream.CancelWrite(0)
+		}
 		tunnel.ClientConn.Close()
 	}
 	p.tunnels = make(map[uint32]*P2PTunnelConn)
@@ -446,16 +464,45 @@ func (p *P2PProxy) handleTCPConn(conn net.Conn) {
 		p.pendingMu.Unlock()
 	}()
 
+	// Offer the target agent a key exchange if the rule is end-to-end encrypted
+	var offer *protocol.E2EOffer
+	var keyExchange *protocol.KeyExchange
+	if p.encrypted {
+		var err error
+		offer, err = protocol.NewE2EOffer(p.client.identity.PrivateKey, p.targetHost, uint16(p.targetPort))
+		if err != nil {
+			log.Printf("P2P proxy: failed to start key exchange: %v", err)
+			conn.Close()
+			return
+		}
+		keyExchange = offer.Exchange
+	}
+
+	// Offer the direct path to the target agent if there is one, else ask
+	// for one for later tunnels
+	var link *quic.Conn
+	if d := p.client.directPaths(); d != nil {
+		if link = d.link(p.targetAgentID); link == nil {
+			go d.request(p.ruleID, p.targetAgentID)
+		}
+	}
+
 	// Send P2P connect request through cloud with local tunnel ID
 	log.Printf("P2P proxy: sending connect request to target agent %s for %s:%d (rule: %s)",
 		p.targetAgentID, p.targetHost, p.targetPort, p.ruleID)
 
+	sourceHost, sourcePort := protocol.SourceHostPort(conn.RemoteAddr())
 	payload := protocol.EncodeP2PConnectPayload(&protocol.P2PConnectPayload{
 		SourceAgentID: p.targetAgentID,
 		Protocol:      p.protocol,
 		TargetHost:    p.targetHost,
 		TargetPort:    uint16(p.targetPort),
 		RuleID:        p.ruleID,
+		Window:        protocol.DefaultWindowSize,
+		KeyExchange:   keyExchange,
+		Direct:        link != nil,
+		SourceHost:    sourceHost,
+		SourcePort:    sourcePort,
 	})
 	msg := protocol.NewMessage(protocol.MsgTypeP2PConnect, localTunnelID, payload)
 	if err := p.client.sendMessage(msg); err != nil {
@@ -485,23 +532,59 @@ func (p *P2PProxy) handleTCPConn(conn net.Conn) {
 	// Get global tunnel ID from ack (cloud assigns this)
 	globalTunnelID := ack.TunnelID
 
+	var cipher *protocol.E2ECipher
+	if offer != nil {
+		var err error
+		if cipher, err = offer.Finish(ack.KeyExchange); err == nil {
+			err = p.client.peers.check(ack.KeyExchange)
+		}
+		if err != nil {
+			log.Printf("P2P tunnel %d: end-to-end key exchange failed: %v", globalTunnelID, err)
+			conn.Close()
+			p.client.sendMessage(protocol.NewCloseMessage(globalTunnelID))
+			return
+		}
+		log.Printf("P2P tunnel %d: end-to-end encrypted, peer key %s", globalTunnelID, ack.KeyExchange.Fingerprint())
+	}
+
+	if ack.Direct && link != nil {
+		// The end-to-end cipher goes unused, the direct path is encrypted
+		p.forwardDirect(conn, link, localTunnelID, globalTunnelID)
+		return
+	}
+
 	// Store local to global mapping
 	p.localGlobalMu.Lock()
 	p.localToGlobal[localTunnelID] = globalTunnelID
 	p.localGlobalMu.Unlock()
 
+	// P2P data goes out on the main connection, the cloud relays it
+	stream := p.client.streams.Open(protocol.StreamConfig{
+		TunnelID:   globalTunnelID,
+		DataType:   protocol.MsgTypeP2PData,
+		PeerWindow: ack.Window,
+		Dst:        conn,
+		Send:       p.client.sendMessage,
+
+		Compression: ack.Compression,
+		Stats:       &p.client.ruleTrafficFor(p.ruleID).compression,
+		Cipher:      cipher,
+	})
+
 	// Register tunnel by global ID
 	p.tunnelsMu.Lock()
 	p.tunnels[globalTunnelID] = &P2PTunnelConn{
 		LocalTunnelID:  localTunnelID,
 		GlobalTunnelID: globalTunnelID,
 		ClientConn:     conn,
+		stream:         stream,
 	}
 	p.tunnelsMu.Unlock()
 
 	log.Printf("P2P tunnel established: local=%d global=%d", localTunnelID, globalTunnelID)
 
 	defer func() {
+		stream.Close()
 		conn.Close()
 		p.tunnelsMu.Lock()
 		delete(p.tunnels, globalTunnelID)
@@ -538,8 +621,7 @@ func (p *P2PProxy) handleTCPConn(conn net.Conn) {
 		if n > 0 {
 			log.Printf("P2P tunnel %d: sending %d bytes to target", globalTunnelID, n)
 			// Send P2P data through cloud with global tunnel ID
-			dataMsg := protocol.NewMessage(protocol.MsgTypeP2PData, globalTunnelID, buf[:n])
-			if err := p.client.sendMessage(dataMsg); err != nil {
+			if _, err := stream.Write(buf[:n]); err != nil {
 				log.Printf("P2P tunnel %d: send error: %v", globalTunnelID, err)
 				return
 			}
@@ -547,6 +629,46 @@ func (p *P2PProxy) handleTCPConn(conn net.Conn) {
 	}
 }
 
+// forwardDirect forwards a tunnel the target accepted on the direct path
+// over a stream of its own, until either side closes
+func (p *P2PProxy) forwardDirect(conn net.Conn, link *quic.Conn, localTunnelID, globalTunnelID uint32) {
+	defer func() {
+		conn.Close()
+		p.client.sendMessage(protocol.NewCloseMessage(globalTunnelID))
+	}()
+
+	ctx, cancel := context.WithTimeout(p.client.ctx, 10*time.Second)
+	stream, err := link.OpenStreamSync(ctx)
+	cancel()
+	if err == nil {
+		err = protocol.WriteDirectStreamHeader(stream, globalTunnelID)
+	}
+	if err != nil {
+		log.Printf("P2P tunnel %d: failed to open direct stream: %v", globalTunnelID, err)
+		if stream != nil {
+			stream.CancelWrite(0)
+		}
+		return
+	}
+
+	p.tunnelsMu.Lock()
+	p.tunnels[globalTunnelID] = &P2PTunnelConn{
+		LocalTunnelID:  localTunnelID,
+		GlobalTunnelID: globalTunnelID,
+		ClientConn:     conn,
+		directStream:   stream,
+	}
+	p.tunnelsMu.Unlock()
+
+	log.Printf("P2P tunnel established on the direct path: local=%d global=%d", localTunnelID, globalTunnelID)
+	pipeDirect(conn, stream)
+
+	p.tunnelsMu.Lock()
+	delete(p.tunnels, globalTunnelID)
+	p.tunnelsMu.Unlock()
+	log.Printf("P2P tunnel closed: local=%d global=%d", localTunnelID, globalTunnelID)
+}
+
 func (p *P2PProxy) handleUDP() {
 	// UDP P2P forwarding would be implemented similarly but more complex
 	// For now, just log a warning
@@ -595,10 +717,13 @@ func (p *P2PProxy) HandleData(globalTunnelID uint32, data []byte) bool {
 	if !exists {
 		return false
 	}
+	if tunnel.stream == nil {
+		// The tunnel is on the direct path
+		return true
+	}
 
 	log.Printf("P2P tunnel %d: received %d bytes from target, writing to client", globalTunnelID, len(data))
-	_, err := tunnel.ClientConn.Write(data)
-	if err != nil {
+	if err := tunnel.stream.Deliver(data); err != nil {
 		log.Printf("P2P tunnel %d: write to client error: %v", globalTunnelID, err)
 		tunnel.ClientConn.Close()
 	}
@@ -634,6 +759,7 @@ type AgentCloudTunnelConn struct {
 	LocalTunnelID  uint32
 	GlobalTunnelID uint32
 	ClientConn     net.Conn
+	stream         *protocol.Stream
 }
 
 // NewAgentCloudProxy creates a new agent-cloud proxy
@@ -709,6 +835,7 @@ func (p *AgentCloudProxy) Stop() {
 	// Close all tunnel connections
 	p.tunnelsMu.Lock()
 	for _, tunnel := range p.tunnels {
+		tunnel.stream.Close()
 		tunnel.ClientConn.Close()
 	}
 	p.tunnels = make(map[uint32]*AgentCloudTunnelConn)
@@ -758,11 +885,15 @@ func (p *AgentCloudProxy) handleTCPConn(conn net.Conn) {
 	// Send agent-cloud connect request to cloud via rule connection
 	log.Printf("Agent-cloud proxy: sending connect request to cloud for %s:%d (rule: %s)", p.targetHost, p.targetPort, p.ruleID)
 
+	sourceHost, sourcePort := protocol.SourceHostPort(conn.RemoteAddr())
 	payload := protocol.EncodeAgentCloudConnectPayload(&protocol.AgentCloudConnectPayload{
 		Protocol:   p.protocol,
 		TargetHost: p.targetHost,
 		TargetPort: uint16(p.targetPort),
 		RuleID:     p.ruleID,
+		Window:     protocol.DefaultWindowSize,
+		SourceHost: sourceHost,
+		SourcePort: sourcePort,
 	})
 	msg := protocol.NewMessage(protocol.MsgTypeAgentCloudConnect, localTunnelID, payload)
 	if err := p.sendMessage(msg); err != nil {
@@ -796,18 +927,31 @@ func (p *AgentCloudProxy) handleTCPConn(conn net.Conn) {
 	p.localToGlobal[localTunnelID] = globalTunnelID
 	p.localGlobalMu.Unlock()
 
+	stream := p.client.streams.Open(protocol.StreamConfig{
+		TunnelID:   globalTunnelID,
+		DataType:   protocol.MsgTypeAgentCloudData,
+		PeerWindow: ack.Window,
+		Dst:        conn,
+		Send:       p.sendMessage,
+
+		Compression: ack.Compression,
+		Stats:       &p.client.ruleTrafficFor(p.ruleID).compression,
+	})
+
 	// Register tunnel
 	p.tunnelsMu.Lock()
 	p.tunnels[globalTunnelID] = &AgentCloudTunnelConn{
 		LocalTunnelID:  localTunnelID,
 		GlobalTunnelID: globalTunnelID,
 		ClientConn:     conn,
+		stream:         stream,
 	}
 	p.tunnelsMu.Unlock()
 
 	log.Printf("Agent-cloud tunnel established: local=%d global=%d", localTunnelID, globalTunnelID)
 
 	defer func() {
+		stream.Close()
 		conn.Close()
 		p.tunnelsMu.Lock()
 		delete(p.tunnels, globalTunnelID)
@@ -843,8 +987,7 @@ func (p *AgentCloudProxy) handleTCPConn(conn net.Conn) {
 
 		if n > 0 {
 			log.Printf("Agent-cloud tunnel %d: sending %d bytes to cloud", globalTunnelID, n)
-			dataMsg := protocol.NewMessage(protocol.MsgTypeAgentCloudData, globalTunnelID, buf[:n])
-			if err := p.sendMessage(dataMsg); err != nil {
+			if _, err := stream.Write(buf[:n]); err != nil {
 				log.Printf("Agent-cloud tunnel %d: send error: %v", globalTunnelID, err)
 				return
 			}
@@ -895,8 +1038,7 @@ func (p *AgentCloudProxy) HandleData(globalTunnelID uint32, data []byte) bool {
 	}
 
 	log.Printf("Agent-cloud tunnel %d: received %d bytes from cloud, writing to client", globalTunnelID, len(data))
-	_, err := tunnel.ClientConn.Write(data)
-	if err != nil {
+	if err := tunnel.stream.Deliver(data); err != nil {
 		log.Printf("Agent-cloud tunnel %d: write to client error: %v", globalTunnelID, err)
 		tunnel.ClientConn.Close()
 	}
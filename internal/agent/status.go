@@ -0,0 +1,318 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+	"github.com/natsvr/natsvr/pkg/metrics"
+	"github.com/natsvr/natsvr/pkg/version"
+)
+
+// ruleTraffic counts the bytes a rule carried over all its rule connections
+type ruleTraffic struct {
+	txBytes int64 // atomic
+	rxBytes int64 // atomic
+
+	compression protocol.CompressionStats // Data of compressed tunnels
+}
+
+// ruleTrafficFor returns the traffic counters of a rule, creating them
+func (c *Client) ruleTrafficFor(ruleID string) *ruleTraffic {
+	c.ruleTrafficMu.Lock()
+	defer c.ruleTrafficMu.Unlock()
+	t, ok := c.ruleTraffic[ruleID]
+	if !ok {
+		t = &ruleTraffic{}
+		c.ruleTraffic[ruleID] = t
+	}
+	return t
+}
+
+// Status is a snapshot of the agent served on /status
+type Status struct {
+	AgentID           string                  `json:"agentId"`
+	Name              string                  `json:"name"`
+	Version           string                  `json:"version"`
+	Server            string                  `json:"server"`
+	Connected         bool                    `json:"connected"`
+	ConnectedAt       string                  `json:"connectedAt,omitempty"`
+	LastError         string                  `json:"lastError,omitempty"`
+	Reconnects        int64                   `json:"reconnects"`
+	Tunnels           []TunnelStatus          `json:"tunnels"`
+	RuleConnections   []RuleConnectionStatus  `json:"ruleConnections"`
+	P2PProxies        []ProxyStatus           `json:"p2pProxies"`
+	AgentCloudProxies []ProxyStatus           `json:"agentCloudProxies"`
+	DirectPaths       []DirectPathStatus      `json:"directPaths"`
+	RuleTraffic       map[string]TrafficStats `json:"ruleTraffic"`
+}
+
+// TunnelStatus describes an active TunnelHandler
+type TunnelStatus struct {
+	ID       uint32 `json:"id"`
+	RuleID   string `json:"ruleId,omitempty"` // empty for tunnels on the control connection
+	Protocol string `json:"protocol"`
+	Target   string `json:"target"`
+}
+
+// RuleConnectionStatus describes the health of a rule connection
+type RuleConnectionStatus struct {
+	RuleID       string `json:"ruleId"`
+	Connected    bool   `json:"connected"`
+	ConnectedAt  string `json:"connectedAt"`
+	LastReceived string `json:"lastReceived,omitempty"`
+	Tunnels      int    `json:"tunnels"`
+}
+
+// ProxyStatus describes a P2PProxy or AgentCloudProxy listener
+type ProxyStatus struct {
+	RuleID      string `json:"ruleId"`
+	Protocol    string `json:"protocol"`
+	ListenPort  int    `json:"listenPort"`
+	TargetAgent string `json:"targetAgent,omitempty"`
+	Target      string `json:"target"`
+	Running     bool   `json:"running"`
+	Tunnels     int    `json:"tunnels"`
+}
+
+// DirectPathStatus describes a direct connection to another agent
+type DirectPathStatus struct {
+	Peer       string `json:"peer"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// TrafficStats holds the bytes a rule carried
+type TrafficStats struct {
+	TxBytes int64 `json:"txBytes"`
+	RxBytes int64 `json:"rxBytes"`
+	// Data of compressed tunnels before and after compression, both ways
+	UncompressedBytes int64 `json:"uncompressedBytes,omitempty"`
+	CompressedBytes   int64 `json:"compressedBytes,omitempty"`
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// Status returns a snapshot of the agent's connections, tunnels and proxies
+func (c *Client) Status() *Status {
+	st := &Status{
+		AgentID:     c.agentID,
+		Name:        c.config.Name,
+		Version:     version.Version,
+		Server:      c.config.ServerURL,
+		Connected:   c.connected,
+		Reconnects:  atomic.LoadInt64(&c.reconnects),
+		RuleTraffic: make(map[string]TrafficStats),
+
+		Tunnels:           []TunnelStatus{},
+		RuleConnections:   []RuleConnectionStatus{},
+		P2PProxies:        []ProxyStatus{},
+		AgentCloudProxies: []ProxyStatus{},
+		DirectPaths:       []DirectPathStatus{},
+	}
+
+	c.statusMu.Lock()
+	if st.Connected && !c.connectedAt.IsZero() {
+		st.ConnectedAt = formatTime(c.connectedAt)
+	}
+	st.LastError = c.lastConnErr
+	c.statusMu.Unlock()
+
+	c.tunnelsMu.RLock()
+	for _, t := range c.tunnels {
+		st.Tunnels = append(st.Tunnels, newTunnelStatus("", t))
+	}
+	c.tunnelsMu.RUnlock()
+
+	c.ruleConnsMu.RLock()
+	for _, rc := range c.ruleConns {
+		rs := RuleConnectionStatus{
+			RuleID:      rc.RuleID,
+			Connected:   rc.connected,
+			ConnectedAt: formatTime(rc.connectedAt),
+		}
+		if ns := atomic.LoadInt64(&rc.lastRecv); ns != 0 {
+			rs.LastReceived = formatTime(time.Unix(0, ns))
+		}
+		rc.tunnelsMu.RLock()
+		rs.Tunnels = len(rc.tunnels)
+		for _, t := range rc.tunnels {
+			st.Tunnels = append(st.Tunnels, newTunnelStatus(rc.RuleID, t))
+		}
+		rc.tunnelsMu.RUnlock()
+		st.RuleConnections = append(st.RuleConnections, rs)
+	}
+	c.ruleConnsMu.RUnlock()
+
+	c.localProxyMu.RLock()
+	for _, p := range c.localProxies {
+		st.P2PProxies = append(st.P2PProxies, p.status())
+	}
+	c.localProxyMu.RUnlock()
+
+	c.agentCloudProxyMu.RLock()
+	for _, p := range c.agentCloudProxies {
+		st.AgentCloudProxies = append(st.AgentCloudProxies, p.status())
+	}
+	c.agentCloudProxyMu.RUnlock()
+
+	if d := c.directPaths(); d != nil {
+		st.DirectPaths = d.status()
+	}
+
+	c.ruleTrafficMu.Lock()
+	for id, t := range c.ruleTraffic {
+		raw, wire := t.compression.Load()
+		st.RuleTraffic[id] = TrafficStats{
+			TxBytes: atomic.LoadInt64(&t.txBytes),
+			RxBytes: atomic.LoadInt64(&t.rxBytes),
+
+			UncompressedBytes: raw,
+			CompressedBytes:   wire,
+		}
+	}
+	c.ruleTrafficMu.Unlock()
+
+	sort.Slice(st.Tunnels, func(i, j int) bool { return st.Tunnels[i].ID < st.Tunnels[j].ID })
+	sort.Slice(st.RuleConnections, func(i, j int) bool { return st.RuleConnections[i].RuleID < st.RuleConnections[j].RuleID })
+	sort.Slice(st.P2PProxies, func(i, j int) bool { return st.P2PProxies[i].RuleID < st.P2PProxies[j].RuleID })
+	sort.Slice(st.AgentCloudProxies, func(i, j int) bool { return st.AgentCloudProxies[i].RuleID < st.AgentCloudProxies[j].RuleID })
+	sort.Slice(st.DirectPaths, func(i, j int) bool { return st.DirectPaths[i].Peer < st.DirectPaths[j].Peer })
+
+	return st
+}
+
+func newTunnelStatus(ruleID string, t *TunnelHandler) TunnelStatus {
+	return TunnelStatus{
+		ID:       t.ID,
+		RuleID:   ruleID,
+		Protocol: t.Protocol,
+		Target:   fmt.Sprintf("%s:%d", t.TargetHost, t.TargetPort),
+	}
+}
+
+func (p *P2PProxy) status() ProxyStatus {
+	p.runMu.Lock()
+	running := p.running
+	p.runMu.Unlock()
+	p.tunnelsMu.RLock()
+	tunnels := len(p.tunnels)
+	p.tunnelsMu.RUnlock()
+
+	return ProxyStatus{
+		RuleID:      p.ruleID,
+		Protocol:    p.protocol,
+		ListenPort:  p.listenPort,
+		TargetAgent: p.targetAgentID,
+		Target:      fmt.Sprintf("%s:%d", p.targetHost, p.targetPort),
+		Running:     running,
+		Tunnels:     tunnels,
+	}
+}
+
+func (p *AgentCloudProxy) status() ProxyStatus {
+	p.runMu.Lock()
+	running := p.running
+	p.runMu.Unlock()
+	p.tunnelsMu.RLock()
+	tunnels := len(p.tunnels)
+	p.tunnelsMu.RUnlock()
+
+	return ProxyStatus{
+		RuleID:     p.ruleID,
+		Protocol:   p.protocol,
+		ListenPort: p.listenPort,
+		Target:     fmt.Sprintf("%s:%d", p.targetHost, p.targetPort),
+		Running:    running,
+		Tunnels:    tunnels,
+	}
+}
+
+// newMetricsRegistry builds the agent's Prometheus metrics, all read from
+// Status at scrape time
+func (c *Client) newMetricsRegistry() *metrics.Registry {
+	reg := metrics.NewRegistry()
+
+	reg.NewGaugeFunc("natsvr_agent_connected",
+		"Whether the control connection to the cloud is up.", nil,
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: boolValue(c.Status().Connected)}}
+		})
+	reg.NewCounterFunc("natsvr_agent_reconnects_total",
+		"Connection attempts after the first.", nil,
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(atomic.LoadInt64(&c.reconnects))}}
+		})
+	reg.NewGaugeFunc("natsvr_agent_tunnels",
+		"Active tunnel handlers.", nil,
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(len(c.Status().Tunnels))}}
+		})
+	reg.NewGaugeFunc("natsvr_agent_proxy_listeners",
+		"Running proxy listeners by kind.", []string{"kind"},
+		func() []metrics.Sample {
+			st := c.Status()
+			return []metrics.Sample{
+				{Labels: []string{"p2p"}, Value: float64(countRunning(st.P2PProxies))},
+				{Labels: []string{"agent-cloud"}, Value: float64(countRunning(st.AgentCloudProxies))},
+			}
+		})
+	reg.NewGaugeFunc("natsvr_agent_rule_connection_up",
+		"Whether each rule connection is up.", []string{"rule_id"},
+		func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, rc := range c.Status().RuleConnections {
+				samples = append(samples, metrics.Sample{Labels: []string{rc.RuleID}, Value: boolValue(rc.Connected)})
+			}
+			return samples
+		})
+	reg.NewCounterFunc("natsvr_agent_rule_bytes_total",
+		"Bytes carried by each rule's connections, by direction.", []string{"rule_id", "direction"},
+		func() []metrics.Sample {
+			var samples []metrics.Sample
+			for id, t := range c.Status().RuleTraffic {
+				samples = append(samples,
+					metrics.Sample{Labels: []string{id, "tx"}, Value: float64(t.TxBytes)},
+					metrics.Sample{Labels: []string{id, "rx"}, Value: float64(t.RxBytes)})
+			}
+			return samples
+		})
+
+	return reg
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func countRunning(proxies []ProxyStatus) int {
+	n := 0
+	for _, p := range proxies {
+		if p.Running {
+			n++
+		}
+	}
+	return n
+}
+
+// ServeStatus serves /metrics (Prometheus text format) and /status (JSON)
+// on addr. It blocks until the listener fails.
+func (c *Client) ServeStatus(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.newMetricsRegistry().Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(c.Status())
+	})
+	return http.ListenAndServe(addr, mux)
+}
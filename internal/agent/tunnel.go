@@ -4,43 +4,90 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 
 	"github.com/natsvr/natsvr/internal/protocol"
 )
 
+// proxySource is the client a TCP tunnel's target hears about in a PROXY
+// header, for rules that ask for one
+type proxySource struct {
+	version protocol.ProxyProtocol
+	addr    netip.AddrPort
+}
+
+func newProxySource(p *protocol.ConnectPayload) proxySource {
+	return proxySource{version: p.ProxyProtocol, addr: protocol.SourceAddrPort(p.SourceHost, p.SourcePort)}
+}
+
+// dial connects to a TCP tunnel's target, starting with the PROXY header
+func (s proxySource) dial(host string, port uint16) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), 10*time.Second)
+	if err != nil || s.version == protocol.ProxyProtocolNone {
+		return conn, err
+	}
+	header := protocol.ProxyHeader(s.version, s.addr, protocol.AddrPortOf(conn.RemoteAddr()))
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // TCPTunnel handles TCP tunnel connections
 type TCPTunnel struct {
 	client     *Client
 	tunnelID   uint32
 	targetHost string
 	targetPort uint16
+	window     uint32 // Window the cloud advertised
 	conn       net.Conn
+	stream     *protocol.Stream
+	// Compression and end-to-end encryption of the tunnel's data, as
+	// accepted in the ack
+	compression protocol.Compression
+	cipher      *protocol.E2ECipher
+	proxy       proxySource // Client the target hears about in a PROXY header
 	connMu     sync.Mutex
 	closed     bool
 }
 
 // NewTCPTunnel creates a new TCP tunnel
-func NewTCPTunnel(client *Client, tunnelID uint32, targetHost string, targetPort uint16) *TCPTunnel {
+func NewTCPTunnel(client *Client, tunnelID uint32, targetHost string, targetPort uint16, window uint32, compression protocol.Compression, cipher *protocol.E2ECipher) *TCPTunnel {
 	return &TCPTunnel{
-		client:     client,
-		tunnelID:   tunnelID,
-		targetHost: targetHost,
-		targetPort: targetPort,
+		client:      client,
+		tunnelID:    tunnelID,
+		targetHost:  targetHost,
+		targetPort:  targetPort,
+		window:      window,
+		compression: compression,
+		cipher:      cipher,
 	}
 }
 
 // Start connects to the target and starts forwarding
 func (t *TCPTunnel) Start() error {
-	addr := fmt.Sprintf("%s:%d", t.targetHost, t.targetPort)
-	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	conn, err := t.proxy.dial(t.targetHost, t.targetPort)
 	if err != nil {
 		return err
 	}
 
+	stream := t.client.streams.Open(protocol.StreamConfig{
+		TunnelID:   t.tunnelID,
+		DataType:   protocol.MsgTypeData,
+		PeerWindow: t.window,
+		Dst:        conn,
+		Send:       t.client.sendMessage,
+
+		Compression: t.compression,
+		Cipher:      t.cipher,
+	})
+
 	t.connMu.Lock()
 	t.conn = conn
+	t.stream = stream
 	t.connMu.Unlock()
 
 	// Start reading from target
@@ -49,29 +96,30 @@ func (t *TCPTunnel) Start() error {
 	return nil
 }
 
-// Stop closes the tunnel
+// Stop closes the tunnel once data already received is written to the target
 func (t *TCPTunnel) Stop() {
 	t.connMu.Lock()
 	t.closed = true
-	if t.conn != nil {
-		t.conn.Close()
-	}
+	conn, stream := t.conn, t.stream
 	t.connMu.Unlock()
+
+	if stream != nil {
+		stream.Finish(func() { conn.Close() })
+	}
 }
 
 // HandleData writes data to the target
 func (t *TCPTunnel) HandleData(data []byte) error {
 	t.connMu.Lock()
-	conn := t.conn
+	stream := t.stream
 	t.connMu.Unlock()
 
-	if conn == nil {
+	if stream == nil {
 		return fmt.Errorf("connection closed")
 	}
 
 	log.Printf("Tunnel %d: writing %d bytes to target", t.tunnelID, len(data))
-	_, err := conn.Write(data)
-	return err
+	return stream.Deliver(data)
 }
 
 func (t *TCPTunnel) readFromTarget() {
@@ -80,7 +128,7 @@ func (t *TCPTunnel) readFromTarget() {
 
 	for {
 		t.connMu.Lock()
-		conn := t.conn
+		conn, stream := t.conn, t.stream
 		closed := t.closed
 		t.connMu.Unlock()
 
@@ -99,7 +147,7 @@ func (t *TCPTunnel) readFromTarget() {
 		}
 
 		log.Printf("Tunnel %d: read %d bytes from target, sending to cloud", t.tunnelID, n)
-		if err := t.client.SendData(t.tunnelID, buf[:n]); err != nil {
+		if _, err := stream.Write(buf[:n]); err != nil {
 			log.Printf("Tunnel %d: send data error: %v", t.tunnelID, err)
 			return
 		}
@@ -291,32 +339,56 @@ type RuleTCPTunnel struct {
 	tunnelID   uint32
 	targetHost string
 	targetPort uint16
+	window     uint32 // Window the cloud advertised
 	conn       net.Conn
+	stream     *protocol.Stream
+	// Compression and end-to-end encryption of the tunnel's data, as
+	// accepted in the ack
+	compression protocol.Compression
+	cipher      *protocol.E2ECipher
+	proxy       proxySource // Client the target hears about in a PROXY header
 	connMu     sync.Mutex
 	closed     bool
 }
 
 // NewRuleTCPTunnel creates a new TCP tunnel for a rule connection
-func NewRuleTCPTunnel(client *Client, ruleConn *RuleConnection, tunnelID uint32, targetHost string, targetPort uint16) *RuleTCPTunnel {
+func NewRuleTCPTunnel(client *Client, ruleConn *RuleConnection, tunnelID uint32, targetHost string, targetPort uint16, window uint32, compression protocol.Compression, cipher *protocol.E2ECipher) *RuleTCPTunnel {
 	return &RuleTCPTunnel{
-		client:     client,
-		ruleConn:   ruleConn,
-		tunnelID:   tunnelID,
-		targetHost: targetHost,
-		targetPort: targetPort,
+		client:      client,
+		ruleConn:    ruleConn,
+		tunnelID:    tunnelID,
+		targetHost:  targetHost,
+		targetPort:  targetPort,
+		window:      window,
+		compression: compression,
+		cipher:      cipher,
 	}
 }
 
 // Start connects to the target and starts forwarding
 func (t *RuleTCPTunnel) Start() error {
-	addr := fmt.Sprintf("%s:%d", t.targetHost, t.targetPort)
-	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	conn, err := t.proxy.dial(t.targetHost, t.targetPort)
 	if err != nil {
 		return err
 	}
 
+	stream := t.client.streams.Open(protocol.StreamConfig{
+		TunnelID:   t.tunnelID,
+		DataType:   protocol.MsgTypeData,
+		PeerWindow: t.window,
+		Dst:        conn,
+		Send: func(msg *protocol.Message) error {
+			return t.client.sendRuleMessage(t.ruleConn, msg)
+		},
+
+		Compression: t.compression,
+		Stats:       &t.client.ruleTrafficFor(t.ruleConn.RuleID).compression,
+		Cipher:      t.cipher,
+	})
+
 	t.connMu.Lock()
 	t.conn = conn
+	t.stream = stream
 	t.connMu.Unlock()
 
 	// Start reading from target
@@ -325,28 +397,29 @@ func (t *RuleTCPTunnel) Start() error {
 	return nil
 }
 
-// Stop closes the tunnel
+// Stop closes the tunnel once data already received is written to the target
 func (t *RuleTCPTunnel) Stop() {
 	t.connMu.Lock()
 	t.closed = true
-	if t.conn != nil {
-		t.conn.Close()
-	}
+	conn, stream := t.conn, t.stream
 	t.connMu.Unlock()
+
+	if stream != nil {
+		stream.Finish(func() { conn.Close() })
+	}
 }
 
 // HandleData writes data to the target
 func (t *RuleTCPTunnel) HandleData(data []byte) error {
 	t.connMu.Lock()
-	conn := t.conn
+	stream := t.stream
 	t.connMu.Unlock()
 
-	if conn == nil {
+	if stream == nil {
 		return fmt.Errorf("connection closed")
 	}
 
-	_, err := conn.Write(data)
-	return err
+	return stream.Deliver(data)
 }
 
 func (t *RuleTCPTunnel) readFromTarget() {
@@ -354,7 +427,7 @@ func (t *RuleTCPTunnel) readFromTarget() {
 
 	for {
 		t.connMu.Lock()
-		conn := t.conn
+		conn, stream := t.conn, t.stream
 		closed := t.closed
 		t.connMu.Unlock()
 
@@ -370,7 +443,7 @@ func (t *RuleTCPTunnel) readFromTarget() {
 			return
 		}
 
-		if err := t.client.SendRuleData(t.ruleConn, t.tunnelID, buf[:n]); err != nil {
+		if _, err := stream.Write(buf[:n]); err != nil {
 			return
 		}
 	}
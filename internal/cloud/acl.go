@@ -0,0 +1,251 @@
+package cloud
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/natsvr/natsvr/internal/geoip"
+)
+
+// Source filters of the rules the cloud listens for: CIDR allow and deny
+// lists and, with a GeoIP database, country allow and deny lists. Denies
+// win, and with any allow list a client must match one of them.
+
+// rejectReportInterval is how often rejections of a client by a rule are
+// logged and audited, the others are counted
+const rejectReportInterval = time.Minute
+
+// maxRejectReports bounds the clients whose rejections are tracked per rule
+const maxRejectReports = 4096
+
+// sourceFilter is the parsed form of a rule's source lists
+type sourceFilter struct {
+	allow, deny                   []netip.Prefix
+	allowCountries, denyCountries []string
+}
+
+// hasSourceFilter reports whether a rule limits the clients it accepts
+func (r *ForwardRule) hasSourceFilter() bool {
+	return len(r.AllowCIDRs) > 0 || len(r.DenyCIDRs) > 0 || len(r.AllowCountries) > 0 || len(r.DenyCountries) > 0
+}
+
+// newSourceFilter parses the source lists of a rule, nil if it has none
+func newSourceFilter(rule *ForwardRule) (*sourceFilter, error) {
+	if !rule.hasSourceFilter() {
+		return nil, nil
+	}
+	filter := &sourceFilter{
+		allowCountries: rule.AllowCountries,
+		denyCountries:  rule.DenyCountries,
+	}
+	var err error
+	if filter.allow, err = parsePrefixes(rule.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if filter.deny, err = parsePrefixes(rule.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// usesCountries reports whether the filter needs the country of clients
+func (sf *sourceFilter) usesCountries() bool {
+	return len(sf.allowCountries) > 0 || len(sf.denyCountries) > 0
+}
+
+// check returns why a client is rejected, empty if it is accepted. Clients
+// of unknown address or country only pass when nothing requires them to
+// match an allow list.
+func (sf *sourceFilter) check(ip netip.Addr, geo *geoip.DB) string {
+	ip = ip.Unmap()
+	if !ip.IsValid() {
+		if len(sf.allow) > 0 || len(sf.allowCountries) > 0 {
+			return "unknown address"
+		}
+		return ""
+	}
+	if prefix, ok := matchPrefix(sf.deny, ip); ok {
+		return "denied by " + prefix.String()
+	}
+
+	var country string
+	if geo != nil && sf.usesCountries() {
+		country = geo.Country(ip)
+	}
+	if country != "" && slices.Contains(sf.denyCountries, country) {
+		return "denied country " + country
+	}
+
+	if len(sf.allow) == 0 && len(sf.allowCountries) == 0 {
+		return ""
+	}
+	if _, ok := matchPrefix(sf.allow, ip); ok {
+		return ""
+	}
+	if country != "" && slices.Contains(sf.allowCountries, country) {
+		return ""
+	}
+	if country != "" {
+		return "country " + country + " not allowed"
+	}
+	return "not allowed"
+}
+
+func matchPrefix(prefixes []netip.Prefix, ip netip.Addr) (netip.Prefix, bool) {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// parsePrefixes parses addresses and CIDRs, an address standing for
+// itself alone
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			// Clients are matched by their IPv4 address, not its IPv6 form
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", entry)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// normalizeCIDRs validates the CIDR list of a rule, returning it in
+// canonical form
+func normalizeCIDRs(entries []string) ([]string, error) {
+	prefixes, err := parsePrefixes(entries)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, prefix := range prefixes {
+		if prefix.IsSingleIP() {
+			out = append(out, prefix.Addr().String())
+		} else {
+			out = append(out, prefix.String())
+		}
+	}
+	return out, nil
+}
+
+// normalizeCountries validates the country list of a rule, returning the
+// codes in upper case
+func normalizeCountries(entries []string) ([]string, error) {
+	var out []string
+	for _, entry := range entries {
+		code := strings.ToUpper(strings.TrimSpace(entry))
+		if code == "" {
+			continue
+		}
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return nil, fmt.Errorf("invalid country code %q, expected ISO 3166-1 alpha-2 such as \"US\"", entry)
+		}
+		out = append(out, code)
+	}
+	return out, nil
+}
+
+// rejectReport tracks the rejections of a client by a rule
+type rejectReport struct {
+	last       time.Time // When a rejection was last reported
+	suppressed int       // Rejections since then
+}
+
+// admitSource checks a client of a rule against its source filter
+func (f *Forwarder) admitSource(state *ForwardRuleState, ip netip.Addr) bool {
+	if state.sourceFilter == nil {
+		return true
+	}
+	reason := state.sourceFilter.check(ip, f.server.geoip)
+	if reason == "" {
+		return true
+	}
+	f.reject(state, ip.Unmap(), AuditRuleSourceReject, reason)
+	return false
+}
+
+// reject counts a rejected client of a rule. It is logged and audited at
+// most once per rejectReportInterval for each client of the rule.
+func (f *Forwarder) reject(state *ForwardRuleState, ip netip.Addr, action, reason string) {
+	atomic.AddInt64(&state.Rejected, 1)
+
+	now := time.Now()
+	state.rejectMu.Lock()
+	if state.rejectReports == nil {
+		state.rejectReports = make(map[netip.Addr]*rejectReport)
+	}
+	report, ok := state.rejectReports[ip]
+	if ok && now.Sub(report.last) < rejectReportInterval {
+		report.suppressed++
+		state.rejectMu.Unlock()
+		return
+	}
+	if !ok {
+		if len(state.rejectReports) >= maxRejectReports {
+			for addr, r := range state.rejectReports {
+				if now.Sub(r.last) >= rejectReportInterval {
+					delete(state.rejectReports, addr)
+				}
+			}
+			if len(state.rejectReports) >= maxRejectReports {
+				// Too many clients to report, they are still counted
+				state.rejectMu.Unlock()
+				return
+			}
+		}
+		report = &rejectReport{}
+		state.rejectReports[ip] = report
+	}
+	suppressed := report.suppressed
+	report.last, report.suppressed = now, 0
+	state.rejectMu.Unlock()
+
+	rule := state.Rule
+	if suppressed > 0 {
+		log.Printf("Rejected %s on rule %s: %s (%d more since last report)", ip, rule.Name, reason, suppressed)
+	} else {
+		log.Printf("Rejected %s on rule %s: %s", ip, rule.Name, reason)
+	}
+	f.server.recordAudit(&AuditEvent{
+		Actor:      AuditActorSystem,
+		ActorKind:  AuditActorSystem,
+		Action:     action,
+		TargetType: "rule",
+		TargetID:   rule.ID,
+		ClientIP:   ip.String(),
+		After:      auditJSON(gin.H{"rule": rule.Name, "reason": reason, "suppressed": suppressed}),
+	})
+}
+
+// GetRuleRejected returns the clients a running rule rejected by its source
+// filter or connection limits, or packets for udp rules
+func (f *Forwarder) GetRuleRejected(ruleID string) int64 {
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+	if state, ok := f.rules[ruleID]; ok {
+		return atomic.LoadInt64(&state.Rejected)
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package cloud
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/geoip"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    []string
+	}{
+		{[]string{"10.0.0.0/8", " 192.0.2.1 ", ""}, []string{"10.0.0.0/8", "192.0.2.1/32"}},
+		{[]string{"10.1.2.3/8"}, []string{"10.0.0.0/8"}}, // Masked
+		{[]string{"2001:db8::1"}, []string{"2001:db8::1/128"}},
+		{[]string{"2001:db8::/32"}, []string{"2001:db8::/32"}},
+		// IPv4 in its IPv6 form matches IPv4 clients
+		{[]string{"::ffff:192.0.2.1"}, []string{"192.0.2.1/32"}},
+		{[]string{"::ffff:10.0.0.0/104"}, []string{"10.0.0.0/8"}},
+		{[]string{"::ffff:0:0/96"}, []string{"0.0.0.0/0"}},
+		// Shorter than the mapped prefix, stays IPv6
+		{[]string{"::ffff:0:0/80"}, []string{"::/80"}},
+	}
+	for _, tt := range tests {
+		prefixes, err := parsePrefixes(tt.entries)
+		if err != nil {
+			t.Errorf("parsePrefixes(%q): %v", tt.entries, err)
+			continue
+		}
+		var got []string
+		for _, p := range prefixes {
+			got = append(got, p.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parsePrefixes(%q) = %q, want %q", tt.entries, got, tt.want)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "example.com", "10.0.0.256", "10.0.0.0/"} {
+		if _, err := parsePrefixes([]string{entry}); err == nil {
+			t.Errorf("parsePrefixes(%q) accepted", entry)
+		}
+	}
+}
+
+func TestSourceFilterCheck(t *testing.T) {
+	geo, err := geoip.Open("../geoip/testdata/countries.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+
+	// In the test database 192.0.2.0/24 is US, 198.51.100.0/24 JP,
+	// 203.0.113.0/24 DE and 100.64.0.0/10 has no country
+	tests := []struct {
+		name   string
+		rule   ForwardRule
+		geo    *geoip.DB
+		ip     string
+		reject bool
+	}{
+		{"no allow list", ForwardRule{DenyCIDRs: []string{"10.0.0.0/8"}}, nil, "192.0.2.1", false},
+		{"denied", ForwardRule{DenyCIDRs: []string{"10.0.0.0/8"}}, nil, "10.1.1.1", true},
+		{"denied mapped", ForwardRule{DenyCIDRs: []string{"10.0.0.0/8"}}, nil, "::ffff:10.1.1.1", true},
+		{"allowed", ForwardRule{AllowCIDRs: []string{"192.0.2.0/24"}}, nil, "192.0.2.1", false},
+		{"not allowed", ForwardRule{AllowCIDRs: []string{"192.0.2.0/24"}}, nil, "192.0.3.1", true},
+		{"deny beats allow", ForwardRule{AllowCIDRs: []string{"192.0.2.0/24"}, DenyCIDRs: []string{"192.0.2.7"}}, nil, "192.0.2.7", true},
+		{"deny beats allowed country", ForwardRule{AllowCountries: []string{"US"}, DenyCIDRs: []string{"192.0.2.7"}}, geo, "192.0.2.7", true},
+		{"denied country beats allow", ForwardRule{AllowCIDRs: []string{"192.0.2.0/24"}, DenyCountries: []string{"US"}}, geo, "192.0.2.1", true},
+		{"allowed country", ForwardRule{AllowCountries: []string{"US", "JP"}}, geo, "198.51.100.1", false},
+		{"other country", ForwardRule{AllowCountries: []string{"US"}}, geo, "203.0.113.1", true},
+		{"allowed by CIDR not country", ForwardRule{AllowCIDRs: []string{"203.0.113.0/24"}, AllowCountries: []string{"US"}}, geo, "203.0.113.1", false},
+		{"denied country", ForwardRule{DenyCountries: []string{"DE"}}, geo, "2001:db8::1", true},
+		{"other than denied country", ForwardRule{DenyCountries: []string{"DE"}}, geo, "192.0.2.1", false},
+		// Clients of unknown country pass deny lists but not allow lists
+		{"unknown country, deny list", ForwardRule{DenyCountries: []string{"DE"}}, geo, "100.64.0.1", false},
+		{"unknown country, allow list", ForwardRule{AllowCountries: []string{"US"}}, geo, "100.64.0.1", true},
+		{"no database, deny list", ForwardRule{DenyCountries: []string{"US"}}, nil, "192.0.2.1", false},
+		{"no database, allow list", ForwardRule{AllowCountries: []string{"US"}}, nil, "192.0.2.1", true},
+		// As are clients of unknown address
+		{"unknown address, deny list", ForwardRule{DenyCIDRs: []string{"0.0.0.0/0"}}, nil, "", false},
+		{"unknown address, allow list", ForwardRule{AllowCIDRs: []string{"0.0.0.0/0"}}, nil, "", true},
+		{"unknown address, allowed country", ForwardRule{AllowCountries: []string{"US"}}, geo, "", true},
+	}
+	for _, tt := range tests {
+		filter, err := newSourceFilter(&tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var ip netip.Addr
+		if tt.ip != "" {
+			ip = netip.MustParseAddr(tt.ip)
+		}
+		reason := filter.check(ip, tt.geo)
+		if (reason != "") != tt.reject {
+			t.Errorf("%s: check(%s) = %q, want rejected %v", tt.name, tt.ip, reason, tt.reject)
+		}
+	}
+
+	if filter, _ := newSourceFilter(&ForwardRule{}); filter != nil {
+		t.Error("rule without source lists has a filter")
+	}
+}
+
+func TestRejectReports(t *testing.T) {
+	s := newTestServer(t)
+	f := s.forwarder
+	state := &ForwardRuleState{Rule: &ForwardRule{ID: "rule-1", Name: "ssh"}}
+
+	reports := func() int {
+		t.Helper()
+		events, _, err := s.store.GetAuditEvents(AuditFilter{Action: AuditRuleSourceReject, TargetID: "rule-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(events)
+	}
+
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+	for range 5 {
+		f.reject(state, a, AuditRuleSourceReject, "not allowed")
+	}
+	f.reject(state, b, AuditRuleSourceReject, "not allowed")
+	if got := atomic.LoadInt64(&state.Rejected); got != 6 {
+		t.Errorf("Rejected = %d, want 6", got)
+	}
+	// The first rejection of each client is reported, the others counted
+	if got := reports(); got != 2 {
+		t.Errorf("%d reports, want 2", got)
+	}
+	if got := state.rejectReports[a].suppressed; got != 4 {
+		t.Errorf("%d suppressed, want 4", got)
+	}
+
+	// After the interval the next rejection is reported with the count of
+	// the suppressed ones
+	state.rejectReports[a].last = time.Now().Add(-rejectReportInterval)
+	f.reject(state, a, AuditRuleSourceReject, "not allowed")
+	if got := reports(); got != 3 {
+		t.Errorf("%d reports after the interval, want 3", got)
+	}
+	if got := state.rejectReports[a].suppressed; got != 0 {
+		t.Errorf("%d suppressed after a report, want 0", got)
+	}
+	events, _, _ := s.store.GetAuditEvents(AuditFilter{Action: AuditRuleSourceReject, Limit: 1})
+	if len(events) != 1 || events[0].ClientIP != a.String() || !strings.Contains(events[0].After, `"suppressed":4`) {
+		t.Errorf("latest report %+v, want %s with 4 suppressed", events, a)
+	}
+}
+
+func TestRejectReportsBounded(t *testing.T) {
+	s := newTestServer(t)
+	f := s.forwarder
+	state := &ForwardRuleState{Rule: &ForwardRule{ID: "rule-1", Name: "ssh"}}
+
+	// Pretend maxRejectReports clients were reported just now
+	state.rejectReports = make(map[netip.Addr]*rejectReport)
+	base := netip.MustParseAddr("10.0.0.0").As4()
+	for i := range maxRejectReports {
+		ip := base
+		ip[2], ip[3] = byte(i>>8), byte(i)
+		state.rejectReports[netip.AddrFrom4(ip)] = &rejectReport{last: time.Now()}
+	}
+
+	// New clients are counted but not tracked
+	f.reject(state, netip.MustParseAddr("192.0.2.1"), AuditRuleSourceReject, "not allowed")
+	if len(state.rejectReports) != maxRejectReports {
+		t.Errorf("%d clients tracked, want %d", len(state.rejectReports), maxRejectReports)
+	}
+	if got := atomic.LoadInt64(&state.Rejected); got != 1 {
+		t.Errorf("Rejected = %d, want 1", got)
+	}
+
+	// Once reports expire their clients make room
+	for _, report := range state.rejectReports {
+		report.last = time.Now().Add(-rejectReportInterval)
+	}
+	f.reject(state, netip.MustParseAddr("192.0.2.1"), AuditRuleSourceReject, "not allowed")
+	if _, ok := state.rejectReports[netip.MustParseAddr("192.0.2.1")]; !ok || len(state.rejectReports) != 1 {
+		t.Errorf("%d clients tracked after expiry, want only the new one", len(state.rejectReports))
+	}
+}
@@ -1,40 +1,89 @@
 package cloud
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/natsvr/natsvr/internal/protocol"
 	"github.com/natsvr/natsvr/pkg/version"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // API response types
 type AgentResponse struct {
-	ID            string `json:"id"`
-	Name          string `json:"name"`
-	IP            string `json:"ip"`
-	Online        bool   `json:"online"`
-	LastSeen      string `json:"lastSeen"`
-	ActiveTunnels int    `json:"activeTunnels"`
-	TxBytes       int64  `json:"txBytes"`
-	RxBytes       int64  `json:"rxBytes"`
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	IP            string            `json:"ip"`
+	Online        bool              `json:"online"`
+	Version       string            `json:"version,omitempty"`
+	OS            string            `json:"os,omitempty"`
+	Arch          string            `json:"arch,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	FirstSeen     string            `json:"firstSeen"`
+	LastSeen      string            `json:"lastSeen"`
+	ActiveTunnels int               `json:"activeTunnels"`
+	TxBytes       int64             `json:"txBytes"` // Cumulative across connections
+	RxBytes       int64             `json:"rxBytes"` // Cumulative across connections
+
+	// Negotiated during auth, set while the agent is online
+	ProtocolVersion uint16   `json:"protocolVersion,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
 }
 
 type ForwardRuleResponse struct {
-	ID            string `json:"id"`
-	Name          string `json:"name"`
-	Type          string `json:"type"`
-	Protocol      string `json:"protocol"`
-	SourceAgentID string `json:"sourceAgentId,omitempty"`
-	ListenPort    int    `json:"listenPort"`
-	TargetAgentID string `json:"targetAgentId,omitempty"`
-	TargetHost    string `json:"targetHost"`
-	TargetPort    int    `json:"targetPort"`
-	Enabled       bool   `json:"enabled"`
-	RateLimit     int64  `json:"rateLimit"`
-	TrafficLimit  int64  `json:"trafficLimit"`
-	TrafficUsed   int64  `json:"trafficUsed"`
-	CreatedAt     string `json:"createdAt"`
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Type          string   `json:"type"`
+	Protocol      string   `json:"protocol"`
+	SourceAgentID string   `json:"sourceAgentId,omitempty"`
+	ListenPort    int      `json:"listenPort"`
+	TargetAgentID string   `json:"targetAgentId,omitempty"`
+	TargetHost    string   `json:"targetHost"`
+	TargetPort    int      `json:"targetPort"`
+	Enabled       bool     `json:"enabled"`
+	RateLimit     int64    `json:"rateLimit"`
+	TrafficLimit  int64    `json:"trafficLimit"`
+	TrafficUsed   int64    `json:"trafficUsed"`
+	Compression   string   `json:"compression,omitempty"`
+	Encrypted     bool     `json:"encrypted,omitempty"`
+	Domains       []string `json:"domains,omitempty"`
+	PathPrefix    string   `json:"pathPrefix,omitempty"`
+	ProxyProtocol string   `json:"proxyProtocol,omitempty"`
+	CreatedAt     string   `json:"createdAt"`
+
+	// Source filters of rules the cloud listens for
+	AllowCIDRs     []string `json:"allowCidrs,omitempty"`
+	DenyCIDRs      []string `json:"denyCidrs,omitempty"`
+	AllowCountries []string `json:"allowCountries,omitempty"`
+	DenyCountries  []string `json:"denyCountries,omitempty"`
+	Rejected       int64    `json:"rejected,omitempty"` // Clients, or udp packets, the running rule rejected
+
+	// Connection limits of tcp and tls-sni rules the cloud listens for
+	MaxConns      int `json:"maxConns,omitempty"`
+	MaxConnRate   int `json:"maxConnRate,omitempty"`
+	MaxConnsPerIP int `json:"maxConnsPerIp,omitempty"`
+
+	// HTTP middleware of http rules, without the secrets
+	BasicAuthUser  string            `json:"basicAuthUser,omitempty"`
+	BearerAuth     bool              `json:"bearerAuth,omitempty"`
+	HostRewrite    string            `json:"hostRewrite,omitempty"`
+	RequestHeaders map[string]string `json:"requestHeaders,omitempty"`
+	ForwardedFor   bool              `json:"forwardedFor,omitempty"`
+	AccessLog      bool              `json:"accessLog,omitempty"`
+
+	// Data of the running rule's compressed tunnels, before and after
+	// compression. P2P tunnels are compressed end to end and not counted.
+	UncompressedBytes int64   `json:"uncompressedBytes,omitempty"`
+	CompressedBytes   int64   `json:"compressedBytes,omitempty"`
+	CompressionRatio  float64 `json:"compressionRatio,omitempty"`
 }
 
 type StatsResponse struct {
@@ -44,33 +93,209 @@ type StatsResponse struct {
 	RxSpeed     float64 `json:"rxSpeed"`
 	OnlineCount int     `json:"onlineCount"`
 	TotalRules  int     `json:"totalRules"`
+
+	// Data of compressed tunnels across running rules
+	UncompressedBytes int64   `json:"uncompressedBytes"`
+	CompressedBytes   int64   `json:"compressedBytes"`
+	CompressionRatio  float64 `json:"compressionRatio"`
 }
 
-type TokenResponse struct {
+type UserResponse struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	Role      Role   `json:"role"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type APIKeyResponse struct {
 	ID         string `json:"id"`
 	Name       string `json:"name"`
-	Token      string `json:"token"`
-	UsageCount int    `json:"usageCount"`
+	Key        string `json:"key,omitempty"` // Only returned once, at creation
+	Prefix     string `json:"prefix"`
+	Role       Role   `json:"role"`
+	AgentScope string `json:"agentScope,omitempty"`
+	LastUsedAt string `json:"lastUsedAt,omitempty"`
 	CreatedAt  string `json:"createdAt"`
 }
 
+type TokenResponse struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Token         string   `json:"token,omitempty"` // Only returned once, at creation or rotation
+	Prefix        string   `json:"prefix"`
+	UsageCount    int      `json:"usageCount"`
+	AgentName     string   `json:"agentName,omitempty"`
+	AgentID       string   `json:"agentId,omitempty"`
+	ExpiresAt     string   `json:"expiresAt,omitempty"`
+	AllowedRules  []string `json:"allowedRules,omitempty"`
+	PrevExpiresAt string   `json:"previousExpiresAt,omitempty"` // Old secret accepted until then
+	CreatedAt     string   `json:"createdAt"`
+}
+
+type AgentCertificateResponse struct {
+	Serial    string `json:"serial"`
+	AgentID   string `json:"agentId"`
+	AgentName string `json:"agentName,omitempty"`
+	NotBefore string `json:"notBefore"`
+	NotAfter  string `json:"notAfter"`
+	RevokedAt string `json:"revokedAt,omitempty"`
+	Live      bool   `json:"live"`  // Neither revoked nor expired
+	InUse     bool   `json:"inUse"` // The agent is connected with it
+}
+
+type RevokeAgentCertificatesRequest struct {
+	Serial string `json:"serial"` // Empty = all of the agent's certificates
+}
+
+func newTokenResponse(t *Token) TokenResponse {
+	resp := TokenResponse{
+		ID:           t.ID,
+		Name:         t.Name,
+		Token:        t.Token,
+		Prefix:       t.Prefix,
+		UsageCount:   t.UsageCount,
+		AgentName:    t.AgentName,
+		AgentID:      t.AgentID,
+		AllowedRules: t.AllowedRules,
+		CreatedAt:    t.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+	if t.ExpiresAt != nil {
+		resp.ExpiresAt = t.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	if t.PrevHash != "" && t.PrevExpiresAt != nil && time.Now().Before(*t.PrevExpiresAt) {
+		resp.PrevExpiresAt = t.PrevExpiresAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return resp
+}
+
+// tokenSnapshot is a token response without the secret, for the audit log
+func tokenSnapshot(t *Token) TokenResponse {
+	resp := newTokenResponse(t)
+	resp.Token = ""
+	return resp
+}
+
+func newForwardRuleResponse(rule *ForwardRule) ForwardRuleResponse {
+	return ForwardRuleResponse{
+		ID:            rule.ID,
+		Name:          rule.Name,
+		Type:          rule.Type,
+		Protocol:      rule.Protocol,
+		SourceAgentID: rule.SourceAgentID,
+		ListenPort:    rule.ListenPort,
+		TargetAgentID: rule.TargetAgentID,
+		TargetHost:    rule.TargetHost,
+		TargetPort:    rule.TargetPort,
+		Enabled:       rule.Enabled,
+		RateLimit:     rule.RateLimit,
+		TrafficLimit:  rule.TrafficLimit,
+		TrafficUsed:   rule.TrafficUsed,
+		Compression:   rule.Compression,
+		Encrypted:     rule.Encrypted,
+		Domains:       rule.Domains,
+		PathPrefix:    rule.PathPrefix,
+		ProxyProtocol: rule.ProxyProtocol,
+		CreatedAt:     rule.CreatedAt.Format("2006-01-02T15:04:05Z"),
+
+		AllowCIDRs:     rule.AllowCIDRs,
+		DenyCIDRs:      rule.DenyCIDRs,
+		AllowCountries: rule.AllowCountries,
+		DenyCountries:  rule.DenyCountries,
+
+		MaxConns:      rule.MaxConns,
+		MaxConnRate:   rule.MaxConnRate,
+		MaxConnsPerIP: rule.MaxConnsPerIP,
+
+		BasicAuthUser:  rule.BasicAuthUser,
+		BearerAuth:     rule.BearerHash != "",
+		HostRewrite:    rule.HostRewrite,
+		RequestHeaders: rule.RequestHeaders,
+		ForwardedFor:   rule.ForwardedFor,
+		AccessLog:      rule.AccessLog,
+	}
+}
+
+// compressionRatio returns how many times smaller compressed data got, or 0
+// if nothing was compressed
+func compressionRatio(raw, wire int64) float64 {
+	if wire == 0 {
+		return 0
+	}
+	return math.Round(float64(raw)/float64(wire)*100) / 100
+}
+
+func newUserResponse(u *User) UserResponse {
+	return UserResponse{
+		ID:        u.ID,
+		Username:  u.Username,
+		Role:      u.Role,
+		CreatedAt: u.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+}
+
+func newAPIKeyResponse(k *APIKey) APIKeyResponse {
+	resp := APIKeyResponse{
+		ID:         k.ID,
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Role:       k.Role,
+		AgentScope: k.AgentScope,
+		CreatedAt:  k.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+	if k.LastUsedAt != nil {
+		resp.LastUsedAt = k.LastUsedAt.Format("2006-01-02T15:04:05Z")
+	}
+	return resp
+}
+
+func newAgentCertificateResponse(cert *AgentCertificate, agent *AgentConn) AgentCertificateResponse {
+	resp := AgentCertificateResponse{
+		Serial:    cert.Serial,
+		AgentID:   cert.AgentID,
+		AgentName: cert.AgentName,
+		NotBefore: cert.NotBefore.UTC().Format("2006-01-02T15:04:05Z"),
+		NotAfter:  cert.NotAfter.UTC().Format("2006-01-02T15:04:05Z"),
+		Live:      cert.Live(time.Now()),
+		InUse:     agent != nil && agent.CertSerial == cert.Serial,
+	}
+	if cert.RevokedAt != nil {
+		resp.RevokedAt = cert.RevokedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return resp
+}
+
 // Agent endpoints
 func (s *Server) handleGetAgents(c *gin.Context) {
+	principal := principalFrom(c)
+
+	records, err := s.store.GetAgentRecords()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	s.agentsMu.RLock()
-	defer s.agentsMu.RUnlock()
-
-	agents := make([]AgentResponse, 0, len(s.agents))
-	for _, a := range s.agents {
-		agents = append(agents, AgentResponse{
-			ID:            a.ID,
-			Name:          a.Name,
-			IP:            a.IP,
-			Online:        true,
-			LastSeen:      a.LastHeartbeat.Format("2006-01-02T15:04:05Z"),
-			ActiveTunnels: a.ActiveTunnels,
-			TxBytes:       a.TxBytes,
-			RxBytes:       a.RxBytes,
-		})
+	online := make(map[string]*AgentConn, len(s.agents))
+	for id, a := range s.agents {
+		online[id] = a
+	}
+	s.agentsMu.RUnlock()
+
+	// Registry records, merged with live connections, include offline agents
+	agents := make([]AgentResponse, 0, len(records))
+	for _, rec := range records {
+		if !principal.CanAccessAgent(rec.ID, rec.Name) {
+			continue
+		}
+		agents = append(agents, newAgentResponse(rec, online[rec.ID]))
+		delete(online, rec.ID)
+	}
+
+	// Connected agents whose record could not be written
+	for _, a := range online {
+		if principal.CanAccessAgent(a.ID, a.Name) {
+			agents = append(agents, newAgentResponse(nil, a))
+		}
 	}
 
 	c.JSON(http.StatusOK, agents)
@@ -80,24 +305,113 @@ func (s *Server) handleGetAgent(c *gin.Context) {
 	id := c.Param("id")
 
 	s.agentsMu.RLock()
-	agent, exists := s.agents[id]
+	agent := s.agents[id]
 	s.agentsMu.RUnlock()
 
-	if !exists {
+	rec, err := s.store.GetAgentRecord(id)
+	if err != nil {
+		rec = nil
+	}
+
+	if agent == nil && rec == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, AgentResponse{
-		ID:            agent.ID,
-		Name:          agent.Name,
-		IP:            agent.IP,
-		Online:        true,
-		LastSeen:      agent.LastHeartbeat.Format("2006-01-02T15:04:05Z"),
-		ActiveTunnels: agent.ActiveTunnels,
-		TxBytes:       agent.TxBytes,
-		RxBytes:       agent.RxBytes,
-	})
+	resp := newAgentResponse(rec, agent)
+	if !principalFrom(c).CanAccessAgent(resp.ID, resp.Name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleDeleteAgent(c *gin.Context) {
+	id := c.Param("id")
+
+	if s.GetAgent(id) != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Agent is online"})
+		return
+	}
+
+	var before any
+	if rec, err := s.store.GetAgentRecord(id); err == nil {
+		before = newAgentResponse(rec, nil)
+	}
+
+	if err := s.store.DeleteAgentRecord(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// A new identity may enroll under the ID now
+	if err := s.store.DeleteAgentCertificates(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.audit(c, AuditAgentDelete, "agent", id, before, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Agent deleted"})
+}
+
+func (s *Server) handleGetAgentCertificates(c *gin.Context) {
+	id := c.Param("id")
+
+	certs, err := s.store.GetAgentCertificates(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := ""
+	if rec, err := s.store.GetAgentRecord(id); err == nil {
+		name = rec.Name
+	} else if len(certs) > 0 {
+		name = certs[0].AgentName
+	}
+	if !principalFrom(c).CanAccessAgent(id, name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+
+	agent := s.GetAgent(id)
+	responses := make([]AgentCertificateResponse, 0, len(certs))
+	for _, cert := range certs {
+		responses = append(responses, newAgentCertificateResponse(cert, agent))
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+// handleRevokeAgentCertificates revokes one or all of an agent's client
+// certificates and disconnects the agent if it can no longer connect
+func (s *Server) handleRevokeAgentCertificates(c *gin.Context) {
+	id := c.Param("id")
+
+	var req RevokeAgentCertificatesRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revoked, err := s.store.RevokeAgentCertificates(id, req.Serial)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Serial != "" && len(revoked) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Certificate not found or already revoked"})
+		return
+	}
+
+	kicked := s.disconnectRevoked(id, revoked)
+	s.audit(c, AuditAgentCertRevoke, "agent", id, nil, gin.H{"serials": revoked, "disconnected": kicked})
+	if kicked {
+		s.auditSystem(AuditAgentKick, "agent", id, gin.H{"reason": "client certificate revoked"})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revoked": len(revoked), "disconnected": kicked})
 }
 
 // Forward rule endpoints
@@ -108,46 +422,67 @@ func (s *Server) handleGetForwardRules(c *gin.Context) {
 		return
 	}
 
-	responses := make([]ForwardRuleResponse, len(rules))
-	for i, r := range rules {
+	principal := principalFrom(c)
+
+	responses := make([]ForwardRuleResponse, 0, len(rules))
+	for _, r := range rules {
+		if !principal.CanAccessRule(r) {
+			continue
+		}
+
+		resp := newForwardRuleResponse(r)
 		// Get real-time traffic if rule is active
-		trafficUsed := r.TrafficUsed
 		if liveTraffic := s.forwarder.GetRuleTraffic(r.ID); liveTraffic > 0 {
-			trafficUsed = liveTraffic
-		}
-		
-		responses[i] = ForwardRuleResponse{
-			ID:            r.ID,
-			Name:          r.Name,
-			Type:          r.Type,
-			Protocol:      r.Protocol,
-			SourceAgentID: r.SourceAgentID,
-			ListenPort:    r.ListenPort,
-			TargetAgentID: r.TargetAgentID,
-			TargetHost:    r.TargetHost,
-			TargetPort:    r.TargetPort,
-			Enabled:       r.Enabled,
-			RateLimit:     r.RateLimit,
-			TrafficLimit:  r.TrafficLimit,
-			TrafficUsed:   trafficUsed,
-			CreatedAt:     r.CreatedAt.Format("2006-01-02T15:04:05Z"),
+			resp.TrafficUsed = liveTraffic
 		}
+		resp.UncompressedBytes, resp.CompressedBytes = s.forwarder.GetRuleCompression(r.ID)
+		resp.CompressionRatio = compressionRatio(resp.UncompressedBytes, resp.CompressedBytes)
+		resp.Rejected = s.forwarder.GetRuleRejected(r.ID)
+		responses = append(responses, resp)
 	}
 
 	c.JSON(http.StatusOK, responses)
 }
 
 type CreateForwardRuleRequest struct {
-	Name          string `json:"name" binding:"required"`
-	Type          string `json:"type" binding:"required"`
-	Protocol      string `json:"protocol" binding:"required"`
-	SourceAgentID string `json:"sourceAgentId"`
-	ListenPort    int    `json:"listenPort" binding:"required"`
-	TargetAgentID string `json:"targetAgentId"`
-	TargetHost    string `json:"targetHost" binding:"required"`
-	TargetPort    int    `json:"targetPort" binding:"required"`
-	RateLimit     int64  `json:"rateLimit"`     // bytes per second, 0 = unlimited
-	TrafficLimit  int64  `json:"trafficLimit"`  // max total bytes, 0 = unlimited
+	Name          string   `json:"name" binding:"required"`
+	Type          string   `json:"type" binding:"required"`
+	Protocol      string   `json:"protocol" binding:"required"`
+	SourceAgentID string   `json:"sourceAgentId"`
+	ListenPort    int      `json:"listenPort"`
+	TargetAgentID string   `json:"targetAgentId"`
+	TargetHost    string   `json:"targetHost" binding:"required"`
+	TargetPort    int      `json:"targetPort" binding:"required"`
+	RateLimit     int64    `json:"rateLimit"`     // bytes per second, 0 = unlimited
+	TrafficLimit  int64    `json:"trafficLimit"`  // max total bytes, 0 = unlimited
+	Compression   string   `json:"compression"`   // "zstd" or "snappy", empty = none
+	Encrypted     bool     `json:"encrypted"`     // End to end between the agents
+	Domains       []string `json:"domains"`       // Hosts of an http or tls-sni rule, e.g. "app.example.com" or "*.example.com"
+	PathPrefix    string   `json:"pathPrefix"`    // Path an http rule is limited to, empty = all paths
+	ProxyProtocol string   `json:"proxyProtocol"` // "v1" or "v2" sends the target a PROXY header, empty = none
+
+	// Source filters of rules the cloud listens for. Entries are addresses
+	// or CIDRs, and ISO 3166-1 alpha-2 country codes.
+	AllowCIDRs     []string `json:"allowCidrs"`
+	DenyCIDRs      []string `json:"denyCidrs"`
+	AllowCountries []string `json:"allowCountries"`
+	DenyCountries  []string `json:"denyCountries"`
+
+	// Connection limits of tcp and tls-sni rules the cloud listens for,
+	// 0 = unlimited
+	MaxConns      int `json:"maxConns"`      // Open connections
+	MaxConnRate   int `json:"maxConnRate"`   // New connections per second
+	MaxConnsPerIP int `json:"maxConnsPerIp"` // Open connections per client address
+
+	// HTTP middleware of http rules. With basic auth or a bearer token,
+	// requests must present either.
+	BasicAuthUser     string            `json:"basicAuthUser"`
+	BasicAuthPassword string            `json:"basicAuthPassword"`
+	BearerToken       string            `json:"bearerToken"`
+	HostRewrite       string            `json:"hostRewrite"`    // Host sent to the target, empty = the requested host
+	RequestHeaders    map[string]string `json:"requestHeaders"` // Set on requests to the target, an empty value removes the header
+	ForwardedFor      bool              `json:"forwardedFor"`   // Add X-Forwarded-For, -Host and -Proto
+	AccessLog         bool              `json:"accessLog"`      // Log requests and publish them as http.request events
 }
 
 func (s *Server) handleCreateForwardRule(c *gin.Context) {
@@ -169,6 +504,135 @@ func (s *Server) handleCreateForwardRule(c *gin.Context) {
 		return
 	}
 
+	// http and tls-sni rules share the cloud's listeners instead of a port
+	if req.Protocol == "http" || req.Protocol == "tls-sni" {
+		if req.Type != "cloud-agent" && req.Type != "remote" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": req.Protocol + " is only supported for cloud-agent rules"})
+			return
+		}
+		domains, err := normalizeDomains(req.Protocol, req.Domains)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Domains = domains
+		req.ListenPort = 0
+		if req.Protocol == "http" {
+			req.PathPrefix = normalizePathPrefix(req.PathPrefix)
+		} else {
+			// The path is encrypted
+			req.PathPrefix = ""
+		}
+
+		rules, err := s.store.GetForwardRules()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if other := hostRuleConflict(rules, req.Protocol, req.Domains, req.PathPrefix); other != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("rule %s already serves one of these domains", other.Name)})
+			return
+		}
+	} else {
+		if req.ListenPort == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "listenPort is required for this protocol"})
+			return
+		}
+		req.Domains, req.PathPrefix = nil, ""
+	}
+
+	if req.Protocol == "http" {
+		if (req.BasicAuthUser == "") != (req.BasicAuthPassword == "") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "basic auth needs both basicAuthUser and basicAuthPassword"})
+			return
+		}
+		if strings.Contains(req.BasicAuthUser, ":") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "basicAuthUser cannot contain ':'"})
+			return
+		}
+		req.HostRewrite = strings.TrimSpace(req.HostRewrite)
+		if strings.ContainsAny(req.HostRewrite, " /\r\n") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid hostRewrite"})
+			return
+		}
+		if err := validateRequestHeaders(req.RequestHeaders); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else if req.BasicAuthUser != "" || req.BasicAuthPassword != "" || req.BearerToken != "" || req.HostRewrite != "" ||
+		len(req.RequestHeaders) > 0 || req.ForwardedFor || req.AccessLog {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "HTTP middleware is only supported for http rules"})
+		return
+	}
+
+	compression, err := protocol.ParseCompression(req.Compression)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if compression == protocol.CompressionNone {
+		req.Compression = ""
+	}
+
+	// A PROXY header describes one client, http rules pool their connections
+	// and udp has no connections
+	proxyProtocol, err := protocol.ParseProxyProtocol(req.ProxyProtocol)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if proxyProtocol != protocol.ProxyProtocolNone && req.Protocol != "tcp" && req.Protocol != "tls-sni" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "proxyProtocol is only supported for tcp and tls-sni rules"})
+		return
+	}
+	req.ProxyProtocol = ""
+	if proxyProtocol != protocol.ProxyProtocolNone {
+		req.ProxyProtocol = proxyProtocol.String()
+	}
+
+	if req.AllowCIDRs, err = normalizeCIDRs(req.AllowCIDRs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "allowCidrs: " + err.Error()})
+		return
+	}
+	if req.DenyCIDRs, err = normalizeCIDRs(req.DenyCIDRs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "denyCidrs: " + err.Error()})
+		return
+	}
+	if req.AllowCountries, err = normalizeCountries(req.AllowCountries); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "allowCountries: " + err.Error()})
+		return
+	}
+	if req.DenyCountries, err = normalizeCountries(req.DenyCountries); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "denyCountries: " + err.Error()})
+		return
+	}
+	// Clients of agent listeners never reach the cloud
+	hasCountries := len(req.AllowCountries) > 0 || len(req.DenyCountries) > 0
+	if (len(req.AllowCIDRs) > 0 || len(req.DenyCIDRs) > 0 || hasCountries) && !cloudListens(req.Type) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source filters are only supported for cloud-agent and cloud-direct rules"})
+		return
+	}
+	if hasCountries && s.geoip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "country filters need a GeoIP database, see -geoip-db"})
+		return
+	}
+
+	if req.MaxConns < 0 || req.MaxConnRate < 0 || req.MaxConnsPerIP < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "connection limits cannot be negative"})
+		return
+	}
+	if (req.MaxConns > 0 || req.MaxConnRate > 0 || req.MaxConnsPerIP > 0) &&
+		(!cloudListens(req.Type) || (req.Protocol != "tcp" && req.Protocol != "tls-sni")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "connection limits are only supported for tcp and tls-sni cloud-agent and cloud-direct rules"})
+		return
+	}
+
+	// Only agent-to-agent TCP tunnels are relayed without the cloud ending them
+	if req.Encrypted && (!isAgentToAgent(req.Type) || req.Protocol != "tcp") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "encrypted is only supported for tcp agent-agent rules"})
+		return
+	}
+
 	rule := &ForwardRule{
 		ID:            uuid.New().String(),
 		Name:          req.Name,
@@ -182,6 +646,32 @@ func (s *Server) handleCreateForwardRule(c *gin.Context) {
 		Enabled:       true,
 		RateLimit:     req.RateLimit,
 		TrafficLimit:  req.TrafficLimit,
+		Compression:   req.Compression,
+		Encrypted:     req.Encrypted,
+		Domains:       req.Domains,
+		PathPrefix:    req.PathPrefix,
+		ProxyProtocol: req.ProxyProtocol,
+
+		AllowCIDRs:     req.AllowCIDRs,
+		DenyCIDRs:      req.DenyCIDRs,
+		AllowCountries: req.AllowCountries,
+		DenyCountries:  req.DenyCountries,
+
+		MaxConns:      req.MaxConns,
+		MaxConnRate:   req.MaxConnRate,
+		MaxConnsPerIP: req.MaxConnsPerIP,
+
+		HostRewrite:    req.HostRewrite,
+		RequestHeaders: req.RequestHeaders,
+		ForwardedFor:   req.ForwardedFor,
+		AccessLog:      req.AccessLog,
+	}
+	if err := rule.setHTTPAuth(req.BasicAuthUser, req.BasicAuthPassword, req.BearerToken); errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "basicAuthPassword must be at most 72 bytes"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	if err := s.store.CreateForwardRule(rule); err != nil {
@@ -195,22 +685,10 @@ func (s *Server) handleCreateForwardRule(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, ForwardRuleResponse{
-		ID:            rule.ID,
-		Name:          rule.Name,
-		Type:          rule.Type,
-		Protocol:      rule.Protocol,
-		SourceAgentID: rule.SourceAgentID,
-		ListenPort:    rule.ListenPort,
-		TargetAgentID: rule.TargetAgentID,
-		TargetHost:    rule.TargetHost,
-		TargetPort:    rule.TargetPort,
-		Enabled:       rule.Enabled,
-		RateLimit:     rule.RateLimit,
-		TrafficLimit:  rule.TrafficLimit,
-		TrafficUsed:   rule.TrafficUsed,
-		CreatedAt:     rule.CreatedAt.Format("2006-01-02T15:04:05Z"),
-	})
+	resp := newForwardRuleResponse(rule)
+	s.audit(c, AuditRuleCreate, "rule", rule.ID, nil, resp)
+
+	c.JSON(http.StatusCreated, resp)
 }
 
 type UpdateForwardRuleRequest struct {
@@ -227,10 +705,11 @@ func (s *Server) handleUpdateForwardRule(c *gin.Context) {
 	}
 
 	rule, err := s.store.GetForwardRule(id)
-	if err != nil {
+	if err != nil || !principalFrom(c).CanAccessRule(rule) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
 		return
 	}
+	before := newForwardRuleResponse(rule)
 
 	if req.Enabled != nil {
 		if *req.Enabled && !rule.Enabled {
@@ -251,26 +730,19 @@ func (s *Server) handleUpdateForwardRule(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, ForwardRuleResponse{
-		ID:            rule.ID,
-		Name:          rule.Name,
-		Type:          rule.Type,
-		Protocol:      rule.Protocol,
-		SourceAgentID: rule.SourceAgentID,
-		ListenPort:    rule.ListenPort,
-		TargetAgentID: rule.TargetAgentID,
-		TargetHost:    rule.TargetHost,
-		TargetPort:    rule.TargetPort,
-		Enabled:       rule.Enabled,
-		RateLimit:     rule.RateLimit,
-		TrafficLimit:  rule.TrafficLimit,
-		TrafficUsed:   rule.TrafficUsed,
-		CreatedAt:     rule.CreatedAt.Format("2006-01-02T15:04:05Z"),
-	})
+	resp := newForwardRuleResponse(rule)
+	s.audit(c, AuditRuleUpdate, "rule", rule.ID, before, resp)
+
+	c.JSON(http.StatusOK, resp)
 }
 
 // Stats endpoint
 func (s *Server) handleGetStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.statsSnapshot())
+}
+
+// statsSnapshot returns the current global stats
+func (s *Server) statsSnapshot() StatsResponse {
 	txBytes, rxBytes, txSpeed, rxSpeed := s.forwarder.GetGlobalStats()
 	
 	s.agentsMu.RLock()
@@ -280,19 +752,30 @@ func (s *Server) handleGetStats(c *gin.Context) {
 	rules, _ := s.store.GetForwardRules()
 	totalRules := len(rules)
 	
-	c.JSON(http.StatusOK, StatsResponse{
+	raw, wire := s.forwarder.GetCompressionStats()
+
+	return StatsResponse{
 		TxBytes:     txBytes,
 		RxBytes:     rxBytes,
 		TxSpeed:     txSpeed,
 		RxSpeed:     rxSpeed,
 		OnlineCount: onlineCount,
 		TotalRules:  totalRules,
-	})
+
+		UncompressedBytes: raw,
+		CompressedBytes:   wire,
+		CompressionRatio:  compressionRatio(raw, wire),
+	}
 }
 
 func (s *Server) handleDeleteForwardRule(c *gin.Context) {
 	id := c.Param("id")
 
+	var before any
+	if rule, err := s.store.GetForwardRule(id); err == nil {
+		before = newForwardRuleResponse(rule)
+	}
+
 	// Stop the rule first
 	s.forwarder.StopRule(id)
 
@@ -301,9 +784,38 @@ func (s *Server) handleDeleteForwardRule(c *gin.Context) {
 		return
 	}
 
+	s.audit(c, AuditRuleDelete, "rule", id, before, nil)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Rule deleted"})
 }
 
+// Tunnel endpoints
+func (s *Server) handleGetTunnels(c *gin.Context) {
+	principal := principalFrom(c)
+
+	f := s.forwarder
+	f.tunnelConnMu.RLock()
+	conns := make([]*TunnelConn, 0, len(f.tunnelConns))
+	for _, tc := range f.tunnelConns {
+		conns = append(conns, tc)
+	}
+	f.tunnelConnMu.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+
+	tunnels := make([]TunnelEventData, 0, len(conns))
+	for _, tc := range conns {
+		f.rulesMu.RLock()
+		state, ok := f.rules[tc.RuleID]
+		f.rulesMu.RUnlock()
+		if ok && !principal.CanAccessRule(state.Rule) || !ok && !principal.CanAccessAgent(tc.AgentID, tc.SourceAgentID) {
+			continue
+		}
+		tunnels = append(tunnels, newTunnelEventData(tc))
+	}
+
+	c.JSON(http.StatusOK, tunnels)
+}
+
 // Token endpoints
 func (s *Server) handleGetTokens(c *gin.Context) {
 	tokens, err := s.store.GetTokens()
@@ -314,20 +826,18 @@ func (s *Server) handleGetTokens(c *gin.Context) {
 
 	responses := make([]TokenResponse, len(tokens))
 	for i, t := range tokens {
-		responses[i] = TokenResponse{
-			ID:         t.ID,
-			Name:       t.Name,
-			Token:      t.Token,
-			UsageCount: t.UsageCount,
-			CreatedAt:  t.CreatedAt.Format("2006-01-02T15:04:05Z"),
-		}
+		responses[i] = newTokenResponse(t)
 	}
 
 	c.JSON(http.StatusOK, responses)
 }
 
 type CreateTokenRequest struct {
-	Name string `json:"name" binding:"required"`
+	Name         string     `json:"name" binding:"required"`
+	AgentName    string     `json:"agentName"`    // Pin the token to an agent name
+	AgentID      string     `json:"agentId"`      // Pin the token to an agent ID
+	ExpiresAt    *time.Time `json:"expiresAt"`    // RFC 3339, omitted = never expires
+	AllowedRules []string   `json:"allowedRules"` // Rule IDs the agent may serve, empty = all
 }
 
 func (s *Server) handleCreateToken(c *gin.Context) {
@@ -337,10 +847,27 @@ func (s *Server) handleCreateToken(c *gin.Context) {
 		return
 	}
 
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return
+	}
+
 	token := &Token{
-		ID:    uuid.New().String(),
-		Name:  req.Name,
-		Token: uuid.New().String() + "-" + uuid.New().String(),
+		ID:           uuid.New().String(),
+		Name:         req.Name,
+		AgentName:    req.AgentName,
+		AgentID:      req.AgentID,
+		ExpiresAt:    req.ExpiresAt,
+		AllowedRules: req.AllowedRules,
+	}
+
+	secret, err := generateTokenSecret()
+	if err == nil {
+		err = token.setSecret(secret)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	if err := s.store.CreateToken(token); err != nil {
@@ -348,26 +875,296 @@ func (s *Server) handleCreateToken(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, TokenResponse{
-		ID:         token.ID,
-		Name:       token.Name,
-		Token:      token.Token,
-		UsageCount: token.UsageCount,
-		CreatedAt:  token.CreatedAt.Format("2006-01-02T15:04:05Z"),
-	})
+	s.audit(c, AuditTokenCreate, "token", token.ID, nil, tokenSnapshot(token))
+
+	c.JSON(http.StatusCreated, newTokenResponse(token))
+}
+
+type RotateTokenRequest struct {
+	GracePeriod string `json:"gracePeriod"` // e.g. "1h", empty = 24h, "0s" = revoke the old secret now
+}
+
+func (s *Server) handleRotateToken(c *gin.Context) {
+	id := c.Param("id")
+
+	var req RotateTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	grace := DefaultTokenGracePeriod
+	if req.GracePeriod != "" {
+		d, err := time.ParseDuration(req.GracePeriod)
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid gracePeriod"})
+			return
+		}
+		grace = d
+	}
+
+	token, err := s.store.GetToken(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	before := tokenSnapshot(token)
+
+	if err := token.rotate(grace); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.store.RotateToken(token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.audit(c, AuditTokenRotate, "token", token.ID, before, tokenSnapshot(token))
+
+	c.JSON(http.StatusOK, newTokenResponse(token))
 }
 
 func (s *Server) handleDeleteToken(c *gin.Context) {
 	id := c.Param("id")
 
+	var before any
+	if token, err := s.store.GetToken(id); err == nil {
+		before = tokenSnapshot(token)
+	}
+
 	if err := s.store.DeleteToken(id); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	s.audit(c, AuditTokenDelete, "token", id, before, nil)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Token deleted"})
 }
 
+// User endpoints
+func (s *Server) handleGetUsers(c *gin.Context) {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	responses := make([]UserResponse, len(users))
+	for i, u := range users {
+		responses[i] = newUserResponse(u)
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Role     Role   `json:"role" binding:"required"`
+}
+
+func (s *Server) handleCreateUser(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !req.Role.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be viewer, operator or admin"})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := &User{
+		ID:           uuid.New().String(),
+		Username:     req.Username,
+		PasswordHash: string(hash),
+		Role:         req.Role,
+	}
+
+	if err := s.store.CreateUser(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := newUserResponse(user)
+	s.audit(c, AuditUserCreate, "user", user.ID, nil, resp)
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+type UpdateUserRequest struct {
+	Password *string `json:"password"`
+	Role     *Role   `json:"role"`
+}
+
+func (s *Server) handleUpdateUser(c *gin.Context) {
+	id := c.Param("id")
+
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := s.store.GetUser(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	before := gin.H{"user": newUserResponse(user)}
+
+	if req.Role != nil {
+		if !req.Role.Valid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role must be viewer, operator or admin"})
+			return
+		}
+		user.Role = *req.Role
+	}
+
+	if req.Password != nil {
+		if *req.Password == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "password must not be empty"})
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(*req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		user.PasswordHash = string(hash)
+	}
+
+	if err := s.store.UpdateUser(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.sessions.SetRole(user.Username, user.Role)
+
+	resp := newUserResponse(user)
+	s.audit(c, AuditUserUpdate, "user", user.ID, before, gin.H{
+		"user":            resp,
+		"passwordChanged": req.Password != nil,
+	})
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleDeleteUser(c *gin.Context) {
+	id := c.Param("id")
+
+	var before any
+	user, err := s.store.GetUser(id)
+	if err == nil {
+		before = newUserResponse(user)
+	}
+
+	if err := s.store.DeleteUser(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user != nil {
+		s.sessions.DeleteUser(user.Username)
+	}
+
+	s.audit(c, AuditUserDelete, "user", id, before, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
+}
+
+// API key endpoints
+func (s *Server) handleGetAPIKeys(c *gin.Context) {
+	keys, err := s.store.GetAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	responses := make([]APIKeyResponse, len(keys))
+	for i, k := range keys {
+		responses[i] = newAPIKeyResponse(k)
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+type CreateAPIKeyRequest struct {
+	Name       string `json:"name" binding:"required"`
+	Role       Role   `json:"role" binding:"required"`
+	AgentScope string `json:"agentScope"` // Restrict the key to one agent (name or ID)
+}
+
+func (s *Server) handleCreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !req.Role.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be viewer, operator or admin"})
+		return
+	}
+
+	// An agent-scoped admin key would still be able to manage tokens and users
+	if req.AgentScope != "" && req.Role == RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent-scoped keys cannot have the admin role"})
+		return
+	}
+
+	key, prefix, hash, err := generateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	apiKey := &APIKey{
+		ID:         uuid.New().String(),
+		Name:       req.Name,
+		KeyHash:    hash,
+		Prefix:     prefix,
+		Role:       req.Role,
+		AgentScope: req.AgentScope,
+	}
+
+	if err := s.store.CreateAPIKey(apiKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := newAPIKeyResponse(apiKey)
+	s.audit(c, AuditAPIKeyCreate, "apikey", apiKey.ID, nil, resp)
+
+	resp.Key = key
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (s *Server) handleDeleteAPIKey(c *gin.Context) {
+	id := c.Param("id")
+
+	var before any
+	if k, err := s.store.GetAPIKey(id); err == nil {
+		before = newAPIKeyResponse(k)
+	}
+
+	if err := s.store.DeleteAPIKey(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.audit(c, AuditAPIKeyDelete, "apikey", id, before, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key deleted"})
+}
+
 // Version endpoint
 func (s *Server) handleGetVersion(c *gin.Context) {
 	c.JSON(http.StatusOK, version.Get())
@@ -0,0 +1,202 @@
+package cloud
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit actions
+const (
+	AuditRuleCreate   = "rule.create"
+	AuditRuleUpdate   = "rule.update"
+	AuditRuleDelete   = "rule.delete"
+	AuditTokenCreate  = "token.create"
+	AuditTokenRotate  = "token.rotate"
+	AuditTokenDelete  = "token.delete"
+	AuditUserCreate   = "user.create"
+	AuditUserUpdate   = "user.update"
+	AuditUserDelete   = "user.delete"
+	AuditAPIKeyCreate = "apikey.create"
+	AuditAPIKeyDelete = "apikey.delete"
+	AuditAgentDelete  = "agent.delete"
+
+	AuditAgentCertIssue  = "agent.cert_issue"
+	AuditAgentCertRevoke = "agent.cert_revoke"
+
+	AuditLogin       = "auth.login"
+	AuditLoginFailed = "auth.login_failed"
+	AuditLogout      = "auth.logout"
+
+	AuditAgentConnect    = "agent.connect"
+	AuditAgentReject     = "agent.reject"
+	AuditAgentDisconnect = "agent.disconnect"
+	AuditAgentKick       = "agent.kick"
+	AuditRuleConnConnect = "rule_conn.connect"
+	AuditRuleConnReject  = "rule_conn.reject"
+
+	AuditRuleSourceReject = "rule.source_reject"
+	AuditRuleConnLimit    = "rule.conn_limit"
+)
+
+// Actor kinds for events not caused by an API principal
+const (
+	AuditActorAgent  = "agent"
+	AuditActorSystem = "system"
+)
+
+// audit records an event caused by the principal of an API request.
+// before and after are snapshots of the target and may be nil.
+func (s *Server) audit(c *gin.Context, action, targetType, targetID string, before, after any) {
+	e := &AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		ClientIP:   c.ClientIP(),
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+	}
+	if p := principalFrom(c); p != nil {
+		e.Actor, e.ActorKind = p.Name, p.Kind
+	}
+	s.recordAudit(e)
+}
+
+// auditAgent records a connection event caused by an agent
+func (s *Server) auditAgent(agentName, clientIP, action, targetType, targetID string, detail any) {
+	s.recordAudit(&AuditEvent{
+		Actor:      agentName,
+		ActorKind:  AuditActorAgent,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		ClientIP:   clientIP,
+		After:      auditJSON(detail),
+	})
+}
+
+// auditSystem records an event the server performed on its own
+func (s *Server) auditSystem(action, targetType, targetID string, detail any) {
+	s.recordAudit(&AuditEvent{
+		Actor:      AuditActorSystem,
+		ActorKind:  AuditActorSystem,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		After:      auditJSON(detail),
+	})
+}
+
+func (s *Server) recordAudit(e *AuditEvent) {
+	if err := s.store.CreateAuditEvent(e); err != nil {
+		log.Printf("Failed to record audit event %s on %s %s: %v", e.Action, e.TargetType, e.TargetID, err)
+	}
+}
+
+// auditJSON encodes a snapshot, returning "" for nil
+func auditJSON(v any) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Audit API types
+type AuditEventResponse struct {
+	ID         int64           `json:"id"`
+	Time       string          `json:"time"`
+	Actor      string          `json:"actor"`
+	ActorKind  string          `json:"actorKind"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType,omitempty"`
+	TargetID   string          `json:"targetId,omitempty"`
+	ClientIP   string          `json:"clientIp,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+type AuditEventsResponse struct {
+	Events   []AuditEventResponse `json:"events"`
+	Total    int                  `json:"total"`
+	Page     int                  `json:"page"`
+	PageSize int                  `json:"pageSize"`
+}
+
+const maxAuditPageSize = 500
+
+// handleGetAuditEvents lists audit events, newest first.
+// Query parameters: actor, action, targetType, targetId, since, until
+// (RFC 3339), page (from 1) and pageSize (default 50).
+func (s *Server) handleGetAuditEvents(c *gin.Context) {
+	filter := AuditFilter{
+		Actor:      c.Query("actor"),
+		Action:     c.Query("action"),
+		TargetType: c.Query("targetType"),
+		TargetID:   c.Query("targetId"),
+	}
+
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param + ", expected RFC 3339"})
+				return
+			}
+			*dst = t
+		}
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", "50"))
+	if err != nil || pageSize < 1 || pageSize > maxAuditPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pageSize must be between 1 and 500"})
+		return
+	}
+	filter.Limit = pageSize
+	filter.Offset = (page - 1) * pageSize
+
+	events, total, err := s.store.GetAuditEvents(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	responses := make([]AuditEventResponse, len(events))
+	for i, e := range events {
+		responses[i] = AuditEventResponse{
+			ID:         e.ID,
+			Time:       e.Time.UTC().Format("2006-01-02T15:04:05Z"),
+			Actor:      e.Actor,
+			ActorKind:  e.ActorKind,
+			Action:     e.Action,
+			TargetType: e.TargetType,
+			TargetID:   e.TargetID,
+			ClientIP:   e.ClientIP,
+		}
+		if e.Before != "" {
+			responses[i].Before = json.RawMessage(e.Before)
+		}
+		if e.After != "" {
+			responses[i].After = json.RawMessage(e.After)
+		}
+	}
+
+	c.JSON(http.StatusOK, AuditEventsResponse{
+		Events:   responses,
+		Total:    total,
+		Page:     page,
+		PageSize: pageSize,
+	})
+}
@@ -0,0 +1,36 @@
+package cloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuditClientIP(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Token = "secret"
+
+	for _, password := range []string{"wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(`{"username":"admin","password":"`+password+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.1:40000"
+		// Set by the client, not by a proxy of the cloud
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		req.Header.Set("X-Real-IP", "198.51.100.7")
+		s.router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	events, _, err := s.store.GetAuditEvents(AuditFilter{Action: "auth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("%d login events, want 2", len(events))
+	}
+	for _, e := range events {
+		if e.ClientIP != "192.0.2.1" {
+			t.Errorf("%s recorded from %q, want 192.0.2.1", e.Action, e.ClientIP)
+		}
+	}
+}
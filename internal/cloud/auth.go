@@ -0,0 +1,399 @@
+package cloud
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultSessionTTL is how long a dashboard session stays valid after login
+const DefaultSessionTTL = 24 * time.Hour
+
+// Session represents an authenticated dashboard session
+type Session struct {
+	Token     string
+	Username  string
+	Role      Role
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// SessionManager keeps dashboard sessions in memory
+type SessionManager struct {
+	sessions map[string]*Session
+	mu       sync.RWMutex
+	ttl      time.Duration
+}
+
+// NewSessionManager creates a new session manager
+// ttl: 0 means DefaultSessionTTL
+func NewSessionManager(ttl time.Duration) *SessionManager {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &SessionManager{
+		sessions: make(map[string]*Session),
+		ttl:      ttl,
+	}
+}
+
+// Create creates a new session for the given user
+func (m *SessionManager) Create(username string, role Role) (*Session, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		Token:     hex.EncodeToString(buf),
+		Username:  username,
+		Role:      role,
+		CreatedAt: now,
+		ExpiresAt: now.Add(m.ttl),
+	}
+
+	m.mu.Lock()
+	m.sessions[session.Token] = session
+	m.mu.Unlock()
+
+	return session, nil
+}
+
+// Get returns the session for a token, or nil if missing or expired
+func (m *SessionManager) Get(token string) *Session {
+	m.mu.RLock()
+	session, ok := m.sessions[token]
+	m.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.ExpiresAt) {
+		m.Delete(token)
+		return nil
+	}
+	return session
+}
+
+// Delete removes a session
+func (m *SessionManager) Delete(token string) {
+	m.mu.Lock()
+	delete(m.sessions, token)
+	m.mu.Unlock()
+}
+
+// SetRole changes the role of a user's sessions, so that a new role takes
+// effect without logging in again
+func (m *SessionManager) SetRole(username string, role Role) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for token, session := range m.sessions {
+		if session.Username == username {
+			// Sessions handed out by Get are read without the lock
+			updated := *session
+			updated.Role = role
+			m.sessions[token] = &updated
+		}
+	}
+}
+
+// DeleteUser removes all sessions of a user
+func (m *SessionManager) DeleteUser(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for token, session := range m.sessions {
+		if session.Username == username {
+			delete(m.sessions, token)
+		}
+	}
+}
+
+// cleanupLoop periodically removes expired sessions
+func (m *SessionManager) cleanupLoop(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			m.mu.Lock()
+			for token, session := range m.sessions {
+				if now.After(session.ExpiresAt) {
+					delete(m.sessions, token)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// Failed logins are free up to loginFreeFailures per client address and
+// per username; each failure past that doubles the wait before the next
+// attempt, from loginBackoffMin up to loginBackoffMax. Failures are
+// forgotten after loginFailureTTL without another.
+const (
+	loginFreeFailures = 5
+	loginBackoffMin   = time.Second
+	loginBackoffMax   = 15 * time.Minute
+	loginFailureTTL   = time.Hour
+)
+
+type loginFailure struct {
+	count int
+	last  time.Time
+	until time.Time // No attempts before
+}
+
+// loginLimiter slows down password guessing by client address and by
+// username
+type loginLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailure
+}
+
+// loginKeys returns the keys a login attempt is limited by
+func loginKeys(clientIP, username string) []string {
+	if username == "" {
+		username = "admin" // The server token logs in as admin
+	}
+	return []string{"ip:" + clientIP, "user:" + strings.ToLower(username)}
+}
+
+// wait returns how long until the keys may try again, 0 if they may now
+func (l *loginLimiter) wait(now time.Time, keys []string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if f := l.failures[key]; f != nil && f.until.Sub(now) > wait {
+			wait = f.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// fail records a failed login of the keys
+func (l *loginLimiter) fail(now time.Time, keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, f := range l.failures {
+		if now.Sub(f.last) > loginFailureTTL && now.After(f.until) {
+			delete(l.failures, key)
+		}
+	}
+	if l.failures == nil {
+		l.failures = make(map[string]*loginFailure)
+	}
+	for _, key := range keys {
+		f := l.failures[key]
+		if f == nil {
+			f = &loginFailure{}
+			l.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if n := f.count - loginFreeFailures; n > 0 {
+			backoff := loginBackoffMax
+			if n <= 20 && loginBackoffMin<<(n-1) < loginBackoffMax {
+				backoff = loginBackoffMin << (n - 1)
+			}
+			f.until = now.Add(backoff)
+		}
+	}
+}
+
+// succeed forgets the failures of a username that logged in. Those of the
+// address stay, so that logging in to an own account doesn't reset them.
+func (l *loginLimiter) succeed(username string) {
+	l.mu.Lock()
+	delete(l.failures, "user:"+strings.ToLower(username))
+	l.mu.Unlock()
+}
+
+// secureCompare compares two secrets in constant time
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// bearerToken extracts the bearer token from the Authorization header
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// abortUnauthorized ends the request with the 401 contract used by the web client
+func abortUnauthorized(c *gin.Context, msg string) {
+	c.Header("WWW-Authenticate", `Bearer realm="natsvr"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg, "code": "unauthorized"})
+}
+
+// authenticateCredentials checks a username/password pair against the
+// config token, the configured admin users and the users table
+func (s *Server) authenticateCredentials(username, password string) (string, Role, bool) {
+	if password == "" {
+		return "", "", false
+	}
+
+	// The server token logs in as "admin"
+	if (username == "" || username == "admin") && s.config.Token != "" && secureCompare(password, s.config.Token) {
+		return "admin", RoleAdmin, true
+	}
+
+	if expected, ok := s.config.AdminUsers[username]; ok && expected != "" && secureCompare(password, expected) {
+		return username, RoleAdmin, true
+	}
+
+	if username != "" {
+		user, err := s.store.GetUserByUsername(username)
+		if err == nil && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil {
+			return user.Username, user.Role, true
+		}
+	}
+
+	return "", "", false
+}
+
+// authMiddleware requires a valid bearer credential on API requests.
+// Accepted credentials are the server token, a session token from login
+// or an API key. The resolved Principal is stored on the context.
+func (s *Server) authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			abortUnauthorized(c, "Authentication required")
+			return
+		}
+
+		var principal *Principal
+		if s.config.Token != "" && secureCompare(token, s.config.Token) {
+			principal = &Principal{Kind: PrincipalServerToken, Name: "admin", Role: RoleAdmin}
+		} else if session := s.sessions.Get(token); session != nil {
+			principal = &Principal{Kind: PrincipalSession, Name: session.Username, Role: session.Role}
+		} else {
+			principal = s.lookupAPIKey(token)
+		}
+
+		if principal == nil {
+			s.metrics.authFailed(authFailAPI)
+			abortUnauthorized(c, "Invalid or expired credentials")
+			return
+		}
+
+		c.Set(ctxKeyPrincipal, principal)
+		c.Next()
+	}
+}
+
+// Auth API types
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password" binding:"required"`
+}
+
+type LoginResponse struct {
+	Token     string `json:"token"`
+	Username  string `json:"username"`
+	Role      Role   `json:"role"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+type MeResponse struct {
+	Username   string `json:"username"`
+	Role       Role   `json:"role"`
+	Kind       string `json:"kind"`
+	AgentScope string `json:"agentScope,omitempty"`
+}
+
+func (s *Server) handleLogin(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	keys := loginKeys(c.ClientIP(), req.Username)
+	if wait := s.logins.wait(time.Now(), keys); wait > 0 {
+		seconds := int(wait.Round(time.Second) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error": fmt.Sprintf("Too many failed logins, try again in %ds", seconds),
+			"code":  "rate_limited",
+		})
+		return
+	}
+
+	username, role, ok := s.authenticateCredentials(req.Username, req.Password)
+	if !ok {
+		s.logins.fail(time.Now(), keys)
+		s.metrics.authFailed(authFailLogin)
+		s.recordAudit(&AuditEvent{
+			Actor:      req.Username,
+			ActorKind:  PrincipalSession,
+			Action:     AuditLoginFailed,
+			TargetType: "session",
+			ClientIP:   c.ClientIP(),
+		})
+		abortUnauthorized(c, "Invalid username or password")
+		return
+	}
+
+	s.logins.succeed(req.Username)
+
+	session, err := s.sessions.Create(username, role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.recordAudit(&AuditEvent{
+		Actor:      username,
+		ActorKind:  PrincipalSession,
+		Action:     AuditLogin,
+		TargetType: "session",
+		ClientIP:   c.ClientIP(),
+		After:      auditJSON(gin.H{"role": role}),
+	})
+
+	c.JSON(http.StatusOK, LoginResponse{
+		Token:     session.Token,
+		Username:  session.Username,
+		Role:      session.Role,
+		ExpiresAt: session.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z"),
+	})
+}
+
+func (s *Server) handleLogout(c *gin.Context) {
+	s.sessions.Delete(bearerToken(c))
+	s.audit(c, AuditLogout, "session", "", nil, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+func (s *Server) handleGetMe(c *gin.Context) {
+	p := principalFrom(c)
+	c.JSON(http.StatusOK, MeResponse{
+		Username:   p.Name,
+		Role:       p.Role,
+		Kind:       p.Kind,
+		AgentScope: p.AgentScope,
+	})
+}
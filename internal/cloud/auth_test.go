@@ -0,0 +1,202 @@
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// apiRequest sends a request to the server's API and returns the recorded
+// response
+func apiRequest(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "192.0.2.1:40000"
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// addTestUser stores a user with the password "change-me"
+func addTestUser(t *testing.T, s *Server, id, username string, role Role) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("change-me"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.CreateUser(&User{ID: id, Username: username, PasswordHash: string(hash), Role: role}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// login logs a user in and returns the session token
+func login(t *testing.T, s *Server, username, password string) string {
+	t.Helper()
+	rec := apiRequest(s, http.MethodPost, "/api/auth/login", "", `{"username":"`+username+`","password":"`+password+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login of %s: %d %s", username, rec.Code, rec.Body)
+	}
+	var resp LoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Token = "server-token"
+	addTestUser(t, s, "u1", "ops", RoleOperator)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"unknown token", "guess", http.StatusUnauthorized},
+		{"server token", "server-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := apiRequest(s, http.MethodGet, "/api/auth/me", tt.token, "")
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tt.name)
+		}
+	}
+
+	token := login(t, s, "ops", "change-me")
+	rec := apiRequest(s, http.MethodGet, "/api/auth/me", token, "")
+	var me MeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &me); err != nil || me.Username != "ops" || me.Role != RoleOperator {
+		t.Fatalf("session of %+v, %v", me, err)
+	}
+
+	// Expired sessions are refused
+	s.sessions.Get(token).ExpiresAt = time.Now().Add(-time.Second)
+	if rec := apiRequest(s, http.MethodGet, "/api/auth/me", token, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expired session: status %d", rec.Code)
+	}
+	if s.sessions.Get(token) != nil {
+		t.Fatal("expired session kept")
+	}
+
+	// So are sessions after logout
+	token = login(t, s, "ops", "change-me")
+	if rec := apiRequest(s, http.MethodPost, "/api/auth/logout", token, ""); rec.Code != http.StatusOK {
+		t.Fatalf("logout: status %d", rec.Code)
+	}
+	if rec := apiRequest(s, http.MethodGet, "/api/auth/me", token, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("session after logout: status %d", rec.Code)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Token = "server-token"
+	addTestUser(t, s, "u1", "ops", RoleOperator)
+
+	for name, body := range map[string]string{
+		"bad password":   `{"username":"ops","password":"change-it"}`,
+		"unknown user":   `{"username":"dev","password":"change-me"}`,
+		"token as other": `{"username":"ops","password":"server-token"}`,
+	} {
+		if rec := apiRequest(s, http.MethodPost, "/api/auth/login", "", body); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d", name, rec.Code)
+		}
+	}
+	if rec := apiRequest(s, http.MethodPost, "/api/auth/login", "", `{"username":"ops"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("no password: status %d", rec.Code)
+	}
+
+	// The server token logs in as admin
+	token := login(t, s, "", "server-token")
+	if session := s.sessions.Get(token); session == nil || session.Username != "admin" || session.Role != RoleAdmin {
+		t.Fatalf("session %+v", session)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	s := newTestServer(t)
+	addTestUser(t, s, "u1", "ops", RoleOperator)
+	addTestUser(t, s, "u2", "dev", RoleViewer)
+
+	for i := range loginFreeFailures + 1 {
+		if rec := apiRequest(s, http.MethodPost, "/api/auth/login", "", `{"username":"ops","password":"guess"}`); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status %d", i, rec.Code)
+		}
+	}
+	// Further attempts wait, even with the right password
+	rec := apiRequest(s, http.MethodPost, "/api/auth/login", "", `{"username":"OPS","password":"change-me"}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("attempt after the failures: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	// From other addresses too, and for other users from the address
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(`{"username":"ops","password":"change-me"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "198.51.100.7:40000"
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("user from another address: status %d", rec.Code)
+	}
+	if rec := apiRequest(s, http.MethodPost, "/api/auth/login", "", `{"username":"dev","password":"change-me"}`); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("other user from the address: status %d", rec.Code)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	var l loginLimiter
+	now := time.Now()
+	keys := loginKeys("192.0.2.1", "Ops")
+
+	for range loginFreeFailures {
+		l.fail(now, keys)
+	}
+	if wait := l.wait(now, keys); wait != 0 {
+		t.Fatalf("wait %v after the free failures", wait)
+	}
+
+	// Each further failure doubles the wait, up to the maximum
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		l.fail(now, keys)
+		if wait := l.wait(now, keys); wait != want {
+			t.Fatalf("wait %v, want %v", wait, want)
+		}
+	}
+	for range 30 {
+		l.fail(now, keys)
+	}
+	if wait := l.wait(now, keys); wait != loginBackoffMax {
+		t.Fatalf("wait %v after many failures, want %v", wait, loginBackoffMax)
+	}
+	if wait := l.wait(now.Add(loginBackoffMax), keys); wait != 0 {
+		t.Fatalf("wait %v once the backoff passed", wait)
+	}
+
+	// Logging in forgets the user's failures, not the address'
+	l.succeed("OPS")
+	if wait := l.wait(now, loginKeys("198.51.100.7", "ops")); wait != 0 {
+		t.Fatalf("user waits %v after logging in", wait)
+	}
+	if wait := l.wait(now, loginKeys("192.0.2.1", "dev")); wait == 0 {
+		t.Fatal("address forgotten after a login")
+	}
+
+	// Old failures are forgotten
+	later := now.Add(loginBackoffMax + loginFailureTTL + time.Second)
+	l.fail(later, loginKeys("203.0.113.9", "dev"))
+	if _, ok := l.failures["ip:192.0.2.1"]; ok || len(l.failures) != 2 {
+		t.Fatalf("%d failure records after expiry", len(l.failures))
+	}
+}
@@ -0,0 +1,276 @@
+package cloud
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+// Agent mTLS modes
+const (
+	MTLSOff      = "off"      // No client certificates
+	MTLSOptional = "optional" // Issued and verified, agents without one are still accepted
+	MTLSRequired = "required" // Enrolled agents must present their certificate
+)
+
+// Client certificate errors, sent back to the agent in auth responses
+var (
+	ErrClientCertRequired = errors.New("Client certificate required")
+	ErrClientCertInvalid  = errors.New("Client certificate does not belong to this agent")
+	ErrClientCertRevoked  = errors.New("Client certificate revoked")
+)
+
+// ErrMTLSRequiresHTTPS is returned by NewServer for required mode with a
+// plain HTTP server, whose ws:// agents could never present a certificate
+var ErrMTLSRequiresHTTPS = errors.New("agent mTLS required needs HTTPS (a TLS certificate or ACME domains): agents on ws:// can't present client certificates")
+
+const (
+	// clientCertLifetime is the validity of issued agent certificates
+	clientCertLifetime = 365 * 24 * time.Hour
+	// clientCertRenewBefore is how long before expiry a certificate is
+	// replaced when the agent connects with it
+	clientCertRenewBefore = clientCertLifetime / 3
+)
+
+// ClientCA issues and verifies the client certificates of agents. The
+// certificate subject is the agent ID, its key the agent's identity key.
+type ClientCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pool *x509.CertPool
+}
+
+// LoadOrCreateClientCA loads the CA certificate and key from PEM files.
+// If neither file exists, a new CA is created and saved there first.
+func LoadOrCreateClientCA(certFile, keyFile string) (*ClientCA, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		if err := createClientCA(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &ClientCA{cert: cert, key: key, pool: pool}, nil
+}
+
+func createClientCA(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "natsvr agent CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(20 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Pool returns the pool that verifies agent certificates
+func (ca *ClientCA) Pool() *x509.CertPool {
+	return ca.pool
+}
+
+// Issue creates a certificate for the agent's identity key. It returns
+// the DER certificate and its store record.
+func (ca *ClientCA) Issue(agentID, agentName string, publicKey ed25519.PublicKey) ([]byte, *AgentCertificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: agentID},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(clientCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, publicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, &AgentCertificate{
+		Serial:    certSerial(template),
+		AgentID:   agentID,
+		AgentName: agentName,
+		NotBefore: template.NotBefore,
+		NotAfter:  template.NotAfter,
+	}, nil
+}
+
+// certSerial is the hex serial number a certificate is stored under
+func certSerial(cert *x509.Certificate) string {
+	return hex.EncodeToString(cert.SerialNumber.Bytes())
+}
+
+// checkClientCertificate checks the certificate an authenticating agent
+// presented, nil if none, against the agent's identity and the issued
+// certificates. It returns the certificate's serial, and whether the agent
+// should be issued a new certificate.
+func (s *Server) checkClientCertificate(cert *x509.Certificate, agentID, publicKey string, caps protocol.Capabilities) (serial string, renew bool, err error) {
+	if s.clientCA == nil {
+		return "", false, nil
+	}
+
+	if cert != nil {
+		serial = certSerial(cert)
+		rec, err := s.store.GetAgentCertificate(serial)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, ErrClientCertInvalid
+		}
+		if err != nil {
+			return "", false, err
+		}
+		key, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok || rec.AgentID != agentID || cert.Subject.CommonName != agentID ||
+			base64.StdEncoding.EncodeToString(key) != publicKey {
+			return "", false, ErrClientCertInvalid
+		}
+		if rec.RevokedAt != nil {
+			return "", false, ErrClientCertRevoked
+		}
+		return serial, time.Until(cert.NotAfter) < clientCertRenewBefore, nil
+	}
+
+	// Without a certificate, an agent whose newest certificate was revoked
+	// stays out, and in required mode only agents yet to get one get in
+	certs, err := s.store.GetAgentCertificates(agentID)
+	if err != nil {
+		return "", false, err
+	}
+	if len(certs) > 0 && certs[0].RevokedAt != nil {
+		return "", false, ErrClientCertRevoked
+	}
+	live := false
+	for _, c := range certs {
+		if c.Live(time.Now()) {
+			live = true
+			break
+		}
+	}
+	if s.config.AgentMTLS == MTLSRequired && (live || publicKey == "" || !caps.Has(protocol.CapMTLS)) {
+		return "", false, ErrClientCertRequired
+	}
+	return "", !live, nil
+}
+
+// issueClientCertificate issues a certificate for the agent's identity key
+// and returns it, or nil if the agent can't use one
+func (s *Server) issueClientCertificate(agent *AgentConn) []byte {
+	if agent.PublicKey == "" || !agent.Capabilities.Has(protocol.CapMTLS) {
+		return nil
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(agent.PublicKey)
+	if err != nil {
+		return nil
+	}
+
+	der, rec, err := s.clientCA.Issue(agent.ID, agent.Name, publicKey)
+	if err == nil {
+		err = s.store.CreateAgentCertificate(rec)
+	}
+	if err != nil {
+		log.Printf("Failed to issue client certificate for agent %s: %v", agent.ID, err)
+		return nil
+	}
+
+	s.auditSystem(AuditAgentCertIssue, "agent", agent.ID, gin.H{
+		"name":     agent.Name,
+		"serial":   rec.Serial,
+		"notAfter": rec.NotAfter,
+	})
+	log.Printf("Issued client certificate %s to agent '%s' (%s)", rec.Serial, agent.Name, agent.ID)
+	return der
+}
+
+// disconnectRevoked closes the connections of an agent that its revoked
+// certificates no longer let in. It reports whether the agent itself was
+// disconnected.
+func (s *Server) disconnectRevoked(agentID string, revoked []string) bool {
+	agent := s.GetAgent(agentID)
+	if agent == nil {
+		return false
+	}
+
+	kick := slices.Contains(revoked, agent.CertSerial)
+	if agent.CertSerial == "" {
+		_, _, err := s.checkClientCertificate(nil, agent.ID, agent.PublicKey, agent.Capabilities)
+		kick = err != nil
+	}
+
+	agent.ruleConnsMu.RLock()
+	for _, rc := range agent.ruleConns {
+		if kick || slices.Contains(revoked, rc.CertSerial) {
+			rc.Conn.Close()
+		}
+	}
+	agent.ruleConnsMu.RUnlock()
+
+	if kick {
+		log.Printf("Agent %s client certificate revoked, disconnecting", agent.ID)
+		agent.Conn.Close()
+	}
+	return kick
+}
@@ -0,0 +1,160 @@
+package cloud
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+func newMTLSTestServer(t *testing.T, mode string) *Server {
+	t.Helper()
+	s, err := NewServer(&Config{DBPath: filepath.Join(t.TempDir(), "natsvr.db"), AgentMTLS: mode, TLSCertFile: "cloud.pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.cancel()
+		s.store.Close()
+	})
+	return s
+}
+
+// issueTestCert issues a certificate to a connected agent with a new
+// identity key and returns it with the key
+func issueTestCert(t *testing.T, s *Server, agentID string) (*x509.Certificate, string) {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, _ := addTestAgent(s, agentID, "web")
+	agent.PublicKey = base64.StdEncoding.EncodeToString(public)
+	der := s.issueClientCertificate(agent)
+	if der == nil {
+		t.Fatal("no certificate issued")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, agent.PublicKey
+}
+
+func TestMTLSRequiresHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewServer(&Config{DBPath: filepath.Join(dir, "natsvr.db"), AgentMTLS: MTLSRequired})
+	if !errors.Is(err, ErrMTLSRequiresHTTPS) {
+		t.Fatalf("required mode over plain HTTP: %v, want ErrMTLSRequiresHTTPS", err)
+	}
+
+	for _, cfg := range []*Config{
+		{AgentMTLS: MTLSRequired, TLSCertFile: "cloud.pem"},
+		{AgentMTLS: MTLSRequired, ACMEDomains: []string{"cloud.example.com"}},
+		{AgentMTLS: MTLSOptional},
+	} {
+		cfg.DBPath = filepath.Join(t.TempDir(), "natsvr.db")
+		s, err := NewServer(cfg)
+		if err != nil {
+			t.Fatalf("%+v: %v", cfg, err)
+		}
+		s.cancel()
+		s.store.Close()
+	}
+}
+
+func TestClientCertificateIssue(t *testing.T) {
+	s := newMTLSTestServer(t, MTLSOptional)
+	cert, publicKey := issueTestCert(t, s, "agent-1")
+
+	if cert.Subject.CommonName != "agent-1" || base64.StdEncoding.EncodeToString(cert.PublicKey.(ed25519.PublicKey)) != publicKey {
+		t.Fatalf("certificate for %s", cert.Subject.CommonName)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: s.clientCA.Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatal(err)
+	}
+
+	serial, renew, err := s.checkClientCertificate(cert, "agent-1", publicKey, protocol.LocalCapabilities)
+	if err != nil || serial != certSerial(cert) || renew {
+		t.Fatalf("checked as %q, renew %v, %v", serial, renew, err)
+	}
+	// The certificate belongs to one agent and key
+	if _, _, err := s.checkClientCertificate(cert, "agent-2", publicKey, protocol.LocalCapabilities); !errors.Is(err, ErrClientCertInvalid) {
+		t.Fatalf("certificate of another agent: %v, want ErrClientCertInvalid", err)
+	}
+	if _, _, err := s.checkClientCertificate(cert, "agent-1", "b3RoZXI=", protocol.LocalCapabilities); !errors.Is(err, ErrClientCertInvalid) {
+		t.Fatalf("certificate of another key: %v, want ErrClientCertInvalid", err)
+	}
+
+	// Agents that can't use a certificate aren't issued one
+	agent, _ := addTestAgent(s, "agent-3", "db")
+	agent.PublicKey = publicKey
+	agent.Capabilities = protocol.LegacyCapabilities
+	if s.issueClientCertificate(agent) != nil {
+		t.Fatal("certificate issued to an agent without the mtls capability")
+	}
+}
+
+func TestClientCertificateRevoked(t *testing.T) {
+	s := newMTLSTestServer(t, MTLSOptional)
+	cert, publicKey := issueTestCert(t, s, "agent-1")
+
+	if _, err := s.store.RevokeAgentCertificates("agent-1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.checkClientCertificate(cert, "agent-1", publicKey, protocol.LocalCapabilities); !errors.Is(err, ErrClientCertRevoked) {
+		t.Fatalf("revoked certificate: %v, want ErrClientCertRevoked", err)
+	}
+	// Leaving out the certificate doesn't get around the revocation
+	if _, _, err := s.checkClientCertificate(nil, "agent-1", publicKey, protocol.LocalCapabilities); !errors.Is(err, ErrClientCertRevoked) {
+		t.Fatalf("without the revoked certificate: %v, want ErrClientCertRevoked", err)
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	s := newMTLSTestServer(t, MTLSRequired)
+	_, publicKey := issueTestCert(t, s, "agent-1")
+
+	// An agent holding a certificate must present it
+	if _, _, err := s.checkClientCertificate(nil, "agent-1", publicKey, protocol.LocalCapabilities); !errors.Is(err, ErrClientCertRequired) {
+		t.Fatalf("missing certificate: %v, want ErrClientCertRequired", err)
+	}
+
+	// A new agent gets in once, to be issued its certificate
+	_, renew, err := s.checkClientCertificate(nil, "agent-2", publicKey, protocol.LocalCapabilities)
+	if err != nil || !renew {
+		t.Fatalf("new agent: renew %v, %v", renew, err)
+	}
+	// Unless it can't use one
+	if _, _, err := s.checkClientCertificate(nil, "agent-2", publicKey, protocol.LegacyCapabilities); !errors.Is(err, ErrClientCertRequired) {
+		t.Fatalf("new agent without the mtls capability: %v, want ErrClientCertRequired", err)
+	}
+	if _, _, err := s.checkClientCertificate(nil, "agent-2", "", protocol.LocalCapabilities); !errors.Is(err, ErrClientCertRequired) {
+		t.Fatalf("new agent without an identity key: %v, want ErrClientCertRequired", err)
+	}
+}
+
+func TestClientCertificateOptional(t *testing.T) {
+	s := newMTLSTestServer(t, MTLSOptional)
+	_, publicKey := issueTestCert(t, s, "agent-1")
+
+	// Agents may leave out their certificate
+	if _, renew, err := s.checkClientCertificate(nil, "agent-1", publicKey, protocol.LocalCapabilities); err != nil || renew {
+		t.Fatalf("missing certificate: renew %v, %v", renew, err)
+	}
+	// Agents without one are accepted and issued one
+	if _, renew, err := s.checkClientCertificate(nil, "agent-2", "", protocol.LegacyCapabilities); err != nil || !renew {
+		t.Fatalf("agent without a certificate: renew %v, %v", renew, err)
+	}
+
+	// Without mTLS, certificates aren't looked at
+	off := newTestServer(t)
+	if serial, renew, err := off.checkClientCertificate(nil, "agent-1", publicKey, protocol.LocalCapabilities); serial != "" || renew || err != nil {
+		t.Fatalf("mTLS off: %q, renew %v, %v", serial, renew, err)
+	}
+}
@@ -0,0 +1,115 @@
+package cloud
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Connection limits of the tcp and tls-sni rules the cloud listens for.
+// Connections over a limit are closed right after they are accepted,
+// before a tunnel to the agent is opened for them.
+
+// connLimiter enforces the connection limits of a running rule
+type connLimiter struct {
+	maxConns int     // Open connections, 0 = unlimited
+	maxPerIP int     // Open connections per client address, 0 = unlimited
+	rate     float64 // New connections per second, 0 = unlimited
+
+	mu         sync.Mutex
+	conns      int
+	perIP      map[netip.Addr]int
+	tokens     float64 // New connections the rate still allows
+	lastRefill time.Time
+}
+
+// hasConnLimits reports whether a rule limits its connections
+func (r *ForwardRule) hasConnLimits() bool {
+	return r.MaxConns > 0 || r.MaxConnRate > 0 || r.MaxConnsPerIP > 0
+}
+
+// newConnLimiter returns the limiter of a rule's connections, nil if it has
+// no limits
+func newConnLimiter(rule *ForwardRule) *connLimiter {
+	if !rule.hasConnLimits() {
+		return nil
+	}
+	return &connLimiter{
+		maxConns: rule.MaxConns,
+		maxPerIP: rule.MaxConnsPerIP,
+		rate:     float64(rule.MaxConnRate),
+		perIP:    make(map[netip.Addr]int),
+		// Allows a burst of one second worth of connections
+		tokens:     float64(rule.MaxConnRate),
+		lastRefill: time.Now(),
+	}
+}
+
+// acquire admits a new connection from a client, returning why it is
+// rejected otherwise. Admitted connections must be released once closed.
+func (l *connLimiter) acquire(ip netip.Addr) string {
+	if l == nil {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConns > 0 && l.conns >= l.maxConns {
+		return fmt.Sprintf("%d connections open", l.conns)
+	}
+	if l.maxPerIP > 0 && ip.IsValid() && l.perIP[ip] >= l.maxPerIP {
+		return fmt.Sprintf("%d connections open from the client", l.perIP[ip])
+	}
+	if l.rate > 0 {
+		now := time.Now()
+		l.tokens = min(l.rate, l.tokens+now.Sub(l.lastRefill).Seconds()*l.rate)
+		l.lastRefill = now
+		if l.tokens < 1 {
+			return fmt.Sprintf("over %g new connections per second", l.rate)
+		}
+		l.tokens--
+	}
+
+	l.conns++
+	if ip.IsValid() {
+		l.perIP[ip]++
+	}
+	return ""
+}
+
+// release ends a connection admitted by acquire
+func (l *connLimiter) release(ip netip.Addr) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+	if !ip.IsValid() {
+		return
+	}
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// admitClient applies a rule's source filter and connection limits to a
+// new client connection. Admitted connections must be released with
+// releaseClient.
+func (f *Forwarder) admitClient(state *ForwardRuleState, ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !f.admitSource(state, ip) {
+		return false
+	}
+	if reason := state.connLimiter.acquire(ip); reason != "" {
+		f.reject(state, ip, AuditRuleConnLimit, reason)
+		return false
+	}
+	return true
+}
+
+// releaseClient ends a connection admitted by admitClient
+func (f *Forwarder) releaseClient(state *ForwardRuleState, ip netip.Addr) {
+	state.connLimiter.release(ip.Unmap())
+}
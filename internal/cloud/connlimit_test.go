@@ -0,0 +1,129 @@
+package cloud
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestConnLimiterMaxConns(t *testing.T) {
+	l := newConnLimiter(&ForwardRule{MaxConns: 2})
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+
+	if reason := l.acquire(a); reason != "" {
+		t.Fatal(reason)
+	}
+	if reason := l.acquire(b); reason != "" {
+		t.Fatal(reason)
+	}
+	if reason := l.acquire(netip.Addr{}); reason != "2 connections open" {
+		t.Fatalf("third connection: %q", reason)
+	}
+
+	// A closed connection makes room for another
+	l.release(a)
+	if reason := l.acquire(b); reason != "" {
+		t.Fatalf("after a release: %q", reason)
+	}
+	if reason := l.acquire(a); reason == "" {
+		t.Fatal("connection over the limit admitted")
+	}
+}
+
+func TestConnLimiterPerIP(t *testing.T) {
+	l := newConnLimiter(&ForwardRule{MaxConnsPerIP: 2})
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+
+	for range 2 {
+		if reason := l.acquire(a); reason != "" {
+			t.Fatal(reason)
+		}
+	}
+	if reason := l.acquire(a); reason != "2 connections open from the client" {
+		t.Fatalf("third connection from the client: %q", reason)
+	}
+	// Other clients and unknown addresses have their own counts
+	if reason := l.acquire(b); reason != "" {
+		t.Fatalf("other client: %q", reason)
+	}
+	for range 3 {
+		if reason := l.acquire(netip.Addr{}); reason != "" {
+			t.Fatalf("unknown address: %q", reason)
+		}
+	}
+
+	// Releasing all of a client's connections forgets it
+	l.release(a)
+	if reason := l.acquire(a); reason != "" {
+		t.Fatalf("after a release: %q", reason)
+	}
+	l.release(a)
+	l.release(a)
+	l.release(netip.Addr{})
+	if _, ok := l.perIP[a]; ok || len(l.perIP) != 1 {
+		t.Fatalf("per-client counts %v after releasing %s", l.perIP, a)
+	}
+	if l.conns != 3 {
+		t.Fatalf("%d connections counted, want 3", l.conns)
+	}
+	l.release(b)
+	if len(l.perIP) != 0 {
+		t.Fatalf("per-client counts %v after releasing every client", l.perIP)
+	}
+}
+
+func TestConnLimiterRate(t *testing.T) {
+	l := newConnLimiter(&ForwardRule{MaxConnRate: 5})
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	// One second worth of connections at once
+	for i := range 5 {
+		if reason := l.acquire(ip); reason != "" {
+			t.Fatalf("connection %d of the burst: %q", i, reason)
+		}
+	}
+	if reason := l.acquire(ip); reason != "over 5 new connections per second" {
+		t.Fatalf("connection after the burst: %q", reason)
+	}
+	// Closing connections doesn't return tokens, rejected ones aren't counted
+	for range 5 {
+		l.release(ip)
+	}
+	if reason := l.acquire(ip); reason == "" {
+		t.Fatal("release refilled the bucket")
+	}
+	if l.conns != 0 {
+		t.Fatalf("%d connections counted after rejections", l.conns)
+	}
+
+	// A fifth of a second adds one connection
+	l.lastRefill = l.lastRefill.Add(-200 * time.Millisecond)
+	if reason := l.acquire(ip); reason != "" {
+		t.Fatalf("after a refill: %q", reason)
+	}
+	if reason := l.acquire(ip); reason == "" {
+		t.Fatal("refill admitted more than one connection")
+	}
+
+	// A long pause refills no more than the burst
+	l.lastRefill = l.lastRefill.Add(-time.Minute)
+	admitted := 0
+	for l.acquire(ip) == "" {
+		admitted++
+	}
+	if admitted != 5 {
+		t.Fatalf("%d connections admitted after a pause, want 5", admitted)
+	}
+}
+
+func TestConnLimiterUnlimited(t *testing.T) {
+	if l := newConnLimiter(&ForwardRule{}); l != nil {
+		t.Fatal("limiter for a rule without limits")
+	}
+	// A rule without limits has a nil limiter
+	var l *connLimiter
+	if reason := l.acquire(netip.MustParseAddr("192.0.2.1")); reason != "" {
+		t.Fatal(reason)
+	}
+	l.release(netip.MustParseAddr("192.0.2.1"))
+}
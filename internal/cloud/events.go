@@ -0,0 +1,263 @@
+package cloud
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event types published on /api/events
+const (
+	EventAgentConnect     = "agent.connect"
+	EventAgentDisconnect  = "agent.disconnect"
+	EventRuleStart        = "rule.start"
+	EventRuleStop         = "rule.stop"
+	EventRuleTrafficLimit = "rule.traffic_limit"
+	EventTunnelOpen       = "tunnel.open"
+	EventTunnelClose      = "tunnel.close"
+	EventHTTPRequest      = "http.request"
+	EventStats            = "stats"
+)
+
+const (
+	eventStatsInterval = 5 * time.Second
+	eventPingInterval  = 15 * time.Second
+	eventBufferSize    = 256
+)
+
+// Event is a message pushed to event stream subscribers
+type Event struct {
+	Type string `json:"type"`
+	Time string `json:"time"`
+	Data any    `json:"data,omitempty"`
+	// What the event concerns, used to filter events for agent-scoped
+	// principals. Events concerning neither are visible to everyone.
+	agents []string // agent IDs and names
+	rule   *ForwardRule
+}
+
+// visibleTo reports whether a subscriber may receive the event
+func (e *Event) visibleTo(p *Principal) bool {
+	switch {
+	case e.rule != nil:
+		return p.CanAccessRule(e.rule)
+	case len(e.agents) > 0:
+		return p.CanAccessAgent(e.agents...)
+	}
+	return true
+}
+
+// EventBus fans events out to subscribers. Publishing never blocks: a
+// subscriber that falls behind by more than its buffer misses events.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[*eventSub]struct{}
+}
+
+type eventSub struct {
+	ch        chan *Event
+	principal *Principal
+	types     []string // empty = all types
+}
+
+// NewEventBus creates an event bus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*eventSub]struct{})}
+}
+
+// Subscribe registers a subscriber for the given event types. A type
+// matches exactly or as a prefix, e.g. "agent" matches "agent.connect".
+func (b *EventBus) Subscribe(p *Principal, types []string) *eventSub {
+	sub := &eventSub{ch: make(chan *Event, eventBufferSize), principal: p, types: types}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe removes a subscriber
+func (b *EventBus) Unsubscribe(sub *eventSub) {
+	b.mu.Lock()
+	delete(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// HasSubscribers reports whether anyone is listening
+func (b *EventBus) HasSubscribers() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs) > 0
+}
+
+// Publish sends an event to every matching subscriber
+func (b *EventBus) Publish(e *Event) {
+	if e.Time == "" {
+		e.Time = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if !sub.wants(e.Type) || !e.visibleTo(sub.principal) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+func (s *eventSub) wants(eventType string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if eventType == t || strings.HasPrefix(eventType, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// publishAgentEvent publishes an event about an agent connection
+func (s *Server) publishAgentEvent(eventType string, agent *AgentConn) {
+	data := newAgentResponse(nil, agent)
+	data.Online = eventType != EventAgentDisconnect
+	s.events.Publish(&Event{
+		Type:   eventType,
+		Data:   data,
+		agents: []string{agent.ID, agent.Name},
+	})
+}
+
+// publishRuleEvent publishes an event about a running forwarding rule
+func (f *Forwarder) publishRuleEvent(eventType string, state *ForwardRuleState) {
+	data := newForwardRuleResponse(state.Rule)
+	data.TrafficUsed = atomic.LoadInt64(&state.TrafficUsed)
+	f.server.events.Publish(&Event{
+		Type: eventType,
+		Data: data,
+		rule: state.Rule,
+	})
+}
+
+// TunnelEventData describes a tunnel in tunnel.open and tunnel.close events
+type TunnelEventData struct {
+	ID            uint32 `json:"id"`
+	RuleID        string `json:"ruleId,omitempty"`
+	AgentID       string `json:"agentId"`
+	SourceAgentID string `json:"sourceAgentId,omitempty"`
+	Protocol      string `json:"protocol"`
+	Target        string `json:"target"`
+	// For P2P tunnels, "direct" or "relay"
+	Path string `json:"path,omitempty"`
+}
+
+func newTunnelEventData(tc *TunnelConn) TunnelEventData {
+	data := TunnelEventData{
+		ID:            tc.ID,
+		RuleID:        tc.RuleID,
+		AgentID:       tc.AgentID,
+		SourceAgentID: tc.SourceAgentID,
+		Protocol:      tc.Protocol,
+		Target:        tc.Target,
+	}
+	if tc.SourceAgentID != "" {
+		data.Path = "relay"
+		if tc.Direct {
+			data.Path = "direct"
+		}
+	}
+	return data
+}
+
+// publishTunnelEvent publishes an event about a tunnel
+func (f *Forwarder) publishTunnelEvent(eventType string, tc *TunnelConn) {
+	e := &Event{
+		Type:   eventType,
+		Data:   newTunnelEventData(tc),
+		agents: []string{tc.AgentID, tc.SourceAgentID},
+	}
+	f.rulesMu.RLock()
+	if state, ok := f.rules[tc.RuleID]; ok {
+		e.rule = state.Rule
+	}
+	f.rulesMu.RUnlock()
+	f.server.events.Publish(e)
+}
+
+// HTTPRequestEventData is an access log entry of an http rule, published
+// as an http.request event
+type HTTPRequestEventData struct {
+	RuleID    string  `json:"ruleId"`
+	Rule      string  `json:"rule"`
+	ClientIP  string  `json:"clientIp"`
+	Method    string  `json:"method"`
+	Host      string  `json:"host"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`     // Response body bytes
+	LatencyMs float64 `json:"latencyMs"` // Until the request was served
+}
+
+// statsPublisher periodically publishes stats snapshots while the event
+// stream has subscribers
+func (s *Server) statsPublisher() {
+	ticker := time.NewTicker(eventStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.events.HasSubscribers() {
+				s.events.Publish(&Event{Type: EventStats, Data: s.statsSnapshot()})
+			}
+		}
+	}
+}
+
+// handleEvents streams events as Server-Sent Events. The optional types
+// query parameter is a comma-separated list of event types or prefixes.
+func (s *Server) handleEvents(c *gin.Context) {
+	var types []string
+	for _, t := range strings.Split(c.Query("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+
+	sub := s.events.Subscribe(principalFrom(c), types)
+	defer s.events.Unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case e := <-sub.ch:
+			c.SSEvent(e.Type, e)
+			c.Writer.Flush()
+		case <-ping.C:
+			// Comment line, keeps proxies from closing an idle stream
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
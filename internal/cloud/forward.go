@@ -1,10 +1,13 @@
 package cloud
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http/httputil"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,6 +24,7 @@ type Forwarder struct {
 	tunnelIDGen  uint32
 	tunnelConns  map[uint32]*TunnelConn
 	tunnelConnMu sync.RWMutex
+	streams      *protocol.Mux // Flow control of tunnels with a local connection
 	pendingAcks  map[uint32]chan *protocol.ConnectAckPayload
 	pendingMu    sync.Mutex
 	globalStats  *GlobalStats
@@ -31,9 +35,19 @@ type ForwardRuleState struct {
 	Rule        *ForwardRule
 	Listener    net.Listener
 	UDPConn     *net.UDPConn
+	HTTPProxy   *httputil.ReverseProxy // Serves the requests routed to an http rule
 	Active      bool
 	RateLimiter *RateLimiter
 	TrafficUsed int64 // atomic
+	DirectConns int64 // atomic, open cloud-self connections (they have no tunnel)
+	limitHit    int32 // atomic, set once the traffic limit event was published
+	Compression protocol.CompressionStats
+	Rejected    int64 // atomic, clients (packets for udp) rejected by the source filter or connection limits
+
+	sourceFilter  *sourceFilter // nil if the rule accepts all clients
+	connLimiter   *connLimiter  // nil if the rule doesn't limit its connections
+	rejectMu      sync.Mutex
+	rejectReports map[netip.Addr]*rejectReport
 }
 
 // TunnelConn represents an active tunnel connection
@@ -46,6 +60,29 @@ type TunnelConn struct {
 	SourceAgentID string // For P2P tunnels, the source agent ID
 	LocalTunnelID uint32 // For P2P tunnels, the source agent's local tunnel ID
 	RuleID        string // The rule this tunnel belongs to (for per-rule connection)
+	Direct        bool   // P2P tunnel whose data goes directly between the agents
+
+	stream *protocol.Stream // Data path to the agent, nil for relayed P2P tunnels
+	peer   *AgentConn       // The agent the stream talks to
+}
+
+// deliver writes data received from the agent to the local connection
+func (tc *TunnelConn) deliver(data []byte) error {
+	if tc.stream == nil {
+		_, err := tc.Conn.Write(data)
+		return err
+	}
+	return tc.stream.Deliver(data)
+}
+
+// closeConn closes the local connection once data already received from
+// the agent has been written to it
+func (tc *TunnelConn) closeConn() {
+	if tc.stream == nil {
+		tc.Conn.Close()
+		return
+	}
+	tc.stream.Finish(func() { tc.Conn.Close() })
 }
 
 // NewForwarder creates a new forwarder
@@ -54,6 +91,7 @@ func NewForwarder(server *Server) *Forwarder {
 		server:      server,
 		rules:       make(map[string]*ForwardRuleState),
 		tunnelConns: make(map[uint32]*TunnelConn),
+		streams:     protocol.NewMux(),
 		pendingAcks: make(map[uint32]chan *protocol.ConnectAckPayload),
 		globalStats: NewGlobalStats(),
 	}
@@ -74,6 +112,53 @@ func (f *Forwarder) GetRuleTraffic(ruleID string) int64 {
 	return 0
 }
 
+// GetRuleCompression returns the data a running rule's compressed tunnels
+// carried before and after compression
+func (f *Forwarder) GetRuleCompression(ruleID string) (raw, wire int64) {
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+	if state, ok := f.rules[ruleID]; ok {
+		return state.Compression.Load()
+	}
+	return 0, 0
+}
+
+// GetCompressionStats returns the data compressed tunnels of all running
+// rules carried before and after compression
+func (f *Forwarder) GetCompressionStats() (raw, wire int64) {
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+	for _, state := range f.rules {
+		r, w := state.Compression.Load()
+		raw += r
+		wire += w
+	}
+	return raw, wire
+}
+
+// tunnelCompression returns the compression to request for a tunnel of a
+// rule and the rule's counters. Compression is only used if every agent
+// the data passes through supports it.
+func (f *Forwarder) tunnelCompression(ruleID string, agents ...*AgentConn) (protocol.Compression, *protocol.CompressionStats) {
+	f.rulesMu.RLock()
+	state, ok := f.rules[ruleID]
+	f.rulesMu.RUnlock()
+	if !ok {
+		return protocol.CompressionNone, nil
+	}
+
+	compression, err := protocol.ParseCompression(state.Rule.Compression)
+	if err != nil {
+		return protocol.CompressionNone, &state.Compression
+	}
+	for _, agent := range agents {
+		if !agent.Capabilities.Has(compression.Capability()) {
+			return protocol.CompressionNone, &state.Compression
+		}
+	}
+	return compression, &state.Compression
+}
+
 // Run starts the forwarder
 func (f *Forwarder) Run() {
 	// Load existing rules from store
@@ -99,18 +184,32 @@ func (f *Forwarder) StartRule(rule *ForwardRule) error {
 		return fmt.Errorf("rule %s already running", rule.ID)
 	}
 
+	if err := f.checkRuleCapabilities(rule); err != nil {
+		return err
+	}
+
+	filter, err := newSourceFilter(rule)
+	if err != nil {
+		return fmt.Errorf("rule %s source filter: %w", rule.Name, err)
+	}
+	if filter != nil && filter.usesCountries() && f.server.geoip == nil {
+		log.Printf("Rule %s filters countries but no GeoIP database is loaded, its country lists match no client", rule.Name)
+	}
+
 	state := &ForwardRuleState{
-		Rule:        rule,
-		Active:      true,
-		RateLimiter: NewRateLimiter(rule.RateLimit),
-		TrafficUsed: rule.TrafficUsed,
+		Rule:         rule,
+		Active:       true,
+		RateLimiter:  NewRateLimiter(rule.RateLimit),
+		TrafficUsed:  rule.TrafficUsed,
+		sourceFilter: filter,
+		connLimiter:  newConnLimiter(rule),
 	}
 
 	switch rule.Type {
 	case "remote", "cloud-agent":
 		// Cloud listens, forwards to agent
 		if rule.Protocol == "tcp" {
-			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", rule.ListenPort))
+			listener, err := f.server.listenTCP(fmt.Sprintf(":%d", rule.ListenPort))
 			if err != nil {
 				return fmt.Errorf("failed to listen on port %d: %v", rule.ListenPort, err)
 			}
@@ -127,11 +226,18 @@ func (f *Forwarder) StartRule(rule *ForwardRule) error {
 			}
 			state.UDPConn = conn
 			go f.handleRemoteUDPListener(state)
+		} else if rule.Protocol == "http" {
+			// No port of its own, requests are routed by Host
+			state.HTTPProxy = f.newHTTPProxy(state)
+			log.Printf("Routing HTTP requests for %v%s to rule %s", rule.Domains, rule.PathPrefix, rule.Name)
+		} else if rule.Protocol == "tls-sni" {
+			// No port of its own, connections are routed by TLS server name
+			log.Printf("Routing TLS connections for %v to rule %s", rule.Domains, rule.Name)
 		}
 	case "cloud-self", "cloud-direct":
 		// Cloud listens, forwards directly to target server (no agent involved)
 		if rule.Protocol == "tcp" {
-			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", rule.ListenPort))
+			listener, err := f.server.listenTCP(fmt.Sprintf(":%d", rule.ListenPort))
 			if err != nil {
 				return fmt.Errorf("failed to listen on port %d: %v", rule.ListenPort, err)
 			}
@@ -156,7 +262,9 @@ func (f *Forwarder) StartRule(rule *ForwardRule) error {
 			if sourceAgent == nil {
 				sourceAgent = f.server.GetAgent(rule.SourceAgentID)
 			}
-			if sourceAgent != nil {
+			if sourceAgent != nil && !sourceAgent.AllowsRule(rule.ID) {
+				log.Printf("Source agent %s token does not allow rule %s, not sending", sourceAgent.Name, rule.Name)
+			} else if sourceAgent != nil {
 				log.Printf("Sending agent-cloud proxy rule %s to source agent %s", rule.Name, sourceAgent.Name)
 				f.sendAgentCloudProxyStart(sourceAgent, rule)
 			} else {
@@ -171,7 +279,9 @@ func (f *Forwarder) StartRule(rule *ForwardRule) error {
 			if sourceAgent == nil {
 				sourceAgent = f.server.GetAgent(rule.SourceAgentID)
 			}
-			if sourceAgent != nil {
+			if sourceAgent != nil && !sourceAgent.AllowsRule(rule.ID) {
+				log.Printf("Source agent %s token does not allow rule %s, not sending", sourceAgent.Name, rule.Name)
+			} else if sourceAgent != nil {
 				log.Printf("Sending local proxy rule %s to source agent %s", rule.Name, sourceAgent.Name)
 				f.sendLocalProxyStart(sourceAgent, rule)
 			} else {
@@ -181,6 +291,7 @@ func (f *Forwarder) StartRule(rule *ForwardRule) error {
 	}
 
 	f.rules[rule.ID] = state
+	f.publishRuleEvent(EventRuleStart, state)
 	log.Printf("Started forward rule: %s (%s:%d -> %s:%s:%d)",
 		rule.Name, rule.Protocol, rule.ListenPort,
 		rule.TargetAgentID, rule.TargetHost, rule.TargetPort)
@@ -204,6 +315,9 @@ func (f *Forwarder) StopRule(ruleID string) error {
 	if state.UDPConn != nil {
 		state.UDPConn.Close()
 	}
+	if state.HTTPProxy != nil {
+		closeHTTPProxy(state.HTTPProxy)
+	}
 
 	// Save traffic used to database
 	trafficUsed := atomic.LoadInt64(&state.TrafficUsed)
@@ -235,6 +349,7 @@ func (f *Forwarder) StopRule(ruleID string) error {
 		}
 	}
 
+	f.publishRuleEvent(EventRuleStop, state)
 	log.Printf("Stopped forward rule: %s", rule.Name)
 
 	return nil
@@ -248,11 +363,29 @@ func (f *Forwarder) addTraffic(state *ForwardRuleState, n int64) bool {
 	
 	// Check traffic limit
 	if state.Rule.TrafficLimit > 0 && newTotal > state.Rule.TrafficLimit {
+		if atomic.CompareAndSwapInt32(&state.limitHit, 0, 1) {
+			f.publishRuleEvent(EventRuleTrafficLimit, state)
+		}
 		return false
 	}
 	return true
 }
 
+// removeTunnelConn unregisters a tunnel connection, publishing its close
+// event if it was still registered. It returns the removed connection.
+func (f *Forwarder) removeTunnelConn(tunnelID uint32) *TunnelConn {
+	f.tunnelConnMu.Lock()
+	tc, exists := f.tunnelConns[tunnelID]
+	delete(f.tunnelConns, tunnelID)
+	f.tunnelConnMu.Unlock()
+
+	if !exists {
+		return nil
+	}
+	f.publishTunnelEvent(EventTunnelClose, tc)
+	return tc
+}
+
 func (f *Forwarder) handleRemoteTCPListener(state *ForwardRuleState) {
 	for state.Active {
 		conn, err := state.Listener.Accept()
@@ -268,6 +401,19 @@ func (f *Forwarder) handleRemoteTCPListener(state *ForwardRuleState) {
 }
 
 func (f *Forwarder) handleRemoteTCPConnection(state *ForwardRuleState, conn net.Conn) {
+	clientIP := protocol.AddrPortOf(conn.RemoteAddr()).Addr()
+	if !f.admitClient(state, clientIP) {
+		conn.Close()
+		return
+	}
+	defer f.releaseClient(state, clientIP)
+
+	f.tunnelRemoteTCP(state, conn)
+}
+
+// tunnelRemoteTCP forwards a client connection of a cloud-agent rule
+// through a tunnel to the target agent, closing it when done
+func (f *Forwarder) tunnelRemoteTCP(state *ForwardRuleState, conn net.Conn) {
 	defer conn.Close()
 
 	// Check traffic limit before starting
@@ -286,6 +432,10 @@ func (f *Forwarder) handleRemoteTCPConnection(state *ForwardRuleState, conn net.
 		log.Printf("Target agent %s not connected", rule.TargetAgentID)
 		return
 	}
+	if !agent.AllowsRule(rule.ID) {
+		log.Printf("Target agent %s token does not allow rule %s", agent.Name, rule.Name)
+		return
+	}
 
 	// Generate tunnel ID
 	tunnelID := atomic.AddUint32(&f.tunnelIDGen, 1)
@@ -303,24 +453,55 @@ func (f *Forwarder) handleRemoteTCPConnection(state *ForwardRuleState, conn net.
 	}()
 
 	// Send connect request to agent via rule-specific connection
-	connectMsg := protocol.NewConnectMessage(tunnelID, "tcp", rule.TargetHost, uint16(rule.TargetPort))
+	compression, compressionStats := f.tunnelCompression(rule.ID, agent)
+	sourceHost, sourcePort := protocol.SourceHostPort(conn.RemoteAddr())
+	proxyProtocol, _ := protocol.ParseProxyProtocol(rule.ProxyProtocol)
+	connectMsg := protocol.NewMessage(protocol.MsgTypeConnect, tunnelID, protocol.EncodeConnectPayload(&protocol.ConnectPayload{
+		Protocol:      "tcp",
+		TargetHost:    rule.TargetHost,
+		TargetPort:    uint16(rule.TargetPort),
+		SourceHost:    sourceHost,
+		SourcePort:    sourcePort,
+		Window:        protocol.DefaultWindowSize,
+		Compression:   compression,
+		ProxyProtocol: proxyProtocol,
+	}))
+	sentAt := time.Now()
 	if err := f.server.sendToAgentRule(agent, rule.ID, connectMsg); err != nil {
 		log.Printf("Failed to send connect message: %v", err)
 		return
 	}
 
 	// Wait for acknowledgment
+	var ack *protocol.ConnectAckPayload
 	select {
-	case ack := <-ackChan:
+	case ack = <-ackChan:
 		if !ack.Success {
+			f.server.metrics.observeConnectAck(rule.Type, ackFailure, sentAt)
 			log.Printf("Tunnel connect failed: %s", ack.Error)
 			return
 		}
+		f.server.metrics.observeConnectAck(rule.Type, ackSuccess, sentAt)
 	case <-time.After(30 * time.Second):
+		f.server.metrics.observeConnectAck(rule.Type, ackTimeout, sentAt)
 		log.Printf("Tunnel connect timeout")
 		return
 	}
 
+	stream := f.streams.Open(protocol.StreamConfig{
+		TunnelID:   tunnelID,
+		DataType:   protocol.MsgTypeData,
+		PeerWindow: ack.Window,
+		Dst:        conn,
+		Send: func(msg *protocol.Message) error {
+			return f.server.sendToAgentRule(agent, rule.ID, msg)
+		},
+
+		// Agents that don't know compression ack without it
+		Compression: ack.Compression,
+		Stats:       compressionStats,
+	})
+
 	// Register tunnel connection
 	tunnelConn := &TunnelConn{
 		ID:       tunnelID,
@@ -329,11 +510,14 @@ func (f *Forwarder) handleRemoteTCPConnection(state *ForwardRuleState, conn net.
 		Protocol: "tcp",
 		Target:   fmt.Sprintf("%s:%d", rule.TargetHost, rule.TargetPort),
 		RuleID:   rule.ID,
+		stream:   stream,
+		peer:     agent,
 	}
 
 	f.tunnelConnMu.Lock()
 	f.tunnelConns[tunnelID] = tunnelConn
 	f.tunnelConnMu.Unlock()
+	f.publishTunnelEvent(EventTunnelOpen, tunnelConn)
 
 	agent.tunnelsMu.Lock()
 	agent.tunnels[tunnelID] = &Tunnel{
@@ -347,13 +531,15 @@ func (f *Forwarder) handleRemoteTCPConnection(state *ForwardRuleState, conn net.
 	agent.tunnelsMu.Unlock()
 
 	defer func() {
-		f.tunnelConnMu.Lock()
-		delete(f.tunnelConns, tunnelID)
-		f.tunnelConnMu.Unlock()
+		stream.Close()
+		f.removeTunnelConn(tunnelID)
 
+		// HandleClose may already have removed the tunnel
 		agent.tunnelsMu.Lock()
-		delete(agent.tunnels, tunnelID)
-		agent.ActiveTunnels--
+		if _, ok := agent.tunnels[tunnelID]; ok {
+			delete(agent.tunnels, tunnelID)
+			agent.ActiveTunnels--
+		}
 		agent.tunnelsMu.Unlock()
 
 		// Send close message via rule-specific connection
@@ -380,9 +566,8 @@ func (f *Forwarder) handleRemoteTCPConnection(state *ForwardRuleState, conn net.
 				state.RateLimiter.Wait(int64(n))
 			}
 
-			dataMsg := protocol.NewDataMessage(tunnelID, buf[:n])
-			// Use rule-specific connection for data transfer
-			if err := f.server.sendToAgentRule(agent, rule.ID, dataMsg); err != nil {
+			// Blocks while the agent's window for this tunnel is full
+			if _, err := stream.Write(buf[:n]); err != nil {
 				return
 			}
 		}
@@ -400,13 +585,16 @@ func (f *Forwarder) handleRemoteUDPListener(state *ForwardRuleState) {
 		if err != nil {
 			continue
 		}
+		if !f.admitSource(state, addr.AddrPort().Addr()) {
+			continue
+		}
 
 		// Try to find target agent by name first, then by ID
 		agent := f.server.GetAgentByName(rule.TargetAgentID)
 		if agent == nil {
 			agent = f.server.GetAgent(rule.TargetAgentID)
 		}
-		if agent == nil {
+		if agent == nil || !agent.AllowsRule(rule.ID) {
 			continue
 		}
 
@@ -445,12 +633,21 @@ func (f *Forwarder) handleCloudSelfTCPListener(state *ForwardRuleState) {
 func (f *Forwarder) handleCloudSelfTCPConnection(state *ForwardRuleState, clientConn net.Conn) {
 	defer clientConn.Close()
 
+	clientIP := protocol.AddrPortOf(clientConn.RemoteAddr()).Addr()
+	if !f.admitClient(state, clientIP) {
+		return
+	}
+	defer f.releaseClient(state, clientIP)
+
 	// Check traffic limit before starting
 	if state.Rule.TrafficLimit > 0 && atomic.LoadInt64(&state.TrafficUsed) >= state.Rule.TrafficLimit {
 		log.Printf("Traffic limit exceeded for rule %s", state.Rule.Name)
 		return
 	}
 
+	atomic.AddInt64(&state.DirectConns, 1)
+	defer atomic.AddInt64(&state.DirectConns, -1)
+
 	rule := state.Rule
 	targetAddr := fmt.Sprintf("%s:%d", rule.TargetHost, rule.TargetPort)
 
@@ -462,6 +659,12 @@ func (f *Forwarder) handleCloudSelfTCPConnection(state *ForwardRuleState, client
 	}
 	defer targetConn.Close()
 
+	proxyProtocol, _ := protocol.ParseProxyProtocol(rule.ProxyProtocol)
+	if err := writeProxyHeader(proxyProtocol, targetConn, protocol.AddrPortOf(clientConn.RemoteAddr()), clientConn.LocalAddr()); err != nil {
+		log.Printf("Failed to send PROXY header to %s: %v", targetAddr, err)
+		return
+	}
+
 	// Bidirectional copy with rate limiting and traffic tracking
 	done := make(chan struct{}, 2)
 
@@ -525,6 +728,9 @@ func (f *Forwarder) handleCloudSelfUDPListener(state *ForwardRuleState) {
 		if err != nil {
 			continue
 		}
+		if !f.admitSource(state, clientAddr.AddrPort().Addr()) {
+			continue
+		}
 
 		clientKey := clientAddr.String()
 
@@ -594,12 +800,53 @@ func (f *Forwarder) HandleData(agent *AgentConn, msg *protocol.Message) {
 		return
 	}
 
-	_, err := tunnelConn.Conn.Write(msg.Payload)
-	if err != nil {
+	if err := tunnelConn.deliver(msg.Payload); err != nil {
 		tunnelConn.Conn.Close()
 	}
 }
 
+// HandleWindowUpdate credits a tunnel's stream. Updates for relayed P2P
+// tunnels are passed on to the agent at the other end.
+func (f *Forwarder) HandleWindowUpdate(agent *AgentConn, msg *protocol.Message) {
+	if f.streams.HandleWindowUpdate(msg) {
+		return
+	}
+
+	f.tunnelConnMu.RLock()
+	tunnelConn, exists := f.tunnelConns[msg.TunnelID]
+	f.tunnelConnMu.RUnlock()
+
+	if !exists || tunnelConn.Conn != nil || tunnelConn.SourceAgentID == "" {
+		return
+	}
+
+	peerID := tunnelConn.SourceAgentID
+	if agent.ID == tunnelConn.SourceAgentID {
+		peerID = tunnelConn.AgentID
+	}
+	if peer := f.server.GetAgent(peerID); peer != nil {
+		f.server.sendToAgentRule(peer, tunnelConn.RuleID, msg)
+	}
+}
+
+// OnAgentDisconnected closes the connections of tunnels whose stream talks
+// to the agent. Their senders would otherwise wait forever for its window
+// updates.
+func (f *Forwarder) OnAgentDisconnected(agent *AgentConn) {
+	var conns []*TunnelConn
+	f.tunnelConnMu.RLock()
+	for _, tc := range f.tunnelConns {
+		if tc.peer == agent {
+			conns = append(conns, tc)
+		}
+	}
+	f.tunnelConnMu.RUnlock()
+
+	for _, tc := range conns {
+		tc.closeConn()
+	}
+}
+
 // HandleUDPData handles incoming UDP data from an agent
 func (f *Forwarder) HandleUDPData(agent *AgentConn, msg *protocol.Message) {
 	payload, err := protocol.DecodeUDPDataPayload(msg.Payload)
@@ -649,17 +896,13 @@ func (f *Forwarder) HandleConnectAck(agent *AgentConn, msg *protocol.Message) {
 
 // HandleClose handles tunnel close message
 func (f *Forwarder) HandleClose(agent *AgentConn, msg *protocol.Message) {
-	f.tunnelConnMu.Lock()
-	tunnelConn, exists := f.tunnelConns[msg.TunnelID]
-	if exists {
+	if tunnelConn := f.removeTunnelConn(msg.TunnelID); tunnelConn != nil {
 		// Only close Conn if it's not nil (P2P tunnels don't have a local Conn)
 		if tunnelConn.Conn != nil {
-			tunnelConn.Conn.Close()
+			tunnelConn.closeConn()
 		}
-		delete(f.tunnelConns, msg.TunnelID)
 		log.Printf("Tunnel %d closed by agent %s", msg.TunnelID, agent.ID)
 	}
-	f.tunnelConnMu.Unlock()
 
 	agent.tunnelsMu.Lock()
 	if _, ok := agent.tunnels[msg.TunnelID]; ok {
@@ -696,6 +939,7 @@ func (f *Forwarder) sendLocalProxyStart(agent *AgentConn, rule *ForwardRule) err
 		TargetAgentID: rule.TargetAgentID,
 		TargetHost:    rule.TargetHost,
 		TargetPort:    uint16(rule.TargetPort),
+		Encrypted:     rule.Encrypted,
 	})
 	msg := protocol.NewMessage(protocol.MsgTypeLocalProxyStart, 0, payload)
 	return f.server.sendToAgent(agent, msg)
@@ -732,6 +976,89 @@ func (f *Forwarder) sendAgentCloudProxyStop(agent *AgentConn, ruleID string) err
 	return f.server.sendToAgent(agent, msg)
 }
 
+// ruleCapabilities returns the capabilities the source and target agents
+// of a rule need
+func ruleCapabilities(rule *ForwardRule) (source, target protocol.Capabilities) {
+	tunnel := protocol.CapTCP
+	if rule.Protocol == "udp" {
+		tunnel = protocol.CapUDP
+	}
+
+	switch rule.Type {
+	case "remote", "cloud-agent":
+		target = tunnel
+	case "agent-cloud":
+		source = protocol.CapAgentCloud
+	case "local", "p2p", "agent-agent":
+		source = protocol.CapP2P
+		if rule.Protocol == "udp" {
+			source |= protocol.CapUDPP2P
+		}
+		target = tunnel
+	}
+	if rule.Encrypted {
+		source |= protocol.CapE2E
+		target |= protocol.CapE2E
+	}
+	// Source agents send the client address, target agents the PROXY header
+	if rule.ProxyProtocol != "" {
+		if source != 0 {
+			source |= protocol.CapProxyProtocol
+		}
+		if target != 0 {
+			target |= protocol.CapProxyProtocol
+		}
+	}
+	return source, target
+}
+
+// isAgentToAgent reports whether a rule type relays tunnels between agents
+func isAgentToAgent(ruleType string) bool {
+	switch ruleType {
+	case "local", "p2p", "agent-agent":
+		return true
+	}
+	return false
+}
+
+// cloudListens reports whether rules of a type accept their clients on the
+// cloud
+func cloudListens(ruleType string) bool {
+	switch ruleType {
+	case "remote", "cloud-agent", "cloud-self", "cloud-direct":
+		return true
+	}
+	return false
+}
+
+// checkRuleCapabilities returns an error if a connected agent of the rule
+// lacks a capability the rule needs. Agents that are not connected are
+// checked when they connect.
+func (f *Forwarder) checkRuleCapabilities(rule *ForwardRule) error {
+	source, target := ruleCapabilities(rule)
+	if err := f.checkAgentCapabilities(rule.SourceAgentID, source); err != nil {
+		return err
+	}
+	return f.checkAgentCapabilities(rule.TargetAgentID, target)
+}
+
+func (f *Forwarder) checkAgentCapabilities(agentID string, want protocol.Capabilities) error {
+	if agentID == "" || want == 0 {
+		return nil
+	}
+	agent := f.server.GetAgentByName(agentID)
+	if agent == nil {
+		agent = f.server.GetAgent(agentID)
+	}
+	if agent == nil {
+		return nil
+	}
+	if missing := want &^ agent.Capabilities; missing != 0 {
+		return fmt.Errorf("agent %s does not support %s", agent.Name, missing)
+	}
+	return nil
+}
+
 // OnAgentConnected is called when an agent connects, to send it local proxy rules
 func (f *Forwarder) OnAgentConnected(agent *AgentConn) {
 	rules, err := f.server.store.GetForwardRules()
@@ -750,6 +1077,17 @@ func (f *Forwarder) OnAgentConnected(agent *AgentConn) {
 			continue
 		}
 
+		if !agent.AllowsRule(rule.ID) {
+			log.Printf("Agent %s token does not allow rule %s, skipping", agent.Name, rule.Name)
+			continue
+		}
+
+		if source, _ := ruleCapabilities(rule); !agent.Capabilities.Has(source) {
+			log.Printf("Agent %s does not support %s needed by rule %s, skipping",
+				agent.Name, source&^agent.Capabilities, rule.Name)
+			continue
+		}
+
 		switch rule.Type {
 		case "local", "p2p", "agent-agent":
 			log.Printf("Sending local proxy rule %s to agent %s (%s)", rule.Name, agent.Name, agent.ID)
@@ -791,13 +1129,24 @@ func (f *Forwarder) HandleP2PConnect(sourceAgent *AgentConn, msg *protocol.Messa
 		// Try by ID
 		targetAgent = f.server.GetAgent(payload.SourceAgentID)
 	}
+
+	var connectErr string
 	if targetAgent == nil {
 		log.Printf("P2P connect: target agent %s not found (not connected)", payload.SourceAgentID)
+		connectErr = "Target agent not connected"
+	} else if !sourceAgent.AllowsRule(ruleID) || !targetAgent.AllowsRule(ruleID) {
+		log.Printf("P2P connect: rule %s not allowed by agent token (source=%s, target=%s)", ruleID, sourceAgent.ID, targetAgent.ID)
+		connectErr = "Rule not allowed by agent token"
+	} else if payload.KeyExchange == nil && f.ruleEncrypted(ruleID) {
+		log.Printf("P2P connect: rule %s is end-to-end encrypted but source %s offered no key exchange", ruleID, sourceAgent.ID)
+		connectErr = "End-to-end encryption required"
+	}
+	if connectErr != "" {
 		// Send failure ack with the local tunnel ID so source can find its pending channel
 		ackPayload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
 			Success:  false,
 			TunnelID: localTunnelID,
-			Error:    "Target agent not connected",
+			Error:    connectErr,
 		})
 		ackMsg := protocol.NewMessage(protocol.MsgTypeP2PConnectAck, localTunnelID, ackPayload)
 		f.server.sendToAgentRule(sourceAgent, ruleID, ackMsg)
@@ -824,7 +1173,47 @@ func (f *Forwarder) HandleP2PConnect(sourceAgent *AgentConn, msg *protocol.Messa
 
 	// Forward connect request to target agent with global tunnel ID
 	// Use rule connection for target agent as well
-	connectMsg := protocol.NewConnectMessage(globalTunnelID, payload.Protocol, payload.TargetHost, payload.TargetPort)
+	// The source's window is passed through, flow control runs end to end.
+	// A tunnel from an agent to itself goes without: window updates could
+	// not tell its two ends apart.
+	window := payload.Window
+	if targetAgent == sourceAgent {
+		window = 0
+	}
+	// Compression runs end to end as well, so both agents must support it
+	compression := protocol.CompressionNone
+	if payload.Protocol == "tcp" {
+		compression, _ = f.tunnelCompression(ruleID, sourceAgent, targetAgent)
+	}
+	// The key exchange of an encrypted tunnel passes through with the
+	// identity key enrolled for each side and its agent ID, which the
+	// agents pin the key to. The cloud only sees ciphertext.
+	if payload.KeyExchange != nil {
+		payload.KeyExchange.IdentityKey = agentIdentityKey(sourceAgent)
+		payload.KeyExchange.AgentID = sourceAgent.ID
+	}
+	// The source may offer its direct path to the target, unless the rule
+	// must stay on the relay. The target takes the tunnel's stream only
+	// from the source's identity key.
+	direct := payload.Direct && f.ruleDirect(ruleID)
+	var directPeerKey []byte
+	if direct {
+		directPeerKey = agentIdentityKey(sourceAgent)
+	}
+	connectMsg := protocol.NewMessage(protocol.MsgTypeConnect, globalTunnelID, protocol.EncodeConnectPayload(&protocol.ConnectPayload{
+		Protocol:      payload.Protocol,
+		TargetHost:    payload.TargetHost,
+		TargetPort:    payload.TargetPort,
+		SourceHost:    payload.SourceHost,
+		SourcePort:    payload.SourcePort,
+		Window:        window,
+		Compression:   compression,
+		KeyExchange:   payload.KeyExchange,
+		Direct:        direct,
+		DirectPeerKey: directPeerKey,
+		ProxyProtocol: f.ruleProxyProtocol(ruleID),
+	}))
+	sentAt := time.Now()
 	if err := f.server.sendToAgentRule(targetAgent, ruleID, connectMsg); err != nil {
 		log.Printf("Failed to send connect to target agent: %v", err)
 		return
@@ -837,21 +1226,37 @@ func (f *Forwarder) HandleP2PConnect(sourceAgent *AgentConn, msg *protocol.Messa
 	select {
 	case ack := <-ackChan:
 		log.Printf("P2P connect: received ack from target, success=%v, error=%s", ack.Success, ack.Error)
+		result := ackSuccess
+		if !ack.Success {
+			result = ackFailure
+		}
+		f.server.metrics.observeConnectAck("p2p", result, sentAt)
+		if window == 0 {
+			ack.Window = 0
+		}
+		if ack.KeyExchange != nil {
+			ack.KeyExchange.IdentityKey = agentIdentityKey(targetAgent)
+			ack.KeyExchange.AgentID = targetAgent.ID
+		}
+		ack.Direct = ack.Direct && direct
 		// Send ack to source agent:
 		// - msg.TunnelID = localTunnelID (so source can find its pending channel)
 		// - payload.TunnelID = globalTunnelID (the actual tunnel ID to use)
 		responsePayload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
-			Success:  ack.Success,
-			TunnelID: globalTunnelID, // Tell source agent to use this ID
-			Error:    ack.Error,
+			Success:     ack.Success,
+			TunnelID:    globalTunnelID, // Tell source agent to use this ID
+			Error:       ack.Error,
+			Window:      ack.Window,
+			Compression: ack.Compression,
+			KeyExchange: ack.KeyExchange,
+			Direct:      ack.Direct,
 		})
 		ackMsg := protocol.NewMessage(protocol.MsgTypeP2PConnectAck, localTunnelID, responsePayload)
 		f.server.sendToAgentRule(sourceAgent, ruleID, ackMsg)
 
 		if ack.Success {
 			// Register the P2P tunnel mapping with global ID and rule ID
-			f.tunnelConnMu.Lock()
-			f.tunnelConns[globalTunnelID] = &TunnelConn{
+			tunnelConn := &TunnelConn{
 				ID:            globalTunnelID,
 				AgentID:       targetAgent.ID,
 				Protocol:      payload.Protocol,
@@ -859,9 +1264,13 @@ func (f *Forwarder) HandleP2PConnect(sourceAgent *AgentConn, msg *protocol.Messa
 				SourceAgentID: sourceAgent.ID,
 				LocalTunnelID: localTunnelID,
 				RuleID:        ruleID,
+				Direct:        ack.Direct,
 			}
+			f.tunnelConnMu.Lock()
+			f.tunnelConns[globalTunnelID] = tunnelConn
 			log.Printf("P2P tunnel %d registered: source=%s, target=%s, rule=%s", globalTunnelID, sourceAgent.ID, targetAgent.ID, ruleID)
 			f.tunnelConnMu.Unlock()
+			f.publishTunnelEvent(EventTunnelOpen, tunnelConn)
 
 			// Store source agent mapping for reverse data flow
 			sourceAgent.tunnelsMu.Lock()
@@ -883,11 +1292,12 @@ func (f *Forwarder) HandleP2PConnect(sourceAgent *AgentConn, msg *protocol.Messa
 			targetAgent.ActiveTunnels++
 			targetAgent.tunnelsMu.Unlock()
 
-			log.Printf("P2P tunnel established: global=%d source=%s target=%s rule=%s",
-				globalTunnelID, sourceAgent.ID, targetAgent.ID, ruleID)
+			log.Printf("P2P tunnel established: global=%d source=%s target=%s rule=%s encrypted=%v direct=%v",
+				globalTunnelID, sourceAgent.ID, targetAgent.ID, ruleID, ack.KeyExchange != nil, ack.Direct)
 		}
 
 	case <-time.After(30 * time.Second):
+		f.server.metrics.observeConnectAck("p2p", ackTimeout, sentAt)
 		ackPayload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
 			Success:  false,
 			TunnelID: localTunnelID,
@@ -898,6 +1308,32 @@ func (f *Forwarder) HandleP2PConnect(sourceAgent *AgentConn, msg *protocol.Messa
 	}
 }
 
+// ruleEncrypted reports whether a running rule requires end-to-end encryption
+func (f *Forwarder) ruleEncrypted(ruleID string) bool {
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+	state, ok := f.rules[ruleID]
+	return ok && state.Rule.Encrypted
+}
+
+// ruleDirect reports whether a running rule's tunnels may use a direct path
+func (f *Forwarder) ruleDirect(ruleID string) bool {
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+	state, ok := f.rules[ruleID]
+	return ok && ruleAllowsDirect(state.Rule)
+}
+
+// agentIdentityKey returns the identity key enrolled for an agent, nil for
+// agents without one
+func agentIdentityKey(agent *AgentConn) []byte {
+	key, err := base64.StdEncoding.DecodeString(agent.PublicKey)
+	if err != nil || len(key) == 0 {
+		return nil
+	}
+	return key
+}
+
 // HandleP2PData handles P2P data from source agent to target agent
 func (f *Forwarder) HandleP2PData(sourceAgent *AgentConn, msg *protocol.Message) {
 	log.Printf("HandleP2PData called: tunnelID=%d, from agent=%s, size=%d", msg.TunnelID, sourceAgent.ID, len(msg.Payload))
@@ -974,6 +1410,18 @@ func (f *Forwarder) HandleAgentCloudConnect(sourceAgent *AgentConn, msg *protoco
 	log.Printf("Agent-cloud connect request from agent %s: target=%s:%d, localTunnelID=%d, rule=%s",
 		sourceAgent.ID, payload.TargetHost, payload.TargetPort, localTunnelID, ruleID)
 
+	if !sourceAgent.AllowsRule(ruleID) {
+		log.Printf("Agent-cloud connect: rule %s not allowed by agent %s token", ruleID, sourceAgent.ID)
+		ackPayload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
+			Success:  false,
+			TunnelID: localTunnelID,
+			Error:    "Rule not allowed by agent token",
+		})
+		ackMsg := protocol.NewMessage(protocol.MsgTypeAgentCloudConnectAck, localTunnelID, ackPayload)
+		f.server.sendToAgentRule(sourceAgent, ruleID, ackMsg)
+		return
+	}
+
 	// Generate global tunnel ID
 	globalTunnelID := atomic.AddUint32(&f.tunnelIDGen, 1)
 
@@ -992,14 +1440,33 @@ func (f *Forwarder) HandleAgentCloudConnect(sourceAgent *AgentConn, msg *protoco
 		return
 	}
 
-	// Send success ack to agent
-	ackPayload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
-		Success:  true,
-		TunnelID: globalTunnelID,
-		Error:    "",
+	source := protocol.SourceAddrPort(payload.SourceHost, payload.SourcePort)
+	if err := writeProxyHeader(f.ruleProxyProtocol(ruleID), targetConn, source, targetConn.RemoteAddr()); err != nil {
+		log.Printf("Agent-cloud connect: failed to send PROXY header to %s: %v", targetAddr, err)
+		targetConn.Close()
+		ackPayload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
+			Success:  false,
+			TunnelID: localTunnelID,
+			Error:    err.Error(),
+		})
+		ackMsg := protocol.NewMessage(protocol.MsgTypeAgentCloudConnectAck, localTunnelID, ackPayload)
+		f.server.sendToAgentRule(sourceAgent, ruleID, ackMsg)
+		return
+	}
+
+	compression, compressionStats := f.tunnelCompression(ruleID, sourceAgent)
+	stream := f.streams.Open(protocol.StreamConfig{
+		TunnelID:   globalTunnelID,
+		DataType:   protocol.MsgTypeAgentCloudData,
+		PeerWindow: payload.Window,
+		Dst:        targetConn,
+		Send: func(msg *protocol.Message) error {
+			return f.server.sendToAgentRule(sourceAgent, ruleID, msg)
+		},
+
+		Compression: compression,
+		Stats:       compressionStats,
 	})
-	ackMsg := protocol.NewMessage(protocol.MsgTypeAgentCloudConnectAck, localTunnelID, ackPayload)
-	f.server.sendToAgentRule(sourceAgent, ruleID, ackMsg)
 
 	// Register tunnel connection (with target connection instead of client connection)
 	tunnelConn := &TunnelConn{
@@ -1011,11 +1478,25 @@ func (f *Forwarder) HandleAgentCloudConnect(sourceAgent *AgentConn, msg *protoco
 		SourceAgentID: sourceAgent.ID,
 		LocalTunnelID: localTunnelID,
 		RuleID:        ruleID,
+		stream:        stream,
+		peer:          sourceAgent,
 	}
 
 	f.tunnelConnMu.Lock()
 	f.tunnelConns[globalTunnelID] = tunnelConn
 	f.tunnelConnMu.Unlock()
+	f.publishTunnelEvent(EventTunnelOpen, tunnelConn)
+
+	// Send success ack to agent once the tunnel can take its data
+	ackPayload := protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{
+		Success:     true,
+		TunnelID:    globalTunnelID,
+		Error:       "",
+		Window:      protocol.DefaultWindowSize,
+		Compression: compression,
+	})
+	ackMsg := protocol.NewMessage(protocol.MsgTypeAgentCloudConnectAck, localTunnelID, ackPayload)
+	f.server.sendToAgentRule(sourceAgent, ruleID, ackMsg)
 
 	log.Printf("Agent-cloud tunnel %d established: agent=%s -> cloud -> %s (rule=%s)", globalTunnelID, sourceAgent.ID, targetAddr, ruleID)
 
@@ -1026,10 +1507,9 @@ func (f *Forwarder) HandleAgentCloudConnect(sourceAgent *AgentConn, msg *protoco
 // readFromAgentCloudTarget reads data from target server and forwards to source agent
 func (f *Forwarder) readFromAgentCloudTarget(sourceAgent *AgentConn, tunnelConn *TunnelConn) {
 	defer func() {
+		tunnelConn.stream.Close()
 		tunnelConn.Conn.Close()
-		f.tunnelConnMu.Lock()
-		delete(f.tunnelConns, tunnelConn.ID)
-		f.tunnelConnMu.Unlock()
+		f.removeTunnelConn(tunnelConn.ID)
 		log.Printf("Agent-cloud tunnel %d closed", tunnelConn.ID)
 	}()
 
@@ -1048,8 +1528,7 @@ func (f *Forwarder) readFromAgentCloudTarget(sourceAgent *AgentConn, tunnelConn
 
 		if n > 0 {
 			// Send data back to agent using rule connection
-			dataMsg := protocol.NewMessage(protocol.MsgTypeAgentCloudData, tunnelConn.ID, buf[:n])
-			if err := f.server.sendToAgentRule(sourceAgent, tunnelConn.RuleID, dataMsg); err != nil {
+			if _, err := tunnelConn.stream.Write(buf[:n]); err != nil {
 				log.Printf("Agent-cloud tunnel %d: send to agent error: %v", tunnelConn.ID, err)
 				return
 			}
@@ -1069,8 +1548,7 @@ func (f *Forwarder) HandleAgentCloudData(sourceAgent *AgentConn, msg *protocol.M
 	}
 
 	// Write data to target server
-	_, err := tunnelConn.Conn.Write(msg.Payload)
-	if err != nil {
+	if err := tunnelConn.deliver(msg.Payload); err != nil {
 		log.Printf("Agent-cloud tunnel %d: write to target error: %v", msg.TunnelID, err)
 		tunnelConn.Conn.Close()
 	}
@@ -1078,13 +1556,9 @@ func (f *Forwarder) HandleAgentCloudData(sourceAgent *AgentConn, msg *protocol.M
 
 // HandleAgentCloudClose handles close message from agent for agent-cloud tunnel
 func (f *Forwarder) HandleAgentCloudClose(sourceAgent *AgentConn, msg *protocol.Message) {
-	f.tunnelConnMu.Lock()
-	tunnelConn, exists := f.tunnelConns[msg.TunnelID]
-	if exists {
-		tunnelConn.Conn.Close()
-		delete(f.tunnelConns, msg.TunnelID)
+	if tunnelConn := f.removeTunnelConn(msg.TunnelID); tunnelConn != nil {
+		tunnelConn.closeConn()
 		log.Printf("Agent-cloud tunnel %d closed by agent", msg.TunnelID)
 	}
-	f.tunnelConnMu.Unlock()
 }
 
@@ -0,0 +1,195 @@
+package cloud
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/natsvr/natsvr/pkg/metrics"
+)
+
+// Auth failure kinds
+const (
+	authFailAgentToken    = "agent_token"
+	authFailAgentIdentity = "agent_identity"
+	authFailAgentProtocol = "agent_protocol"
+	authFailAgentCert     = "agent_cert"
+	authFailRuleConn      = "rule_conn"
+	authFailLogin         = "login"
+	authFailAPI           = "api"
+)
+
+// Connect-ack results
+const (
+	ackSuccess = "success"
+	ackFailure = "failure"
+	ackTimeout = "timeout"
+)
+
+// serverMetrics holds the instruments updated on hot paths. Everything
+// else is read from server state when /metrics is scraped.
+type serverMetrics struct {
+	registry     *metrics.Registry
+	authFailures *metrics.CounterVec
+	connectAck   *metrics.HistogramVec
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	reg := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: reg,
+		authFailures: reg.NewCounterVec("natsvr_auth_failures_total",
+			"Rejected authentication attempts by kind.", "kind"),
+		connectAck: reg.NewHistogramVec("natsvr_connect_ack_duration_seconds",
+			"Time from sending a tunnel connect request to an agent until its ack arrives.",
+			metrics.DefLatencyBuckets, "kind", "result"),
+	}
+
+	reg.NewCounterFunc("natsvr_traffic_bytes_total",
+		"Bytes carried by the server, by direction.", []string{"direction"},
+		func() []metrics.Sample {
+			tx, rx, _, _ := s.forwarder.GetGlobalStats()
+			return []metrics.Sample{
+				{Labels: []string{"tx"}, Value: float64(tx)},
+				{Labels: []string{"rx"}, Value: float64(rx)},
+			}
+		})
+
+	ruleLabels := []string{"rule_id", "rule", "type"}
+	reg.NewCounterFunc("natsvr_rule_traffic_bytes_total",
+		"Traffic counted against each running rule's limit.", ruleLabels,
+		func() []metrics.Sample {
+			return s.forwarder.ruleSamples(func(r *ruleSnapshot) float64 { return float64(r.traffic) })
+		})
+	reg.NewGaugeFunc("natsvr_rule_active_connections",
+		"Open client connections of each running rule.", ruleLabels,
+		func() []metrics.Sample {
+			return s.forwarder.ruleSamples(func(r *ruleSnapshot) float64 { return float64(r.conns) })
+		})
+	reg.NewCounterFunc("natsvr_rule_ratelimit_wait_seconds_total",
+		"Time connections of each running rule spent blocked by its rate limit.", ruleLabels,
+		func() []metrics.Sample {
+			return s.forwarder.ruleSamples(func(r *ruleSnapshot) float64 { return r.waited.Seconds() })
+		})
+	reg.NewCounterFunc("natsvr_rule_uncompressed_bytes_total",
+		"Data of each running rule's compressed tunnels before compression.", ruleLabels,
+		func() []metrics.Sample {
+			return s.forwarder.ruleSamples(func(r *ruleSnapshot) float64 { return float64(r.rawBytes) })
+		})
+	reg.NewCounterFunc("natsvr_rule_compressed_bytes_total",
+		"Data of each running rule's compressed tunnels after compression.", ruleLabels,
+		func() []metrics.Sample {
+			return s.forwarder.ruleSamples(func(r *ruleSnapshot) float64 { return float64(r.wireBytes) })
+		})
+	reg.NewCounterFunc("natsvr_rule_rejected_total",
+		"Clients, or packets of udp rules, rejected by each running rule's source filter or connection limits.", ruleLabels,
+		func() []metrics.Sample {
+			return s.forwarder.ruleSamples(func(r *ruleSnapshot) float64 { return float64(r.rejected) })
+		})
+
+	reg.NewGaugeFunc("natsvr_agents_connected",
+		"Number of connected agents.", nil,
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(len(s.GetAgents()))}}
+		})
+
+	agentLabels := []string{"agent_id", "agent"}
+	reg.NewCounterFunc("natsvr_agent_tx_bytes_total",
+		"Bytes sent to each connected agent during its current connection.", agentLabels,
+		func() []metrics.Sample {
+			return s.agentSamples(func(a *AgentConn) float64 { return float64(a.TxBytes) })
+		})
+	reg.NewCounterFunc("natsvr_agent_rx_bytes_total",
+		"Bytes received from each connected agent during its current connection.", agentLabels,
+		func() []metrics.Sample {
+			return s.agentSamples(func(a *AgentConn) float64 { return float64(a.RxBytes) })
+		})
+	reg.NewGaugeFunc("natsvr_agent_active_tunnels",
+		"Open tunnels of each connected agent.", agentLabels,
+		func() []metrics.Sample {
+			return s.agentSamples(func(a *AgentConn) float64 {
+				a.tunnelsMu.RLock()
+				defer a.tunnelsMu.RUnlock()
+				return float64(a.ActiveTunnels)
+			})
+		})
+
+	return m
+}
+
+// authFailed counts a rejected authentication attempt
+func (m *serverMetrics) authFailed(kind string) {
+	m.authFailures.With(kind).Inc()
+}
+
+// observeConnectAck records how long an agent took to answer a connect request
+func (m *serverMetrics) observeConnectAck(kind, result string, start time.Time) {
+	m.connectAck.With(kind, result).Observe(time.Since(start).Seconds())
+}
+
+// ruleSnapshot is the scrape-time state of a running rule
+type ruleSnapshot struct {
+	id, name, typ string
+	traffic       int64
+	conns         int
+	waited        time.Duration
+	rawBytes      int64
+	wireBytes     int64
+	rejected      int64
+}
+
+// ruleSnapshots returns the state of all running rules. Tunneled
+// connections are counted from the tunnel table, cloud-self connections
+// from the rule itself.
+func (f *Forwarder) ruleSnapshots() []*ruleSnapshot {
+	tunnels := make(map[string]int)
+	f.tunnelConnMu.RLock()
+	for _, tc := range f.tunnelConns {
+		if tc.RuleID != "" {
+			tunnels[tc.RuleID]++
+		}
+	}
+	f.tunnelConnMu.RUnlock()
+
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+	snapshots := make([]*ruleSnapshot, 0, len(f.rules))
+	for id, state := range f.rules {
+		raw, wire := state.Compression.Load()
+		snapshots = append(snapshots, &ruleSnapshot{
+			id:        id,
+			name:      state.Rule.Name,
+			typ:       state.Rule.Type,
+			traffic:   atomic.LoadInt64(&state.TrafficUsed),
+			conns:     tunnels[id] + int(atomic.LoadInt64(&state.DirectConns)),
+			waited:    state.RateLimiter.WaitTime(),
+			rawBytes:  raw,
+			wireBytes: wire,
+			rejected:  atomic.LoadInt64(&state.Rejected),
+		})
+	}
+	return snapshots
+}
+
+func (f *Forwarder) ruleSamples(value func(*ruleSnapshot) float64) []metrics.Sample {
+	snapshots := f.ruleSnapshots()
+	samples := make([]metrics.Sample, len(snapshots))
+	for i, r := range snapshots {
+		samples[i] = metrics.Sample{Labels: []string{r.id, r.name, r.typ}, Value: value(r)}
+	}
+	return samples
+}
+
+func (s *Server) agentSamples(value func(*AgentConn) float64) []metrics.Sample {
+	agents := s.GetAgents()
+	samples := make([]metrics.Sample, len(agents))
+	for i, a := range agents {
+		samples[i] = metrics.Sample{Labels: []string{a.ID, a.Name}, Value: value(a)}
+	}
+	return samples
+}
+
+// handleMetrics serves all metrics in the Prometheus text format
+func (s *Server) handleMetrics(c *gin.Context) {
+	s.metrics.registry.Handler().ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,213 @@
+package cloud
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HTTP middleware of http rules: source filters and authentication in front
+// of the target, rewriting of the requests sent to it and access logs.
+
+// setHTTPAuth sets the basic auth credentials and bearer token protecting
+// an http rule, keeping only hashes of the secrets: bcrypt for the
+// password, like user passwords, and a salted hash for the random bearer
+// token. Empty values leave the rule open.
+func (r *ForwardRule) setHTTPAuth(user, password, bearer string) error {
+	r.BasicAuthUser, r.BasicAuthHash, r.BearerHash, r.AuthSalt = "", "", "", ""
+	if user != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		r.BasicAuthUser = user
+		r.BasicAuthHash = string(hash)
+	}
+	if bearer != "" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		r.AuthSalt = hex.EncodeToString(salt)
+		r.BearerHash = hashTokenSecret(r.AuthSalt, bearer)
+	}
+	return nil
+}
+
+// requiresHTTPAuth reports whether requests to an http rule must be
+// authenticated
+func (r *ForwardRule) requiresHTTPAuth() bool {
+	return r.BasicAuthHash != "" || r.BearerHash != ""
+}
+
+// authorizeHTTP reports whether a request presents the basic auth
+// credentials or the bearer token of an http rule
+func (r *ForwardRule) authorizeHTTP(req *http.Request) bool {
+	if r.BasicAuthHash != "" {
+		if user, password, ok := req.BasicAuth(); ok {
+			userOK := secureCompare(user, r.BasicAuthUser)
+			passwordOK := bcrypt.CompareHashAndPassword([]byte(r.BasicAuthHash), []byte(password)) == nil
+			if userOK && passwordOK {
+				return true
+			}
+		}
+	}
+	if r.BearerHash != "" {
+		header := req.Header.Get("Authorization")
+		if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+			return secureCompare(hashTokenSecret(r.AuthSalt, strings.TrimSpace(header[7:])), r.BearerHash)
+		}
+	}
+	return false
+}
+
+// rewriteHTTPRequest applies an http rule's rewrites to a request for its
+// target
+func rewriteHTTPRequest(rule *ForwardRule, pr *httputil.ProxyRequest) {
+	// The credentials were for the cloud, not the target
+	if rule.requiresHTTPAuth() {
+		pr.Out.Header.Del("Authorization")
+	}
+	if rule.HostRewrite != "" {
+		pr.Out.Host = rule.HostRewrite
+	}
+	if rule.ForwardedFor {
+		// Replaces the X-Forwarded-* headers of the client, which can't be
+		// trusted
+		pr.SetXForwarded()
+	}
+	for name, value := range rule.RequestHeaders {
+		if value == "" {
+			pr.Out.Header.Del(name)
+		} else {
+			pr.Out.Header.Set(name, value)
+		}
+	}
+}
+
+// validateRequestHeaders checks the request headers of an http rule. Host
+// is set with the host rewrite instead.
+func validateRequestHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.EqualFold(name, "Host") {
+			return fmt.Errorf("use hostRewrite to change the Host header")
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value of header %s", name)
+		}
+	}
+	return nil
+}
+
+// serveHTTP serves a request routed to an http rule through the rule's
+// middleware
+func (f *Forwarder) serveHTTP(state *ForwardRuleState, w http.ResponseWriter, r *http.Request) {
+	rule := state.Rule
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w}
+
+	clientAddr, _ := netip.ParseAddrPort(r.RemoteAddr)
+	if !f.admitSource(state, clientAddr.Addr()) {
+		http.Error(rec, "Forbidden", http.StatusForbidden)
+	} else if rule.requiresHTTPAuth() && !rule.authorizeHTTP(r) {
+		if rule.BasicAuthHash != "" {
+			rec.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", rule.Name))
+		}
+		if rule.BearerHash != "" {
+			rec.Header().Add("WWW-Authenticate", "Bearer")
+		}
+		http.Error(rec, "Unauthorized", http.StatusUnauthorized)
+	} else {
+		state.HTTPProxy.ServeHTTP(rec, r)
+	}
+
+	if rule.AccessLog {
+		f.logHTTPRequest(rule, r, rec, time.Since(start))
+	}
+}
+
+// logHTTPRequest logs a request served by an http rule and publishes it as
+// an http.request event
+func (f *Forwarder) logHTTPRequest(rule *ForwardRule, r *http.Request, rec *responseRecorder, latency time.Duration) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	status := rec.status
+	if status == 0 {
+		// Nothing was written, net/http answers 200
+		status = http.StatusOK
+	}
+
+	data := &HTTPRequestEventData{
+		RuleID:    rule.ID,
+		Rule:      rule.Name,
+		ClientIP:  clientIP,
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		Status:    status,
+		Bytes:     rec.bytes,
+		LatencyMs: math.Round(float64(latency.Microseconds())/10) / 100,
+	}
+	log.Printf("HTTP access rule=%s client=%s method=%s host=%s path=%q status=%d bytes=%d latency=%s",
+		rule.Name, clientIP, r.Method, r.Host, r.URL.Path, status, rec.bytes, latency.Round(time.Microsecond))
+	f.server.events.Publish(&Event{
+		Type: EventHTTPRequest,
+		Data: data,
+		rule: rule,
+	})
+}
+
+// responseRecorder records the status and body size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	// 1xx responses precede the final one
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack takes over the connection of an upgraded request, such as a
+// WebSocket, whose 101 response the proxy writes itself
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
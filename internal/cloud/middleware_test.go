@@ -0,0 +1,63 @@
+package cloud
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHTTPAuth(t *testing.T) {
+	rule := &ForwardRule{}
+	if err := rule.setHTTPAuth("ops", "change-me", "ci-secret"); err != nil {
+		t.Fatal(err)
+	}
+	// The password is kept as a bcrypt hash, like user passwords
+	if cost, err := bcrypt.Cost([]byte(rule.BasicAuthHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("basic auth hash %q: cost %d, %v", rule.BasicAuthHash, cost, err)
+	}
+	if strings.Contains(rule.BasicAuthHash+rule.BearerHash, "change-me") || strings.Contains(rule.BearerHash, "ci-secret") {
+		t.Fatal("secret stored in the clear")
+	}
+
+	tests := []struct {
+		name  string
+		set   func(r *http.Request)
+		allow bool
+	}{
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("ops", "change-me") }, true},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "bearer ci-secret") }, true},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("ops", "change-it") }, false},
+		{"wrong user", func(r *http.Request) { r.SetBasicAuth("dev", "change-me") }, false},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ci-secrets") }, false},
+		{"password as token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer change-me") }, false},
+		{"none", func(r *http.Request) {}, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		tt.set(req)
+		if got := rule.authorizeHTTP(req); got != tt.allow {
+			t.Errorf("%s: authorized %v, want %v", tt.name, got, tt.allow)
+		}
+	}
+
+	// Basic auth alone
+	if err := rule.setHTTPAuth("ops", "change-me", ""); err != nil {
+		t.Fatal(err)
+	}
+	if rule.BearerHash != "" || rule.AuthSalt != "" || !rule.requiresHTTPAuth() {
+		t.Fatalf("bearer token left set: %+v", rule)
+	}
+
+	// bcrypt takes passwords of up to 72 bytes
+	if err := rule.setHTTPAuth("ops", strings.Repeat("x", 73), ""); !errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		t.Fatalf("73 byte password: %v", err)
+	}
+
+	if err := rule.setHTTPAuth("", "", ""); err != nil || rule.requiresHTTPAuth() {
+		t.Fatalf("cleared auth still required: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package cloud
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+// proxyHeaderTimeout bounds the wait for the PROXY header of a connection
+// from a trusted load balancer
+const proxyHeaderTimeout = 10 * time.Second
+
+// parseProxyFrom parses the addresses and CIDRs whose connections start
+// with a PROXY header
+func parseProxyFrom(entries []string) ([]netip.Prefix, error) {
+	prefixes, err := parsePrefixes(entries)
+	if err != nil {
+		return nil, fmt.Errorf("PROXY protocol sources: %w", err)
+	}
+	return prefixes, nil
+}
+
+// listenTCP listens on a TCP address of the cloud. Connections from the
+// trusted load balancers must start with a PROXY header, which gives them
+// the client's address as RemoteAddr.
+func (s *Server) listenTCP(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || len(s.proxyFrom) == 0 {
+		return listener, err
+	}
+
+	proxied := &proxyListener{
+		connListener: newConnListener(listener.Addr()),
+		inner:        listener,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("Accept error on %s: %v", addr, err)
+				continue
+			}
+			if !s.trustsProxy(conn.RemoteAddr()) {
+				go proxied.deliver(conn)
+				continue
+			}
+			// Reading the header must not hold up other connections
+			go func() {
+				if conn, err := readProxyConn(conn); err == nil {
+					proxied.deliver(conn)
+				}
+			}()
+		}
+	}()
+	return proxied, nil
+}
+
+// trustsProxy reports whether connections from addr start with a PROXY
+// header
+func (s *Server) trustsProxy(addr net.Addr) bool {
+	ip := protocol.AddrPortOf(addr).Addr().Unmap()
+	for _, prefix := range s.proxyFrom {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyConn reads the PROXY header of a connection from a trusted load
+// balancer. Connections without a valid header are closed.
+func readProxyConn(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	r := bufio.NewReader(conn)
+	src, dst, err := protocol.ReadProxyHeader(r)
+	if err != nil {
+		log.Printf("PROXY header from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	proxied := &proxiedConn{Conn: conn, r: r, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	// UNKNOWN and LOCAL headers keep the load balancer's addresses
+	if src.IsValid() {
+		proxied.remote = net.TCPAddrFromAddrPort(src)
+		proxied.local = net.TCPAddrFromAddrPort(dst)
+	}
+	return proxied, nil
+}
+
+// proxyListener accepts the connections of listenTCP once their PROXY
+// header is read
+type proxyListener struct {
+	*connListener
+	inner net.Listener
+}
+
+func (l *proxyListener) Close() error {
+	l.connListener.Close()
+	return l.inner.Close()
+}
+
+// proxiedConn is a connection whose addresses came in a PROXY header
+type proxiedConn struct {
+	net.Conn
+	r             io.Reader // Data read past the header
+	remote, local net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxiedConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxiedConn) LocalAddr() net.Addr        { return c.local }
+
+// ruleProxyProtocol returns the PROXY protocol version a running rule
+// sends its target
+func (f *Forwarder) ruleProxyProtocol(ruleID string) protocol.ProxyProtocol {
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+	state, ok := f.rules[ruleID]
+	if !ok {
+		return protocol.ProxyProtocolNone
+	}
+	version, _ := protocol.ParseProxyProtocol(state.Rule.ProxyProtocol)
+	return version
+}
+
+// writeProxyHeader starts a connection the cloud opened to a rule's target
+// with a PROXY header for the client at src, if the rule asks for one
+func writeProxyHeader(version protocol.ProxyProtocol, target net.Conn, src netip.AddrPort, dst net.Addr) error {
+	if version == protocol.ProxyProtocolNone {
+		return nil
+	}
+	_, err := target.Write(protocol.ProxyHeader(version, src, protocol.AddrPortOf(dst)))
+	return err
+}
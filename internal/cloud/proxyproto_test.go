@@ -0,0 +1,71 @@
+package cloud
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+func TestAgentClientIP(t *testing.T) {
+	s := newTestServer(t)
+	var err error
+	if s.proxyFrom, err = parseProxyFrom([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := s.listenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: s.router}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	// The load balancer gives the client's address in a PROXY header, the
+	// client claims another one in X-Forwarded-For
+	dialer := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write([]byte("PROXY TCP4 203.0.113.9 127.0.0.1 40000 8080\r\n")); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+	header := http.Header{"X-Forwarded-For": {"198.51.100.7"}, "X-Real-Ip": {"198.51.100.7"}}
+	conn, _, err := dialer.Dial("ws://"+listener.Addr().String()+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := protocol.NewAuthMessage(&protocol.AuthPayload{Token: "wrong", AgentID: "agent-1", AgentName: "web"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	// The rejection is audited before the response is sent
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, _, err := s.store.GetAuditEvents(AuditFilter{Action: AuditAgentReject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d rejections audited, want 1", len(events))
+	}
+	if events[0].ClientIP != "203.0.113.9" {
+		t.Fatalf("rejection audited from %q, want 203.0.113.9", events[0].ClientIP)
+	}
+}
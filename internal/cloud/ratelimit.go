@@ -14,6 +14,7 @@ type RateLimiter struct {
 	maxTokens      int64
 	lastRefill     time.Time
 	mu             sync.Mutex
+	waited         int64 // atomic, total nanoseconds spent blocked in Wait
 }
 
 // NewRateLimiter creates a new rate limiter
@@ -60,9 +61,18 @@ func (r *RateLimiter) Wait(n int64) {
 		
 		// Sleep and retry
 		time.Sleep(waitTime)
+		atomic.AddInt64(&r.waited, int64(waitTime))
 	}
 }
 
+// WaitTime returns the total time callers have been blocked in Wait
+func (r *RateLimiter) WaitTime() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&r.waited))
+}
+
 func (r *RateLimiter) refill() {
 	now := time.Now()
 	elapsed := now.Sub(r.lastRefill)
@@ -0,0 +1,184 @@
+package cloud
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role is a dashboard/API permission level
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // Read-only access to stats, agents and rules
+	RoleOperator Role = "operator" // Viewer + enable/disable forward rules
+	RoleAdmin    Role = "admin"    // Full access, including tokens, users and API keys
+)
+
+// APIKeyPrefix marks API keys so they can be told apart from session tokens
+const APIKeyPrefix = "nsk_"
+
+// Principal kinds
+const (
+	PrincipalServerToken = "server-token"
+	PrincipalSession     = "session"
+	PrincipalAPIKey      = "api-key"
+)
+
+const ctxKeyPrincipal = "auth.principal"
+
+// Principal is the authenticated caller of an API request
+type Principal struct {
+	Kind       string
+	Name       string
+	Role       Role
+	AgentScope string // Non-empty restricts the caller to one agent (name or ID)
+	// ID and name of the scoped agent, as rules refer to agents by either
+	scopeAgent []string
+}
+
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	return r.level() > 0
+}
+
+// Allows reports whether r grants at least the required role
+func (r Role) Allows(required Role) bool {
+	return r.level() >= required.level()
+}
+
+// CanAccessAgent reports whether the principal may see or act on an agent
+func (p *Principal) CanAccessAgent(idOrName ...string) bool {
+	if p == nil || p.AgentScope == "" {
+		return true
+	}
+	for _, v := range idOrName {
+		if p.inScope(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessRule reports whether the principal may see or act on a rule.
+// A scoped principal can only touch rules whose source or target is its agent.
+func (p *Principal) CanAccessRule(rule *ForwardRule) bool {
+	if p == nil || p.AgentScope == "" {
+		return true
+	}
+	return p.inScope(rule.SourceAgentID) || p.inScope(rule.TargetAgentID)
+}
+
+// inScope reports whether an agent ID or name refers to the scoped agent
+func (p *Principal) inScope(idOrName string) bool {
+	return idOrName != "" && (idOrName == p.AgentScope || slices.Contains(p.scopeAgent, idOrName))
+}
+
+// resolveAgentScope returns the ID and name of the agent a scope names by
+// either, looking it up like rule targets: connected agents by name, then
+// by ID, then agents that were seen before. Unknown agents resolve to nil.
+func (s *Server) resolveAgentScope(scope string) []string {
+	if scope == "" {
+		return nil
+	}
+	agent := s.GetAgentByName(scope)
+	if agent == nil {
+		agent = s.GetAgent(scope)
+	}
+	if agent != nil {
+		return []string{agent.ID, agent.Name}
+	}
+	records, err := s.store.GetAgentRecords()
+	if err != nil {
+		return nil
+	}
+	for _, r := range records {
+		if r.Name == scope || r.ID == scope {
+			return []string{r.ID, r.Name}
+		}
+	}
+	return nil
+}
+
+// principalFrom returns the principal set by authMiddleware
+func principalFrom(c *gin.Context) *Principal {
+	if v, ok := c.Get(ctxKeyPrincipal); ok {
+		if p, ok := v.(*Principal); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// requireRole rejects requests whose principal lacks the required role
+func requireRole(required Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := principalFrom(c)
+		if p == nil {
+			abortUnauthorized(c, "Authentication required")
+			return
+		}
+		if !p.Role.Allows(required) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Requires " + string(required) + " role",
+				"code":  "forbidden",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// generateAPIKey returns a new API key, its visible prefix and its hash
+func generateAPIKey() (key, prefix, hash string, err error) {
+	buf := make([]byte, 20)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", "", err
+	}
+	key = APIKeyPrefix + hex.EncodeToString(buf)
+	prefix = key[:len(APIKeyPrefix)+8]
+	return key, prefix, hashAPIKey(key), nil
+}
+
+// hashAPIKey hashes a high-entropy API key for storage and lookup
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIKey resolves an API key credential to a principal
+func (s *Server) lookupAPIKey(key string) *Principal {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil
+	}
+	k, err := s.store.GetAPIKeyByHash(hashAPIKey(key))
+	if err != nil {
+		return nil
+	}
+	s.store.TouchAPIKey(k.ID)
+	return &Principal{
+		Kind:       PrincipalAPIKey,
+		Name:       k.Name,
+		Role:       k.Role,
+		AgentScope: k.AgentScope,
+		scopeAgent: s.resolveAgentScope(k.AgentScope),
+	}
+}
@@ -0,0 +1,102 @@
+package cloud
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCanAccessRuleScope(t *testing.T) {
+	s := newTestServer(t)
+	addTestAgent(s, "agent-1", "web")
+	// An agent that is offline, known from an earlier connection
+	if err := s.store.UpsertAgentRecord(&AgentRecord{ID: "agent-2", Name: "db", LastSeen: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rules name their agents by name or by ID
+	rules := map[string]*ForwardRule{
+		"to web by name":      {ID: "r1", SourceAgentID: "", TargetAgentID: "web"},
+		"from web to db":      {ID: "r2", SourceAgentID: "agent-1", TargetAgentID: "db"},
+		"to db by ID":         {ID: "r3", TargetAgentID: "agent-2"},
+		"between other hosts": {ID: "r4", SourceAgentID: "cache", TargetAgentID: "agent-9"},
+	}
+	tests := []struct {
+		scope   string
+		visible []string
+	}{
+		{"", []string{"to web by name", "from web to db", "to db by ID", "between other hosts"}},
+		{"agent-1", []string{"to web by name", "from web to db"}},
+		{"web", []string{"to web by name", "from web to db"}},
+		{"agent-2", []string{"from web to db", "to db by ID"}},
+		{"db", []string{"from web to db", "to db by ID"}},
+		// Agents never seen match rules naming them as scoped
+		{"agent-9", []string{"between other hosts"}},
+		{"ghost", nil},
+	}
+	for _, tt := range tests {
+		key, prefix, hash, err := generateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.store.CreateAPIKey(&APIKey{ID: "key-" + tt.scope, Name: tt.scope, KeyHash: hash, Prefix: prefix, Role: RoleOperator, AgentScope: tt.scope}); err != nil {
+			t.Fatal(err)
+		}
+		p := s.lookupAPIKey(key)
+		if p == nil {
+			t.Fatalf("scope %q: key not found", tt.scope)
+		}
+
+		want := make(map[string]bool)
+		for _, name := range tt.visible {
+			want[name] = true
+		}
+		for name, rule := range rules {
+			if got := p.CanAccessRule(rule); got != want[name] {
+				t.Errorf("scope %q, rule %s: access %v, want %v", tt.scope, name, got, want[name])
+			}
+		}
+
+		// Agents are matched the same way
+		if tt.scope == "web" && (!p.CanAccessAgent("agent-1") || p.CanAccessAgent("agent-2", "db")) {
+			t.Errorf("scope %q: access to agents by ID", tt.scope)
+		}
+	}
+}
+
+func TestUserChangesReachSessions(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Token = "server-token"
+	addTestUser(t, s, "u1", "ops", RoleAdmin)
+	addTestUser(t, s, "u2", "dev", RoleAdmin)
+	token := login(t, s, "ops", "change-me")
+	other := login(t, s, "dev", "change-me")
+
+	if rec := apiRequest(s, http.MethodGet, "/api/users", token, ""); rec.Code != http.StatusOK {
+		t.Fatalf("admin session: status %d", rec.Code)
+	}
+
+	// A demoted user loses the admin endpoints at once
+	if rec := apiRequest(s, http.MethodPatch, "/api/users/u1", "server-token", `{"role":"viewer"}`); rec.Code != http.StatusOK {
+		t.Fatalf("demotion: status %d %s", rec.Code, rec.Body)
+	}
+	if rec := apiRequest(s, http.MethodGet, "/api/users", token, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("admin endpoint after the demotion: status %d", rec.Code)
+	}
+	if rec := apiRequest(s, http.MethodGet, "/api/stats", token, ""); rec.Code != http.StatusOK {
+		t.Fatalf("viewer endpoint after the demotion: status %d", rec.Code)
+	}
+
+	// A deleted user's sessions end
+	if rec := apiRequest(s, http.MethodDelete, "/api/users/u1", "server-token", ""); rec.Code != http.StatusOK {
+		t.Fatalf("deletion: status %d", rec.Code)
+	}
+	if rec := apiRequest(s, http.MethodGet, "/api/stats", token, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("session after the deletion: status %d", rec.Code)
+	}
+
+	// Other users' sessions are left alone
+	if rec := apiRequest(s, http.MethodGet, "/api/users", other, ""); rec.Code != http.StatusOK {
+		t.Fatalf("other user's session: status %d", rec.Code)
+	}
+}
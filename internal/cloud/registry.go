@@ -0,0 +1,218 @@
+package cloud
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+// Agent identity errors, sent back to the agent in auth responses
+var (
+	ErrAgentSignatureInvalid = errors.New("Invalid agent identity signature")
+	ErrAgentSignatureReused  = errors.New("Agent identity signature was already used")
+	ErrAgentIdentityMismatch = errors.New("Agent ID is enrolled with a different identity")
+	ErrAgentNameTaken        = errors.New("Agent name is registered to a different identity")
+)
+
+// authSignatureMaxSkew bounds the clock difference accepted on signed auth
+const authSignatureMaxSkew = 5 * time.Minute
+
+// seenSignatures remembers the signatures of accepted agent auths while
+// their timestamps are within the accepted skew, so that a captured auth
+// message can't be replayed to connect as the agent
+type seenSignatures struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // Signature -> when its timestamp expires
+}
+
+// add records a signature until it expires, reporting false if it was
+// already recorded
+func (c *seenSignatures) add(signature []byte, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for sig, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, sig)
+		}
+	}
+	if _, ok := c.seen[string(signature)]; ok {
+		return false
+	}
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	c.seen[string(signature)] = expires
+	return true
+}
+
+// verifyAgentIdentity checks the identity proof of an authenticating agent
+// against the registry and returns its base64 public key. Each signature is
+// accepted once. Agents that send no key (older versions) are accepted
+// unless they claim an enrolled ID or name.
+func (s *Server) verifyAgentIdentity(p *protocol.AuthPayload, agentID string) (string, error) {
+	var publicKey string
+	if len(p.PublicKey) > 0 {
+		if len(p.PublicKey) != ed25519.PublicKeySize || p.AgentID != agentID {
+			return "", ErrAgentSignatureInvalid
+		}
+		skew := time.Since(time.Unix(p.Timestamp, 0))
+		if skew < 0 {
+			skew = -skew
+		}
+		msg := protocol.AuthSigningMessage(p.AgentID, p.AgentName, p.Timestamp)
+		if skew > authSignatureMaxSkew || !ed25519.Verify(p.PublicKey, msg, p.Signature) {
+			return "", ErrAgentSignatureInvalid
+		}
+		if !s.authSignatures.add(p.Signature, time.Unix(p.Timestamp, 0).Add(authSignatureMaxSkew)) {
+			return "", ErrAgentSignatureReused
+		}
+		publicKey = base64.StdEncoding.EncodeToString(p.PublicKey)
+	}
+
+	rec, err := s.store.GetAgentRecord(agentID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if err == nil && rec.PublicKey != "" && rec.PublicKey != publicKey {
+		return "", ErrAgentIdentityMismatch
+	}
+
+	if p.AgentName != "" {
+		rec, err := s.store.GetEnrolledAgentByName(p.AgentName)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		if err == nil && rec.ID != agentID {
+			return "", ErrAgentNameTaken
+		}
+	}
+
+	return publicKey, nil
+}
+
+// newRuleAuthNonce returns a nonce for an agent connection, which the
+// agent signs to open rule connections
+func newRuleAuthNonce() []byte {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return nonce
+}
+
+// verifyRuleAuth checks that a rule connection comes from the identity of
+// the agent's main connection: the agent signs the nonce issued there with
+// its identity key. Each signature is accepted once. Agents without a key
+// authenticate rule connections with their token alone, as their main one.
+func (s *Server) verifyRuleAuth(agent *AgentConn, p *protocol.RuleAuthPayload) error {
+	if agent.PublicKey == "" {
+		return nil
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(agent.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return ErrAgentSignatureInvalid
+	}
+	skew := time.Since(time.Unix(p.Timestamp, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	msg := protocol.RuleAuthSigningMessage(agent.ID, p.RuleID, agent.ruleAuthNonce, p.Timestamp)
+	if skew > authSignatureMaxSkew || !ed25519.Verify(publicKey, msg, p.Signature) {
+		return ErrAgentSignatureInvalid
+	}
+	if !s.authSignatures.add(p.Signature, time.Unix(p.Timestamp, 0).Add(authSignatureMaxSkew)) {
+		return ErrAgentSignatureReused
+	}
+	return nil
+}
+
+// registerAgent records a newly authenticated agent in the persistent registry
+func (s *Server) registerAgent(agent *AgentConn) {
+	now := time.Now()
+	err := s.store.UpsertAgentRecord(&AgentRecord{
+		ID:        agent.ID,
+		Name:      agent.Name,
+		LastIP:    agent.IP,
+		Version:   agent.Version,
+		OS:        agent.OS,
+		Arch:      agent.Arch,
+		Labels:    agent.Labels,
+		PublicKey: agent.PublicKey,
+		FirstSeen: now,
+		LastSeen:  now,
+	})
+	if err != nil {
+		log.Printf("Failed to record agent %s: %v", agent.ID, err)
+	}
+}
+
+// flushAgentStats persists the agent's last seen time and the traffic it
+// carried since the previous flush
+func (s *Server) flushAgentStats(agent *AgentConn) {
+	agent.statsMu.Lock()
+	defer agent.statsMu.Unlock()
+
+	tx, rx := agent.TxBytes, agent.RxBytes
+	if err := s.store.AddAgentTraffic(agent.ID, agent.LastHeartbeat, tx-agent.flushedTx, rx-agent.flushedRx); err != nil {
+		log.Printf("Failed to update agent %s stats: %v", agent.ID, err)
+		return
+	}
+	agent.flushedTx, agent.flushedRx = tx, rx
+}
+
+// unflushedTraffic returns the traffic not yet added to the agent's record
+func (a *AgentConn) unflushedTraffic() (tx, rx int64) {
+	a.statsMu.Lock()
+	defer a.statsMu.Unlock()
+	return a.TxBytes - a.flushedTx, a.RxBytes - a.flushedRx
+}
+
+// newAgentResponse merges an agent's registry record with its live
+// connection. Either may be nil, but not both.
+func newAgentResponse(rec *AgentRecord, agent *AgentConn) AgentResponse {
+	var resp AgentResponse
+	if rec != nil {
+		resp = AgentResponse{
+			ID:        rec.ID,
+			Name:      rec.Name,
+			IP:        rec.LastIP,
+			Version:   rec.Version,
+			OS:        rec.OS,
+			Arch:      rec.Arch,
+			Labels:    rec.Labels,
+			FirstSeen: rec.FirstSeen.Format("2006-01-02T15:04:05Z"),
+			LastSeen:  rec.LastSeen.Format("2006-01-02T15:04:05Z"),
+			TxBytes:   rec.TxBytes,
+			RxBytes:   rec.RxBytes,
+		}
+	}
+	if agent == nil {
+		return resp
+	}
+
+	tx, rx := agent.unflushedTraffic()
+	resp.ID = agent.ID
+	resp.Name = agent.Name
+	resp.IP = agent.IP
+	resp.Version = agent.Version
+	resp.OS = agent.OS
+	resp.Arch = agent.Arch
+	resp.Labels = agent.Labels
+	resp.Online = true
+	resp.LastSeen = agent.LastHeartbeat.Format("2006-01-02T15:04:05Z")
+	resp.ActiveTunnels = agent.ActiveTunnels
+	resp.ProtocolVersion = agent.ProtocolVersion
+	resp.Capabilities = agent.Capabilities.Names()
+	resp.TxBytes += tx
+	resp.RxBytes += rx
+	if resp.FirstSeen == "" {
+		resp.FirstSeen = agent.ConnectedAt.Format("2006-01-02T15:04:05Z")
+	}
+	return resp
+}
@@ -0,0 +1,79 @@
+package cloud
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+func TestVerifyAgentIdentity(t *testing.T) {
+	s := newTestServer(t)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func(ts int64) *protocol.AuthPayload {
+		return &protocol.AuthPayload{
+			AgentID:   "agent-1",
+			AgentName: "web",
+			PublicKey: public,
+			Signature: ed25519.Sign(private, protocol.AuthSigningMessage("agent-1", "web", ts)),
+			Timestamp: ts,
+		}
+	}
+
+	now := time.Now().Unix()
+	auth := signed(now)
+	if _, err := s.verifyAgentIdentity(auth, "agent-1"); err != nil {
+		t.Fatal(err)
+	}
+	// A captured auth can't be used again
+	if _, err := s.verifyAgentIdentity(auth, "agent-1"); !errors.Is(err, ErrAgentSignatureReused) {
+		t.Fatalf("replayed auth: %v, want ErrAgentSignatureReused", err)
+	}
+	// The agent signs every connection anew
+	if _, err := s.verifyAgentIdentity(signed(now+2), "agent-1"); err != nil {
+		t.Fatalf("next connection: %v", err)
+	}
+
+	// Timestamps outside the skew are refused, so the signatures seen need
+	// not be kept longer
+	for _, ts := range []int64{now - 301, now + 301} {
+		if _, err := s.verifyAgentIdentity(signed(ts), "agent-1"); !errors.Is(err, ErrAgentSignatureInvalid) {
+			t.Errorf("timestamp %+ds: %v, want ErrAgentSignatureInvalid", ts-now, err)
+		}
+	}
+	other := signed(now + 4)
+	other.AgentName = "db"
+	if _, err := s.verifyAgentIdentity(other, "agent-1"); !errors.Is(err, ErrAgentSignatureInvalid) {
+		t.Errorf("auth for another name: %v, want ErrAgentSignatureInvalid", err)
+	}
+	if _, err := s.verifyAgentIdentity(signed(now+6), "agent-2"); !errors.Is(err, ErrAgentSignatureInvalid) {
+		t.Errorf("auth for another ID: %v, want ErrAgentSignatureInvalid", err)
+	}
+}
+
+func TestSeenSignatures(t *testing.T) {
+	var c seenSignatures
+	if !c.add([]byte("a"), time.Now().Add(time.Minute)) {
+		t.Fatal("first signature refused")
+	}
+	if c.add([]byte("a"), time.Now().Add(time.Minute)) {
+		t.Fatal("signature accepted twice")
+	}
+
+	// Expired signatures are forgotten
+	c.add([]byte("b"), time.Now().Add(-time.Second))
+	if !c.add([]byte("b"), time.Now().Add(time.Minute)) {
+		t.Fatal("expired signature still remembered")
+	}
+	c.seen["a"] = time.Now().Add(-time.Second)
+	c.add([]byte("c"), time.Now().Add(time.Minute))
+	if _, ok := c.seen["a"]; ok || len(c.seen) != 2 {
+		t.Fatalf("remembered %d signatures after expiry", len(c.seen))
+	}
+}
@@ -0,0 +1,259 @@
+package cloud
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+const (
+	// endpointTTL is how long a registered UDP endpoint is trusted without
+	// the agent binding again. Agents rebind well within it, which also
+	// keeps their NAT mapping open.
+	endpointTTL = 2 * time.Minute
+	// maxLocalEndpoints bounds the local endpoints an agent may register
+	maxLocalEndpoints = 8
+)
+
+// Rendezvous is the UDP listener agents register their endpoints with, so
+// the cloud can introduce them to each other for hole punching
+type Rendezvous struct {
+	server *Server
+	conn   *net.UDPConn
+	tokens map[string]*AgentConn // Bind token -> agent
+	mu     sync.RWMutex
+}
+
+// udpEndpoints holds the UDP endpoints an agent registered
+type udpEndpoints struct {
+	mu       sync.Mutex
+	observed string   // As seen by the rendezvous listener
+	local    []string // As reported by the agent, for peers on the same network
+	boundAt  time.Time
+}
+
+// NewRendezvous listens for bind packets on a UDP address
+func NewRendezvous(server *Server, addr string) (*Rendezvous, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Rendezvous{
+		server: server,
+		conn:   conn,
+		tokens: make(map[string]*AgentConn),
+	}, nil
+}
+
+// Run answers bind packets until the listener is closed
+func (r *Rendezvous) Run() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkt, err := protocol.DecodePunchPacket(buf[:n])
+		if err != nil || pkt.Type != protocol.PunchBind {
+			continue
+		}
+
+		r.mu.RLock()
+		agent := r.tokens[string(pkt.Token)]
+		r.mu.RUnlock()
+		if agent == nil {
+			continue
+		}
+
+		local := pkt.Endpoints
+		if len(local) > maxLocalEndpoints {
+			local = local[:maxLocalEndpoints]
+		}
+		agent.udp.mu.Lock()
+		if agent.udp.observed != addr.String() {
+			log.Printf("Agent %s registered UDP endpoint %s (local %v)", agent.Name, addr, local)
+		}
+		agent.udp.observed = addr.String()
+		agent.udp.local = local
+		agent.udp.boundAt = time.Now()
+		agent.udp.mu.Unlock()
+
+		r.conn.WriteToUDP(protocol.EncodePunchPacket(&protocol.PunchPacket{
+			Type:      protocol.PunchBound,
+			Endpoints: []string{addr.String()},
+		}), addr)
+	}
+}
+
+// Close stops the listener
+func (r *Rendezvous) Close() {
+	r.conn.Close()
+}
+
+// Register hands an agent a bind token and tells it where to bind
+func (r *Rendezvous) Register(agent *AgentConn) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(buf)
+
+	r.mu.Lock()
+	r.tokens[token] = agent
+	r.mu.Unlock()
+	agent.udpToken = token
+
+	msg := protocol.NewMessage(protocol.MsgTypeRendezvous, 0, protocol.EncodeRendezvousPayload(&protocol.RendezvousPayload{
+		Addr:  r.advertisedAddr(),
+		Token: []byte(token),
+	}))
+	return r.server.sendToAgent(agent, msg)
+}
+
+// Unregister forgets a disconnected agent's token
+func (r *Rendezvous) Unregister(agent *AgentConn) {
+	r.mu.Lock()
+	if r.tokens[agent.udpToken] == agent {
+		delete(r.tokens, agent.udpToken)
+	}
+	r.mu.Unlock()
+}
+
+// advertisedAddr is the listener's address as agents should reach it. An
+// unspecified host is left empty, agents then use the cloud's host.
+func (r *Rendezvous) advertisedAddr() string {
+	addr := r.conn.LocalAddr().(*net.UDPAddr)
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return fmt.Sprintf(":%d", addr.Port)
+	}
+	return addr.String()
+}
+
+// endpoints returns the agent's registered UDP endpoints, the observed one
+// first, or nil if it has not bound recently
+func (a *AgentConn) endpoints() []string {
+	a.udp.mu.Lock()
+	defer a.udp.mu.Unlock()
+
+	if a.udp.observed == "" || time.Since(a.udp.boundAt) > endpointTTL {
+		return nil
+	}
+	eps := []string{a.udp.observed}
+	for _, ep := range a.udp.local {
+		if ep != a.udp.observed {
+			eps = append(eps, ep)
+		}
+	}
+	return eps
+}
+
+// handlePunchRequest introduces the source agent of an agent-to-agent rule
+// and the rule's target agent to each other, so they can try to reach each
+// other directly. Failures are reported to the source, whose tunnels stay
+// on the relay.
+func (s *Server) handlePunchRequest(source *AgentConn, msg *protocol.Message) {
+	req, err := protocol.DecodePunchRequestPayload(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode punch request from agent %s: %v", source.ID, err)
+		return
+	}
+
+	target, err := s.punchTarget(source, req.RuleID)
+	var sourceEndpoints, targetEndpoints []string
+	var sourceKey, targetKey []byte
+	if err == nil {
+		sourceEndpoints, targetEndpoints = source.endpoints(), target.endpoints()
+		sourceKey, targetKey = agentIdentityKey(source), agentIdentityKey(target)
+		switch {
+		case len(sourceEndpoints) == 0:
+			err = fmt.Errorf("agent %s has no registered UDP endpoint", source.Name)
+		case len(targetEndpoints) == 0:
+			err = fmt.Errorf("agent %s has no registered UDP endpoint", target.Name)
+		case sourceKey == nil || targetKey == nil:
+			err = fmt.Errorf("direct paths need agents with identity keys")
+		}
+	}
+	if err != nil {
+		log.Printf("Punch request from agent %s for rule %s refused: %v", source.Name, req.RuleID, err)
+		s.sendToAgent(source, protocol.NewMessage(protocol.MsgTypePunch, 0, protocol.EncodePunchPayload(&protocol.PunchPayload{
+			PeerAgentID: req.TargetAgentID,
+			Error:       err.Error(),
+		})))
+		return
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	session := hex.EncodeToString(buf)
+
+	s.sendToAgent(target, protocol.NewMessage(protocol.MsgTypePunch, 0, protocol.EncodePunchPayload(&protocol.PunchPayload{
+		Session:     session,
+		PeerAgentID: source.ID,
+		PeerKey:     sourceKey,
+		Endpoints:   sourceEndpoints,
+	})))
+	s.sendToAgent(source, protocol.NewMessage(protocol.MsgTypePunch, 0, protocol.EncodePunchPayload(&protocol.PunchPayload{
+		Session:     session,
+		PeerAgentID: req.TargetAgentID,
+		PeerKey:     targetKey,
+		Endpoints:   targetEndpoints,
+		Dial:        true,
+	})))
+	log.Printf("Punch session %s: %s %v <-> %s %v (rule %s)",
+		session, source.Name, sourceEndpoints, target.Name, targetEndpoints, req.RuleID)
+}
+
+// punchTarget returns the target agent of a rule the source agent may ask
+// a direct path for
+func (s *Server) punchTarget(source *AgentConn, ruleID string) (*AgentConn, error) {
+	if s.rendezvous == nil {
+		return nil, fmt.Errorf("rendezvous is not enabled")
+	}
+
+	s.forwarder.rulesMu.RLock()
+	state, ok := s.forwarder.rules[ruleID]
+	s.forwarder.rulesMu.RUnlock()
+	if !ok || !isAgentToAgent(state.Rule.Type) {
+		return nil, fmt.Errorf("no running agent-to-agent rule %s", ruleID)
+	}
+	rule := state.Rule
+	if rule.SourceAgentID != source.ID && rule.SourceAgentID != source.Name {
+		return nil, fmt.Errorf("agent is not the source of the rule")
+	}
+	if !ruleAllowsDirect(rule) {
+		return nil, fmt.Errorf("rule has traffic limits, enforced on the relay")
+	}
+
+	target := s.GetAgentByName(rule.TargetAgentID)
+	if target == nil {
+		target = s.GetAgent(rule.TargetAgentID)
+	}
+	switch {
+	case target == nil:
+		return nil, fmt.Errorf("target agent %s not connected", rule.TargetAgentID)
+	case target == source:
+		return nil, fmt.Errorf("target is the source agent")
+	case !source.AllowsRule(ruleID) || !target.AllowsRule(ruleID):
+		return nil, fmt.Errorf("rule not allowed by agent token")
+	case !target.Capabilities.Has(protocol.CapDirect):
+		return nil, fmt.Errorf("agent %s does not support %s", target.Name, protocol.CapDirect)
+	}
+	return target, nil
+}
+
+// ruleAllowsDirect reports whether a rule's tunnels may bypass the relay.
+// Rate and traffic limits are enforced on the relay, so limited rules stay
+// on it.
+func ruleAllowsDirect(rule *ForwardRule) bool {
+	return rule.RateLimit == 0 && rule.TrafficLimit == 0
+}
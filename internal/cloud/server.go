@@ -2,19 +2,26 @@ package cloud
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/natsvr/natsvr/internal/geoip"
 	"github.com/natsvr/natsvr/internal/protocol"
+	"github.com/natsvr/natsvr/internal/transport"
 )
 
 // WebFS is set by main package to embed frontend files
@@ -27,20 +34,86 @@ type Config struct {
 	DBPath  string
 	DevMode bool   // When true, proxy frontend to Vite dev server
 	DevURL  string // Vite dev server URL (default: http://localhost:5173)
+	// AdminUsers are named dashboard users (username -> password).
+	// The server token can always log in as "admin".
+	AdminUsers map[string]string
+	SessionTTL time.Duration // Dashboard session lifetime (default: 24h)
+	// RendezvousAddr is the UDP address agents register their endpoints
+	// with for direct agent-to-agent paths, empty = tunnels are relayed
+	RendezvousAddr string
+	// Listeners are the transports agents may connect over besides
+	// WebSocket, as URLs like quic://:8443, tls://:8444 or kcp://:8445
+	Listeners []string
+	// TransportCertFile and TransportKeyFile hold the certificate of those
+	// listeners. Default: a self-signed certificate next to the database,
+	// created on first start.
+	TransportCertFile string
+	TransportKeyFile  string
+	// AgentMTLS is "off" (default), "optional" or "required": whether the
+	// cloud issues client certificates to agents and requires them
+	AgentMTLS string
+	// ClientCACertFile and ClientCAKeyFile hold the CA that issues agent
+	// certificates. Default: a CA next to the database, created on first
+	// start.
+	ClientCACertFile string
+	ClientCAKeyFile  string
+	// TLSCertFile and TLSKeyFile make the HTTP server serve HTTPS with a
+	// static certificate
+	TLSCertFile string
+	TLSKeyFile  string
+	// ACMEDomains make the HTTP server serve HTTPS with certificates for
+	// these domains from an ACME CA, validated by TLS-ALPN-01 on Addr and,
+	// if ACMEHTTPAddr is set (e.g. ":80"), by HTTP-01 there
+	ACMEDomains   []string
+	ACMEEmail     string
+	ACMEDirectory string // Directory URL, default Let's Encrypt
+	ACMECAFile    string // PEM roots the directory is served with, for a private CA such as Pebble
+	ACMECacheDir  string // Account and certificates, default "acme" next to the database
+	ACMEHTTPAddr  string
+	// VHostAddr is a plain HTTP listener serving only http rules, e.g. ":80".
+	// They are served on Addr too, for the hosts they claim.
+	VHostAddr string
+	// SNIAddr is the TCP listener of tls-sni rules, e.g. ":443". With
+	// HTTPS, connections no rule serves go to the HTTP server, so it may
+	// be Addr itself.
+	SNIAddr string
+	// ProxyProtocolFrom lists the addresses and CIDRs of load balancers in
+	// front of the cloud. Their connections to its TCP listeners must start
+	// with a PROXY header, which gives the client's address.
+	ProxyProtocolFrom []string
+	// GeoIPDBFile is a MaxMind DB file with the countries of addresses,
+	// e.g. GeoLite2-Country.mmdb, for the country filters of rules
+	GeoIPDBFile string
 }
 
 // Server is the main cloud server
+
 type Server struct {
-	config     *Config
-	store      *Store
-	agents     map[string]*AgentConn
-	agentsMu   sync.RWMutex
-	forwarder  *Forwarder
-	router     *gin.Engine
-	httpServer *http.Server
-	upgrader   websocket.Upgrader
-	ctx        context.Context
-	cancel     context.CancelFunc
+	config      *Config
+	store       *Store
+	sessions    *SessionManager
+	agents      map[string]*AgentConn
+	agentsMu    sync.RWMutex
+	forwarder   *Forwarder
+	rendezvous  *Rendezvous // nil unless direct paths are enabled
+	listeners   []transport.Listener
+	clientCA    *ClientCA      // nil unless agent mTLS is enabled
+	acmeServer  *http.Server   // HTTP-01 challenges, nil unless enabled
+	vhostServer *http.Server   // http rules, nil unless VHostAddr is set
+	sniListener net.Listener   // tls-sni rules, nil unless SNIAddr is set
+	sniFallback *connListener  // TLS connections no tls-sni rule serves, for the HTTPS server
+	proxyFrom   []netip.Prefix // Load balancers sending PROXY headers
+	geoip       *geoip.DB      // nil unless GeoIPDBFile is set
+	metrics     *serverMetrics
+	events      *EventBus
+	router      *gin.Engine
+	httpServer  *http.Server
+	upgrader    websocket.Upgrader
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	authSignatures seenSignatures // Signed agent auths, each accepted once
+	logins         loginLimiter   // Failed dashboard logins
 }
 
 // AgentConn represents a connected agent
@@ -48,25 +121,45 @@ type AgentConn struct {
 	ID            string
 	Name          string
 	IP            string
-	Conn          *websocket.Conn // Main control connection
+	Conn          transport.Conn // Main control connection
 	ConnectedAt   time.Time
 	LastHeartbeat time.Time
 	TxBytes       int64
 	RxBytes       int64
 	ActiveTunnels int
+	Token         *Token // Stored token used to authenticate, nil for the server token
+	Version       string
+	OS            string
+	Arch          string
+	Labels        map[string]string
+	PublicKey     string // Base64 identity key, empty for agents without one
+	CertSerial    string // Client certificate the agent connected with, if any
 	writeMu       sync.Mutex
-	tunnels       map[uint32]*Tunnel
-	tunnelsMu     sync.RWMutex
+	// Signed by the agent's rule connections, issued on this connection
+	ruleAuthNonce []byte
+	// Negotiated during auth
+	ProtocolVersion uint16
+	Capabilities    protocol.Capabilities
+	// Traffic already added to the agent's registry record
+	flushedTx int64
+	flushedRx int64
+	statsMu   sync.Mutex
+	tunnels   map[uint32]*Tunnel
+	tunnelsMu sync.RWMutex
 	// Rule-specific connections (per-rule isolation)
 	ruleConns   map[string]*RuleConn // ruleID -> connection
 	ruleConnsMu sync.RWMutex
+	// Rendezvous registration for direct paths
+	udpToken string
+	udp      udpEndpoints
 }
 
 // RuleConn represents a rule-specific WebSocket connection
 type RuleConn struct {
-	RuleID  string
-	Conn    *websocket.Conn
-	writeMu sync.Mutex
+	RuleID     string
+	Conn       transport.Conn
+	CertSerial string
+	writeMu    sync.Mutex
 }
 
 // Tunnel represents an active tunnel
@@ -92,11 +185,13 @@ func NewServer(cfg *Config) (*Server, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &Server{
-		config: cfg,
-		store:  store,
-		agents: make(map[string]*AgentConn),
-		ctx:    ctx,
-		cancel: cancel,
+		config:   cfg,
+		store:    store,
+		sessions: NewSessionManager(cfg.SessionTTL),
+		agents:   make(map[string]*AgentConn),
+		events:   NewEventBus(),
+		ctx:      ctx,
+		cancel:   cancel,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
@@ -106,7 +201,44 @@ func NewServer(cfg *Config) (*Server, error) {
 		},
 	}
 
+	switch cfg.AgentMTLS {
+	case "", MTLSOff:
+	case MTLSOptional, MTLSRequired:
+		// Agents on ws:// can't present the certificate they are issued,
+		// and required mode refuses them from then on
+		if cfg.AgentMTLS == MTLSRequired && cfg.TLSCertFile == "" && len(cfg.ACMEDomains) == 0 {
+			return nil, ErrMTLSRequiresHTTPS
+		}
+		certFile, keyFile := cfg.ClientCACertFile, cfg.ClientCAKeyFile
+		if certFile == "" && keyFile == "" {
+			dir := filepath.Dir(cfg.DBPath)
+			certFile, keyFile = filepath.Join(dir, "client-ca-cert.pem"), filepath.Join(dir, "client-ca-key.pem")
+		}
+		s.clientCA, err = LoadOrCreateClientCA(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client CA: %w", err)
+		}
+		log.Printf("Agent mTLS %s, client CA %s", cfg.AgentMTLS, certFile)
+	default:
+		return nil, fmt.Errorf("invalid agent mTLS mode %q", cfg.AgentMTLS)
+	}
+
+	if s.proxyFrom, err = parseProxyFrom(cfg.ProxyProtocolFrom); err != nil {
+		return nil, err
+	}
+	if len(s.proxyFrom) > 0 {
+		log.Printf("Accepting PROXY protocol headers from %v", s.proxyFrom)
+	}
+
+	if cfg.GeoIPDBFile != "" {
+		if s.geoip, err = geoip.Open(cfg.GeoIPDBFile); err != nil {
+			return nil, fmt.Errorf("GeoIP database: %w", err)
+		}
+		log.Printf("Loaded GeoIP database %s (%s, built %s)", cfg.GeoIPDBFile, s.geoip.Type, s.geoip.BuildTime.Format("2006-01-02"))
+	}
+
 	s.forwarder = NewForwarder(s)
+	s.metrics = newServerMetrics(s)
 	s.setupRouter()
 
 	return s, nil
@@ -116,29 +248,69 @@ func (s *Server) setupRouter() {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	r.Use(gin.Recovery())
+	// Client addresses come from the connection, which listenTCP takes from
+	// the PROXY header of trusted load balancers. X-Forwarded-For is set by
+	// the client and would let it forge the address in the audit log.
+	r.SetTrustedProxies(nil)
 
 	// WebSocket endpoint
 	r.GET("/ws", s.handleWebSocket)
 
-	// API endpoints
-	api := r.Group("/api")
+	// Public API endpoints
+	public := r.Group("/api")
 	{
-		api.GET("/version", s.handleGetVersion)
-		api.GET("/stats", s.handleGetStats)
-
-		api.GET("/agents", s.handleGetAgents)
-		api.GET("/agents/:id", s.handleGetAgent)
-
-		api.GET("/forward-rules", s.handleGetForwardRules)
-		api.POST("/forward-rules", s.handleCreateForwardRule)
-		api.PATCH("/forward-rules/:id", s.handleUpdateForwardRule)
-		api.DELETE("/forward-rules/:id", s.handleDeleteForwardRule)
+		public.GET("/version", s.handleGetVersion)
+		public.POST("/auth/login", s.handleLogin)
+	}
 
-		api.GET("/tokens", s.handleGetTokens)
-		api.POST("/tokens", s.handleCreateToken)
-		api.DELETE("/tokens/:id", s.handleDeleteToken)
+	// Authenticated API endpoints
+	api := r.Group("/api")
+	api.Use(s.authMiddleware())
+	{
+		api.GET("/auth/me", s.handleGetMe)
+		api.POST("/auth/logout", s.handleLogout)
+
+		// Viewer: read-only dashboards
+		viewer := api.Group("", requireRole(RoleViewer))
+		viewer.GET("/stats", s.handleGetStats)
+		viewer.GET("/agents", s.handleGetAgents)
+		viewer.GET("/agents/:id", s.handleGetAgent)
+		viewer.GET("/agents/:id/certificates", s.handleGetAgentCertificates)
+		viewer.GET("/forward-rules", s.handleGetForwardRules)
+		viewer.GET("/tunnels", s.handleGetTunnels)
+		viewer.GET("/events", s.handleEvents)
+
+		// Operator: toggle existing rules
+		operator := api.Group("", requireRole(RoleOperator))
+		operator.PATCH("/forward-rules/:id", s.handleUpdateForwardRule)
+
+		// Admin: rule lifecycle, tokens, users, API keys and the audit log
+		admin := api.Group("", requireRole(RoleAdmin))
+		admin.POST("/forward-rules", s.handleCreateForwardRule)
+		admin.DELETE("/forward-rules/:id", s.handleDeleteForwardRule)
+		admin.DELETE("/agents/:id", s.handleDeleteAgent)
+		admin.POST("/agents/:id/certificates/revoke", s.handleRevokeAgentCertificates)
+
+		admin.GET("/tokens", s.handleGetTokens)
+		admin.POST("/tokens", s.handleCreateToken)
+		admin.POST("/tokens/:id/rotate", s.handleRotateToken)
+		admin.DELETE("/tokens/:id", s.handleDeleteToken)
+
+		admin.GET("/users", s.handleGetUsers)
+		admin.POST("/users", s.handleCreateUser)
+		admin.PATCH("/users/:id", s.handleUpdateUser)
+		admin.DELETE("/users/:id", s.handleDeleteUser)
+
+		admin.GET("/api-keys", s.handleGetAPIKeys)
+		admin.POST("/api-keys", s.handleCreateAPIKey)
+		admin.DELETE("/api-keys/:id", s.handleDeleteAPIKey)
+
+		admin.GET("/audit", s.handleGetAuditEvents)
 	}
 
+	// Prometheus metrics, scraped with any viewer credential
+	r.GET("/metrics", s.authMiddleware(), requireRole(RoleViewer), s.handleMetrics)
+
 	// Serve frontend
 	if s.config.DevMode {
 		// Development mode: proxy to Vite dev server
@@ -200,12 +372,66 @@ func (s *Server) Run() error {
 	// Start heartbeat checker
 	go s.heartbeatChecker()
 
+	// Start stats snapshots for the event stream
+	go s.statsPublisher()
+
+	// Start expired session cleanup
+	go s.sessions.cleanupLoop(s.ctx)
+
+	// Start the rendezvous listener for direct agent-to-agent paths
+	if s.config.RendezvousAddr != "" {
+		rendezvous, err := NewRendezvous(s, s.config.RendezvousAddr)
+		if err != nil {
+			return fmt.Errorf("rendezvous listener: %w", err)
+		}
+		s.rendezvous = rendezvous
+		go rendezvous.Run()
+		log.Printf("Rendezvous listening on udp %s", s.config.RendezvousAddr)
+	}
+
+	// Start the transport listeners for agents
+	if len(s.config.Listeners) > 0 {
+		if err := s.listenTransports(); err != nil {
+			return err
+		}
+	}
+
+	tlsConfig, err := s.httpTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := s.listenVHost(); err != nil {
+		return err
+	}
+	if err := s.listenSNI(tlsConfig != nil); err != nil {
+		return err
+	}
+
 	s.httpServer = &http.Server{
-		Addr:    s.config.Addr,
-		Handler: s.router,
+		Addr:      s.config.Addr,
+		Handler:   s.vhostHandler(s.router),
+		TLSConfig: tlsConfig,
 	}
 
-	return s.httpServer.ListenAndServe()
+	if tlsConfig != nil {
+		log.Printf("Serving HTTPS on %s", s.config.Addr)
+		if s.sniFallback != nil {
+			// The tls-sni listener owns Addr if they are the same
+			if s.config.SNIAddr == s.config.Addr {
+				return s.httpServer.ServeTLS(s.sniFallback, "", "")
+			}
+			go s.httpServer.ServeTLS(s.sniFallback, "", "")
+		}
+	}
+	listener, err := s.listenTCP(s.config.Addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		return s.httpServer.ServeTLS(listener, "", "")
+	}
+	return s.httpServer.Serve(listener)
 }
 
 // Shutdown gracefully shuts down the server
@@ -215,9 +441,25 @@ func (s *Server) Shutdown() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Before the HTTP server, whose end ends the process
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
 	if s.httpServer != nil {
 		s.httpServer.Shutdown(ctx)
 	}
+	if s.acmeServer != nil {
+		s.acmeServer.Shutdown(ctx)
+	}
+	if s.vhostServer != nil {
+		s.vhostServer.Shutdown(ctx)
+	}
+	if s.sniListener != nil {
+		s.sniListener.Close()
+	}
+	if s.rendezvous != nil {
+		s.rendezvous.Close()
+	}
 
 	s.agentsMu.Lock()
 	for _, agent := range s.agents {
@@ -235,13 +477,62 @@ func (s *Server) handleWebSocket(c *gin.Context) {
 		return
 	}
 
-	clientIP := c.ClientIP()
+	// The connection's address, or the client's from the PROXY header of a
+	// trusted load balancer; never a header the client sets itself
+	clientIP := c.RemoteIP()
 	log.Printf("New WebSocket connection from %s", clientIP)
 
 	go s.handleAgentConnection(conn, clientIP)
 }
 
-func (s *Server) handleAgentConnection(conn *websocket.Conn, clientIP string) {
+// listenTransports accepts agent connections on the configured transport
+// listeners, which share one certificate
+func (s *Server) listenTransports() error {
+	certFile, keyFile := s.config.TransportCertFile, s.config.TransportKeyFile
+	if certFile == "" && keyFile == "" {
+		dir := filepath.Dir(s.config.DBPath)
+		certFile, keyFile = filepath.Join(dir, "transport-cert.pem"), filepath.Join(dir, "transport-key.pem")
+	}
+	cert, err := transport.LoadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("transport certificate: %w", err)
+	}
+	log.Printf("Transport certificate %s (sha256 %s)", certFile, transport.Fingerprint(cert.Certificate[0]))
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if s.clientCA != nil {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = s.clientCA.Pool()
+	}
+
+	for _, listenURL := range s.config.Listeners {
+		listener, err := transport.Listen(listenURL, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", listenURL, err)
+		}
+		s.listeners = append(s.listeners, listener)
+		scheme, _, _ := strings.Cut(listenURL, "://")
+		log.Printf("Listening for agents on %s://%s", scheme, listener.Addr())
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				clientIP := conn.RemoteAddr().String()
+				if host, _, err := net.SplitHostPort(clientIP); err == nil {
+					clientIP = host
+				}
+				log.Printf("New %s connection from %s", strings.ToUpper(scheme), clientIP)
+				go s.handleAgentConnection(conn, clientIP)
+			}
+		}()
+	}
+	return nil
+}
+
+func (s *Server) handleAgentConnection(conn transport.Conn, clientIP string) {
 	defer conn.Close()
 
 	// Wait for authentication
@@ -276,20 +567,55 @@ func (s *Server) handleAgentConnection(conn *websocket.Conn, clientIP string) {
 		return
 	}
 
-	// Validate token
-	valid := s.validateToken(authPayload.Token)
-	if !valid {
-		log.Printf("Invalid token from %s", clientIP)
-		s.sendAuthResponse(conn, false, "", "Invalid token")
-		return
-	}
-
 	// Create agent connection
 	agentID := authPayload.AgentID
 	if agentID == "" {
 		agentID = generateAgentID()
 	}
 
+	// Refuse agents speaking a protocol this server doesn't, before any
+	// other check fails on a payload it can't read
+	if err := protocol.CheckProtocolVersion(authPayload.ProtocolVersion); err != nil {
+		log.Printf("Agent '%s' (%s) from %s rejected: %v", authPayload.AgentName, agentID, clientIP, err)
+		s.metrics.authFailed(authFailAgentProtocol)
+		s.auditAgent(authPayload.AgentName, clientIP, AuditAgentReject, "agent", agentID, gin.H{
+			"error":           err.Error(),
+			"protocolVersion": authPayload.ProtocolVersion,
+		})
+		s.sendAuthResponse(conn, false, "", err.Error(), nil, nil)
+		return
+	}
+
+	// Validate token and its agent binding
+	token, err := s.authorizeAgentToken(authPayload.Token, agentID, authPayload.AgentName)
+	if err != nil {
+		log.Printf("Agent '%s' (%s) from %s rejected: %v", authPayload.AgentName, agentID, clientIP, err)
+		s.metrics.authFailed(authFailAgentToken)
+		s.auditAgent(authPayload.AgentName, clientIP, AuditAgentReject, "agent", agentID, gin.H{"error": err.Error()})
+		s.sendAuthResponse(conn, false, "", err.Error(), nil, nil)
+		return
+	}
+
+	// Check the agent's identity against the registry
+	publicKey, err := s.verifyAgentIdentity(authPayload, agentID)
+	if err != nil {
+		log.Printf("Agent '%s' (%s) from %s rejected: %v", authPayload.AgentName, agentID, clientIP, err)
+		s.metrics.authFailed(authFailAgentIdentity)
+		s.auditAgent(authPayload.AgentName, clientIP, AuditAgentReject, "agent", agentID, gin.H{"error": err.Error()})
+		s.sendAuthResponse(conn, false, "", err.Error(), nil, nil)
+		return
+	}
+
+	// Check the client certificate, if the agent presented one
+	certSerial, renewCert, err := s.checkClientCertificate(transport.PeerCertificate(conn), agentID, publicKey, authPayload.Capabilities)
+	if err != nil {
+		log.Printf("Agent '%s' (%s) from %s rejected: %v", authPayload.AgentName, agentID, clientIP, err)
+		s.metrics.authFailed(authFailAgentCert)
+		s.auditAgent(authPayload.AgentName, clientIP, AuditAgentReject, "agent", agentID, gin.H{"error": err.Error()})
+		s.sendAuthResponse(conn, false, "", err.Error(), nil, nil)
+		return
+	}
+
 	agent := &AgentConn{
 		ID:            agentID,
 		Name:          authPayload.AgentName,
@@ -297,27 +623,69 @@ func (s *Server) handleAgentConnection(conn *websocket.Conn, clientIP string) {
 		Conn:          conn,
 		ConnectedAt:   time.Now(),
 		LastHeartbeat: time.Now(),
+		Token:         token,
+		Version:       authPayload.Version,
+		OS:            authPayload.OS,
+		Arch:          authPayload.Arch,
+		Labels:        authPayload.Labels,
+		PublicKey:     publicKey,
+		CertSerial:    certSerial,
 		tunnels:       make(map[uint32]*Tunnel),
 		ruleConns:     make(map[string]*RuleConn),
+		ruleAuthNonce: newRuleAuthNonce(),
+
+		ProtocolVersion: authPayload.ProtocolVersion,
+		Capabilities:    authPayload.Capabilities,
 	}
 
 	s.agentsMu.Lock()
 	// Check for existing agent with same ID
-	if existing, ok := s.agents[agentID]; ok {
+	existing, replaced := s.agents[agentID]
+	if replaced {
 		existing.Conn.Close()
 		delete(s.agents, agentID)
 	}
 	s.agents[agentID] = agent
 	s.agentsMu.Unlock()
 
-	log.Printf("Agent '%s' (%s) connected from %s", agent.Name, agent.ID, clientIP)
+	if replaced {
+		s.auditSystem(AuditAgentKick, "agent", agentID, gin.H{"reason": "replaced by new connection", "ip": existing.IP})
+	}
+
+	s.registerAgent(agent)
+	s.auditAgent(agent.Name, clientIP, AuditAgentConnect, "agent", agentID, gin.H{
+		"version":         agent.Version,
+		"os":              agent.OS,
+		"arch":            agent.Arch,
+		"protocolVersion": agent.ProtocolVersion,
+		"capabilities":    agent.Capabilities.Names(),
+	})
+
+	s.publishAgentEvent(EventAgentConnect, agent)
+	log.Printf("Agent '%s' (%s) connected from %s (protocol %d, capabilities %s)",
+		agent.Name, agent.ID, clientIP, agent.ProtocolVersion, agent.Capabilities)
+
+	// Issue a client certificate on enrollment, or replace one about to
+	// expire
+	var clientCert []byte
+	if renewCert {
+		clientCert = s.issueClientCertificate(agent)
+	}
 
 	// Send auth response
-	s.sendAuthResponse(conn, true, agentID, "")
+	s.sendAuthResponse(conn, true, agentID, "", clientCert, agent.ruleAuthNonce)
 
 	// Reset read deadline
 	conn.SetReadDeadline(time.Time{})
 
+	// Let the agent register its UDP endpoint for direct paths
+	if s.rendezvous != nil && agent.Capabilities.Has(protocol.CapDirect) {
+		if err := s.rendezvous.Register(agent); err != nil {
+			log.Printf("Failed to send rendezvous to agent %s: %v", agent.ID, err)
+		}
+		defer s.rendezvous.Unregister(agent)
+	}
+
 	// Notify forwarder about new agent connection
 	s.forwarder.OnAgentConnected(agent)
 
@@ -326,35 +694,32 @@ func (s *Server) handleAgentConnection(conn *websocket.Conn, clientIP string) {
 
 	// Cleanup on disconnect
 	s.agentsMu.Lock()
-	delete(s.agents, agentID)
-	s.agentsMu.Unlock()
-
-	log.Printf("Agent '%s' (%s) disconnected", agent.Name, agent.ID)
-}
-
-func (s *Server) validateToken(token string) bool {
-	// Check against config token
-	if token == s.config.Token {
-		return true
+	if s.agents[agentID] == agent {
+		delete(s.agents, agentID)
 	}
+	s.agentsMu.Unlock()
 
-	// Check against stored tokens
-	tokens, _ := s.store.GetTokens()
-	for _, t := range tokens {
-		if t.Token == token {
-			s.store.IncrementTokenUsage(t.ID)
-			return true
-		}
-	}
+	s.forwarder.OnAgentDisconnected(agent)
+	s.flushAgentStats(agent)
+	s.auditAgent(agent.Name, agent.IP, AuditAgentDisconnect, "agent", agentID, gin.H{
+		"duration": time.Since(agent.ConnectedAt).Round(time.Second).String(),
+		"txBytes":  agent.TxBytes,
+		"rxBytes":  agent.RxBytes,
+	})
 
-	return false
+	s.publishAgentEvent(EventAgentDisconnect, agent)
+	log.Printf("Agent '%s' (%s) disconnected", agent.Name, agent.ID)
 }
 
-func (s *Server) sendAuthResponse(conn *websocket.Conn, success bool, agentID, errMsg string) {
+func (s *Server) sendAuthResponse(conn transport.Conn, success bool, agentID, errMsg string, clientCert, ruleAuthNonce []byte) {
 	payload := protocol.EncodeAuthResponsePayload(&protocol.AuthResponsePayload{
-		Success: success,
-		AgentID: agentID,
-		Error:   errMsg,
+		Success:           success,
+		AgentID:           agentID,
+		Error:             errMsg,
+		ProtocolVersion:   protocol.ProtocolVersion,
+		Capabilities:      protocol.LocalCapabilities,
+		ClientCertificate: clientCert,
+		RuleAuthNonce:     ruleAuthNonce,
 	})
 	msg := protocol.NewMessage(protocol.MsgTypeAuthResponse, 0, payload)
 	data, _ := msg.Encode()
@@ -399,6 +764,9 @@ func (s *Server) handleAgentMessages(agent *AgentConn) {
 		case protocol.MsgTypeData:
 			s.forwarder.HandleData(agent, msg)
 
+		case protocol.MsgTypeWindowUpdate:
+			s.forwarder.HandleWindowUpdate(agent, msg)
+
 		case protocol.MsgTypeUDPData:
 			s.forwarder.HandleUDPData(agent, msg)
 
@@ -423,6 +791,9 @@ func (s *Server) handleAgentMessages(agent *AgentConn) {
 
 		case protocol.MsgTypeAgentCloudData:
 			s.forwarder.HandleAgentCloudData(agent, msg)
+
+		case protocol.MsgTypePunchRequest:
+			s.handlePunchRequest(agent, msg)
 		}
 	}
 }
@@ -525,6 +896,12 @@ func (s *Server) GetAgents() []*AgentConn {
 	return agents
 }
 
+// agentKick is an agent disconnected by the heartbeat checker
+type agentKick struct {
+	agent  *AgentConn
+	reason string
+}
+
 func (s *Server) heartbeatChecker() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -535,19 +912,34 @@ func (s *Server) heartbeatChecker() {
 			return
 		case <-ticker.C:
 			s.agentsMu.RLock()
+			agents := make([]*AgentConn, 0, len(s.agents))
+			var kicked []agentKick
 			for _, agent := range s.agents {
+				agents = append(agents, agent)
 				if time.Since(agent.LastHeartbeat) > 90*time.Second {
 					log.Printf("Agent %s heartbeat timeout", agent.ID)
 					agent.Conn.Close()
+					kicked = append(kicked, agentKick{agent, "heartbeat timeout"})
+				} else if agent.Token != nil && agent.Token.Expired() {
+					log.Printf("Agent %s token expired, disconnecting", agent.ID)
+					agent.Conn.Close()
+					kicked = append(kicked, agentKick{agent, "token expired"})
 				}
 			}
 			s.agentsMu.RUnlock()
+
+			for _, agent := range agents {
+				s.flushAgentStats(agent)
+			}
+			for _, k := range kicked {
+				s.auditSystem(AuditAgentKick, "agent", k.agent.ID, gin.H{"name": k.agent.Name, "reason": k.reason})
+			}
 		}
 	}
 }
 
 // handleRuleConnection handles a rule-specific WebSocket connection
-func (s *Server) handleRuleConnection(conn *websocket.Conn, clientIP string, authMsg *protocol.Message) {
+func (s *Server) handleRuleConnection(conn transport.Conn, clientIP string, authMsg *protocol.Message) {
 	ruleAuth, err := protocol.DecodeRuleAuthPayload(authMsg.Payload)
 	if err != nil {
 		log.Printf("Failed to decode rule auth payload: %v", err)
@@ -555,25 +947,41 @@ func (s *Server) handleRuleConnection(conn *websocket.Conn, clientIP string, aut
 		return
 	}
 
-	// Validate token
-	if !s.validateToken(ruleAuth.Token) {
-		log.Printf("Invalid token for rule connection from %s", clientIP)
-		s.sendRuleAuthResponse(conn, false, ruleAuth.RuleID, "Invalid token")
-		return
-	}
-
 	// Find the agent
 	agent := s.GetAgent(ruleAuth.AgentID)
 	if agent == nil {
 		log.Printf("Agent %s not found for rule connection", ruleAuth.AgentID)
+		s.metrics.authFailed(authFailRuleConn)
+		s.auditAgent(ruleAuth.AgentID, clientIP, AuditRuleConnReject, "rule", ruleAuth.RuleID, gin.H{"error": "Agent not found"})
 		s.sendRuleAuthResponse(conn, false, ruleAuth.RuleID, "Agent not found")
 		return
 	}
 
+	// Validate token against the agent it claims to be and the rule
+	token, err := s.authorizeAgentToken(ruleAuth.Token, agent.ID, agent.Name)
+	if err == nil && token != nil && !token.AllowsRule(ruleAuth.RuleID) {
+		err = ErrTokenRuleDenied
+	}
+	if err == nil {
+		err = s.verifyRuleAuth(agent, ruleAuth)
+	}
+	var certSerial string
+	if err == nil {
+		certSerial, _, err = s.checkClientCertificate(transport.PeerCertificate(conn), agent.ID, agent.PublicKey, agent.Capabilities)
+	}
+	if err != nil {
+		log.Printf("Rule connection for agent %s rule %s from %s rejected: %v", agent.ID, ruleAuth.RuleID, clientIP, err)
+		s.metrics.authFailed(authFailRuleConn)
+		s.auditAgent(agent.Name, clientIP, AuditRuleConnReject, "rule", ruleAuth.RuleID, gin.H{"agentId": agent.ID, "error": err.Error()})
+		s.sendRuleAuthResponse(conn, false, ruleAuth.RuleID, err.Error())
+		return
+	}
+
 	// Register rule connection
 	ruleConn := &RuleConn{
-		RuleID: ruleAuth.RuleID,
-		Conn:   conn,
+		RuleID:     ruleAuth.RuleID,
+		Conn:       conn,
+		CertSerial: certSerial,
 	}
 
 	agent.ruleConnsMu.Lock()
@@ -585,6 +993,7 @@ func (s *Server) handleRuleConnection(conn *websocket.Conn, clientIP string, aut
 	agent.ruleConnsMu.Unlock()
 
 	log.Printf("Rule connection established: agent=%s, rule=%s from %s", agent.Name, ruleAuth.RuleID, clientIP)
+	s.auditAgent(agent.Name, clientIP, AuditRuleConnConnect, "rule", ruleAuth.RuleID, gin.H{"agentId": agent.ID})
 
 	// Send success response
 	s.sendRuleAuthResponse(conn, true, ruleAuth.RuleID, "")
@@ -603,7 +1012,7 @@ func (s *Server) handleRuleConnection(conn *websocket.Conn, clientIP string, aut
 	log.Printf("Rule connection closed: agent=%s, rule=%s", agent.Name, ruleAuth.RuleID)
 }
 
-func (s *Server) sendRuleAuthResponse(conn *websocket.Conn, success bool, ruleID, errMsg string) {
+func (s *Server) sendRuleAuthResponse(conn transport.Conn, success bool, ruleID, errMsg string) {
 	payload := protocol.EncodeRuleAuthResponsePayload(&protocol.RuleAuthResponsePayload{
 		Success: success,
 		RuleID:  ruleID,
@@ -654,6 +1063,9 @@ func (s *Server) handleRuleMessages(agent *AgentConn, ruleConn *RuleConn) {
 		case protocol.MsgTypeData:
 			s.forwarder.HandleData(agent, msg)
 
+		case protocol.MsgTypeWindowUpdate:
+			s.forwarder.HandleWindowUpdate(agent, msg)
+
 		case protocol.MsgTypeUDPData:
 			s.forwarder.HandleUDPData(agent, msg)
 
@@ -0,0 +1,194 @@
+package cloud
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+// authAgentConn is an agent connection that sends one auth message
+type authAgentConn struct {
+	fakeAgentConn
+	auth []byte
+}
+
+func (c *authAgentConn) ReadMessage() (int, []byte, error) {
+	if c.auth == nil {
+		return 0, nil, io.EOF
+	}
+	data := c.auth
+	c.auth = nil
+	return 0, data, nil
+}
+
+// authenticate runs an agent's auth payload against the server and
+// returns the response
+func authenticate(t *testing.T, s *Server, payload []byte) *protocol.AuthResponsePayload {
+	t.Helper()
+	data, err := protocol.NewMessage(protocol.MsgTypeAuth, 0, payload).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &authAgentConn{fakeAgentConn: fakeAgentConn{sent: make(chan *protocol.Message, 16)}, auth: data}
+	s.handleAgentConnection(conn, "192.0.2.1")
+
+	msg := <-conn.sent
+	if msg.Type != protocol.MsgTypeAuthResponse {
+		t.Fatalf("response %v", msg.Type)
+	}
+	resp, err := protocol.DecodeAuthResponsePayload(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAgentProtocolVersion(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Token = "secret"
+
+	tests := []struct {
+		name    string
+		version uint16
+		token   string
+		want    error
+	}{
+		{"too old", protocol.MinProtocolVersion - 1, "secret", protocol.ErrProtocolVersion},
+		{"too new", protocol.ProtocolVersion + 1, "secret", protocol.ErrProtocolVersion},
+		// Reported as such before the token is looked at
+		{"too new with a bad token", protocol.ProtocolVersion + 1, "wrong", protocol.ErrProtocolVersion},
+		{"current with a bad token", protocol.ProtocolVersion, "wrong", ErrTokenInvalid},
+		{"current", protocol.ProtocolVersion, "secret", nil},
+	}
+	for _, tt := range tests {
+		resp := authenticate(t, s, protocol.EncodeAuthPayload(&protocol.AuthPayload{
+			Token:           tt.token,
+			AgentID:         "agent-1",
+			AgentName:       "web",
+			ProtocolVersion: tt.version,
+			Capabilities:    protocol.LocalCapabilities,
+		}))
+		if tt.want == nil {
+			if !resp.Success {
+				t.Errorf("%s: rejected: %s", tt.name, resp.Error)
+			}
+			if len(resp.RuleAuthNonce) == 0 {
+				t.Errorf("%s: no rule auth nonce issued", tt.name)
+			}
+			continue
+		}
+		if resp.Success || !strings.HasPrefix(resp.Error, tt.want.Error()) {
+			t.Errorf("%s: response %q, want %q", tt.name, resp.Error, tt.want)
+		}
+		if resp.ProtocolVersion != protocol.ProtocolVersion {
+			t.Errorf("%s: response of version %d", tt.name, resp.ProtocolVersion)
+		}
+	}
+}
+
+func TestLegacyAgentAccepted(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Token = "secret"
+
+	// An auth payload that ends before the version fields
+	p := &protocol.AuthPayload{Token: "secret", AgentID: "agent-1", AgentName: "web"}
+	payload := protocol.EncodeAuthPayload(p)
+	if resp := authenticate(t, s, payload[:len(payload)-6]); !resp.Success {
+		t.Fatalf("legacy agent rejected: %s", resp.Error)
+	}
+	// The agent is gone once its connection ended, its connection is audited
+	events, _, err := s.store.GetAuditEvents(AuditFilter{Action: AuditAgentConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || !strings.Contains(string(events[0].After), `"protocolVersion":1`) {
+		t.Fatalf("connection of the legacy agent audited as %+v", events)
+	}
+}
+
+// ruleAuthenticate opens a rule connection against the server and returns
+// the response
+func ruleAuthenticate(t *testing.T, s *Server, p *protocol.RuleAuthPayload) *protocol.RuleAuthResponsePayload {
+	t.Helper()
+	data, err := protocol.NewMessage(protocol.MsgTypeRuleAuth, 0, protocol.EncodeRuleAuthPayload(p)).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &authAgentConn{fakeAgentConn: fakeAgentConn{sent: make(chan *protocol.Message, 16)}, auth: data}
+	s.handleAgentConnection(conn, "192.0.2.1")
+
+	msg := <-conn.sent
+	if msg.Type != protocol.MsgTypeRuleAuthResponse {
+		t.Fatalf("response %v", msg.Type)
+	}
+	resp, err := protocol.DecodeRuleAuthResponsePayload(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestRuleAuthIdentity(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Token = "secret"
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, _ := addTestAgent(s, "agent-1", "web")
+	agent.PublicKey = base64.StdEncoding.EncodeToString(public)
+	agent.ruleAuthNonce = newRuleAuthNonce()
+
+	signed := func(key ed25519.PrivateKey, nonce []byte, ts time.Time) *protocol.RuleAuthPayload {
+		msg := protocol.RuleAuthSigningMessage("agent-1", "rule-1", nonce, ts.Unix())
+		return &protocol.RuleAuthPayload{
+			Token:     "secret",
+			AgentID:   "agent-1",
+			RuleID:    "rule-1",
+			Timestamp: ts.Unix(),
+			Signature: ed25519.Sign(key, msg),
+		}
+	}
+
+	valid := signed(private, agent.ruleAuthNonce, time.Now())
+	if resp := ruleAuthenticate(t, s, valid); !resp.Success {
+		t.Fatalf("rule connection of the agent rejected: %s", resp.Error)
+	}
+
+	// The token alone doesn't open a rule connection for an agent with an
+	// identity key
+	tests := []struct {
+		name string
+		p    *protocol.RuleAuthPayload
+		want error
+	}{
+		{"replayed", valid, ErrAgentSignatureReused},
+		{"different key", signed(other, agent.ruleAuthNonce, time.Now()), ErrAgentSignatureInvalid},
+		{"unsigned", &protocol.RuleAuthPayload{Token: "secret", AgentID: "agent-1", RuleID: "rule-1"}, ErrAgentSignatureInvalid},
+		{"other connection's nonce", signed(private, newRuleAuthNonce(), time.Now()), ErrAgentSignatureInvalid},
+		{"stale", signed(private, agent.ruleAuthNonce, time.Now().Add(-2*authSignatureMaxSkew)), ErrAgentSignatureInvalid},
+	}
+	for _, tt := range tests {
+		if resp := ruleAuthenticate(t, s, tt.p); resp.Success || resp.Error != tt.want.Error() {
+			t.Errorf("%s: response %q, want %q", tt.name, resp.Error, tt.want)
+		}
+	}
+
+	// Agents without an identity key still authenticate with their token
+	legacy, _ := addTestAgent(s, "agent-2", "db")
+	legacy.ruleAuthNonce = newRuleAuthNonce()
+	if resp := ruleAuthenticate(t, s, &protocol.RuleAuthPayload{Token: "secret", AgentID: "agent-2", RuleID: "rule-1"}); !resp.Success {
+		t.Fatalf("rule connection of an agent without a key rejected: %s", resp.Error)
+	}
+}
@@ -0,0 +1,167 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// tls-sni rules are cloud-agent rules without a port of their own. Their
+// connections arrive on the SNIAddr listener and are routed, still
+// encrypted, by the server name of the TLS ClientHello.
+
+// sniPeekTimeout bounds the wait for a client's ClientHello
+const sniPeekTimeout = 10 * time.Second
+
+// errHelloRead stops the handshake used to parse a ClientHello
+var errHelloRead = errors.New("client hello read")
+
+// listenSNI starts the listener of tls-sni rules. With HTTPS, connections
+// no rule serves go to the HTTP server, so it can share the address.
+func (s *Server) listenSNI(httpsEnabled bool) error {
+	addr := s.config.SNIAddr
+	if addr == "" {
+		return nil
+	}
+	if addr == s.config.Addr && !httpsEnabled {
+		return fmt.Errorf("the tls-sni listener can only share the HTTP address when serving HTTPS")
+	}
+
+	listener, err := s.listenTCP(addr)
+	if err != nil {
+		return fmt.Errorf("tls-sni listener: %w", err)
+	}
+	s.sniListener = listener
+	if httpsEnabled {
+		s.sniFallback = newConnListener(listener.Addr())
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("tls-sni accept error: %v", err)
+				continue
+			}
+			go s.handleSNIConnection(conn)
+		}
+	}()
+	log.Printf("Serving tls-sni rules on %s", addr)
+	return nil
+}
+
+// handleSNIConnection hands a connection to the tls-sni rule serving its
+// server name, or to the HTTP server if none does
+func (s *Server) handleSNIConnection(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	serverName, conn, err := peekServerName(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if state := s.forwarder.routeHost("tls-sni", serverName, ""); state != nil {
+		s.forwarder.handleRemoteTCPConnection(state, conn)
+		return
+	}
+	if s.sniFallback != nil {
+		s.sniFallback.deliver(conn)
+		return
+	}
+	log.Printf("No tls-sni rule serves %q, closing connection from %s", serverName, conn.RemoteAddr())
+	conn.Close()
+}
+
+// peekServerName reads the ClientHello of a TLS connection and returns its
+// server name, empty if it has none, and the connection with the
+// ClientHello still to be read
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	var helloRead bool
+
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, helloRead = hello.ServerName, true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	conn = &peekedConn{Conn: conn, r: io.MultiReader(&peeked, conn)}
+	if !helloRead {
+		return "", conn, err
+	}
+	return serverName, conn, nil
+}
+
+// readOnlyConn lets a TLS handshake read a ClientHello without answering
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekedConn is a connection whose first bytes were read ahead
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// connListener is a listener accepting connections handed over by another
+// listener
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// deliver hands a connection to Accept, or closes it once the listener is
+// closed
+func (l *connListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,199 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+// recordingConn records what a client writes
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.written.Bytes())
+}
+
+// tlsPipe returns a TLS client for serverName, empty for none, over a pipe
+// whose other end is returned for the cloud to serve
+func tlsPipe(t *testing.T, serverName string) (*tls.Conn, *recordingConn, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	rec := &recordingConn{Conn: client}
+	return tls.Client(rec, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}), rec, server
+}
+
+func TestPeekServerName(t *testing.T) {
+	for _, name := range []string{"app.example.com", ""} {
+		client, rec, server := tlsPipe(t, name)
+		go client.Handshake()
+
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, conn, err := peekServerName(server)
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		if got != name {
+			t.Errorf("server name %q, want %q", got, name)
+		}
+
+		// The ClientHello is read again, byte for byte
+		hello := rec.bytes()
+		replayed := make([]byte, len(hello))
+		if _, err := io.ReadFull(conn, replayed); err != nil {
+			t.Fatalf("%q: replay: %v", name, err)
+		}
+		if !bytes.Equal(replayed, hello) {
+			t.Errorf("%q: replayed bytes differ from the ClientHello", name)
+		}
+	}
+
+	// Not TLS
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n"))
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if name, _, err := peekServerName(server); err == nil {
+		t.Errorf("plain HTTP read as a ClientHello for %q", name)
+	}
+}
+
+func TestSNIRouting(t *testing.T) {
+	s := newTestServer(t)
+	agent, agentConn := addTestAgent(s, "agent-1", "web")
+	rule := &ForwardRule{
+		ID:            "rule-1",
+		Name:          "tls",
+		Type:          "cloud-agent",
+		Protocol:      "tls-sni",
+		Domains:       []string{"app.example.com"},
+		TargetAgentID: "web",
+		TargetHost:    "127.0.0.1",
+		TargetPort:    8443,
+		Enabled:       true,
+	}
+	if err := s.forwarder.StartRule(rule); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dashboard serves what no rule does
+	s.sniFallback = newConnListener(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443})
+	dashboard := httptest.NewUnstartedServer(s.vhostHandler(s.router))
+	dashboard.Listener.Close()
+	dashboard.Listener = s.sniFallback
+	dashboard.StartTLS()
+	defer dashboard.Close()
+
+	t.Run("rule", func(t *testing.T) {
+		client, rec, server := tlsPipe(t, "app.example.com")
+		go client.Handshake()
+		go s.handleSNIConnection(server)
+
+		var connect *protocol.Message
+		select {
+		case connect = <-agentConn.sent:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no connect sent to the rule's agent")
+		}
+		payload, err := protocol.DecodeConnectPayload(connect.Payload)
+		if err != nil || connect.Type != protocol.MsgTypeConnect || payload.TargetPort != 8443 {
+			t.Fatalf("agent got %s %+v, want a connect to port 8443", connect.Type, payload)
+		}
+		s.forwarder.HandleConnectAck(agent, protocol.NewMessage(protocol.MsgTypeConnectAck, connect.TunnelID,
+			protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{Success: true, TunnelID: connect.TunnelID})))
+
+		// The target gets the ClientHello as the client sent it
+		hello := rec.bytes()
+		var forwarded []byte
+		for len(forwarded) < len(hello) {
+			select {
+			case msg := <-agentConn.sent:
+				if msg.Type == protocol.MsgTypeData && msg.TunnelID == connect.TunnelID {
+					forwarded = append(forwarded, msg.Payload...)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("forwarded %d of the %d bytes of the ClientHello", len(forwarded), len(hello))
+			}
+		}
+		if !bytes.Equal(forwarded, hello) {
+			t.Fatal("forwarded bytes differ from the ClientHello")
+		}
+
+		// The tunnel closes with the client
+		rec.Close()
+		for {
+			select {
+			case msg := <-agentConn.sent:
+				if msg.Type == protocol.MsgTypeClose {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("tunnel not closed with the client")
+			}
+		}
+	})
+
+	for _, name := range []string{"other.example.com", ""} {
+		t.Run("dashboard "+name, func(t *testing.T) {
+			client, _, server := tlsPipe(t, name)
+			go s.handleSNIConnection(server)
+
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := client.Write([]byte("GET /api/version HTTP/1.1\r\nHost: dashboard\r\nConnection: close\r\n\r\n")); err != nil {
+				t.Fatalf("handshake with the dashboard: %v", err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("dashboard answered %d", resp.StatusCode)
+			}
+			select {
+			case msg := <-agentConn.sent:
+				t.Errorf("connection for %q sent %s to the agent", name, msg.Type)
+			default:
+			}
+		})
+	}
+
+	// Without HTTPS there is nothing to fall back to
+	s.sniFallback = nil
+	client, _, server := tlsPipe(t, "other.example.com")
+	go s.handleSNIConnection(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := client.Handshake(); err == nil || isTimeout(err) {
+		t.Errorf("unrouted connection without fallback: %v, want it closed", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -2,8 +2,12 @@ package cloud
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/natsvr/natsvr/internal/protocol"
 	_ "modernc.org/sqlite"
 )
 
@@ -12,28 +16,150 @@ type ForwardRule struct {
 	ID            string
 	Name          string
 	Type          string // "cloud-direct", "cloud-agent", "agent-cloud", "agent-agent"
-	Protocol      string // "tcp", "udp"
+	Protocol      string // "tcp", "udp", or "http" / "tls-sni" for cloud-agent rules routed by host
 	SourceAgentID string
 	ListenPort    int
 	TargetAgentID string
 	TargetHost    string
 	TargetPort    int
 	Enabled       bool
-	RateLimit     int64 // bytes per second, 0 = unlimited
-	TrafficLimit  int64 // max total bytes, 0 = unlimited
-	TrafficUsed   int64 // current traffic used
-	CreatedAt     time.Time
+	RateLimit     int64    // bytes per second, 0 = unlimited
+	TrafficLimit  int64    // max total bytes, 0 = unlimited
+	TrafficUsed   int64    // current traffic used
+	Compression   string   // "", "zstd" or "snappy", for TCP tunnels through agents
+	Encrypted     bool     // End-to-end encrypted between the agents, for TCP agent-agent rules
+	Domains       []string // Hosts of an http or tls-sni rule, "*.example.com" matches any subdomain
+	PathPrefix    string   // Path an http rule is limited to, empty = all paths
+	ProxyProtocol string   // "v1" or "v2" to send the client address to the target in a PROXY header, empty = none
+
+	// Source filters of rules the cloud listens for. Denies win, and with
+	// an allow list set clients must match one of the allow lists.
+	AllowCIDRs     []string
+	DenyCIDRs      []string
+	AllowCountries []string // ISO 3166-1 alpha-2 codes, looked up in the GeoIP database
+	DenyCountries  []string
+
+	// Connection limits of tcp and tls-sni rules the cloud listens for,
+	// 0 = unlimited
+	MaxConns      int // Open connections
+	MaxConnRate   int // New connections per second
+	MaxConnsPerIP int // Open connections per client address
+
+	// HTTP middleware of http rules. With basic auth or a bearer token set,
+	// requests must present either.
+	BasicAuthUser  string
+	BasicAuthHash  string            // bcrypt hash of the basic auth password
+	BearerHash     string            // Salted hash of the bearer token
+	AuthSalt       string            // Salt of the bearer token hash
+	HostRewrite    string            // Host sent to the target, empty = the requested host
+	RequestHeaders map[string]string // Set on requests to the target, an empty value removes the header
+	ForwardedFor   bool              // Add X-Forwarded-For, -Host and -Proto
+	AccessLog      bool              // Log every request and publish it as an http.request event
+
+	CreatedAt time.Time
 }
 
-// Token represents an authentication token
+// Token represents an agent authentication token.
+// Only a salted hash of the secret is stored; the plaintext Token is set
+// only on a freshly created or rotated token.
 type Token struct {
+	ID            string
+	Name          string
+	Token         string
+	Prefix        string // Short visible prefix of the secret, used for lookup
+	Salt          string
+	Hash          string
+	PrevPrefix    string // Previous secret, still accepted until PrevExpiresAt
+	PrevSalt      string
+	PrevHash      string
+	PrevExpiresAt *time.Time
+	UsageCount    int
+	AgentName     string     // If set, only an agent with this name may use the token
+	AgentID       string     // If set, only an agent with this ID may use the token
+	ExpiresAt     *time.Time // nil = never expires
+	AllowedRules  []string   // Rule IDs the agent may serve, empty = all rules
+	CreatedAt     time.Time
+}
+
+// User represents a dashboard user
+type User struct {
+	ID           string
+	Username     string
+	PasswordHash string
+	Role         Role
+	CreatedAt    time.Time
+}
+
+// APIKey represents a programmatic API credential
+type APIKey struct {
 	ID         string
 	Name       string
-	Token      string
-	UsageCount int
+	KeyHash    string
+	Prefix     string // Short visible prefix of the key
+	Role       Role
+	AgentScope string // Agent name or ID this key is restricted to, empty = all agents
+	LastUsedAt *time.Time
 	CreatedAt  time.Time
 }
 
+// AgentRecord is the persistent registry entry of an agent that has connected
+type AgentRecord struct {
+	ID        string
+	Name      string
+	LastIP    string
+	Version   string
+	OS        string
+	Arch      string
+	Labels    map[string]string
+	PublicKey string // Base64 ed25519 key enrolled on first connect, empty for legacy agents
+	FirstSeen time.Time
+	LastSeen  time.Time
+	TxBytes   int64 // Cumulative across connections
+	RxBytes   int64 // Cumulative across connections
+}
+
+// AgentCertificate is a client certificate issued to an agent. Records
+// are kept after revocation, so the serial stays refused.
+type AgentCertificate struct {
+	Serial    string // Hex serial number
+	AgentID   string
+	AgentName string
+	NotBefore time.Time
+	NotAfter  time.Time
+	RevokedAt *time.Time
+}
+
+// Live reports whether the certificate is neither revoked nor expired
+func (c *AgentCertificate) Live(now time.Time) bool {
+	return c.RevokedAt == nil && now.Before(c.NotAfter)
+}
+
+// AuditEvent is an append-only record of an administrative or connection event
+type AuditEvent struct {
+	ID         int64
+	Time       time.Time
+	Actor      string // Username, API key or agent name, or "system"
+	ActorKind  string // Principal kind, "agent" or "system"
+	Action     string // e.g. "rule.create", "agent.connect"
+	TargetType string
+	TargetID   string
+	ClientIP   string
+	Before     string // JSON snapshot before the change, empty if none
+	After      string // JSON snapshot after the change or event details, empty if none
+}
+
+// AuditFilter selects audit events. Zero values match everything.
+type AuditFilter struct {
+	Actor      string
+	Action     string // Exact action, or a prefix such as "rule" matching "rule.*"
+	TargetType string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
 // Store handles database operations
 type Store struct {
 	db *sql.DB
@@ -41,7 +167,9 @@ type Store struct {
 
 // NewStore creates a new store
 func NewStore(dbPath string) (*Store, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	// Wait for locks instead of failing with SQLITE_BUSY when agents
+	// connect concurrently
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, err
 	}
@@ -70,85 +198,259 @@ func (s *Store) migrate() error {
 			rate_limit INTEGER NOT NULL DEFAULT 0,
 			traffic_limit INTEGER NOT NULL DEFAULT 0,
 			traffic_used INTEGER NOT NULL DEFAULT 0,
+			compression TEXT NOT NULL DEFAULT '',
+			encrypted INTEGER NOT NULL DEFAULT 0,
+			domains TEXT NOT NULL DEFAULT '',
+			path_prefix TEXT NOT NULL DEFAULT '',
+			basic_auth_user TEXT NOT NULL DEFAULT '',
+			basic_auth_hash TEXT NOT NULL DEFAULT '',
+			bearer_hash TEXT NOT NULL DEFAULT '',
+			auth_salt TEXT NOT NULL DEFAULT '',
+			host_rewrite TEXT NOT NULL DEFAULT '',
+			request_headers TEXT NOT NULL DEFAULT '',
+			forwarded_for INTEGER NOT NULL DEFAULT 0,
+			access_log INTEGER NOT NULL DEFAULT 0,
+			proxy_protocol TEXT NOT NULL DEFAULT '',
+			allow_cidrs TEXT NOT NULL DEFAULT '',
+			deny_cidrs TEXT NOT NULL DEFAULT '',
+			allow_countries TEXT NOT NULL DEFAULT '',
+			deny_countries TEXT NOT NULL DEFAULT '',
+			max_conns INTEGER NOT NULL DEFAULT 0,
+			max_conn_rate INTEGER NOT NULL DEFAULT 0,
+			max_conns_per_ip INTEGER NOT NULL DEFAULT 0,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
 
-		CREATE TABLE IF NOT EXISTS tokens (
+		CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS api_keys (
 			id TEXT PRIMARY KEY,
 			name TEXT NOT NULL,
-			token TEXT NOT NULL UNIQUE,
-			usage_count INTEGER NOT NULL DEFAULT 0,
+			key_hash TEXT NOT NULL UNIQUE,
+			prefix TEXT NOT NULL,
+			role TEXT NOT NULL,
+			agent_scope TEXT NOT NULL DEFAULT '',
+			last_used_at DATETIME,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
+
+		CREATE TABLE IF NOT EXISTS agents (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			last_ip TEXT NOT NULL DEFAULT '',
+			version TEXT NOT NULL DEFAULT '',
+			os TEXT NOT NULL DEFAULT '',
+			arch TEXT NOT NULL DEFAULT '',
+			labels TEXT NOT NULL DEFAULT '',
+			public_key TEXT NOT NULL DEFAULT '',
+			first_seen DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL,
+			tx_bytes INTEGER NOT NULL DEFAULT 0,
+			rx_bytes INTEGER NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE IF NOT EXISTS agent_certificates (
+			serial TEXT PRIMARY KEY,
+			agent_id TEXT NOT NULL,
+			agent_name TEXT NOT NULL DEFAULT '',
+			not_before DATETIME NOT NULL,
+			not_after DATETIME NOT NULL,
+			revoked_at DATETIME
+		);
+		CREATE INDEX IF NOT EXISTS idx_agent_certificates_agent ON agent_certificates (agent_id);
+
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time DATETIME NOT NULL,
+			actor TEXT NOT NULL,
+			actor_kind TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target_type TEXT NOT NULL DEFAULT '',
+			target_id TEXT NOT NULL DEFAULT '',
+			client_ip TEXT NOT NULL DEFAULT '',
+			before TEXT NOT NULL DEFAULT '',
+			after TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_events_time ON audit_events (time);
+		CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events (action);
+
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;
 	`)
 	if err != nil {
 		return err
 	}
 
+	if _, err := s.db.Exec(tokensTableSchema); err != nil {
+		return err
+	}
+
 	// Migration: add new columns if they don't exist
 	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN rate_limit INTEGER NOT NULL DEFAULT 0")
 	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN traffic_limit INTEGER NOT NULL DEFAULT 0")
 	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN traffic_used INTEGER NOT NULL DEFAULT 0")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN compression TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN encrypted INTEGER NOT NULL DEFAULT 0")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN domains TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN path_prefix TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN basic_auth_user TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN basic_auth_hash TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN bearer_hash TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN auth_salt TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN host_rewrite TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN request_headers TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN forwarded_for INTEGER NOT NULL DEFAULT 0")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN access_log INTEGER NOT NULL DEFAULT 0")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN proxy_protocol TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN allow_cidrs TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN deny_cidrs TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN allow_countries TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN deny_countries TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN max_conns INTEGER NOT NULL DEFAULT 0")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN max_conn_rate INTEGER NOT NULL DEFAULT 0")
+	s.db.Exec("ALTER TABLE forward_rules ADD COLUMN max_conns_per_ip INTEGER NOT NULL DEFAULT 0")
+	s.db.Exec("ALTER TABLE tokens ADD COLUMN agent_name TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE tokens ADD COLUMN agent_id TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE tokens ADD COLUMN expires_at DATETIME")
+	s.db.Exec("ALTER TABLE tokens ADD COLUMN allowed_rules TEXT NOT NULL DEFAULT ''")
+	s.db.Exec("ALTER TABLE agents ADD COLUMN public_key TEXT NOT NULL DEFAULT ''")
+
+	// Migration: replace plaintext tokens with salted hashes
+	if err := s.migratePlaintextTokens(); err != nil {
+		return err
+	}
+	s.db.Exec("CREATE INDEX IF NOT EXISTS idx_tokens_prefix ON tokens (prefix)")
+	s.db.Exec("CREATE INDEX IF NOT EXISTS idx_tokens_prev_prefix ON tokens (prev_prefix)")
 
 	return nil
 }
 
-// Close closes the database
-func (s *Store) Close() error {
-	return s.db.Close()
-}
+const tokensTableSchema = `
+	CREATE TABLE IF NOT EXISTS tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		salt TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		prev_prefix TEXT NOT NULL DEFAULT '',
+		prev_salt TEXT NOT NULL DEFAULT '',
+		prev_hash TEXT NOT NULL DEFAULT '',
+		prev_expires_at DATETIME,
+		usage_count INTEGER NOT NULL DEFAULT 0,
+		agent_name TEXT NOT NULL DEFAULT '',
+		agent_id TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME,
+		allowed_rules TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+`
 
-// Forward Rules
+// migratePlaintextTokens rebuilds a tokens table from older versions, which
+// stored the secret in a plaintext "token" column, hashing every secret.
+func (s *Store) migratePlaintextTokens() error {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('tokens') WHERE name = 'token'").Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
 
-func (s *Store) GetForwardRules() ([]*ForwardRule, error) {
-	rows, err := s.db.Query(`
-		SELECT id, name, type, protocol, source_agent_id, listen_port, 
-		       target_agent_id, target_host, target_port, enabled,
-		       rate_limit, traffic_limit, traffic_used, created_at
-		FROM forward_rules
-		ORDER BY created_at DESC
-	`)
+	tx, err := s.db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var rules []*ForwardRule
+	if _, err := tx.Exec("ALTER TABLE tokens RENAME TO tokens_plaintext"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(tokensTableSchema); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, name, token, usage_count, agent_name, agent_id,
+		       expires_at, allowed_rules, created_at
+		FROM tokens_plaintext
+	`)
+	if err != nil {
+		return err
+	}
+	var tokens []*Token
 	for rows.Next() {
-		r := &ForwardRule{}
-		var sourceAgentID, targetAgentID sql.NullString
-		err := rows.Scan(
-			&r.ID, &r.Name, &r.Type, &r.Protocol, &sourceAgentID,
-			&r.ListenPort, &targetAgentID, &r.TargetHost, &r.TargetPort,
-			&r.Enabled, &r.RateLimit, &r.TrafficLimit, &r.TrafficUsed, &r.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
+		t := &Token{}
+		var expiresAt sql.NullTime
+		var allowedRules string
+		if err := rows.Scan(&t.ID, &t.Name, &t.Token, &t.UsageCount, &t.AgentName, &t.AgentID,
+			&expiresAt, &allowedRules, &t.CreatedAt); err != nil {
+			rows.Close()
+			return err
 		}
-		if sourceAgentID.Valid {
-			r.SourceAgentID = sourceAgentID.String
+		if expiresAt.Valid {
+			t.ExpiresAt = &expiresAt.Time
 		}
-		if targetAgentID.Valid {
-			r.TargetAgentID = targetAgentID.String
+		t.AllowedRules = splitList(allowedRules)
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+
+	for _, t := range tokens {
+		if err := t.setSecret(t.Token); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO tokens (id, name, prefix, salt, hash, usage_count, agent_name, agent_id,
+			                    expires_at, allowed_rules, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, t.ID, t.Name, t.Prefix, t.Salt, t.Hash, t.UsageCount, t.AgentName, t.AgentID,
+			t.ExpiresAt, strings.Join(t.AllowedRules, ","), t.CreatedAt); err != nil {
+			return err
 		}
-		rules = append(rules, r)
 	}
 
-	return rules, nil
+	if _, err := tx.Exec("DROP TABLE tokens_plaintext"); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *Store) GetForwardRule(id string) (*ForwardRule, error) {
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Forward Rules
+
+const forwardRuleColumns = `
+	id, name, type, protocol, source_agent_id, listen_port,
+	target_agent_id, target_host, target_port, enabled,
+	rate_limit, traffic_limit, traffic_used, compression, encrypted,
+	domains, path_prefix, basic_auth_user, basic_auth_hash, bearer_hash, auth_salt,
+	host_rewrite, request_headers, forwarded_for, access_log, proxy_protocol,
+	allow_cidrs, deny_cidrs, allow_countries, deny_countries,
+	max_conns, max_conn_rate, max_conns_per_ip, created_at
+`
+
+func scanForwardRule(row interface{ Scan(...any) error }) (*ForwardRule, error) {
 	r := &ForwardRule{}
 	var sourceAgentID, targetAgentID sql.NullString
-	err := s.db.QueryRow(`
-		SELECT id, name, type, protocol, source_agent_id, listen_port, 
-		       target_agent_id, target_host, target_port, enabled,
-		       rate_limit, traffic_limit, traffic_used, created_at
-		FROM forward_rules WHERE id = ?
-	`, id).Scan(
+	var domains, requestHeaders string
+	var allowCIDRs, denyCIDRs, allowCountries, denyCountries string
+	err := row.Scan(
 		&r.ID, &r.Name, &r.Type, &r.Protocol, &sourceAgentID,
 		&r.ListenPort, &targetAgentID, &r.TargetHost, &r.TargetPort,
-		&r.Enabled, &r.RateLimit, &r.TrafficLimit, &r.TrafficUsed, &r.CreatedAt,
+		&r.Enabled, &r.RateLimit, &r.TrafficLimit, &r.TrafficUsed, &r.Compression, &r.Encrypted,
+		&domains, &r.PathPrefix, &r.BasicAuthUser, &r.BasicAuthHash, &r.BearerHash, &r.AuthSalt,
+		&r.HostRewrite, &requestHeaders, &r.ForwardedFor, &r.AccessLog, &r.ProxyProtocol,
+		&allowCIDRs, &denyCIDRs, &allowCountries, &denyCountries,
+		&r.MaxConns, &r.MaxConnRate, &r.MaxConnsPerIP, &r.CreatedAt,
 	)
 	if err != nil {
 		return nil, err
@@ -159,20 +461,63 @@ func (s *Store) GetForwardRule(id string) (*ForwardRule, error) {
 	if targetAgentID.Valid {
 		r.TargetAgentID = targetAgentID.String
 	}
+	r.Domains = splitList(domains)
+	r.AllowCIDRs, r.DenyCIDRs = splitList(allowCIDRs), splitList(denyCIDRs)
+	r.AllowCountries, r.DenyCountries = splitList(allowCountries), splitList(denyCountries)
+	if requestHeaders != "" {
+		if err := json.Unmarshal([]byte(requestHeaders), &r.RequestHeaders); err != nil {
+			return nil, fmt.Errorf("rule %s request headers: %w", r.ID, err)
+		}
+	}
 	return r, nil
 }
 
+// encodeRequestHeaders encodes a rule's request headers for storage. Header
+// values may contain commas, so unlike lists they are stored as JSON.
+func encodeRequestHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(headers)
+	return string(data)
+}
+
+func (s *Store) GetForwardRules() ([]*ForwardRule, error) {
+	rows, err := s.db.Query(`SELECT ` + forwardRuleColumns + ` FROM forward_rules ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*ForwardRule
+	for rows.Next() {
+		r, err := scanForwardRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func (s *Store) GetForwardRule(id string) (*ForwardRule, error) {
+	return scanForwardRule(s.db.QueryRow(`SELECT `+forwardRuleColumns+` FROM forward_rules WHERE id = ?`, id))
+}
+
 func (s *Store) CreateForwardRule(r *ForwardRule) error {
 	r.CreatedAt = time.Now()
 	_, err := s.db.Exec(`
-		INSERT INTO forward_rules (id, name, type, protocol, source_agent_id, 
-		                           listen_port, target_agent_id, target_host, 
-		                           target_port, enabled, rate_limit, traffic_limit,
-		                           traffic_used, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO forward_rules (`+forwardRuleColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, r.ID, r.Name, r.Type, r.Protocol, r.SourceAgentID,
 		r.ListenPort, r.TargetAgentID, r.TargetHost, r.TargetPort,
-		r.Enabled, r.RateLimit, r.TrafficLimit, r.TrafficUsed, r.CreatedAt)
+		r.Enabled, r.RateLimit, r.TrafficLimit, r.TrafficUsed, r.Compression, r.Encrypted,
+		strings.Join(r.Domains, ","), r.PathPrefix, r.BasicAuthUser, r.BasicAuthHash, r.BearerHash, r.AuthSalt,
+		r.HostRewrite, encodeRequestHeaders(r.RequestHeaders), r.ForwardedFor, r.AccessLog, r.ProxyProtocol,
+		strings.Join(r.AllowCIDRs, ","), strings.Join(r.DenyCIDRs, ","),
+		strings.Join(r.AllowCountries, ","), strings.Join(r.DenyCountries, ","),
+		r.MaxConns, r.MaxConnRate, r.MaxConnsPerIP, r.CreatedAt)
 	return err
 }
 
@@ -182,11 +527,21 @@ func (s *Store) UpdateForwardRule(r *ForwardRule) error {
 		SET name = ?, type = ?, protocol = ?, source_agent_id = ?,
 		    listen_port = ?, target_agent_id = ?, target_host = ?,
 		    target_port = ?, enabled = ?, rate_limit = ?, traffic_limit = ?,
-		    traffic_used = ?
+		    traffic_used = ?, compression = ?, encrypted = ?, domains = ?,
+		    path_prefix = ?, basic_auth_user = ?, basic_auth_hash = ?, bearer_hash = ?,
+		    auth_salt = ?, host_rewrite = ?, request_headers = ?, forwarded_for = ?,
+		    access_log = ?, proxy_protocol = ?, allow_cidrs = ?, deny_cidrs = ?,
+		    allow_countries = ?, deny_countries = ?, max_conns = ?, max_conn_rate = ?,
+		    max_conns_per_ip = ?
 		WHERE id = ?
 	`, r.Name, r.Type, r.Protocol, r.SourceAgentID,
 		r.ListenPort, r.TargetAgentID, r.TargetHost, r.TargetPort,
-		r.Enabled, r.RateLimit, r.TrafficLimit, r.TrafficUsed, r.ID)
+		r.Enabled, r.RateLimit, r.TrafficLimit, r.TrafficUsed, r.Compression, r.Encrypted,
+		strings.Join(r.Domains, ","), r.PathPrefix, r.BasicAuthUser, r.BasicAuthHash, r.BearerHash,
+		r.AuthSalt, r.HostRewrite, encodeRequestHeaders(r.RequestHeaders), r.ForwardedFor,
+		r.AccessLog, r.ProxyProtocol, strings.Join(r.AllowCIDRs, ","), strings.Join(r.DenyCIDRs, ","),
+		strings.Join(r.AllowCountries, ","), strings.Join(r.DenyCountries, ","),
+		r.MaxConns, r.MaxConnRate, r.MaxConnsPerIP, r.ID)
 	return err
 }
 
@@ -203,12 +558,33 @@ func (s *Store) DeleteForwardRule(id string) error {
 
 // Tokens
 
-func (s *Store) GetTokens() ([]*Token, error) {
-	rows, err := s.db.Query(`
-		SELECT id, name, token, usage_count, created_at
-		FROM tokens
-		ORDER BY created_at DESC
-	`)
+const tokenColumns = `
+	id, name, prefix, salt, hash, prev_prefix, prev_salt, prev_hash, prev_expires_at,
+	usage_count, agent_name, agent_id, expires_at, allowed_rules, created_at
+`
+
+func scanToken(row interface{ Scan(...any) error }) (*Token, error) {
+	t := &Token{}
+	var prevExpiresAt, expiresAt sql.NullTime
+	var allowedRules string
+	err := row.Scan(&t.ID, &t.Name, &t.Prefix, &t.Salt, &t.Hash,
+		&t.PrevPrefix, &t.PrevSalt, &t.PrevHash, &prevExpiresAt,
+		&t.UsageCount, &t.AgentName, &t.AgentID, &expiresAt, &allowedRules, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if prevExpiresAt.Valid {
+		t.PrevExpiresAt = &prevExpiresAt.Time
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	t.AllowedRules = splitList(allowedRules)
+	return t, nil
+}
+
+func (s *Store) queryTokens(query string, args ...any) ([]*Token, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -216,8 +592,7 @@ func (s *Store) GetTokens() ([]*Token, error) {
 
 	var tokens []*Token
 	for rows.Next() {
-		t := &Token{}
-		err := rows.Scan(&t.ID, &t.Name, &t.Token, &t.UsageCount, &t.CreatedAt)
+		t, err := scanToken(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -227,12 +602,37 @@ func (s *Store) GetTokens() ([]*Token, error) {
 	return tokens, nil
 }
 
+func (s *Store) GetTokens() ([]*Token, error) {
+	return s.queryTokens("SELECT " + tokenColumns + " FROM tokens ORDER BY created_at DESC")
+}
+
+func (s *Store) GetToken(id string) (*Token, error) {
+	return scanToken(s.db.QueryRow("SELECT "+tokenColumns+" FROM tokens WHERE id = ?", id))
+}
+
+// GetTokensByPrefix returns the tokens whose current or previous secret has the prefix
+func (s *Store) GetTokensByPrefix(prefix string) ([]*Token, error) {
+	return s.queryTokens("SELECT "+tokenColumns+" FROM tokens WHERE prefix = ? OR prev_prefix = ?", prefix, prefix)
+}
+
 func (s *Store) CreateToken(t *Token) error {
 	t.CreatedAt = time.Now()
 	_, err := s.db.Exec(`
-		INSERT INTO tokens (id, name, token, usage_count, created_at)
-		VALUES (?, ?, ?, ?, ?)
-	`, t.ID, t.Name, t.Token, t.UsageCount, t.CreatedAt)
+		INSERT INTO tokens (id, name, prefix, salt, hash, usage_count, agent_name, agent_id,
+		                    expires_at, allowed_rules, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, t.ID, t.Name, t.Prefix, t.Salt, t.Hash, t.UsageCount, t.AgentName, t.AgentID,
+		t.ExpiresAt, strings.Join(t.AllowedRules, ","), t.CreatedAt)
+	return err
+}
+
+// RotateToken stores a token's new secret together with its previous one
+func (s *Store) RotateToken(t *Token) error {
+	_, err := s.db.Exec(`
+		UPDATE tokens SET prefix = ?, salt = ?, hash = ?,
+		                  prev_prefix = ?, prev_salt = ?, prev_hash = ?, prev_expires_at = ?
+		WHERE id = ?
+	`, t.Prefix, t.Salt, t.Hash, t.PrevPrefix, t.PrevSalt, t.PrevHash, t.PrevExpiresAt, t.ID)
 	return err
 }
 
@@ -245,3 +645,429 @@ func (s *Store) IncrementTokenUsage(id string) error {
 	_, err := s.db.Exec("UPDATE tokens SET usage_count = usage_count + 1 WHERE id = ?", id)
 	return err
 }
+
+// splitList splits a comma-separated column into its non-empty values
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Users
+
+func (s *Store) GetUsers() ([]*User, error) {
+	rows, err := s.db.Query(`
+		SELECT id, username, password_hash, role, created_at
+		FROM users
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u := &User{}
+		err := rows.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+func (s *Store) GetUser(id string) (*User, error) {
+	u := &User{}
+	err := s.db.QueryRow(`
+		SELECT id, username, password_hash, role, created_at
+		FROM users WHERE id = ?
+	`, id).Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Store) GetUserByUsername(username string) (*User, error) {
+	u := &User{}
+	err := s.db.QueryRow(`
+		SELECT id, username, password_hash, role, created_at
+		FROM users WHERE username = ?
+	`, username).Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Store) CreateUser(u *User) error {
+	u.CreatedAt = time.Now()
+	_, err := s.db.Exec(`
+		INSERT INTO users (id, username, password_hash, role, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, u.ID, u.Username, u.PasswordHash, u.Role, u.CreatedAt)
+	return err
+}
+
+func (s *Store) UpdateUser(u *User) error {
+	_, err := s.db.Exec(`
+		UPDATE users SET password_hash = ?, role = ? WHERE id = ?
+	`, u.PasswordHash, u.Role, u.ID)
+	return err
+}
+
+func (s *Store) DeleteUser(id string) error {
+	_, err := s.db.Exec("DELETE FROM users WHERE id = ?", id)
+	return err
+}
+
+// API Keys
+
+func (s *Store) GetAPIKeys() ([]*APIKey, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, key_hash, prefix, role, agent_scope, last_used_at, created_at
+		FROM api_keys
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k := &APIKey{}
+		var lastUsed sql.NullTime
+		err := rows.Scan(&k.ID, &k.Name, &k.KeyHash, &k.Prefix, &k.Role, &k.AgentScope, &lastUsed, &k.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			k.LastUsedAt = &lastUsed.Time
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (s *Store) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	k := &APIKey{}
+	var lastUsed sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT id, name, key_hash, prefix, role, agent_scope, last_used_at, created_at
+		FROM api_keys WHERE key_hash = ?
+	`, keyHash).Scan(&k.ID, &k.Name, &k.KeyHash, &k.Prefix, &k.Role, &k.AgentScope, &lastUsed, &k.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if lastUsed.Valid {
+		k.LastUsedAt = &lastUsed.Time
+	}
+	return k, nil
+}
+
+func (s *Store) CreateAPIKey(k *APIKey) error {
+	k.CreatedAt = time.Now()
+	_, err := s.db.Exec(`
+		INSERT INTO api_keys (id, name, key_hash, prefix, role, agent_scope, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, k.ID, k.Name, k.KeyHash, k.Prefix, k.Role, k.AgentScope, k.CreatedAt)
+	return err
+}
+
+func (s *Store) GetAPIKey(id string) (*APIKey, error) {
+	k := &APIKey{}
+	var lastUsed sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT id, name, key_hash, prefix, role, agent_scope, last_used_at, created_at
+		FROM api_keys WHERE id = ?
+	`, id).Scan(&k.ID, &k.Name, &k.KeyHash, &k.Prefix, &k.Role, &k.AgentScope, &lastUsed, &k.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if lastUsed.Valid {
+		k.LastUsedAt = &lastUsed.Time
+	}
+	return k, nil
+}
+
+func (s *Store) DeleteAPIKey(id string) error {
+	_, err := s.db.Exec("DELETE FROM api_keys WHERE id = ?", id)
+	return err
+}
+
+func (s *Store) TouchAPIKey(id string) error {
+	_, err := s.db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", time.Now(), id)
+	return err
+}
+
+// Agents
+
+func scanAgentRecord(row interface{ Scan(...any) error }) (*AgentRecord, error) {
+	a := &AgentRecord{}
+	var labels string
+	err := row.Scan(&a.ID, &a.Name, &a.LastIP, &a.Version, &a.OS, &a.Arch, &labels, &a.PublicKey,
+		&a.FirstSeen, &a.LastSeen, &a.TxBytes, &a.RxBytes)
+	if err != nil {
+		return nil, err
+	}
+	a.Labels = protocol.ParseLabels(labels)
+	return a, nil
+}
+
+func (s *Store) GetAgentRecords() ([]*AgentRecord, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, last_ip, version, os, arch, labels, public_key, first_seen, last_seen, tx_bytes, rx_bytes
+		FROM agents
+		ORDER BY last_seen DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var agents []*AgentRecord
+	for rows.Next() {
+		a, err := scanAgentRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, a)
+	}
+
+	return agents, nil
+}
+
+func (s *Store) GetAgentRecord(id string) (*AgentRecord, error) {
+	return scanAgentRecord(s.db.QueryRow(`
+		SELECT id, name, last_ip, version, os, arch, labels, public_key, first_seen, last_seen, tx_bytes, rx_bytes
+		FROM agents WHERE id = ?
+	`, id))
+}
+
+// GetEnrolledAgentByName returns the agent with an enrolled identity that
+// holds the name, or sql.ErrNoRows
+func (s *Store) GetEnrolledAgentByName(name string) (*AgentRecord, error) {
+	return scanAgentRecord(s.db.QueryRow(`
+		SELECT id, name, last_ip, version, os, arch, labels, public_key, first_seen, last_seen, tx_bytes, rx_bytes
+		FROM agents WHERE name = ? AND public_key != ''
+		ORDER BY first_seen LIMIT 1
+	`, name))
+}
+
+// UpsertAgentRecord records an agent connection, keeping first_seen and the
+// cumulative traffic of an existing record. An enrolled public key is never
+// replaced.
+func (s *Store) UpsertAgentRecord(a *AgentRecord) error {
+	_, err := s.db.Exec(`
+		INSERT INTO agents (id, name, last_ip, version, os, arch, labels, public_key, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			name = excluded.name,
+			last_ip = excluded.last_ip,
+			version = excluded.version,
+			os = excluded.os,
+			arch = excluded.arch,
+			labels = excluded.labels,
+			public_key = CASE WHEN agents.public_key = '' THEN excluded.public_key ELSE agents.public_key END,
+			last_seen = excluded.last_seen
+	`, a.ID, a.Name, a.LastIP, a.Version, a.OS, a.Arch, protocol.FormatLabels(a.Labels),
+		a.PublicKey, a.FirstSeen, a.LastSeen)
+	return err
+}
+
+// AddAgentTraffic bumps an agent's last_seen and adds to its cumulative traffic
+func (s *Store) AddAgentTraffic(id string, lastSeen time.Time, txBytes, rxBytes int64) error {
+	_, err := s.db.Exec(`
+		UPDATE agents SET last_seen = ?, tx_bytes = tx_bytes + ?, rx_bytes = rx_bytes + ?
+		WHERE id = ?
+	`, lastSeen, txBytes, rxBytes, id)
+	return err
+}
+
+func (s *Store) DeleteAgentRecord(id string) error {
+	_, err := s.db.Exec("DELETE FROM agents WHERE id = ?", id)
+	return err
+}
+
+// Agent Certificates
+
+func scanAgentCertificate(row interface{ Scan(...any) error }) (*AgentCertificate, error) {
+	c := &AgentCertificate{}
+	var revoked sql.NullTime
+	err := row.Scan(&c.Serial, &c.AgentID, &c.AgentName, &c.NotBefore, &c.NotAfter, &revoked)
+	if err != nil {
+		return nil, err
+	}
+	if revoked.Valid {
+		c.RevokedAt = &revoked.Time
+	}
+	return c, nil
+}
+
+func (s *Store) GetAgentCertificate(serial string) (*AgentCertificate, error) {
+	return scanAgentCertificate(s.db.QueryRow(`
+		SELECT serial, agent_id, agent_name, not_before, not_after, revoked_at
+		FROM agent_certificates WHERE serial = ?
+	`, serial))
+}
+
+// GetAgentCertificates returns an agent's certificates, newest first
+func (s *Store) GetAgentCertificates(agentID string) ([]*AgentCertificate, error) {
+	rows, err := s.db.Query(`
+		SELECT serial, agent_id, agent_name, not_before, not_after, revoked_at
+		FROM agent_certificates WHERE agent_id = ?
+		ORDER BY not_before DESC
+	`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var certs []*AgentCertificate
+	for rows.Next() {
+		c, err := scanAgentCertificate(rows)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+
+	return certs, nil
+}
+
+func (s *Store) CreateAgentCertificate(c *AgentCertificate) error {
+	_, err := s.db.Exec(`
+		INSERT INTO agent_certificates (serial, agent_id, agent_name, not_before, not_after)
+		VALUES (?, ?, ?, ?, ?)
+	`, c.Serial, c.AgentID, c.AgentName, c.NotBefore, c.NotAfter)
+	return err
+}
+
+// RevokeAgentCertificates revokes the agent's certificate with the given
+// serial, or all of its certificates if serial is empty. It returns the
+// serials it revoked.
+func (s *Store) RevokeAgentCertificates(agentID, serial string) ([]string, error) {
+	rows, err := s.db.Query(`
+		UPDATE agent_certificates SET revoked_at = ?
+		WHERE agent_id = ? AND (? = '' OR serial = ?) AND revoked_at IS NULL
+		RETURNING serial
+	`, time.Now(), agentID, serial, serial)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var serials []string
+	for rows.Next() {
+		var revoked string
+		if err := rows.Scan(&revoked); err != nil {
+			return nil, err
+		}
+		serials = append(serials, revoked)
+	}
+
+	return serials, rows.Err()
+}
+
+func (s *Store) DeleteAgentCertificates(agentID string) error {
+	_, err := s.db.Exec("DELETE FROM agent_certificates WHERE agent_id = ?", agentID)
+	return err
+}
+
+// Audit Events
+
+func (s *Store) CreateAuditEvent(e *AuditEvent) error {
+	// Times are kept in UTC so the time range filters compare correctly
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	res, err := s.db.Exec(`
+		INSERT INTO audit_events (time, actor, actor_kind, action, target_type, target_id,
+		                          client_ip, before, after)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, e.Time, e.Actor, e.ActorKind, e.Action, e.TargetType, e.TargetID, e.ClientIP, e.Before, e.After)
+	if err != nil {
+		return err
+	}
+	e.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// GetAuditEvents returns the events matching the filter, newest first, and
+// the total number of matching events
+func (s *Store) GetAuditEvents(f AuditFilter) ([]*AuditEvent, int, error) {
+	var where []string
+	var args []any
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		where = append(where, "(action = ? OR action LIKE ? || '.%')")
+		args = append(args, f.Action, f.Action)
+	}
+	if f.TargetType != "" {
+		where = append(where, "target_type = ?")
+		args = append(args, f.TargetType)
+	}
+	if f.TargetID != "" {
+		where = append(where, "target_id = ?")
+		args = append(args, f.TargetID)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, f.Until.UTC())
+	}
+
+	cond := ""
+	if len(where) > 0 {
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM audit_events"+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := s.db.Query(`
+		SELECT id, time, actor, actor_kind, action, target_type, target_id, client_ip, before, after
+		FROM audit_events`+cond+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, f.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		e := &AuditEvent{}
+		err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.ActorKind, &e.Action, &e.TargetType,
+			&e.TargetID, &e.ClientIP, &e.Before, &e.After)
+		if err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e)
+	}
+
+	return events, total, nil
+}
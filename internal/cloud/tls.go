@@ -0,0 +1,184 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// httpTLSConfig returns the TLS config of the HTTP server, or nil to serve
+// plain HTTP. With ACME, it also starts the HTTP-01 challenge listener if
+// one is configured.
+func (s *Server) httpTLSConfig() (*tls.Config, error) {
+	cfg := s.config
+	var tlsConfig *tls.Config
+
+	switch {
+	case len(cfg.ACMEDomains) > 0 && cfg.TLSCertFile != "":
+		return nil, fmt.Errorf("a TLS certificate file and ACME domains are mutually exclusive")
+
+	case len(cfg.ACMEDomains) > 0:
+		manager, err := s.acmeManager()
+		if err != nil {
+			return nil, err
+		}
+		// Answers TLS-ALPN-01 challenges itself
+		tlsConfig = manager.TLSConfig()
+
+		if cfg.ACMEHTTPAddr != "" {
+			handler := manager.HTTPHandler(nil) // Redirects everything else to HTTPS
+			if cfg.VHostAddr == cfg.ACMEHTTPAddr {
+				// Except requests for http rules served on the same address
+				handler = manager.HTTPHandler(s.vhostHandler(handler))
+			}
+			listener, err := s.listenTCP(cfg.ACMEHTTPAddr)
+			if err != nil {
+				return nil, fmt.Errorf("ACME HTTP-01 listener: %w", err)
+			}
+			s.acmeServer = &http.Server{Handler: handler}
+			go func() {
+				if err := s.acmeServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+					log.Printf("ACME HTTP-01 listener error: %v", err)
+				}
+			}()
+			log.Printf("ACME HTTP-01 challenges on %s", cfg.ACMEHTTPAddr)
+		}
+		log.Printf("ACME certificates for %v from %s", cfg.ACMEDomains, manager.Client.DirectoryURL)
+
+	case cfg.TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	default:
+		return nil, nil
+	}
+
+	tlsConfig.MinVersion = tls.VersionTLS12
+	// Agents on wss:// may present the client certificates the cloud issued
+	if s.clientCA != nil {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = s.clientCA.Pool()
+	}
+	return tlsConfig, nil
+}
+
+// acmeManager obtains and renews the HTTP server's certificates from an
+// ACME CA, Let's Encrypt unless another directory is configured
+func (s *Server) acmeManager() (*autocert.Manager, error) {
+	cfg := s.config
+
+	cacheDir := cfg.ACMECacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(filepath.Dir(cfg.DBPath), "acme")
+	}
+	client := &acme.Client{DirectoryURL: cfg.ACMEDirectory}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A private CA such as Pebble serves its directory with a certificate
+	// of its own
+	if cfg.ACMECAFile != "" {
+		pem, err := os.ReadFile(cfg.ACMECAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ACME CA: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ACME CA: no certificates in %s", cfg.ACMECAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	client.HTTPClient = &http.Client{Transport: &orderLocations{
+		next:   transport,
+		orders: make(map[string]string),
+	}}
+
+	// HTTP-01 requests to another port than 80, as Pebble makes them,
+	// carry the port in Host. The exact domains of http rules get
+	// certificates too.
+	whitelist := autocert.HostWhitelist(cfg.ACMEDomains...)
+	hostPolicy := func(ctx context.Context, host string) error {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if s.forwarder.servesHTTPDomain(host) {
+			return nil
+		}
+		return whitelist(ctx, host)
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: hostPolicy,
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      cfg.ACMEEmail,
+		Client:     client,
+	}, nil
+}
+
+// orderLocations adds the order URL to finalize responses that leave it
+// out, which CAs finalizing asynchronously such as Pebble do. The ACME
+// client polls that URL until the certificate is issued.
+type orderLocations struct {
+	next   http.RoundTripper
+	orders map[string]string // Finalize URL -> order URL
+	mu     sync.Mutex
+}
+
+func (t *orderLocations) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost || !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return res, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &order) != nil || order.Finalize == "" {
+		return res, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if req.URL.String() == order.Finalize {
+		if url, ok := t.orders[order.Finalize]; ok && res.Header.Get("Location") == "" {
+			res.Header.Set("Location", url)
+		}
+		delete(t.orders, order.Finalize)
+		return res, nil
+	}
+	// A new order says where it is in Location, an order fetched by its
+	// URL was requested from there
+	url := res.Header.Get("Location")
+	if url == "" {
+		url = req.URL.String()
+	}
+	t.orders[order.Finalize] = url
+	return res, nil
+}
@@ -0,0 +1,152 @@
+package cloud
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// AgentTokenPrefix marks agent tokens generated by the server
+const AgentTokenPrefix = "nat_"
+
+// tokenPrefixLen is how many leading characters of a secret are stored in
+// the clear to find its token without scanning the table
+const tokenPrefixLen = len(AgentTokenPrefix) + 8
+
+// DefaultTokenGracePeriod is how long the old secret stays valid after a rotation
+const DefaultTokenGracePeriod = 24 * time.Hour
+
+// Agent token authorization errors, sent back to the agent in auth responses
+var (
+	ErrTokenInvalid       = errors.New("Invalid token")
+	ErrTokenExpired       = errors.New("Token expired")
+	ErrTokenAgentMismatch = errors.New("Token not valid for this agent")
+	ErrTokenRuleDenied    = errors.New("Token not valid for this rule")
+)
+
+// generateTokenSecret returns a new random agent token secret
+func generateTokenSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return AgentTokenPrefix + hex.EncodeToString(buf), nil
+}
+
+// tokenPrefix returns the lookup prefix of a secret
+func tokenPrefix(secret string) string {
+	if len(secret) < tokenPrefixLen {
+		return secret
+	}
+	return secret[:tokenPrefixLen]
+}
+
+// hashTokenSecret hashes a secret with the given salt
+func hashTokenSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// setSecret sets the token's plaintext secret along with its prefix, salt and hash
+func (t *Token) setSecret(secret string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	t.Token = secret
+	t.Prefix = tokenPrefix(secret)
+	t.Salt = hex.EncodeToString(salt)
+	t.Hash = hashTokenSecret(t.Salt, secret)
+	return nil
+}
+
+// rotate replaces the token's secret with a new one. The old secret stays
+// valid for the grace period; a zero grace period revokes it immediately.
+func (t *Token) rotate(grace time.Duration) error {
+	secret, err := generateTokenSecret()
+	if err != nil {
+		return err
+	}
+
+	t.PrevPrefix, t.PrevSalt, t.PrevHash, t.PrevExpiresAt = "", "", "", nil
+	if grace > 0 {
+		expiresAt := time.Now().Add(grace)
+		t.PrevPrefix, t.PrevSalt, t.PrevHash = t.Prefix, t.Salt, t.Hash
+		t.PrevExpiresAt = &expiresAt
+	}
+	return t.setSecret(secret)
+}
+
+// Matches reports whether the secret is the token's current secret, or its
+// previous secret during the rotation grace period
+func (t *Token) Matches(secret string) bool {
+	if secureCompare(hashTokenSecret(t.Salt, secret), t.Hash) {
+		return true
+	}
+	return t.PrevHash != "" && t.PrevExpiresAt != nil && time.Now().Before(*t.PrevExpiresAt) &&
+		secureCompare(hashTokenSecret(t.PrevSalt, secret), t.PrevHash)
+}
+
+// Expired reports whether the token is past its expiry
+func (t *Token) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// AllowsAgent reports whether the token may be used by the given agent
+func (t *Token) AllowsAgent(agentID, agentName string) bool {
+	if t.AgentID != "" && t.AgentID != agentID {
+		return false
+	}
+	if t.AgentName != "" && t.AgentName != agentName {
+		return false
+	}
+	return true
+}
+
+// AllowsRule reports whether an agent using the token may serve the rule
+func (t *Token) AllowsRule(ruleID string) bool {
+	if len(t.AllowedRules) == 0 {
+		return true
+	}
+	for _, id := range t.AllowedRules {
+		if id == ruleID {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeAgentToken validates an agent token for the given agent identity.
+// It returns the matching stored token, or nil when the config token was used
+// (which is unrestricted).
+func (s *Server) authorizeAgentToken(token, agentID, agentName string) (*Token, error) {
+	// Check against config token
+	if s.config.Token != "" && secureCompare(token, s.config.Token) {
+		return nil, nil
+	}
+
+	// Check against stored tokens sharing the secret's prefix
+	tokens, _ := s.store.GetTokensByPrefix(tokenPrefix(token))
+	for _, t := range tokens {
+		if !t.Matches(token) {
+			continue
+		}
+		if t.Expired() {
+			return nil, ErrTokenExpired
+		}
+		if !t.AllowsAgent(agentID, agentName) {
+			return nil, ErrTokenAgentMismatch
+		}
+		s.store.IncrementTokenUsage(t.ID)
+		return t, nil
+	}
+
+	return nil, ErrTokenInvalid
+}
+
+// AllowsRule reports whether the agent's token lets it serve the rule
+func (a *AgentConn) AllowsRule(ruleID string) bool {
+	return a.Token == nil || a.Token.AllowsRule(ruleID)
+}
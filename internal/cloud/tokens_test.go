@@ -0,0 +1,125 @@
+package cloud
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenMatches(t *testing.T) {
+	tok := &Token{}
+	if err := tok.setSecret("nat_0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if tok.Prefix != "nat_01234567" || strings.Contains(tok.Hash, "0123456789abcdef") {
+		t.Fatalf("prefix %q, hash %q", tok.Prefix, tok.Hash)
+	}
+	if !tok.Matches("nat_0123456789abcdef") || tok.Matches("nat_0123456789abcdeF") || tok.Matches("") {
+		t.Fatal("secret matched wrongly")
+	}
+
+	// The same secret hashes differently under another salt
+	other := &Token{}
+	if err := other.setSecret("nat_0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if other.Salt == tok.Salt || other.Hash == tok.Hash {
+		t.Fatal("salt reused")
+	}
+}
+
+func TestTokenRotate(t *testing.T) {
+	tok := &Token{}
+	if err := tok.setSecret("nat_0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tok.rotate(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if tok.Token == "nat_0123456789abcdef" || tok.PrevPrefix != "nat_01234567" {
+		t.Fatalf("rotated token %+v", tok)
+	}
+	// Both secrets are accepted during the grace period
+	if !tok.Matches(tok.Token) || !tok.Matches("nat_0123456789abcdef") {
+		t.Fatal("secret refused during the grace period")
+	}
+
+	// The old secret is refused once the grace period is over
+	ended := time.Now().Add(-time.Second)
+	tok.PrevExpiresAt = &ended
+	if tok.Matches("nat_0123456789abcdef") || !tok.Matches(tok.Token) {
+		t.Fatal("old secret accepted after the grace period")
+	}
+
+	// A rotation without grace revokes the old secret at once
+	current := tok.Token
+	if err := tok.rotate(0); err != nil {
+		t.Fatal(err)
+	}
+	if tok.Matches(current) || tok.PrevHash != "" || tok.PrevExpiresAt != nil {
+		t.Fatalf("old secret kept: %+v", tok)
+	}
+}
+
+func TestAuthorizeAgentToken(t *testing.T) {
+	s := newTestServer(t)
+	secret, err := generateTokenSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := &Token{ID: "t1", Name: "web", AgentName: "web"}
+	if err := tok.setSecret(secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.CreateToken(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := s.authorizeAgentToken(secret, "agent-1", "web"); err != nil || got == nil || got.ID != "t1" {
+		t.Fatalf("authorized %+v, %v", got, err)
+	}
+	if _, err := s.authorizeAgentToken(secret, "agent-2", "db"); !errors.Is(err, ErrTokenAgentMismatch) {
+		t.Fatalf("other agent: %v, want ErrTokenAgentMismatch", err)
+	}
+	if _, err := s.authorizeAgentToken(secret+"0", "agent-1", "web"); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("wrong secret: %v, want ErrTokenInvalid", err)
+	}
+
+	// After a rotation, the stored previous secret is looked up by its prefix
+	if err := tok.rotate(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.RotateToken(tok); err != nil {
+		t.Fatal(err)
+	}
+	for _, sec := range []string{secret, tok.Token} {
+		if _, err := s.authorizeAgentToken(sec, "agent-1", "web"); err != nil {
+			t.Fatalf("during the grace period: %v", err)
+		}
+	}
+	ended := time.Now().Add(-time.Second)
+	tok.PrevExpiresAt = &ended
+	if err := s.store.RotateToken(tok); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.authorizeAgentToken(secret, "agent-1", "web"); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("after the grace period: %v, want ErrTokenInvalid", err)
+	}
+	if _, err := s.authorizeAgentToken(tok.Token, "agent-1", "web"); err != nil {
+		t.Fatalf("current secret after the grace period: %v", err)
+	}
+
+	// Expired tokens are refused
+	expired := &Token{ID: "t2", Name: "old", ExpiresAt: &ended}
+	old, _ := generateTokenSecret()
+	if err := expired.setSecret(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.CreateToken(expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.authorizeAgentToken(old, "agent-1", "web"); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expired token: %v, want ErrTokenExpired", err)
+	}
+}
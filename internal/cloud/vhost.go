@@ -0,0 +1,242 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// http rules are cloud-agent rules without a port of their own. Their
+// requests arrive on the cloud's HTTP(S) server, or the VHostAddr
+// listener, and are routed by Host and path to the rule's target through
+// a tunnel to the agent.
+
+// newHTTPProxy returns the reverse proxy of an http rule
+func (f *Forwarder) newHTTPProxy(state *ForwardRuleState) *httputil.ReverseProxy {
+	rule := state.Rule
+	target := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(rule.TargetHost, strconv.Itoa(rule.TargetPort)),
+	}
+
+	transport := &http.Transport{
+		// Every connection is a tunnel to the target, addr is always the target
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return f.dialHTTPRule(state)
+		},
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			// The target sees the public host, as with a port of its own
+			r.Out.Host = r.In.Host
+			rewriteHTTPRequest(rule, r)
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("HTTP rule %s: %s %s%s: %v", rule.Name, r.Method, r.Host, r.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// dialHTTPRule opens a tunnel to the target of an http rule. The tunnel
+// runs like a connection accepted on a tcp rule's port, except that
+// serveHTTP already checked the client of each request against the rule's
+// source filter.
+func (f *Forwarder) dialHTTPRule(state *ForwardRuleState) (net.Conn, error) {
+	rule := state.Rule
+	agent := f.server.GetAgentByName(rule.TargetAgentID)
+	if agent == nil {
+		agent = f.server.GetAgent(rule.TargetAgentID)
+	}
+	if agent == nil {
+		return nil, fmt.Errorf("target agent %s not connected", rule.TargetAgentID)
+	}
+
+	conn, tunnel := net.Pipe()
+	go f.tunnelRemoteTCP(state, tunnel)
+	return conn, nil
+}
+
+// closeHTTPProxy closes the idle tunnels of a stopped http rule
+func closeHTTPProxy(proxy *httputil.ReverseProxy) {
+	if transport, ok := proxy.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+// routeHost returns the running rule of a host-routed protocol, http or
+// tls-sni, that serves host and path, or nil. Exact domains win over
+// wildcards, longer wildcards over shorter ones, then longer path prefixes
+// over shorter ones.
+func (f *Forwarder) routeHost(protocol, host, urlPath string) *ForwardRuleState {
+	host = normalizeHost(host)
+
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+
+	var best *ForwardRuleState
+	bestRank := -1
+	for _, state := range f.rules {
+		if state.Rule.Protocol != protocol || !matchPathPrefix(state.Rule.PathPrefix, urlPath) {
+			continue
+		}
+		for _, domain := range state.Rule.Domains {
+			rank := matchDomain(domain, host)
+			if rank < 0 {
+				continue
+			}
+			if rank > bestRank || (rank == bestRank && len(state.Rule.PathPrefix) > len(best.Rule.PathPrefix)) {
+				best, bestRank = state, rank
+			}
+		}
+	}
+	return best
+}
+
+// servesHTTPDomain reports whether a running http rule has host as one of
+// its exact domains
+func (f *Forwarder) servesHTTPDomain(host string) bool {
+	host = normalizeHost(host)
+
+	f.rulesMu.RLock()
+	defer f.rulesMu.RUnlock()
+	for _, state := range f.rules {
+		if state.Rule.Protocol == "http" && slices.Contains(state.Rule.Domains, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain ranks how specifically a rule domain matches host: exact
+// domains above every wildcard, longer wildcards above shorter ones. It
+// returns -1 if the domain doesn't match.
+func matchDomain(domain, host string) int {
+	if domain == host {
+		return 1 << 16
+	}
+	// "*.example.com" matches subdomains at any depth, not example.com
+	if suffix, ok := strings.CutPrefix(domain, "*"); ok && len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+		return len(suffix)
+	}
+	return -1
+}
+
+// matchPathPrefix reports whether a request path is under a rule's path
+// prefix. "/api" matches "/api" and "/api/users", not "/apis".
+func matchPathPrefix(prefix, urlPath string) bool {
+	return prefix == "" || urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+}
+
+// normalizeHost strips the port and trailing dot of a Host header
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// normalizeDomains validates the domains of an http or tls-sni rule and
+// returns them lowercased and without duplicates
+func normalizeDomains(protocol string, domains []string) ([]string, error) {
+	var out []string
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain == "" {
+			continue
+		}
+		base := strings.TrimPrefix(domain, "*.")
+		if base == "" || strings.ContainsAny(base, "*:/ ") || strings.HasPrefix(base, ".") {
+			return nil, fmt.Errorf("invalid domain %q", domain)
+		}
+		if !slices.Contains(out, domain) {
+			out = append(out, domain)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("domains are required for %s rules", protocol)
+	}
+	return out, nil
+}
+
+// normalizePathPrefix cleans the path prefix of an http rule. The root
+// path is stored as no prefix.
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return ""
+	}
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+// hostRuleConflict returns the rule of the protocol among rules that
+// already serves one of the domains under the same path prefix, or nil
+func hostRuleConflict(rules []*ForwardRule, protocol string, domains []string, pathPrefix string) *ForwardRule {
+	for _, r := range rules {
+		if r.Protocol != protocol || r.PathPrefix != pathPrefix {
+			continue
+		}
+		for _, domain := range domains {
+			if slices.Contains(r.Domains, domain) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// vhostHandler serves requests for the hosts of http rules through their
+// rules, and passes the others to next, or answers them 404 if next is nil
+func (s *Server) vhostHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state := s.forwarder.routeHost("http", r.Host, r.URL.Path); state != nil {
+			s.forwarder.serveHTTP(state, w, r)
+			return
+		}
+		if next == nil {
+			http.Error(w, "No rule serves this host", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenVHost starts the plain HTTP listener of http rules, unless the
+// ACME HTTP-01 listener is on the same address and serves them itself
+func (s *Server) listenVHost() error {
+	addr := s.config.VHostAddr
+	if addr == "" || (s.acmeServer != nil && addr == s.config.ACMEHTTPAddr) {
+		return nil
+	}
+
+	listener, err := s.listenTCP(addr)
+	if err != nil {
+		return fmt.Errorf("http rules listener: %w", err)
+	}
+	s.vhostServer = &http.Server{Handler: s.vhostHandler(nil)}
+	go func() {
+		if err := s.vhostServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP rules listener error: %v", err)
+		}
+	}()
+	log.Printf("Serving http rules on %s", addr)
+	return nil
+}
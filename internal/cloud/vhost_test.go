@@ -0,0 +1,137 @@
+package cloud
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+// fakeAgentConn is the control connection of an agent that records the
+// messages the cloud sends it
+type fakeAgentConn struct {
+	sent chan *protocol.Message
+}
+
+func (c *fakeAgentConn) ReadMessage() (int, []byte, error) { select {} }
+func (c *fakeAgentConn) SetReadDeadline(time.Time) error   { return nil }
+func (c *fakeAgentConn) RemoteAddr() net.Addr              { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *fakeAgentConn) Close() error                      { return nil }
+
+func (c *fakeAgentConn) WriteMessage(_ int, data []byte) error {
+	msg, err := protocol.DecodeFromBytes(data)
+	if err != nil {
+		return err
+	}
+	c.sent <- msg
+	return nil
+}
+
+// newTestServer returns a server on a fresh database, not listening
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer(&Config{DBPath: filepath.Join(t.TempDir(), "natsvr.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.cancel()
+		s.store.Close()
+	})
+	return s
+}
+
+// addTestAgent connects a fake agent to a server
+func addTestAgent(s *Server, id, name string) (*AgentConn, *fakeAgentConn) {
+	conn := &fakeAgentConn{sent: make(chan *protocol.Message, 16)}
+	agent := &AgentConn{
+		ID:           id,
+		Name:         name,
+		Conn:         conn,
+		ConnectedAt:  time.Now(),
+		Capabilities: protocol.LocalCapabilities,
+		tunnels:      make(map[uint32]*Tunnel),
+		ruleConns:    make(map[string]*RuleConn),
+	}
+	s.agentsMu.Lock()
+	s.agents[id] = agent
+	s.agentsMu.Unlock()
+	return agent, conn
+}
+
+func TestHTTPRuleAllowList(t *testing.T) {
+	s := newTestServer(t)
+	agent, agentConn := addTestAgent(s, "agent-1", "web")
+	f := s.forwarder
+
+	rule := &ForwardRule{
+		ID:            "rule-1",
+		Name:          "site",
+		Type:          "cloud-agent",
+		Protocol:      "http",
+		Domains:       []string{"example.com"},
+		TargetAgentID: "web",
+		TargetHost:    "127.0.0.1",
+		TargetPort:    8080,
+		AllowCIDRs:    []string{"192.0.2.0/24"},
+		Enabled:       true,
+	}
+	if err := f.StartRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	state := f.routeHost("http", "example.com", "/")
+	if state == nil {
+		t.Fatal("http rule not routed")
+	}
+
+	serve := func(remoteAddr string) chan int {
+		status := make(chan int, 1)
+		go func() {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = remoteAddr
+			rec := httptest.NewRecorder()
+			f.serveHTTP(state, rec, req)
+			status <- rec.Code
+		}()
+		return status
+	}
+
+	// An allowed client is tunnelled to the agent, the tunnel isn't
+	// checked again
+	status := serve("192.0.2.10:40000")
+	var connect *protocol.Message
+	select {
+	case connect = <-agentConn.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("allowed request sent no connect to the agent")
+	}
+	if connect.Type != protocol.MsgTypeConnect {
+		t.Fatalf("agent got %s, want a connect", connect.Type)
+	}
+	f.HandleConnectAck(agent, protocol.NewMessage(protocol.MsgTypeConnectAck, connect.TunnelID,
+		protocol.EncodeConnectAckPayload(&protocol.ConnectAckPayload{Success: false, Error: "refused"})))
+	if code := <-status; code != http.StatusBadGateway {
+		t.Errorf("allowed request with a failed tunnel: status %d, want %d", code, http.StatusBadGateway)
+	}
+	if rejected := atomic.LoadInt64(&state.Rejected); rejected != 0 {
+		t.Errorf("allowed request counted %d rejections", rejected)
+	}
+
+	// Other clients are refused before any tunnel is opened
+	if code := <-serve("198.51.100.7:40000"); code != http.StatusForbidden {
+		t.Errorf("denied request: status %d, want %d", code, http.StatusForbidden)
+	}
+	if rejected := atomic.LoadInt64(&state.Rejected); rejected != 1 {
+		t.Errorf("denied request counted %d rejections, want 1", rejected)
+	}
+	select {
+	case msg := <-agentConn.sent:
+		t.Errorf("denied request sent %s to the agent", msg.Type)
+	default:
+	}
+}
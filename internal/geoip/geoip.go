@@ -0,0 +1,90 @@
+// Package geoip looks up the country of IP addresses in a local MaxMind DB
+// file, such as GeoLite2-Country.mmdb or DB-IP's IP to Country Lite.
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is an open MaxMind DB file
+type DB struct {
+	Type      string    // Database type, e.g. "GeoLite2-Country"
+	BuildTime time.Time // When the database was built
+
+	reader *maxminddb.Reader
+
+	mu        sync.RWMutex
+	countries map[uintptr]string // By data offset, lookups share few records
+}
+
+// record is the part of a database record lookups need. GeoLite2 and
+// DB-IP store the country as a map with an iso_code, others as a plain
+// code.
+type record struct {
+	Country any `maxminddb:"country"`
+}
+
+// Open opens a MaxMind DB file
+func Open(path string) (*DB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{
+		Type:      reader.Metadata.DatabaseType,
+		BuildTime: time.Unix(int64(reader.Metadata.BuildEpoch), 0),
+		reader:    reader,
+		countries: make(map[uintptr]string),
+	}, nil
+}
+
+// Close closes the file
+func (db *DB) Close() error {
+	return db.reader.Close()
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country an address
+// is in, empty if the database doesn't know it
+func (db *DB) Country(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
+	}
+	offset, err := db.reader.LookupOffset(net.IP(ip.Unmap().AsSlice()))
+	if err != nil || offset == maxminddb.NotFound {
+		return ""
+	}
+
+	db.mu.RLock()
+	country, cached := db.countries[offset]
+	db.mu.RUnlock()
+	if cached {
+		return country
+	}
+
+	var rec record
+	if err := db.reader.Decode(offset, &rec); err == nil {
+		country = countryOf(rec.Country)
+	}
+	db.mu.Lock()
+	db.countries[offset] = country
+	db.mu.Unlock()
+	return country
+}
+
+// countryOf returns the code of a record's country field
+func countryOf(value any) string {
+	switch country := value.(type) {
+	case map[string]any:
+		code, _ := country["iso_code"].(string)
+		return strings.ToUpper(code)
+	case string:
+		return strings.ToUpper(country)
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package geoip
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//go:generate go run testdata/mkdb.go
+
+const testDB = "testdata/countries.mmdb"
+
+func TestOpen(t *testing.T) {
+	db, err := Open(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.reader.Verify(); err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+	if db.Type != "Test-Country" {
+		t.Errorf("Type = %q, want Test-Country", db.Type)
+	}
+	if db.BuildTime.Unix() != 1700000000 {
+		t.Errorf("BuildTime = %v", db.BuildTime)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"empty":     nil,
+		"no marker": []byte("not a database"),
+		"bad tree":  []byte("\xab\xcd\xefMaxMind.com\xe2\x4anode_count\xc3\xff\xff\xff\x4brecord_size\xa1\x18"),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if db, err := Open(path); err == nil {
+			db.Close()
+			t.Errorf("%s: opened", name)
+		}
+	}
+	if _, err := Open(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file: opened")
+	}
+}
+
+func TestCountry(t *testing.T) {
+	db, err := Open(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "US"},        // country.iso_code
+		{"192.0.2.255", "US"},      // Last address of the network
+		{"::ffff:192.0.2.7", "US"}, // IPv4-mapped
+		{"198.51.100.9", "JP"},     // Plain lower case code behind a pointer
+		{"203.0.113.200", "DE"},    // Another record
+		{"2001:db8::1", "DE"},      // IPv6
+		{"2001:db8:ffff::1", "DE"}, // IPv6, end of the network
+		{"100.100.1.1", ""},        // Record without a country
+		{"192.0.3.1", ""},          // Next to a known network
+		{"8.8.8.8", ""},            // Not in the tree
+		{"2001:db9::1", ""},        // Not in the tree
+		{"::", ""},                 // Left edge
+		{"ffff:ffff:ffff::", ""},   // Right edge
+	}
+	for _, tt := range tests {
+		// Twice, the second lookup is cached
+		for range 2 {
+			if got := db.Country(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("Country(%s) = %q, want %q", tt.ip, got, tt.want)
+			}
+		}
+	}
+	if got := db.Country(netip.Addr{}); got != "" {
+		t.Errorf("Country(invalid) = %q", got)
+	}
+}
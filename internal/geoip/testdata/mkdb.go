@@ -0,0 +1,169 @@
+//go:build ignore
+
+// mkdb writes countries.mmdb, the MaxMind DB the tests look up: an IPv6
+// tree with 24-bit records and the country of a few documentation
+// networks, stored the ways real databases store it.
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net/netip"
+	"os"
+)
+
+// Data section types
+const (
+	typePointer = 1
+	typeString  = 2
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+	typeUint64  = 9 // Extended
+	typeArray   = 11
+)
+
+func ctrl(typ, size int) []byte {
+	if typ > 7 {
+		return []byte{byte(size), byte(typ - 7)}
+	}
+	return []byte{byte(typ<<5 | size)}
+}
+
+func str(s string) []byte {
+	return append(ctrl(typeString, len(s)), s...)
+}
+
+func unsigned(typ, size int, n uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, n)
+	return append(ctrl(typ, size), b[8-size:]...)
+}
+
+func pointer(offset int) []byte {
+	return []byte{byte(typePointer<<5 | offset>>8), byte(offset)}
+}
+
+func array(values ...[]byte) []byte {
+	b := ctrl(typeArray, len(values))
+	for _, v := range values {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// kv is a map entry, maps keep their order
+type kv struct {
+	key   string
+	value []byte
+}
+
+func dict(entries ...kv) []byte {
+	b := ctrl(typeMap, len(entries))
+	for _, e := range entries {
+		b = append(append(b, str(e.key)...), e.value...)
+	}
+	return b
+}
+
+// node is a node of the search tree, a child is a *node, a data offset
+// (int) or nil for no data
+type node struct {
+	child [2]any
+	id    int
+}
+
+func (n *node) insert(prefix netip.Prefix, offset int) {
+	// IPv4 networks go under ::/96, where lookups of IPv4 addresses start
+	var addr [16]byte
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		v4 := prefix.Addr().As4()
+		copy(addr[12:], v4[:])
+		bits += 96
+	} else {
+		addr = prefix.Addr().As16()
+	}
+	for i := 0; i < bits; i++ {
+		bit := addr[i/8] >> (7 - i%8) & 1
+		if i == bits-1 {
+			n.child[bit] = offset
+			return
+		}
+		next, ok := n.child[bit].(*node)
+		if !ok {
+			next = &node{}
+			n.child[bit] = next
+		}
+		n = next
+	}
+}
+
+func (n *node) number(nodes []*node) []*node {
+	n.id = len(nodes)
+	nodes = append(nodes, n)
+	for _, c := range n.child {
+		if c, ok := c.(*node); ok {
+			nodes = c.number(nodes)
+		}
+	}
+	return nodes
+}
+
+func main() {
+	var data []byte
+	add := func(b []byte) int {
+		offset := len(data)
+		data = append(data, b...)
+		return offset
+	}
+
+	us := add(dict(
+		kv{"country", dict(kv{"geoname_id", unsigned(typeUint32, 3, 6252001)}, kv{"iso_code", str("US")})},
+		kv{"continent", dict(kv{"code", str("NA")})},
+	))
+	de := add(dict(kv{"country", dict(kv{"iso_code", str("DE")})}))
+	// A plain, lower case code, its key a pointer to the one of us
+	jp := add(append(append(ctrl(typeMap, 1), pointer(us+1)...), str("jp")...))
+	// No country
+	eu := add(dict(kv{"continent", dict(kv{"code", str("EU")})}))
+
+	root := &node{}
+	root.insert(netip.MustParsePrefix("192.0.2.0/24"), us)
+	root.insert(netip.MustParsePrefix("198.51.100.0/24"), jp)
+	root.insert(netip.MustParsePrefix("203.0.113.0/24"), de)
+	root.insert(netip.MustParsePrefix("2001:db8::/32"), de)
+	root.insert(netip.MustParsePrefix("100.64.0.0/10"), eu)
+	nodes := root.number(nil)
+
+	var tree []byte
+	for _, n := range nodes {
+		for _, c := range n.child {
+			record := len(nodes) // No data
+			switch c := c.(type) {
+			case *node:
+				record = c.id
+			case int:
+				record = len(nodes) + 16 + c
+			}
+			tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, "\xab\xcd\xefMaxMind.com"...)
+	file = append(file, dict(
+		kv{"binary_format_major_version", unsigned(typeUint16, 1, 2)},
+		kv{"binary_format_minor_version", unsigned(typeUint16, 0, 0)},
+		kv{"build_epoch", unsigned(typeUint64, 4, 1700000000)},
+		kv{"database_type", str("Test-Country")},
+		kv{"description", dict(kv{"en", str("natsvr test countries")})},
+		kv{"ip_version", unsigned(typeUint16, 1, 6)},
+		kv{"languages", array(str("en"))},
+		kv{"node_count", unsigned(typeUint32, 2, uint64(len(nodes)))},
+		kv{"record_size", unsigned(typeUint16, 1, 24)},
+	)...)
+	if err := os.WriteFile("testdata/countries.mmdb", file, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
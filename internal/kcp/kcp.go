@@ -0,0 +1,590 @@
+// Package kcp runs reliable byte streams over UDP with KCP, an ARQ
+// protocol that trades bandwidth for latency: it retransmits early and
+// doesn't back off the way TCP does, which holds up far better on lossy
+// links.
+//
+// Segments use the standard KCP wire format in stream mode, without FEC
+// or packet encryption; callers run TLS on top.
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+)
+
+const (
+	rtoNoDelay = 30 // Minimum RTO in no-delay mode, in ms
+	rtoMin     = 100
+	rtoDefault = 200
+	rtoMax     = 60000
+
+	cmdPush       = 81 // Data
+	cmdAck        = 82
+	cmdWindowAsk  = 83 // Ask the peer for its window size
+	cmdWindowTell = 84 // Tell the peer our window size
+
+	askSend = 1 // Send cmdWindowAsk
+	askTell = 2 // Send cmdWindowTell
+
+	overhead   = 24 // Segment header size
+	deadLink   = 20 // Transmissions of one segment before the peer counts as gone
+	fastLimit  = 5  // Transmissions of one segment after which only timeouts resend it
+	threshInit = 2
+	threshMin  = 2
+	probeInit  = 7000   // Initial window probe interval, in ms
+	probeLimit = 120000 // Maximum window probe interval, in ms
+)
+
+var (
+	errShortPacket = errors.New("kcp: short packet")
+	errConv        = errors.New("kcp: conversation mismatch")
+	errCommand     = errors.New("kcp: unknown command")
+)
+
+var epoch = time.Now()
+
+// currentMs is the KCP clock, in milliseconds. It wraps around; compare
+// timestamps with diff.
+func currentMs() uint32 {
+	return uint32(time.Since(epoch) / time.Millisecond)
+}
+
+// diff compares two wrapping sequence numbers or timestamps
+func diff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+type segment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	rto      uint32
+	xmit     uint32
+	resendts uint32
+	fastack  uint32
+	data     []byte
+}
+
+// encode appends the segment header to buf
+func (s *segment) encode(buf []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, s.conv)
+	buf = append(buf, s.cmd, s.frg)
+	buf = binary.LittleEndian.AppendUint16(buf, s.wnd)
+	buf = binary.LittleEndian.AppendUint32(buf, s.ts)
+	buf = binary.LittleEndian.AppendUint32(buf, s.sn)
+	buf = binary.LittleEndian.AppendUint32(buf, s.una)
+	return binary.LittleEndian.AppendUint32(buf, uint32(len(s.data)))
+}
+
+type ack struct {
+	sn uint32
+	ts uint32
+}
+
+// kcp is the protocol state of one conversation. It does no I/O of its
+// own: packets come in through input and go out through output, and
+// flush must be called regularly to drive retransmissions. It is not safe
+// for concurrent use.
+type kcp struct {
+	conv uint32
+	mtu  uint32
+	mss  uint32
+	dead bool // A segment went unacknowledged deadLink times
+
+	sndUna uint32 // First unacknowledged segment
+	sndNxt uint32 // Next segment to send
+	rcvNxt uint32 // Next segment to deliver
+
+	ssthresh uint32
+	rxRttvar int32
+	rxSrtt   int32
+	rxRto    uint32
+	rxMinrto uint32
+
+	sndWnd uint32
+	rcvWnd uint32
+	rmtWnd uint32
+	cwnd   uint32
+	incr   uint32
+	probe  uint32
+
+	interval   uint32
+	tsProbe    uint32
+	probeWait  uint32
+	nodelay    bool
+	fastresend uint32
+	nocwnd     bool
+
+	sndQueue []segment // Written, waiting for the send window
+	sndBuf   []segment // Sent, waiting for acknowledgement
+	rcvQueue []segment // In order, waiting to be read
+	rcvBuf   []segment // Received out of order
+	acklist  []ack
+
+	buffer []byte
+	output func(packet []byte)
+	clock  func() uint32 // currentMs, replaced in tests
+}
+
+func newKCP(conv uint32, output func(packet []byte)) *kcp {
+	k := &kcp{
+		conv:     conv,
+		sndWnd:   32,
+		rcvWnd:   128,
+		rmtWnd:   128,
+		rxRto:    rtoDefault,
+		rxMinrto: rtoMin,
+		interval: 100,
+		ssthresh: threshInit,
+		output:   output,
+		clock:    currentMs,
+	}
+	k.setMTU(1400)
+	return k
+}
+
+// setMTU sets the largest packet passed to output
+func (k *kcp) setMTU(mtu uint32) {
+	k.mtu = mtu
+	k.mss = mtu - overhead
+	k.buffer = make([]byte, 0, mtu)
+}
+
+// setWindow sets the send and receive windows, in segments
+func (k *kcp) setWindow(snd, rcv uint32) {
+	k.sndWnd = snd
+	k.rcvWnd = max(rcv, 128)
+}
+
+// setNoDelay tunes retransmission: nodelay lowers the minimum RTO and
+// backs off slower, interval is how often flush is called in ms, resend
+// retransmits a segment once that many later ones were acknowledged (0 =
+// off) and nc turns off congestion control.
+func (k *kcp) setNoDelay(nodelay bool, interval, resend uint32, nc bool) {
+	k.nodelay = nodelay
+	if nodelay {
+		k.rxMinrto = rtoNoDelay
+	} else {
+		k.rxMinrto = rtoMin
+	}
+	k.interval = min(max(interval, 10), 5000)
+	k.fastresend = resend
+	k.nocwnd = nc
+}
+
+// waitSnd is the number of segments not yet acknowledged
+func (k *kcp) waitSnd() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+// readable reports whether recv has data
+func (k *kcp) readable() bool {
+	return len(k.rcvQueue) > 0
+}
+
+// recv reads in-order data into buf and returns how much it read
+func (k *kcp) recv(buf []byte) int {
+	fastRecover := uint32(len(k.rcvQueue)) >= k.rcvWnd
+
+	n, count := 0, 0
+	for i := range k.rcvQueue {
+		seg := &k.rcvQueue[i]
+		copied := copy(buf[n:], seg.data)
+		n += copied
+		if copied < len(seg.data) {
+			seg.data = seg.data[copied:]
+			break
+		}
+		count++
+		if n == len(buf) {
+			break
+		}
+	}
+	k.rcvQueue = slices.Delete(k.rcvQueue, 0, count)
+	k.moveReceived()
+
+	// The window reopened, tell the peer instead of waiting for its probe
+	if fastRecover && uint32(len(k.rcvQueue)) < k.rcvWnd {
+		k.probe |= askTell
+	}
+	return n
+}
+
+// send queues data, filling up the last queued segment first
+func (k *kcp) send(buf []byte) {
+	if n := len(k.sndQueue); n > 0 {
+		last := &k.sndQueue[n-1]
+		if room := int(k.mss) - len(last.data); room > 0 {
+			extend := min(room, len(buf))
+			last.data = append(last.data, buf[:extend]...)
+			buf = buf[extend:]
+		}
+	}
+	for len(buf) > 0 {
+		size := min(len(buf), int(k.mss))
+		data := make([]byte, size, k.mss)
+		copy(data, buf)
+		k.sndQueue = append(k.sndQueue, segment{data: data})
+		buf = buf[size:]
+	}
+}
+
+func (k *kcp) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttvar = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttvar = (3*k.rxRttvar + delta) / 4
+		k.rxSrtt = (7*k.rxSrtt + rtt) / 8
+		if k.rxSrtt < 1 {
+			k.rxSrtt = 1
+		}
+	}
+	rto := uint32(k.rxSrtt) + max(k.interval, uint32(4*k.rxRttvar))
+	k.rxRto = min(max(k.rxMinrto, rto), rtoMax)
+}
+
+func (k *kcp) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *kcp) parseAck(sn uint32) {
+	if diff(sn, k.sndUna) < 0 || diff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i := range k.sndBuf {
+		if sn == k.sndBuf[i].sn {
+			k.sndBuf = slices.Delete(k.sndBuf, i, i+1)
+			break
+		}
+		if diff(sn, k.sndBuf[i].sn) < 0 {
+			break
+		}
+	}
+}
+
+// parseFastack counts the segments before the highest acknowledged one as
+// skipped, for fast retransmission
+func (k *kcp) parseFastack(sn uint32) {
+	if diff(sn, k.sndUna) < 0 || diff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i := range k.sndBuf {
+		seg := &k.sndBuf[i]
+		if diff(sn, seg.sn) < 0 {
+			break
+		}
+		if sn != seg.sn {
+			seg.fastack++
+		}
+	}
+}
+
+// parseUna drops the segments the peer received everything up to
+func (k *kcp) parseUna(una uint32) {
+	count := 0
+	for i := range k.sndBuf {
+		if diff(una, k.sndBuf[i].sn) <= 0 {
+			break
+		}
+		count++
+	}
+	k.sndBuf = slices.Delete(k.sndBuf, 0, count)
+}
+
+func (k *kcp) parseData(newseg segment) {
+	sn := newseg.sn
+	if diff(sn, k.rcvNxt+k.rcvWnd) >= 0 || diff(sn, k.rcvNxt) < 0 {
+		return
+	}
+
+	idx := 0
+	for i := len(k.rcvBuf) - 1; i >= 0; i-- {
+		seg := &k.rcvBuf[i]
+		if seg.sn == sn {
+			return // Duplicate
+		}
+		if diff(sn, seg.sn) > 0 {
+			idx = i + 1
+			break
+		}
+	}
+	k.rcvBuf = slices.Insert(k.rcvBuf, idx, newseg)
+	k.moveReceived()
+}
+
+// moveReceived moves segments that are next in order to the receive
+// queue, as far as the receive window allows
+func (k *kcp) moveReceived() {
+	count := 0
+	for i := range k.rcvBuf {
+		if k.rcvBuf[i].sn != k.rcvNxt || uint32(len(k.rcvQueue)+count) >= k.rcvWnd {
+			break
+		}
+		k.rcvNxt++
+		count++
+	}
+	if count > 0 {
+		k.rcvQueue = append(k.rcvQueue, k.rcvBuf[:count]...)
+		k.rcvBuf = slices.Delete(k.rcvBuf, 0, count)
+	}
+}
+
+// input processes a packet from the peer
+func (k *kcp) input(data []byte) error {
+	if len(data) < overhead {
+		return errShortPacket
+	}
+	current := k.clock()
+	prevUna := k.sndUna
+	var maxAck uint32
+	acked := false
+
+	for len(data) >= overhead {
+		conv := binary.LittleEndian.Uint32(data)
+		cmd := data[4]
+		frg := data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[overhead:]
+
+		if conv != k.conv {
+			return errConv
+		}
+		if uint32(len(data)) < length {
+			return errShortPacket
+		}
+		switch cmd {
+		case cmdPush, cmdAck, cmdWindowAsk, cmdWindowTell:
+		default:
+			return errCommand
+		}
+
+		k.rmtWnd = uint32(wnd)
+		k.parseUna(una)
+		k.shrinkBuf()
+
+		switch cmd {
+		case cmdAck:
+			if rtt := diff(current, ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(sn)
+			k.shrinkBuf()
+			if !acked || diff(sn, maxAck) > 0 {
+				acked = true
+				maxAck = sn
+			}
+		case cmdPush:
+			if diff(sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.acklist = append(k.acklist, ack{sn: sn, ts: ts})
+				if diff(sn, k.rcvNxt) >= 0 {
+					k.parseData(segment{
+						conv: conv,
+						cmd:  cmd,
+						frg:  frg,
+						wnd:  wnd,
+						ts:   ts,
+						sn:   sn,
+						una:  una,
+						data: bytes.Clone(data[:length]),
+					})
+				}
+			}
+		case cmdWindowAsk:
+			k.probe |= askTell
+		}
+		data = data[length:]
+	}
+
+	if acked {
+		k.parseFastack(maxAck)
+	}
+
+	// Grow the congestion window as acknowledgements come in
+	if diff(k.sndUna, prevUna) > 0 && k.cwnd < k.rmtWnd {
+		mss := k.mss
+		if k.cwnd < k.ssthresh {
+			k.cwnd++
+			k.incr += mss
+		} else {
+			if k.incr < mss {
+				k.incr = mss
+			}
+			k.incr += (mss*mss)/k.incr + mss/16
+			if (k.cwnd+1)*mss <= k.incr {
+				k.cwnd = (k.incr + mss - 1) / mss
+			}
+		}
+		if k.cwnd > k.rmtWnd {
+			k.cwnd = k.rmtWnd
+			k.incr = k.rmtWnd * mss
+		}
+	}
+	return nil
+}
+
+func (k *kcp) wndUnused() uint16 {
+	if n := uint32(len(k.rcvQueue)); n < k.rcvWnd {
+		return uint16(k.rcvWnd - n)
+	}
+	return 0
+}
+
+// flush sends pending acknowledgements and window probes, moves queued
+// data into the send window and sends what is new or due for
+// retransmission
+func (k *kcp) flush() {
+	current := k.clock()
+	seg := segment{
+		conv: k.conv,
+		cmd:  cmdAck,
+		wnd:  k.wndUnused(),
+		una:  k.rcvNxt,
+	}
+
+	buf := k.buffer[:0]
+	makeSpace := func(space int) {
+		if len(buf)+space > int(k.mtu) {
+			k.output(buf)
+			buf = k.buffer[:0]
+		}
+	}
+
+	for _, a := range k.acklist {
+		makeSpace(overhead)
+		seg.sn, seg.ts = a.sn, a.ts
+		buf = seg.encode(buf)
+	}
+	k.acklist = k.acklist[:0]
+
+	// Probe a peer whose window is full
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = probeInit
+			k.tsProbe = current + k.probeWait
+		} else if diff(current, k.tsProbe) >= 0 {
+			k.probeWait = max(k.probeWait, probeInit)
+			k.probeWait = min(k.probeWait+k.probeWait/2, probeLimit)
+			k.tsProbe = current + k.probeWait
+			k.probe |= askSend
+		}
+	} else {
+		k.tsProbe = 0
+		k.probeWait = 0
+	}
+	seg.sn, seg.ts = 0, 0
+	if k.probe&askSend != 0 {
+		seg.cmd = cmdWindowAsk
+		makeSpace(overhead)
+		buf = seg.encode(buf)
+	}
+	if k.probe&askTell != 0 {
+		seg.cmd = cmdWindowTell
+		makeSpace(overhead)
+		buf = seg.encode(buf)
+	}
+	k.probe = 0
+
+	cwnd := min(k.sndWnd, k.rmtWnd)
+	if !k.nocwnd {
+		cwnd = min(k.cwnd, cwnd)
+	}
+	moved := 0
+	for moved < len(k.sndQueue) && diff(k.sndNxt, k.sndUna+cwnd) < 0 {
+		newseg := k.sndQueue[moved]
+		newseg.conv = k.conv
+		newseg.cmd = cmdPush
+		newseg.sn = k.sndNxt
+		k.sndBuf = append(k.sndBuf, newseg)
+		k.sndNxt++
+		moved++
+	}
+	k.sndQueue = slices.Delete(k.sndQueue, 0, moved)
+
+	resent := k.fastresend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+	var rtomin uint32
+	if !k.nodelay {
+		rtomin = k.rxRto >> 3
+	}
+
+	change, lost := false, false
+	for i := range k.sndBuf {
+		s := &k.sndBuf[i]
+		needsend := false
+		switch {
+		case s.xmit == 0:
+			needsend = true
+			s.rto = k.rxRto
+			s.resendts = current + s.rto + rtomin
+		case diff(current, s.resendts) >= 0:
+			needsend = true
+			if k.nodelay {
+				s.rto += s.rto / 2
+			} else {
+				s.rto += max(s.rto, k.rxRto)
+			}
+			s.resendts = current + s.rto
+			lost = true
+		case s.fastack >= resent && s.xmit <= fastLimit:
+			needsend = true
+			s.fastack = 0
+			s.resendts = current + s.rto
+			change = true
+		}
+		if !needsend {
+			continue
+		}
+
+		s.xmit++
+		s.ts = current
+		s.wnd = seg.wnd
+		s.una = k.rcvNxt
+		makeSpace(overhead + len(s.data))
+		buf = s.encode(buf)
+		buf = append(buf, s.data...)
+		if s.xmit >= deadLink {
+			k.dead = true
+		}
+	}
+	if len(buf) > 0 {
+		k.output(buf)
+	}
+
+	if change {
+		inflight := k.sndNxt - k.sndUna
+		k.ssthresh = max(inflight/2, threshMin)
+		k.cwnd = k.ssthresh + resent
+		k.incr = k.cwnd * k.mss
+	}
+	if lost {
+		k.ssthresh = max(cwnd/2, threshMin)
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+	if k.cwnd < 1 {
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+}
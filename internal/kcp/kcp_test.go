@@ -0,0 +1,330 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// link is a simulated network between two conversations, driven by a fake
+// clock. It drops, duplicates and delays packets at random, which also
+// reorders them.
+type link struct {
+	rng      *rand.Rand
+	now      uint32 // Fake clock, in ms
+	loss     float64
+	dup      float64
+	maxDelay uint32 // Packets arrive after 1..maxDelay ms
+	inflight []packet
+}
+
+type packet struct {
+	at   uint32
+	to   *kcp
+	data []byte
+}
+
+// pair returns two conversations connected by the link
+func (l *link) pair(conv uint32) (*kcp, *kcp) {
+	clock := func() uint32 { return l.now }
+	var a, b *kcp
+	a = newKCP(conv, func(p []byte) { l.send(b, p) })
+	b = newKCP(conv, func(p []byte) { l.send(a, p) })
+	a.clock, b.clock = clock, clock
+	return a, b
+}
+
+func (l *link) send(to *kcp, data []byte) {
+	copies := 1
+	if l.rng.Float64() < l.loss {
+		copies = 0
+	} else if l.rng.Float64() < l.dup {
+		copies = 2
+	}
+	for range copies {
+		delay := 1 + uint32(l.rng.Int63n(int64(max(l.maxDelay, 1))))
+		l.inflight = append(l.inflight, packet{at: l.now + delay, to: to, data: bytes.Clone(data)})
+	}
+}
+
+// step advances the clock by 1 ms, delivering the packets due and
+// flushing both conversations every interval
+func (l *link) step(t *testing.T, a, b *kcp) {
+	t.Helper()
+	l.now++
+	due := l.inflight[:0:0]
+	var later []packet
+	for _, p := range l.inflight {
+		if diff(l.now, p.at) >= 0 {
+			due = append(due, p)
+		} else {
+			later = append(later, p)
+		}
+	}
+	l.inflight = later
+	for _, p := range due {
+		if err := p.to.input(p.data); err != nil {
+			t.Fatalf("input: %v", err)
+		}
+	}
+	if l.now%a.interval == 0 {
+		a.flush()
+		b.flush()
+	}
+}
+
+// transfer sends data from a to b over the link and returns what b read
+func transfer(t *testing.T, l *link, a, b *kcp, data []byte, readChunk int) []byte {
+	t.Helper()
+	var got []byte
+	buf := make([]byte, readChunk)
+	rest := data
+	for i := 0; len(got) < len(data); i++ {
+		if i > 600000 {
+			t.Fatalf("received %d of %d bytes in 10 minutes", len(got), len(data))
+		}
+		// Write as an application would, bounded by the unacknowledged data
+		for len(rest) > 0 && a.waitSnd() < 2*int(a.sndWnd) {
+			n := min(len(rest), 3000)
+			a.send(rest[:n])
+			rest = rest[n:]
+		}
+		l.step(t, a, b)
+		for b.readable() {
+			n := b.recv(buf)
+			got = append(got, buf[:n]...)
+		}
+		if uint32(len(b.rcvQueue)) > b.rcvWnd {
+			t.Fatalf("receive queue of %d segments exceeds the window of %d", len(b.rcvQueue), b.rcvWnd)
+		}
+		if inflight := a.sndNxt - a.sndUna; inflight > a.sndWnd {
+			t.Fatalf("%d segments in flight exceed the send window of %d", inflight, a.sndWnd)
+		}
+		if a.dead {
+			t.Fatal("link reported dead")
+		}
+	}
+	// Everything is acknowledged eventually
+	for i := 0; a.waitSnd() > 0; i++ {
+		if i > 60000 {
+			t.Fatalf("%d segments still unacknowledged", a.waitSnd())
+		}
+		l.step(t, a, b)
+	}
+	return got
+}
+
+func TestDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		loss     float64
+		dup      float64
+		maxDelay uint32
+		session  bool // Tuned like sessions, else KCP defaults with congestion control
+	}{
+		{"clean", 0, 0, 1, true},
+		{"reordered", 0, 0, 40, true},
+		{"duplicated", 0, 0.2, 20, true},
+		{"lossy", 0.1, 0, 5, true},
+		{"very lossy and reordered", 0.3, 0.05, 30, true},
+		{"clean, congestion control", 0, 0, 1, false},
+		{"lossy, congestion control", 0.1, 0.05, 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &link{rng: rand.New(rand.NewSource(1)), loss: tt.loss, dup: tt.dup, maxDelay: tt.maxDelay}
+			a, b := l.pair(7)
+			if tt.session {
+				for _, k := range []*kcp{a, b} {
+					k.setMTU(mtu)
+					k.setWindow(128, 128)
+					k.setNoDelay(true, 10, fastResend, true)
+				}
+			}
+
+			data := make([]byte, 300<<10)
+			l.rng.Read(data)
+			got := transfer(t, l, a, b, data, 1000)
+			if !bytes.Equal(got, data) {
+				t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(data))
+			}
+
+			// And back, reading a byte at a time
+			back := transfer(t, l, b, a, data[:8<<10], 1)
+			if !bytes.Equal(back, data[:8<<10]) {
+				t.Fatal("data sent back differs")
+			}
+		})
+	}
+}
+
+func TestFullReceiveWindow(t *testing.T) {
+	l := &link{rng: rand.New(rand.NewSource(2)), maxDelay: 1}
+	a, b := l.pair(1)
+	a.setWindow(64, 128)
+	b.setWindow(64, 128)
+
+	// The receiver doesn't read, the sender fills its window and stops
+	data := make([]byte, 400*int(a.mss))
+	l.rng.Read(data)
+	a.send(data)
+	for range 5000 {
+		l.step(t, a, b)
+	}
+	if uint32(len(b.rcvQueue)) != b.rcvWnd {
+		t.Fatalf("receive queue holds %d segments, want the window of %d", len(b.rcvQueue), b.rcvWnd)
+	}
+	if a.rmtWnd != 0 {
+		t.Fatalf("sender sees a window of %d, want 0", a.rmtWnd)
+	}
+	if a.dead {
+		t.Fatal("a full window counts as a dead link")
+	}
+
+	// Reading reopens the window, the receiver tells the sender right away
+	var got []byte
+	buf := make([]byte, 4096)
+	for i := 0; len(got) < len(data) || a.waitSnd() > 0; i++ {
+		if i > 100000 {
+			t.Fatalf("received %d of %d bytes, %d segments unacknowledged", len(got), len(data), a.waitSnd())
+		}
+		for b.readable() {
+			n := b.recv(buf)
+			got = append(got, buf[:n]...)
+		}
+		l.step(t, a, b)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data differs")
+	}
+}
+
+func TestUna(t *testing.T) {
+	l := &link{rng: rand.New(rand.NewSource(3)), loss: 1, maxDelay: 1}
+	a, _ := l.pair(1)
+	a.setNoDelay(true, 10, 0, true)
+	a.send(make([]byte, 5*int(a.mss)))
+	a.flush()
+	if a.sndNxt != 5 || len(a.sndBuf) != 5 {
+		t.Fatalf("%d segments sent, %d buffered, want 5", a.sndNxt, len(a.sndBuf))
+	}
+
+	// An ack of segment 3 with una 2 drops 0, 1 and 3
+	seg := segment{conv: 1, cmd: cmdAck, wnd: 128, sn: 3, una: 2}
+	if err := a.input(seg.encode(nil)); err != nil {
+		t.Fatal(err)
+	}
+	var sns []uint32
+	for _, s := range a.sndBuf {
+		sns = append(sns, s.sn)
+	}
+	if a.sndUna != 2 || len(sns) != 2 || sns[0] != 2 || sns[1] != 4 {
+		t.Fatalf("una %d, buffered %v, want una 2 and [2 4]", a.sndUna, sns)
+	}
+	// Segment 2 was skipped by a later ack
+	if a.sndBuf[0].fastack != 1 {
+		t.Errorf("fastack of segment 2 = %d, want 1", a.sndBuf[0].fastack)
+	}
+
+	// Acks out of the window are ignored
+	seg = segment{conv: 1, cmd: cmdAck, wnd: 128, sn: 9, una: 2}
+	a.input(seg.encode(nil))
+	if len(a.sndBuf) != 2 {
+		t.Fatalf("ack beyond sndNxt changed the buffer to %d segments", len(a.sndBuf))
+	}
+
+	// Una covering everything empties the buffer
+	seg = segment{conv: 1, cmd: cmdWindowTell, wnd: 128, una: 5}
+	a.input(seg.encode(nil))
+	if len(a.sndBuf) != 0 || a.sndUna != 5 {
+		t.Fatalf("una 5 left %d segments, sndUna %d", len(a.sndBuf), a.sndUna)
+	}
+}
+
+func TestDeadLink(t *testing.T) {
+	l := &link{rng: rand.New(rand.NewSource(4)), loss: 1, maxDelay: 1}
+	a, b := l.pair(1)
+	a.setNoDelay(true, 10, fastResend, true)
+	a.send([]byte("hello"))
+	for i := 0; !a.dead; i++ {
+		// Backing off from the default RTO, 20 transmissions take about
+		// 15 minutes
+		if i > 30*60000 {
+			t.Fatal("unacknowledged segment never counted as a dead link")
+		}
+		l.step(t, a, b)
+	}
+	if a.sndBuf[0].xmit != deadLink {
+		t.Errorf("dead after %d transmissions, want %d", a.sndBuf[0].xmit, deadLink)
+	}
+}
+
+func TestInputErrors(t *testing.T) {
+	k := newKCP(1, func([]byte) {})
+	push := segment{conv: 1, cmd: cmdPush, wnd: 128, data: []byte("abc")}
+	valid := append(push.encode(nil), push.data...)
+
+	other := segment{conv: 2, cmd: cmdPush, wnd: 128}
+	unknown := segment{conv: 1, cmd: 99, wnd: 128}
+	long := push.encode(nil)
+	binary.LittleEndian.PutUint32(long[20:], 100)
+
+	for name, packet := range map[string][]byte{
+		"short":          valid[:overhead-1],
+		"other conv":     other.encode(nil),
+		"unknown cmd":    unknown.encode(nil),
+		"truncated data": long,
+	} {
+		if err := k.input(packet); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if k.readable() {
+		t.Fatal("invalid packets delivered data")
+	}
+
+	// The same segment twice is delivered once
+	k.input(valid)
+	k.input(valid)
+	buf := make([]byte, 16)
+	if n := k.recv(buf); string(buf[:n]) != "abc" || k.readable() {
+		t.Fatalf("read %q, readable %v", buf[:n], k.readable())
+	}
+	// Both copies are acknowledged
+	if len(k.acklist) != 2 {
+		t.Errorf("%d acks queued, want 2", len(k.acklist))
+	}
+}
+
+func TestSendCoalesces(t *testing.T) {
+	k := newKCP(1, func([]byte) {})
+	k.send([]byte("ab"))
+	k.send([]byte("cd"))
+	if len(k.sndQueue) != 1 || string(k.sndQueue[0].data) != "abcd" {
+		t.Fatalf("queued %d segments", len(k.sndQueue))
+	}
+	k.send(make([]byte, 2*int(k.mss)))
+	if len(k.sndQueue) != 3 || len(k.sndQueue[0].data) != int(k.mss) || len(k.sndQueue[2].data) != 4 {
+		t.Fatalf("queued %d segments", len(k.sndQueue))
+	}
+}
+
+func TestOpensConversation(t *testing.T) {
+	first := segment{conv: 1, cmd: cmdPush, sn: 0}
+	later := segment{conv: 1, cmd: cmdPush, sn: 1}
+	ackSeg := segment{conv: 1, cmd: cmdAck, sn: 0}
+	for name, tt := range map[string]struct {
+		packet []byte
+		want   bool
+	}{
+		"first push": {first.encode(nil), true},
+		"later push": {later.encode(nil), false},
+		"ack":        {ackSeg.encode(nil), false},
+		"short":      {first.encode(nil)[:10], false},
+	} {
+		if got := opensConversation(tt.packet); got != tt.want {
+			t.Errorf("%s: %v, want %v", name, got, tt.want)
+		}
+	}
+}
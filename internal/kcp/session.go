@@ -0,0 +1,427 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	mtu        = 1350 // Fits the path MTU of most links, tunnels included
+	window     = 1024 // Send and receive window, in segments
+	interval   = 10 * time.Millisecond
+	fastResend = 2
+	// maxWaitSnd bounds the unacknowledged segments; writes block beyond
+	maxWaitSnd = 2 * window
+	// idleTimeout closes conversations the peer went silent on. Callers
+	// keep theirs alive with heartbeats.
+	idleTimeout = 90 * time.Second
+	// lingerTimeout is how long Close waits for written data to be
+	// acknowledged
+	lingerTimeout = time.Second
+	socketBuffer  = 4 << 20
+	acceptBacklog = 128
+)
+
+var (
+	errDeadLink = errors.New("kcp: peer unreachable")
+	errIdle     = errors.New("kcp: idle timeout")
+)
+
+// Conn is a KCP conversation over UDP. It implements net.Conn.
+type Conn struct {
+	kcp    *kcp
+	mu     sync.Mutex
+	err    error // Set once the conversation ended
+	socket net.PacketConn
+	remote net.Addr
+	// listener accepted the conversation and owns the socket; nil for a
+	// dialed one, which owns its socket
+	listener *Listener
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lastInput     time.Time
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	die        chan struct{}
+	dieOnce    sync.Once
+}
+
+func newConn(conv uint32, socket net.PacketConn, remote net.Addr, listener *Listener) *Conn {
+	c := &Conn{
+		socket:     socket,
+		remote:     remote,
+		listener:   listener,
+		lastInput:  time.Now(),
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		die:        make(chan struct{}),
+	}
+	c.kcp = newKCP(conv, func(packet []byte) {
+		socket.WriteTo(packet, remote)
+	})
+	c.kcp.setMTU(mtu)
+	c.kcp.setWindow(window, window)
+	c.kcp.setNoDelay(true, uint32(interval/time.Millisecond), fastResend, true)
+	go c.update()
+	return c
+}
+
+// Dial starts a conversation with a KCP listener on a UDP address
+func Dial(addr string) (*Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	socket.SetReadBuffer(socketBuffer)
+	socket.SetWriteBuffer(socketBuffer)
+
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	c := newConn(binary.LittleEndian.Uint32(buf), socket, remote, nil)
+	go c.readLoop(socket)
+	return c, nil
+}
+
+// readLoop feeds a dialed conversation the packets from its peer
+func (c *Conn) readLoop(socket *net.UDPConn) {
+	remote := c.remote.(*net.UDPAddr).AddrPort()
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := socket.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if netip.AddrPortFrom(from.Addr().Unmap(), from.Port()) != remote {
+			continue
+		}
+		c.input(buf[:n])
+	}
+}
+
+// input processes a packet from the peer. Acknowledgements go out right
+// away rather than on the next update.
+func (c *Conn) input(packet []byte) {
+	c.mu.Lock()
+	if c.kcp.input(packet) == nil {
+		c.lastInput = time.Now()
+	}
+	c.kcp.flush()
+	readable := c.kcp.readable()
+	writable := c.kcp.waitSnd() < maxWaitSnd
+	c.mu.Unlock()
+
+	if readable {
+		notify(c.readEvent)
+	}
+	if writable {
+		notify(c.writeEvent)
+	}
+}
+
+// update drives retransmissions and ends the conversation once the peer
+// is gone
+func (c *Conn) update() {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+
+		c.mu.Lock()
+		c.kcp.flush()
+		dead := c.kcp.dead
+		idle := time.Since(c.lastInput) > idleTimeout
+		writable := c.kcp.waitSnd() < maxWaitSnd
+		c.mu.Unlock()
+
+		switch {
+		case dead:
+			c.fail(errDeadLink)
+		case idle:
+			c.fail(errIdle)
+		case writable:
+			notify(c.writeEvent)
+		}
+	}
+}
+
+// Read reads data from the conversation
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		c.mu.Lock()
+		if c.kcp.readable() {
+			n := c.kcp.recv(b)
+			c.mu.Unlock()
+			return n, nil
+		}
+		err, deadline := c.err, c.readDeadline
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := wait(c.readEvent, c.die, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues data for the peer. It blocks while too much sent data is
+// unacknowledged.
+func (c *Conn) Write(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		if c.kcp.waitSnd() < maxWaitSnd {
+			c.kcp.send(b)
+			c.kcp.flush()
+			c.mu.Unlock()
+			return len(b), nil
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+		if err := wait(c.writeEvent, c.die, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait blocks until an event, the conversation's end or the deadline
+func wait(event, die chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-event:
+	case <-die:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func notify(event chan struct{}) {
+	select {
+	case event <- struct{}{}:
+	default:
+	}
+}
+
+// Close ends the conversation, after giving written data a moment to be
+// acknowledged
+func (c *Conn) Close() error {
+	deadline := time.Now().Add(lingerTimeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		done := c.err != nil || c.kcp.waitSnd() == 0
+		c.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(interval)
+	}
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+func (c *Conn) fail(err error) {
+	c.dieOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.die)
+		if c.listener != nil {
+			c.listener.remove(c)
+		} else {
+			c.socket.Close()
+		}
+	})
+}
+
+// LocalAddr returns the local UDP address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.LocalAddr()
+}
+
+// RemoteAddr returns the peer's UDP address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Read
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readEvent)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writeEvent)
+	return nil
+}
+
+// Listener accepts KCP conversations on a UDP socket. It implements
+// net.Listener.
+type Listener struct {
+	socket  *net.UDPConn
+	conns   map[string]*Conn // By remote address
+	connsMu sync.Mutex
+	accept  chan *Conn
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// Listen listens for KCP conversations on a UDP address
+func Listen(addr string) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	socket.SetReadBuffer(socketBuffer)
+	socket.SetWriteBuffer(socketBuffer)
+
+	l := &Listener{
+		socket: socket,
+		conns:  make(map[string]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		die:    make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+// readLoop hands packets to their conversation, starting a new one for a
+// packet that opens one
+func (l *Listener) readLoop() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := l.socket.ReadFromUDP(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		packet := buf[:n]
+		key := from.String()
+
+		l.connsMu.Lock()
+		c := l.conns[key]
+		if c == nil {
+			if !opensConversation(packet) {
+				l.connsMu.Unlock()
+				continue
+			}
+			c = newConn(binary.LittleEndian.Uint32(packet), l.socket, from, l)
+			select {
+			case l.accept <- c:
+				l.conns[key] = c
+			default:
+				// Backlog full, the peer retransmits
+				l.connsMu.Unlock()
+				c.fail(net.ErrClosed)
+				continue
+			}
+		}
+		l.connsMu.Unlock()
+		c.input(packet)
+	}
+}
+
+// opensConversation reports whether a packet starts with the first data
+// segment of a conversation
+func opensConversation(packet []byte) bool {
+	return len(packet) >= overhead && packet[4] == cmdPush && binary.LittleEndian.Uint32(packet[12:]) == 0
+}
+
+func (l *Listener) remove(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	key := c.remote.String()
+	if l.conns[key] == c {
+		delete(l.conns, key)
+	}
+}
+
+// Accept returns the next conversation
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.die:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener and ends its conversations
+func (l *Listener) Close() error {
+	l.dieOnce.Do(func() {
+		close(l.die)
+		l.connsMu.Lock()
+		conns := make([]*Conn, 0, len(l.conns))
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.connsMu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+		l.socket.Close()
+	})
+	return nil
+}
+
+// Addr returns the listener's UDP address
+func (l *Listener) Addr() net.Addr {
+	return l.socket.LocalAddr()
+}
+
+var _ net.Conn = (*Conn)(nil)
+var _ net.Listener = (*Listener)(nil)
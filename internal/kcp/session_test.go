@@ -0,0 +1,280 @@
+package kcp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) *Listener {
+	t.Helper()
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func accept(t *testing.T, l *Listener) net.Conn {
+	t.Helper()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := l.Accept()
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("no conversation accepted")
+		return nil
+	}
+}
+
+// lossyRelay forwards UDP packets between one client and a server,
+// dropping some and holding back others so they arrive out of order
+func lossyRelay(t *testing.T, server net.Addr, loss float64) net.Addr {
+	t.Helper()
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(1))
+	var client net.Addr
+	relay := func(from *net.UDPConn, to *net.UDPConn, dst func() net.Addr) {
+		buf := make([]byte, 64<<10)
+		var held []byte
+		for {
+			n, addr, err := from.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if from == front {
+				client = addr
+			}
+			r := rng.Float64()
+			mu.Unlock()
+			target := dst()
+			if target == nil || r < loss {
+				continue
+			}
+			packet := bytes.Clone(buf[:n])
+			if held == nil && r < 2*loss {
+				held = packet
+				continue
+			}
+			to.WriteTo(packet, target)
+			if held != nil {
+				to.WriteTo(held, target)
+				held = nil
+			}
+		}
+	}
+	go relay(front, back, func() net.Addr { return server })
+	go relay(back, front, func() net.Addr {
+		mu.Lock()
+		defer mu.Unlock()
+		return client
+	})
+	return front.LocalAddr()
+}
+
+func TestSessionTransfer(t *testing.T) {
+	for _, loss := range []float64{0, 0.1} {
+		l := listen(t)
+		addr := l.Addr()
+		if loss > 0 {
+			addr = lossyRelay(t, addr, loss)
+		}
+		client, err := Dial(addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		data := make([]byte, 2<<20)
+		rand.New(rand.NewSource(2)).Read(data)
+		go client.Write(data)
+
+		server := accept(t, l)
+		defer server.Close()
+		server.SetReadDeadline(time.Now().Add(30 * time.Second))
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatalf("loss %g: %v", loss, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("loss %g: received data differs", loss)
+		}
+
+		// And back
+		if _, err := server.Write(data[:64<<10]); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if _, err := io.ReadFull(client, got[:64<<10]); err != nil {
+			t.Fatalf("loss %g: reply: %v", loss, err)
+		}
+		if !bytes.Equal(got[:64<<10], data[:64<<10]) {
+			t.Fatalf("loss %g: reply differs", loss)
+		}
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	l := listen(t)
+	client, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close lingers until written data is acknowledged
+	data := bytes.Repeat([]byte("natsvr"), 50000)
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	server := accept(t, l)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("data written before Close: %v", err)
+	}
+
+	if _, err := client.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close: %v, want net.ErrClosed", err)
+	}
+	if _, err := client.Read(got); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after Close: %v, want net.ErrClosed", err)
+	}
+
+	// Closing the listener ends its conversations
+	l.Close()
+	if _, err := server.Read(got); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after the listener closed: %v, want net.ErrClosed", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close: %v, want net.ErrClosed", err)
+	}
+}
+
+func TestSessionDeadline(t *testing.T) {
+	l := listen(t)
+	client, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read: %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("deadline hit after %v", elapsed)
+	}
+}
+
+func TestListenerConversations(t *testing.T) {
+	l := listen(t)
+
+	// Packets that don't open a conversation don't start one
+	stray, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stray.Close()
+	ackSeg := segment{conv: 9, cmd: cmdAck, sn: 3}
+	later := segment{conv: 9, cmd: cmdPush, sn: 5}
+	stray.WriteTo(ackSeg.encode(nil), l.Addr())
+	stray.WriteTo(later.encode(nil), l.Addr())
+	stray.WriteTo([]byte("junk"), l.Addr())
+
+	// Each client gets a conversation of its own
+	const clients = 4
+	dialed := make([]*Conn, clients)
+	for i := range dialed {
+		c, err := Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		dialed[i] = c
+		if _, err := c.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[byte]bool)
+	for range clients {
+		server := accept(t, l)
+		defer server.Close()
+		buf := make([]byte, 1)
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Fatal(err)
+		}
+		i := buf[0]
+		if int(i) >= clients || seen[i] {
+			t.Fatalf("conversation of client %d accepted twice or unknown", i)
+		}
+		seen[i] = true
+		if !sameUDPPort(server.RemoteAddr(), dialed[i].LocalAddr()) {
+			t.Errorf("client %d accepted from %s, dialed from %s", i, server.RemoteAddr(), dialed[i].LocalAddr())
+		}
+		// Replies reach the client that wrote
+		if _, err := server.Write([]byte{i + 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range dialed {
+		buf := make([]byte, 1)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, buf); err != nil || buf[0] != byte(i+100) {
+			t.Errorf("client %d read %v, %v", i, buf, err)
+		}
+	}
+
+	// No conversation came from the stray packets
+	l.connsMu.Lock()
+	n := len(l.conns)
+	l.connsMu.Unlock()
+	if n != clients {
+		t.Errorf("%d conversations, want %d", n, clients)
+	}
+}
+
+// sameUDPPort compares the ports of UDP addresses, for clients bound to the
+// unspecified address
+func sameUDPPort(a, b net.Addr) bool {
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	return ok1 && ok2 && ua.Port == ub.Port
+}
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion is the wire protocol version of this build. It is raised
+// for changes a peer can't opt out of; optional features are negotiated
+// with capabilities instead.
+const ProtocolVersion uint16 = 2
+
+// MinProtocolVersion is the oldest peer protocol version still accepted.
+// Peers predating the handshake fields report no version and are treated
+// as version 1, served with LegacyCapabilities. Peers newer than
+// ProtocolVersion made changes this build doesn't know and are refused.
+const MinProtocolVersion uint16 = 1
+
+// ErrProtocolVersion is returned for peers outside the accepted versions
+var ErrProtocolVersion = errors.New("incompatible protocol version")
+
+// Capabilities is a bitmap of optional features a peer supports
+type Capabilities uint32
+
+const (
+	CapTCP           Capabilities = 1 << iota // TCP tunnels
+	CapUDP                                    // UDP tunnels
+	CapICMP                                   // ICMP tunnels
+	CapP2P                                    // Agent-to-agent proxies
+	CapUDPP2P                                 // UDP on agent-to-agent proxies
+	CapAgentCloud                             // Agent-to-cloud proxies
+	CapMux                                    // Per-tunnel flow control windows
+	CapZstd                                   // zstd compressed tunnels
+	CapSnappy                                 // snappy compressed tunnels
+	CapE2E                                    // End-to-end encrypted agent-to-agent tunnels
+	CapDirect                                 // Direct agent-to-agent paths by hole punching
+	CapMTLS                                   // Client certificates issued by the cloud
+	CapProxyProtocol                          // PROXY protocol headers toward targets
+)
+
+// LegacyCapabilities are assumed for peers predating capability negotiation
+const LegacyCapabilities = CapTCP | CapUDP | CapICMP | CapP2P | CapUDPP2P | CapAgentCloud
+
+// LocalCapabilities are the capabilities of this build
+const LocalCapabilities = LegacyCapabilities | CapMux | CapZstd | CapSnappy | CapE2E | CapDirect | CapMTLS | CapProxyProtocol
+
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapTCP, "tcp"},
+	{CapUDP, "udp"},
+	{CapICMP, "icmp"},
+	{CapP2P, "p2p"},
+	{CapUDPP2P, "udp-p2p"},
+	{CapAgentCloud, "agent-cloud"},
+	{CapMux, "mux"},
+	{CapZstd, "zstd"},
+	{CapSnappy, "snappy"},
+	{CapE2E, "e2e"},
+	{CapDirect, "direct"},
+	{CapMTLS, "mtls"},
+	{CapProxyProtocol, "proxy-protocol"},
+}
+
+// Has reports whether all capabilities in want are present
+func (c Capabilities) Has(want Capabilities) bool {
+	return c&want == want
+}
+
+// Names returns the names of the known capabilities in c
+func (c Capabilities) Names() []string {
+	names := []string{}
+	for _, n := range capabilityNames {
+		if c&n.cap != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+func (c Capabilities) String() string {
+	return strings.Join(c.Names(), ",")
+}
+
+// CheckProtocolVersion returns an error wrapping ErrProtocolVersion if a
+// peer speaking version can't be served, telling which side to upgrade
+func CheckProtocolVersion(version uint16) error {
+	switch {
+	case version < MinProtocolVersion:
+		return fmt.Errorf("%w: peer speaks version %d, this side needs %d to %d, upgrade the peer",
+			ErrProtocolVersion, version, MinProtocolVersion, ProtocolVersion)
+	case version > ProtocolVersion:
+		return fmt.Errorf("%w: peer speaks version %d, this side supports %d to %d, upgrade this side",
+			ErrProtocolVersion, version, MinProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckProtocolVersion(t *testing.T) {
+	for _, v := range []uint16{MinProtocolVersion, ProtocolVersion} {
+		if err := CheckProtocolVersion(v); err != nil {
+			t.Errorf("version %d: %v", v, err)
+		}
+	}
+	for _, v := range []uint16{MinProtocolVersion - 1, ProtocolVersion + 1, 0xffff} {
+		if err := CheckProtocolVersion(v); !errors.Is(err, ErrProtocolVersion) {
+			t.Errorf("version %d: %v, want ErrProtocolVersion", v, err)
+		}
+	}
+}
+
+func TestAuthPayloadVersion(t *testing.T) {
+	p := &AuthPayload{Token: "t", AgentName: "web", AgentID: "a1", PublicKey: []byte("k"), Signature: []byte("s"), Timestamp: 1,
+		ProtocolVersion: ProtocolVersion + 1, Capabilities: LocalCapabilities}
+	full := EncodeAuthPayload(p)
+	got, err := DecodeAuthPayload(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(CheckProtocolVersion(got.ProtocolVersion), ErrProtocolVersion) {
+		t.Fatalf("newer peer of version %d accepted", got.ProtocolVersion)
+	}
+
+	// Peers predating the version fields are served as version 1
+	got, err = DecodeAuthPayload(full[:len(full)-6])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ProtocolVersion != 1 || got.Capabilities != LegacyCapabilities {
+		t.Fatalf("legacy peer decoded as version %d, capabilities %s", got.ProtocolVersion, got.Capabilities)
+	}
+	if err := CheckProtocolVersion(got.ProtocolVersion); err != nil {
+		t.Fatalf("legacy peer: %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"sort"
+	"strings"
 )
 
 var ErrInvalidPayload = errors.New("invalid payload")
@@ -26,6 +28,17 @@ func EncodeAuthPayload(p *AuthPayload) []byte {
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(idBytes)))
 	copy(buf[offset+2:], idBytes)
 
+	// Optional trailing fields
+	buf = appendString(buf, p.Version)
+	buf = appendString(buf, p.OS)
+	buf = appendString(buf, p.Arch)
+	buf = appendString(buf, FormatLabels(p.Labels))
+	buf = appendString(buf, string(p.PublicKey))
+	buf = appendString(buf, string(p.Signature))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(p.Timestamp))
+	buf = binary.BigEndian.AppendUint16(buf, p.ProtocolVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(p.Capabilities))
+
 	return buf
 }
 
@@ -65,12 +78,73 @@ func DecodeAuthPayload(data []byte) (*AuthPayload, error) {
 		return nil, ErrInvalidPayload
 	}
 	id := string(data[offset : offset+int(idLen)])
+	offset += int(idLen)
+
+	// Version, OS, Arch, labels, the identity proof and the protocol
+	// version are optional for backward compatibility
+	p := &AuthPayload{
+		Token:           token,
+		AgentName:       name,
+		AgentID:         id,
+		ProtocolVersion: 1,
+		Capabilities:    LegacyCapabilities,
+	}
+	var labels, publicKey, signature string
+	fields := []*string{&p.Version, &p.OS, &p.Arch, &labels, &publicKey, &signature}
+	complete := true
+	for _, field := range fields {
+		v, n, ok := readString(data, offset)
+		if !ok {
+			complete = false
+			break
+		}
+		*field = v
+		offset = n
+	}
+	p.Labels = ParseLabels(labels)
+	if complete && offset+8 <= len(data) {
+		p.PublicKey = []byte(publicKey)
+		p.Signature = []byte(signature)
+		p.Timestamp = int64(binary.BigEndian.Uint64(data[offset : offset+8]))
+		offset += 8
+		if offset+6 <= len(data) {
+			p.ProtocolVersion = binary.BigEndian.Uint16(data[offset : offset+2])
+			p.Capabilities = Capabilities(binary.BigEndian.Uint32(data[offset+2 : offset+6]))
+		}
+	}
 
-	return &AuthPayload{
-		Token:     token,
-		AgentName: name,
-		AgentID:   id,
-	}, nil
+	return p, nil
+}
+
+// FormatLabels encodes labels as a sorted "key=value,key=value" list
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + labels[k]
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseLabels decodes a "key=value,key=value" list, returning nil when empty
+func ParseLabels(s string) map[string]string {
+	var labels map[string]string
+	for _, part := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k == "" {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[k] = v
+	}
+	return labels
 }
 
 // EncodeAuthResponsePayload encodes an authentication response payload
@@ -93,6 +167,11 @@ func EncodeAuthResponsePayload(p *AuthResponsePayload) []byte {
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(errBytes)))
 	copy(buf[offset+2:], errBytes)
 
+	buf = binary.BigEndian.AppendUint16(buf, p.ProtocolVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(p.Capabilities))
+	buf = appendString(buf, string(p.ClientCertificate))
+	buf = appendString(buf, string(p.RuleAuthNonce))
+
 	return buf
 }
 
@@ -116,12 +195,30 @@ func DecodeAuthResponsePayload(data []byte) (*AuthResponsePayload, error) {
 		return nil, ErrInvalidPayload
 	}
 	errMsg := string(data[offset+2 : offset+2+int(errLen)])
-
-	return &AuthResponsePayload{
-		Success: success,
-		AgentID: id,
-		Error:   errMsg,
-	}, nil
+	offset += 2 + int(errLen)
+
+	// The protocol version and client certificate are optional for
+	// backward compatibility
+	p := &AuthResponsePayload{
+		Success:         success,
+		AgentID:         id,
+		Error:           errMsg,
+		ProtocolVersion: 1,
+		Capabilities:    LegacyCapabilities,
+	}
+	if offset+6 <= len(data) {
+		p.ProtocolVersion = binary.BigEndian.Uint16(data[offset : offset+2])
+		p.Capabilities = Capabilities(binary.BigEndian.Uint32(data[offset+2 : offset+6]))
+		if cert, next, ok := readString(data, offset+6); ok {
+			if cert != "" {
+				p.ClientCertificate = []byte(cert)
+			}
+			if nonce, _, ok := readString(data, next); ok && nonce != "" {
+				p.RuleAuthNonce = []byte(nonce)
+			}
+		}
+	}
+	return p, nil
 }
 
 // EncodeConnectPayload encodes a connect payload
@@ -130,7 +227,7 @@ func EncodeConnectPayload(p *ConnectPayload) []byte {
 	hostBytes := []byte(p.TargetHost)
 	srcHostBytes := []byte(p.SourceHost)
 
-	buf := make([]byte, 10+len(protocolBytes)+len(hostBytes)+len(srcHostBytes))
+	buf := make([]byte, 15+len(protocolBytes)+len(hostBytes)+len(srcHostBytes))
 
 	offset := 0
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(protocolBytes)))
@@ -152,8 +249,19 @@ func EncodeConnectPayload(p *ConnectPayload) []byte {
 	offset += len(srcHostBytes)
 
 	binary.BigEndian.PutUint16(buf[offset:offset+2], p.SourcePort)
+	offset += 2
 
-	return buf
+	binary.BigEndian.PutUint32(buf[offset:offset+4], p.Window)
+	offset += 4
+
+	buf[offset] = byte(p.Compression)
+
+	return appendExtensions(buf, extensions{
+		keyExchange:   p.KeyExchange,
+		direct:        p.Direct,
+		directPeerKey: p.DirectPeerKey,
+		proxyProtocol: p.ProxyProtocol,
+	})
 }
 
 // DecodeConnectPayload decodes a connect payload
@@ -191,6 +299,9 @@ func DecodeConnectPayload(data []byte) (*ConnectPayload, error) {
 
 	var srcHost string
 	var srcPort uint16
+	var window uint32
+	var compression Compression
+	var ext extensions
 
 	if offset+2 <= len(data) {
 		srcHostLen := binary.BigEndian.Uint16(data[offset : offset+2])
@@ -201,22 +312,43 @@ func DecodeConnectPayload(data []byte) (*ConnectPayload, error) {
 		}
 		if offset+2 <= len(data) {
 			srcPort = binary.BigEndian.Uint16(data[offset : offset+2])
+			offset += 2
+		}
+	}
+
+	// Window, compression and the extension block are optional for
+	// backward compatibility
+	if offset+4 <= len(data) {
+		window = binary.BigEndian.Uint32(data[offset : offset+4])
+		offset += 4
+	}
+	if offset < len(data) {
+		compression = Compression(data[offset])
+		var err error
+		if ext, err = readExtensions(data, offset+1); err != nil {
+			return nil, err
 		}
 	}
 
 	return &ConnectPayload{
-		Protocol:   protocol,
-		TargetHost: host,
-		TargetPort: port,
-		SourceHost: srcHost,
-		SourcePort: srcPort,
+		Protocol:      protocol,
+		TargetHost:    host,
+		TargetPort:    port,
+		SourceHost:    srcHost,
+		SourcePort:    srcPort,
+		Window:        window,
+		Compression:   compression,
+		KeyExchange:   ext.keyExchange,
+		Direct:        ext.direct,
+		DirectPeerKey: ext.directPeerKey,
+		ProxyProtocol: ext.proxyProtocol,
 	}, nil
 }
 
 // EncodeConnectAckPayload encodes a connect acknowledgment payload
 func EncodeConnectAckPayload(p *ConnectAckPayload) []byte {
 	errBytes := []byte(p.Error)
-	buf := make([]byte, 7+len(errBytes))
+	buf := make([]byte, 12+len(errBytes))
 
 	if p.Success {
 		buf[0] = 1
@@ -227,8 +359,10 @@ func EncodeConnectAckPayload(p *ConnectAckPayload) []byte {
 	binary.BigEndian.PutUint32(buf[1:5], p.TunnelID)
 	binary.BigEndian.PutUint16(buf[5:7], uint16(len(errBytes)))
 	copy(buf[7:], errBytes)
+	binary.BigEndian.PutUint32(buf[7+len(errBytes):], p.Window)
+	buf[11+len(errBytes)] = byte(p.Compression)
 
-	return buf
+	return appendExtensions(buf, extensions{keyExchange: p.KeyExchange, direct: p.Direct})
 }
 
 // DecodeConnectAckPayload decodes a connect acknowledgment payload
@@ -246,10 +380,30 @@ func DecodeConnectAckPayload(data []byte) (*ConnectAckPayload, error) {
 	}
 	errMsg := string(data[7 : 7+errLen])
 
+	// Window, compression and the extension block are optional for
+	// backward compatibility
+	var window uint32
+	var compression Compression
+	var ext extensions
+	if 7+int(errLen)+4 <= len(data) {
+		window = binary.BigEndian.Uint32(data[7+int(errLen):])
+	}
+	if 7+int(errLen)+5 <= len(data) {
+		compression = Compression(data[11+int(errLen)])
+		var err error
+		if ext, err = readExtensions(data, 12+int(errLen)); err != nil {
+			return nil, err
+		}
+	}
+
 	return &ConnectAckPayload{
-		Success:  success,
-		TunnelID: tunnelID,
-		Error:    errMsg,
+		Success:     success,
+		TunnelID:    tunnelID,
+		Error:       errMsg,
+		Window:      window,
+		Compression: compression,
+		KeyExchange: ext.keyExchange,
+		Direct:      ext.direct,
 	}, nil
 }
 
@@ -415,7 +569,8 @@ func EncodeLocalProxyStartPayload(p *LocalProxyStartPayload) []byte {
 
 	// 2 (ruleID len) + ruleID + 2 (protocol len) + protocol + 2 (listen port)
 	// + 2 (target agent len) + target agent + 2 (target host len) + target host + 2 (target port)
-	buf := make([]byte, 12+len(ruleIDBytes)+len(protocolBytes)+len(targetAgentBytes)+len(targetHostBytes))
+	// + 1 (encrypted)
+	buf := make([]byte, 13+len(ruleIDBytes)+len(protocolBytes)+len(targetAgentBytes)+len(targetHostBytes))
 
 	offset := 0
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(ruleIDBytes)))
@@ -442,6 +597,11 @@ func EncodeLocalProxyStartPayload(p *LocalProxyStartPayload) []byte {
 	offset += len(targetHostBytes)
 
 	binary.BigEndian.PutUint16(buf[offset:offset+2], p.TargetPort)
+	offset += 2
+
+	if p.Encrypted {
+		buf[offset] = 1
+	}
 
 	return buf
 }
@@ -505,6 +665,10 @@ func DecodeLocalProxyStartPayload(data []byte) (*LocalProxyStartPayload, error)
 		return nil, ErrInvalidPayload
 	}
 	targetPort := binary.BigEndian.Uint16(data[offset : offset+2])
+	offset += 2
+
+	// Encrypted is optional for backward compatibility
+	encrypted := offset < len(data) && data[offset] == 1
 
 	return &LocalProxyStartPayload{
 		RuleID:        ruleID,
@@ -513,6 +677,7 @@ func DecodeLocalProxyStartPayload(data []byte) (*LocalProxyStartPayload, error)
 		TargetAgentID: targetAgentID,
 		TargetHost:    targetHost,
 		TargetPort:    targetPort,
+		Encrypted:     encrypted,
 	}, nil
 }
 
@@ -549,7 +714,7 @@ func EncodeP2PConnectPayload(p *P2PConnectPayload) []byte {
 	targetHostBytes := []byte(p.TargetHost)
 	ruleIDBytes := []byte(p.RuleID)
 
-	buf := make([]byte, 12+len(srcAgentBytes)+len(protocolBytes)+len(targetHostBytes)+len(ruleIDBytes))
+	buf := make([]byte, 16+len(srcAgentBytes)+len(protocolBytes)+len(targetHostBytes)+len(ruleIDBytes))
 
 	offset := 0
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(srcAgentBytes)))
@@ -572,9 +737,18 @@ func EncodeP2PConnectPayload(p *P2PConnectPayload) []byte {
 
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(ruleIDBytes)))
 	offset += 2
-	copy(buf[offset:], ruleIDBytes)
+	copy(buf[offset:offset+len(ruleIDBytes)], ruleIDBytes)
+	offset += len(ruleIDBytes)
 
-	return buf
+	binary.BigEndian.PutUint32(buf[offset:offset+4], p.Window)
+	offset += 4
+
+	return appendExtensions(buf[:offset], extensions{
+		keyExchange: p.KeyExchange,
+		direct:      p.Direct,
+		sourceHost:  p.SourceHost,
+		sourcePort:  p.SourcePort,
+	})
 }
 
 // DecodeP2PConnectPayload decodes a P2P connect payload
@@ -621,13 +795,24 @@ func DecodeP2PConnectPayload(data []byte) (*P2PConnectPayload, error) {
 	targetPort := binary.BigEndian.Uint16(data[offset : offset+2])
 	offset += 2
 
-	// RuleID is optional for backward compatibility
+	// RuleID, Window and the extension block are optional for backward
+	// compatibility
 	var ruleID string
+	var window uint32
+	var ext extensions
 	if offset+2 <= len(data) {
 		ruleIDLen := binary.BigEndian.Uint16(data[offset : offset+2])
 		offset += 2
 		if offset+int(ruleIDLen) <= len(data) {
 			ruleID = string(data[offset : offset+int(ruleIDLen)])
+			offset += int(ruleIDLen)
+		}
+		if offset+4 <= len(data) {
+			window = binary.BigEndian.Uint32(data[offset : offset+4])
+			var err error
+			if ext, err = readExtensions(data, offset+4); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -637,6 +822,11 @@ func DecodeP2PConnectPayload(data []byte) (*P2PConnectPayload, error) {
 		TargetHost:    targetHost,
 		TargetPort:    targetPort,
 		RuleID:        ruleID,
+		Window:        window,
+		KeyExchange:   ext.keyExchange,
+		Direct:        ext.direct,
+		SourceHost:    ext.sourceHost,
+		SourcePort:    ext.sourcePort,
 	}, nil
 }
 
@@ -797,7 +987,7 @@ func EncodeAgentCloudConnectPayload(p *AgentCloudConnectPayload) []byte {
 	targetHostBytes := []byte(p.TargetHost)
 	ruleIDBytes := []byte(p.RuleID)
 
-	buf := make([]byte, 8+len(protocolBytes)+len(targetHostBytes)+len(ruleIDBytes))
+	buf := make([]byte, 12+len(protocolBytes)+len(targetHostBytes)+len(ruleIDBytes))
 
 	offset := 0
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(protocolBytes)))
@@ -815,9 +1005,13 @@ func EncodeAgentCloudConnectPayload(p *AgentCloudConnectPayload) []byte {
 
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(ruleIDBytes)))
 	offset += 2
-	copy(buf[offset:], ruleIDBytes)
+	copy(buf[offset:offset+len(ruleIDBytes)], ruleIDBytes)
+	offset += len(ruleIDBytes)
 
-	return buf
+	binary.BigEndian.PutUint32(buf[offset:offset+4], p.Window)
+
+	buf = appendString(buf, p.SourceHost)
+	return binary.BigEndian.AppendUint16(buf, p.SourcePort)
 }
 
 // DecodeAgentCloudConnectPayload decodes an agent-cloud connect payload
@@ -853,13 +1047,24 @@ func DecodeAgentCloudConnectPayload(data []byte) (*AgentCloudConnectPayload, err
 	targetPort := binary.BigEndian.Uint16(data[offset : offset+2])
 	offset += 2
 
-	// RuleID is optional for backward compatibility
+	// RuleID, Window and the client address are optional for backward
+	// compatibility
 	var ruleID string
+	var window uint32
+	var srcHost string
+	var srcPort uint16
 	if offset+2 <= len(data) {
 		ruleIDLen := binary.BigEndian.Uint16(data[offset : offset+2])
 		offset += 2
 		if offset+int(ruleIDLen) <= len(data) {
 			ruleID = string(data[offset : offset+int(ruleIDLen)])
+			offset += int(ruleIDLen)
+		}
+		if offset+4 <= len(data) {
+			window = binary.BigEndian.Uint32(data[offset : offset+4])
+			if host, next, ok := readString(data, offset+4); ok && next+2 <= len(data) {
+				srcHost, srcPort = host, binary.BigEndian.Uint16(data[next:next+2])
+			}
 		}
 	}
 
@@ -868,6 +1073,9 @@ func DecodeAgentCloudConnectPayload(data []byte) (*AgentCloudConnectPayload, err
 		TargetHost: targetHost,
 		TargetPort: targetPort,
 		RuleID:     ruleID,
+		Window:     window,
+		SourceHost: srcHost,
+		SourcePort: srcPort,
 	}, nil
 }
 
@@ -894,6 +1102,11 @@ func EncodeRuleAuthPayload(p *RuleAuthPayload) []byte {
 	offset += 2
 	copy(buf[offset:], ruleIDBytes)
 
+	if len(p.Signature) > 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(p.Timestamp))
+		buf = appendString(buf, string(p.Signature))
+	}
+
 	return buf
 }
 
@@ -933,12 +1146,21 @@ func DecodeRuleAuthPayload(data []byte) (*RuleAuthPayload, error) {
 		return nil, ErrInvalidPayload
 	}
 	ruleID := string(data[offset : offset+int(ruleIDLen)])
+	offset += int(ruleIDLen)
 
-	return &RuleAuthPayload{
+	p := &RuleAuthPayload{
 		Token:   token,
 		AgentID: agentID,
 		RuleID:  ruleID,
-	}, nil
+	}
+	// The signature is optional for agents without an identity key
+	if offset+8 <= len(data) {
+		p.Timestamp = int64(binary.BigEndian.Uint64(data[offset : offset+8]))
+		if sig, _, ok := readString(data, offset+8); ok && sig != "" {
+			p.Signature = []byte(sig)
+		}
+	}
+	return p, nil
 }
 
 // EncodeRuleAuthResponsePayload encodes a rule auth response payload
@@ -992,3 +1214,134 @@ func DecodeRuleAuthResponsePayload(data []byte) (*RuleAuthResponsePayload, error
 	}, nil
 }
 
+// appendString appends a length-prefixed string
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// readString reads a length-prefixed string at offset, returning the offset
+// after it. ok is false when data ends before a complete string.
+func readString(data []byte, offset int) (s string, next int, ok bool) {
+	if offset+2 > len(data) {
+		return "", offset, false
+	}
+	n := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	offset += 2
+	if offset+n > len(data) {
+		return "", offset, false
+	}
+	return string(data[offset : offset+n]), offset + n, true
+}
+
+// Connect extensions
+//
+// The optional fields of connect, connect ack and P2P connect payloads
+// follow their fixed fields in one extension block: a 2-byte length, then
+// entries of a type byte, a 2-byte length and the value. Entries may come
+// in any order and decoders skip types they don't know, so a field doesn't
+// depend on the ones before it. Peers that predate the block ignore it as
+// trailing data, and their payloads end before it.
+
+type extensionType uint8
+
+const (
+	extKeyExchange   extensionType = 1 // Key exchange of an end-to-end encrypted tunnel
+	extDirect        extensionType = 2 // The tunnel uses the direct path, of the peer with the identity key in the value if any
+	extProxyProtocol extensionType = 3 // PROXY protocol version, 1 byte
+	extSourceAddr    extensionType = 4 // Client address, a string and a 2-byte port
+	extKeyAgent      extensionType = 5 // Agent ID of the key exchange's signer
+)
+
+// extensions are the optional fields of a connect payload
+type extensions struct {
+	keyExchange   *KeyExchange
+	direct        bool
+	directPeerKey []byte
+	proxyProtocol ProxyProtocol
+	sourceHost    string
+	sourcePort    uint16
+}
+
+// appendExtensions appends the extension block, or nothing if no field is
+// set
+func appendExtensions(buf []byte, e extensions) []byte {
+	var block []byte
+	entry := func(t extensionType, value []byte) {
+		block = append(block, byte(t))
+		block = appendString(block, string(value))
+	}
+	if e.keyExchange != nil {
+		entry(extKeyExchange, appendKeyExchange(nil, e.keyExchange))
+		if e.keyExchange.AgentID != "" {
+			entry(extKeyAgent, []byte(e.keyExchange.AgentID))
+		}
+	}
+	if e.direct {
+		entry(extDirect, e.directPeerKey)
+	}
+	if e.proxyProtocol != ProxyProtocolNone {
+		entry(extProxyProtocol, []byte{byte(e.proxyProtocol)})
+	}
+	if e.sourceHost != "" {
+		entry(extSourceAddr, binary.BigEndian.AppendUint16(appendString(nil, e.sourceHost), e.sourcePort))
+	}
+	if block == nil {
+		return buf
+	}
+	return appendString(buf, string(block))
+}
+
+// readExtensions reads the extension block at offset. A payload that ends
+// before it has none.
+func readExtensions(data []byte, offset int) (extensions, error) {
+	var e extensions
+	if offset >= len(data) {
+		return e, nil
+	}
+	raw, next, ok := readString(data, offset)
+	if !ok || next != len(data) {
+		return e, ErrInvalidPayload
+	}
+	block := []byte(raw)
+	var keyAgent string
+	for i := 0; i < len(block); {
+		t := extensionType(block[i])
+		s, next, ok := readString(block, i+1)
+		if !ok {
+			return e, ErrInvalidPayload
+		}
+		i = next
+		value := []byte(s)
+		switch t {
+		case extKeyExchange:
+			k, end := readKeyExchange(value, 0)
+			if k == nil || end != len(value) {
+				return e, ErrInvalidPayload
+			}
+			e.keyExchange = k
+		case extKeyAgent:
+			keyAgent = s
+		case extDirect:
+			e.direct = true
+			if len(value) > 0 {
+				e.directPeerKey = value
+			}
+		case extProxyProtocol:
+			if len(value) != 1 {
+				return e, ErrInvalidPayload
+			}
+			e.proxyProtocol = ProxyProtocol(value[0])
+		case extSourceAddr:
+			host, end, ok := readString(value, 0)
+			if !ok || end+2 != len(value) {
+				return e, ErrInvalidPayload
+			}
+			e.sourceHost, e.sourcePort = host, binary.BigEndian.Uint16(value[end:])
+		}
+	}
+	if e.keyExchange != nil {
+		e.keyExchange.AgentID = keyAgent
+	}
+	return e, nil
+}
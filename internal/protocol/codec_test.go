@@ -0,0 +1,192 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestConnectPayloadRoundTrip(t *testing.T) {
+	k := &KeyExchange{PublicKey: []byte("public"), Signature: []byte("signature"), IdentityKey: []byte("identity"), AgentID: "agent-1"}
+	base := ConnectPayload{Protocol: "tcp", TargetHost: "10.0.0.1", TargetPort: 22, SourceHost: "192.0.2.1", SourcePort: 40000, Window: DefaultWindowSize, Compression: CompressionZstd}
+
+	tests := []struct {
+		name   string
+		modify func(p *ConnectPayload)
+	}{
+		{"none", func(p *ConnectPayload) {}},
+		{"key exchange", func(p *ConnectPayload) { p.KeyExchange = k }},
+		{"direct", func(p *ConnectPayload) { p.Direct = true }},
+		{"PROXY v1", func(p *ConnectPayload) { p.ProxyProtocol = ProxyProtocolV1 }},
+		{"PROXY v2", func(p *ConnectPayload) { p.ProxyProtocol = ProxyProtocolV2 }},
+		{"key exchange and direct", func(p *ConnectPayload) { p.KeyExchange, p.Direct = k, true }},
+		{"key exchange and PROXY", func(p *ConnectPayload) { p.KeyExchange, p.ProxyProtocol = k, ProxyProtocolV2 }},
+		{"direct and PROXY", func(p *ConnectPayload) { p.Direct, p.ProxyProtocol = true, ProxyProtocolV1 }},
+		{"direct with peer key", func(p *ConnectPayload) { p.Direct, p.DirectPeerKey = true, []byte("peer") }},
+		{"all", func(p *ConnectPayload) {
+			p.KeyExchange, p.Direct, p.DirectPeerKey, p.ProxyProtocol = k, true, []byte("peer"), ProxyProtocolV2
+		}},
+	}
+	for _, tt := range tests {
+		p := base
+		tt.modify(&p)
+		got, err := DecodeConnectPayload(EncodeConnectPayload(&p))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, p) {
+			t.Errorf("%s: decoded %+v, want %+v", tt.name, *got, p)
+		}
+	}
+
+	// Without optional fields, the payload ends after the compression
+	if got := len(EncodeConnectPayload(&base)); got != 15+len("tcp")+len("10.0.0.1")+len("192.0.2.1") {
+		t.Errorf("payload without extensions of %d bytes", got)
+	}
+}
+
+func TestConnectAckPayloadRoundTrip(t *testing.T) {
+	k := &KeyExchange{PublicKey: []byte("public"), Signature: []byte("signature"), IdentityKey: []byte("identity"), AgentID: "agent-2"}
+	for _, p := range []ConnectAckPayload{
+		{Success: true, TunnelID: 7, Window: DefaultWindowSize, Compression: CompressionSnappy},
+		{Success: true, TunnelID: 7, KeyExchange: k},
+		{Success: true, TunnelID: 7, Direct: true},
+		{Success: true, TunnelID: 7, KeyExchange: k, Direct: true},
+		{TunnelID: 7, Error: "connection refused"},
+	} {
+		got, err := DecodeConnectAckPayload(EncodeConnectAckPayload(&p))
+		if err != nil {
+			t.Errorf("%+v: %v", p, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, p) {
+			t.Errorf("decoded %+v, want %+v", *got, p)
+		}
+	}
+}
+
+func TestP2PConnectPayloadRoundTrip(t *testing.T) {
+	k := &KeyExchange{PublicKey: []byte("public"), Signature: []byte("signature"), IdentityKey: []byte("identity")}
+	base := P2PConnectPayload{SourceAgentID: "a1", Protocol: "tcp", TargetHost: "10.0.0.1", TargetPort: 22, RuleID: "r1", Window: DefaultWindowSize}
+
+	tests := []struct {
+		name   string
+		modify func(p *P2PConnectPayload)
+	}{
+		{"none", func(p *P2PConnectPayload) {}},
+		{"key exchange", func(p *P2PConnectPayload) { p.KeyExchange = k }},
+		{"direct", func(p *P2PConnectPayload) { p.Direct = true }},
+		{"client address", func(p *P2PConnectPayload) { p.SourceHost, p.SourcePort = "192.0.2.1", 40000 }},
+		{"key exchange and client address", func(p *P2PConnectPayload) {
+			p.KeyExchange, p.SourceHost, p.SourcePort = k, "2001:db8::1", 1
+		}},
+		{"all", func(p *P2PConnectPayload) {
+			p.KeyExchange, p.Direct, p.SourceHost, p.SourcePort = k, true, "192.0.2.1", 40000
+		}},
+	}
+	for _, tt := range tests {
+		p := base
+		tt.modify(&p)
+		got, err := DecodeP2PConnectPayload(EncodeP2PConnectPayload(&p))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, p) {
+			t.Errorf("%s: decoded %+v, want %+v", tt.name, *got, p)
+		}
+	}
+}
+
+func TestConnectPayloadLegacy(t *testing.T) {
+	p := &ConnectPayload{Protocol: "tcp", TargetHost: "10.0.0.1", TargetPort: 22, SourceHost: "192.0.2.1", SourcePort: 40000, KeyExchange: &KeyExchange{PublicKey: []byte("k")}}
+	full := EncodeConnectPayload(p)
+
+	// Payloads of peers that end before the window, or before the
+	// extension block, decode without the optional fields
+	for _, n := range []int{10 + len("tcp") + len("10.0.0.1") + len("192.0.2.1"), 15 + len("tcp") + len("10.0.0.1") + len("192.0.2.1")} {
+		got, err := DecodeConnectPayload(full[:n])
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if got.SourceHost != "192.0.2.1" || got.SourcePort != 40000 || got.KeyExchange != nil {
+			t.Fatalf("%d bytes decoded as %+v", n, got)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	// Unknown entries are skipped, wherever they are
+	block := []byte{99}
+	block = appendString(block, "from a newer peer")
+	block = append(block, byte(extProxyProtocol))
+	block = appendString(block, "\x02")
+	block = append(block, 98)
+	block = appendString(block, "")
+	e, err := readExtensions(appendString([]byte("head"), string(block)), 4)
+	if err != nil || e.proxyProtocol != ProxyProtocolV2 {
+		t.Fatalf("read %+v, %v", e, err)
+	}
+
+	// No fields, no block
+	if buf := appendExtensions([]byte("head"), extensions{}); string(buf) != "head" {
+		t.Fatalf("empty extensions encoded as %q", buf)
+	}
+
+	valid := appendExtensions(nil, extensions{direct: true, proxyProtocol: ProxyProtocolV1})
+	for name, data := range map[string][]byte{
+		"truncated block":      valid[:len(valid)-1],
+		"trailing data":        append(valid, 0),
+		"truncated entry":      appendString(nil, "\x03\x00\x05ab"),
+		"entry without length": appendString(nil, "\x03"),
+		"long PROXY version":   appendString(nil, "\x03\x00\x02\x01\x01"),
+		"empty key exchange":   appendString(nil, "\x01\x00\x00"),
+		"short client port":    appendString(nil, "\x04\x00\x03\x00\x01a"),
+	} {
+		if _, err := readExtensions(data, 0); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: %v, want ErrInvalidPayload", name, err)
+		}
+	}
+}
+
+func TestRuleAuthPayloadRoundTrip(t *testing.T) {
+	for _, p := range []*RuleAuthPayload{
+		{Token: "secret", AgentID: "agent-1", RuleID: "rule-1"},
+		{Token: "secret", AgentID: "agent-1", RuleID: "rule-1", Timestamp: 1700000000, Signature: []byte("signature")},
+	} {
+		got, err := DecodeRuleAuthPayload(EncodeRuleAuthPayload(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("decoded %+v, want %+v", got, p)
+		}
+	}
+
+	// Agents without an identity key send the payload of older versions
+	if got := len(EncodeRuleAuthPayload(&RuleAuthPayload{Token: "secret", AgentID: "agent-1", RuleID: "rule-1"})); got != 6+len("secret")+len("agent-1")+len("rule-1") {
+		t.Errorf("unsigned payload of %d bytes", got)
+	}
+}
+
+func TestAuthResponseRuleAuthNonce(t *testing.T) {
+	p := &AuthResponsePayload{Success: true, AgentID: "agent-1", ProtocolVersion: ProtocolVersion, Capabilities: LocalCapabilities, RuleAuthNonce: []byte("nonce")}
+	full := EncodeAuthResponsePayload(p)
+	got, err := DecodeAuthResponsePayload(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Fatalf("decoded %+v, want %+v", got, p)
+	}
+
+	// Responses of older clouds end before the nonce
+	got, err = DecodeAuthResponsePayload(full[:len(full)-2-len("nonce")])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RuleAuthNonce != nil || !got.Success {
+		t.Fatalf("response without a nonce decoded as %+v", got)
+	}
+}
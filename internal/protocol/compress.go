@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm applied to the data messages of a tunnel.
+// Each compressed payload starts with a flag byte telling whether the rest
+// is compressed, so data that doesn't shrink is sent as is.
+type Compression uint8
+
+const (
+	CompressionNone   Compression = 0
+	CompressionZstd   Compression = 1
+	CompressionSnappy Compression = 2
+)
+
+// maxCompressChunk bounds the data compressed or encrypted into one
+// message, so that payloads stay below MaxPayloadSize even when data
+// doesn't shrink
+const maxCompressChunk = 32 * 1024
+
+const (
+	payloadRaw        byte = 0
+	payloadCompressed byte = 1
+)
+
+var ErrDecompress = errors.New("invalid compressed payload")
+
+// ParseCompression parses a compression name as used in forwarding rules.
+// The empty string and "none" mean no compression.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "zstd":
+		return CompressionZstd, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	}
+	return CompressionNone, fmt.Errorf("unknown compression %q", name)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return "unknown"
+}
+
+// Supported reports whether this build implements the compression
+func (c Compression) Supported() bool {
+	switch c {
+	case CompressionNone, CompressionZstd, CompressionSnappy:
+		return true
+	}
+	return false
+}
+
+// Capability returns the capability a peer needs to use the compression
+func (c Compression) Capability() Capabilities {
+	switch c {
+	case CompressionZstd:
+		return CapZstd
+	case CompressionSnappy:
+		return CapSnappy
+	}
+	return 0
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodec returns the shared zstd encoder and decoder, which are safe for
+// concurrent EncodeAll and DecodeAll calls
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(MaxPayloadSize))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compress returns the payload of a data message carrying p
+func (c Compression) compress(p []byte) []byte {
+	var out []byte
+	switch c {
+	case CompressionZstd:
+		enc, _ := zstdCodec()
+		out = enc.EncodeAll(p, []byte{payloadCompressed})
+	case CompressionSnappy:
+		out = make([]byte, 1+snappy.MaxEncodedLen(len(p)))
+		out[0] = payloadCompressed
+		out = out[:1+len(snappy.Encode(out[1:], p))]
+	default:
+		return p
+	}
+	if len(out) > len(p) {
+		return append([]byte{payloadRaw}, p...)
+	}
+	return out
+}
+
+// decompress returns the data carried by the payload of a data message
+func (c Compression) decompress(payload []byte) ([]byte, error) {
+	if c == CompressionNone {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, ErrDecompress
+	}
+	if payload[0] == payloadRaw {
+		return payload[1:], nil
+	}
+
+	switch c {
+	case CompressionZstd:
+		_, dec := zstdCodec()
+		out, err := dec.DecodeAll(payload[1:], nil)
+		if err != nil {
+			return nil, ErrDecompress
+		}
+		return out, nil
+	case CompressionSnappy:
+		if n, err := snappy.DecodedLen(payload[1:]); err != nil || n > MaxPayloadSize {
+			return nil, ErrDecompress
+		}
+		out, err := snappy.Decode(nil, payload[1:])
+		if err != nil {
+			return nil, ErrDecompress
+		}
+		return out, nil
+	}
+	return nil, ErrDecompress
+}
+
+// CompressionStats counts the data a tunnel carried before and after
+// compression, in both directions. It may be shared by many streams.
+type CompressionStats struct {
+	RawBytes  int64 // atomic, data before compression or after decompression
+	WireBytes int64 // atomic, payloads as sent or received
+}
+
+func (s *CompressionStats) add(raw, wire int) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.RawBytes, int64(raw))
+	atomic.AddInt64(&s.WireBytes, int64(wire))
+}
+
+// Load returns the raw and wire byte counts
+func (s *CompressionStats) Load() (raw, wire int64) {
+	return atomic.LoadInt64(&s.RawBytes), atomic.LoadInt64(&s.WireBytes)
+}
@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 200)
+	random := make([]byte, maxCompressChunk)
+	rand.Read(random)
+
+	for _, c := range []Compression{CompressionZstd, CompressionSnappy} {
+		for name, data := range map[string][]byte{
+			"text":   text,
+			"random": random,
+			"byte":   {'x'},
+			"empty":  {},
+		} {
+			payload := c.compress(data)
+			if len(payload) > len(data)+1 {
+				t.Errorf("%s, %s: %d bytes sent for %d", c, name, len(payload), len(data))
+			}
+			got, err := c.decompress(payload)
+			if err != nil {
+				t.Errorf("%s, %s: %v", c, name, err)
+				continue
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s, %s: decompressed %d bytes, want %d", c, name, len(got), len(data))
+			}
+		}
+
+		// Data that shrinks is sent compressed
+		if payload := c.compress(text); payload[0] != payloadCompressed || len(payload) >= len(text)/4 {
+			t.Errorf("%s: text sent as %d bytes, flag %d", c, len(payload), payload[0])
+		}
+		// Data that doesn't is sent as is, behind the flag
+		if payload := c.compress(random); payload[0] != payloadRaw || !bytes.Equal(payload[1:], random) {
+			t.Errorf("%s: random data not sent raw", c)
+		}
+		if payload := c.compress(nil); !bytes.Equal(payload, []byte{payloadRaw}) {
+			t.Errorf("%s: empty data sent as %v", c, payload)
+		}
+	}
+
+	// Without compression, payloads are the data
+	if payload := CompressionNone.compress(text); !bytes.Equal(payload, text) {
+		t.Error("data changed without compression")
+	}
+	if got, err := CompressionNone.decompress(nil); err != nil || len(got) != 0 {
+		t.Errorf("empty payload without compression: %v, %v", got, err)
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	large := make([]byte, MaxPayloadSize+1)
+	enc, _ := zstdCodec()
+
+	// Valid frames of more data than a message carries
+	zstdLarge := enc.EncodeAll(large, []byte{payloadCompressed})
+	snappyLarge := append([]byte{payloadCompressed}, snappy.Encode(nil, large)...)
+	// A snappy header claiming more data, before any of it
+	snappyHeader := binary.AppendUvarint([]byte{payloadCompressed}, MaxPayloadSize+1)
+
+	tests := []struct {
+		name    string
+		c       Compression
+		payload []byte
+	}{
+		{"zstd empty", CompressionZstd, nil},
+		{"snappy empty", CompressionSnappy, nil},
+		{"zstd corrupt", CompressionZstd, []byte{payloadCompressed, 1, 2, 3, 4, 5}},
+		{"snappy corrupt", CompressionSnappy, []byte{payloadCompressed, 10, 0xff, 0xff}},
+		{"zstd truncated", CompressionZstd, CompressionZstd.compress(bytes.Repeat([]byte("abc"), 1000))[:20]},
+		{"zstd over the payload size", CompressionZstd, zstdLarge},
+		{"snappy over the payload size", CompressionSnappy, snappyLarge},
+		{"snappy header over the payload size", CompressionSnappy, snappyHeader},
+		{"unknown compression", Compression(9), []byte{payloadCompressed, 0}},
+	}
+	for _, tt := range tests {
+		if _, err := tt.c.decompress(tt.payload); !errors.Is(err, ErrDecompress) {
+			t.Errorf("%s: %v, want ErrDecompress", tt.name, err)
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for name, want := range map[string]Compression{"": CompressionNone, "none": CompressionNone, "zstd": CompressionZstd, "snappy": CompressionSnappy} {
+		if got, err := ParseCompression(name); err != nil || got != want {
+			t.Errorf("%q: parsed %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseCompression("gzip"); err == nil {
+		t.Error("unknown compression parsed")
+	}
+}
@@ -0,0 +1,216 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Direct paths
+//
+// Agent-to-agent tunnels normally go through the cloud. When the cloud runs
+// a rendezvous UDP listener, agents register the endpoint it observes for
+// them from a UDP socket of their own, and a source agent may ask for a
+// direct path to a rule's target agent. The cloud then sends both agents a
+// punch message with the other's endpoints and identity key. Both send
+// probe packets towards each other, opening their NAT mappings, and once a
+// probe gets through the source dials the target with QUIC over the same
+// socket, each side authenticating the other by its identity key.
+//
+// Tunnels are still set up through the cloud. A source with a direct path
+// offers it in the P2P connect request and the target accepts it in its
+// ack. The tunnel's data then flows over a QUIC stream that starts with
+// the global tunnel ID, instead of in data messages relayed by the cloud.
+// Tunnels fall back to the relay whenever there is no direct path.
+
+// DirectALPN is the ALPN protocol of direct QUIC connections between agents
+const DirectALPN = "natsvr-direct"
+
+// PunchPacketType is the type of a rendezvous or probe UDP packet
+type PunchPacketType uint8
+
+// Punch packets share the agent's UDP socket with QUIC. Their first byte
+// leaves the QUIC fixed bit clear, so QUIC hands them over.
+const (
+	PunchBind  PunchPacketType = 0x01 // Agent registers its endpoint with the cloud
+	PunchBound PunchPacketType = 0x02 // Cloud answers with the endpoint it observed
+	PunchProbe PunchPacketType = 0x03 // Agent probes a peer during hole punching
+)
+
+var punchMagic = []byte("NTSV")
+
+// PunchPacket is a rendezvous or probe UDP packet
+type PunchPacket struct {
+	Type      PunchPacketType
+	Token     []byte   // Bind: the token the cloud handed out in the rendezvous message
+	Session   string   // Probe: the punch session
+	Endpoints []string // Bind: the agent's local endpoints, Bound: the observed endpoint
+}
+
+// RendezvousPayload tells an agent where to register its UDP endpoint
+type RendezvousPayload struct {
+	Addr  string // UDP address of the rendezvous listener, host may be empty
+	Token []byte // Identifies the agent's connection in bind packets
+}
+
+// PunchRequestPayload asks the cloud for a direct path to a rule's target
+type PunchRequestPayload struct {
+	RuleID        string
+	TargetAgentID string // As the source agent knows it, echoed in the punch
+}
+
+// PunchPayload introduces an agent to the peer it should punch towards
+type PunchPayload struct {
+	Session     string
+	PeerAgentID string   // For the source, TargetAgentID of the request
+	PeerKey     []byte   // ed25519 identity key of the peer
+	Endpoints   []string // Endpoints of the peer to probe
+	Dial        bool     // The agent dials the QUIC connection
+	Error       string   // Set if the cloud can't arrange a direct path
+}
+
+// EncodePunchPacket encodes a punch packet
+func EncodePunchPacket(p *PunchPacket) []byte {
+	buf := append([]byte{byte(p.Type)}, punchMagic...)
+	buf = appendString(buf, string(p.Token))
+	buf = appendString(buf, p.Session)
+	buf = append(buf, byte(len(p.Endpoints)))
+	for _, ep := range p.Endpoints {
+		buf = appendString(buf, ep)
+	}
+	return buf
+}
+
+// DecodePunchPacket decodes a punch packet
+func DecodePunchPacket(data []byte) (*PunchPacket, error) {
+	if len(data) < 1+len(punchMagic) || !bytes.Equal(data[1:1+len(punchMagic)], punchMagic) {
+		return nil, ErrInvalidPayload
+	}
+	p := &PunchPacket{Type: PunchPacketType(data[0])}
+
+	offset := 1 + len(punchMagic)
+	token, offset, ok := readString(data, offset)
+	if !ok {
+		return nil, ErrInvalidPayload
+	}
+	p.Token = []byte(token)
+	if p.Session, offset, ok = readString(data, offset); !ok || offset >= len(data) {
+		return nil, ErrInvalidPayload
+	}
+	count := int(data[offset])
+	offset++
+	for i := 0; i < count; i++ {
+		var ep string
+		if ep, offset, ok = readString(data, offset); !ok {
+			return nil, ErrInvalidPayload
+		}
+		p.Endpoints = append(p.Endpoints, ep)
+	}
+	return p, nil
+}
+
+// EncodeRendezvousPayload encodes a rendezvous payload
+func EncodeRendezvousPayload(p *RendezvousPayload) []byte {
+	buf := appendString(nil, p.Addr)
+	return appendString(buf, string(p.Token))
+}
+
+// DecodeRendezvousPayload decodes a rendezvous payload
+func DecodeRendezvousPayload(data []byte) (*RendezvousPayload, error) {
+	addr, offset, ok := readString(data, 0)
+	if !ok {
+		return nil, ErrInvalidPayload
+	}
+	token, _, ok := readString(data, offset)
+	if !ok {
+		return nil, ErrInvalidPayload
+	}
+	return &RendezvousPayload{Addr: addr, Token: []byte(token)}, nil
+}
+
+// EncodePunchRequestPayload encodes a punch request payload
+func EncodePunchRequestPayload(p *PunchRequestPayload) []byte {
+	buf := appendString(nil, p.RuleID)
+	return appendString(buf, p.TargetAgentID)
+}
+
+// DecodePunchRequestPayload decodes a punch request payload
+func DecodePunchRequestPayload(data []byte) (*PunchRequestPayload, error) {
+	ruleID, offset, ok := readString(data, 0)
+	if !ok {
+		return nil, ErrInvalidPayload
+	}
+	target, _, ok := readString(data, offset)
+	if !ok {
+		return nil, ErrInvalidPayload
+	}
+	return &PunchRequestPayload{RuleID: ruleID, TargetAgentID: target}, nil
+}
+
+// EncodePunchPayload encodes a punch payload
+func EncodePunchPayload(p *PunchPayload) []byte {
+	buf := appendString(nil, p.Session)
+	buf = appendString(buf, p.PeerAgentID)
+	buf = appendString(buf, string(p.PeerKey))
+	buf = append(buf, byte(len(p.Endpoints)))
+	for _, ep := range p.Endpoints {
+		buf = appendString(buf, ep)
+	}
+	if p.Dial {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	return appendString(buf, p.Error)
+}
+
+// DecodePunchPayload decodes a punch payload
+func DecodePunchPayload(data []byte) (*PunchPayload, error) {
+	p := &PunchPayload{}
+	var key string
+	var ok bool
+	offset := 0
+	for _, field := range []*string{&p.Session, &p.PeerAgentID, &key} {
+		if *field, offset, ok = readString(data, offset); !ok {
+			return nil, ErrInvalidPayload
+		}
+	}
+	p.PeerKey = []byte(key)
+
+	if offset >= len(data) {
+		return nil, ErrInvalidPayload
+	}
+	count := int(data[offset])
+	offset++
+	for i := 0; i < count; i++ {
+		var ep string
+		if ep, offset, ok = readString(data, offset); !ok {
+			return nil, ErrInvalidPayload
+		}
+		p.Endpoints = append(p.Endpoints, ep)
+	}
+
+	if offset >= len(data) {
+		return nil, ErrInvalidPayload
+	}
+	p.Dial = data[offset] == 1
+	if p.Error, _, ok = readString(data, offset+1); !ok {
+		return nil, ErrInvalidPayload
+	}
+	return p, nil
+}
+
+// WriteDirectStreamHeader starts a direct tunnel stream with its tunnel ID
+func WriteDirectStreamHeader(w io.Writer, tunnelID uint32) error {
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, tunnelID))
+	return err
+}
+
+// ReadDirectStreamHeader reads the tunnel ID a direct tunnel stream starts with
+func ReadDirectStreamHeader(r io.Reader) (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
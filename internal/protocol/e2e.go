@@ -0,0 +1,250 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// End-to-end encryption
+//
+// Agent-to-agent tunnels may be encrypted between the two agents, so the
+// cloud relaying them only sees ciphertext. The source agent offers an
+// ephemeral X25519 key in its P2P connect request, signed with its identity
+// key together with the destination. The cloud passes the offer on to the
+// target agent along with the identity key it enrolled for the source, and
+// the target answers in kind in its connect ack. Both sides derive a
+// ChaCha20-Poly1305 key per direction from the shared secret with HKDF.
+// Data messages are sealed in order under a counter nonce, so a message the
+// relay drops, replays or reorders fails to open and ends the tunnel.
+//
+// Identity keys are handed out by the cloud along with the agent ID they
+// belong to. So that a cloud substituting keys can't interpose, agents pin
+// the key of each peer ID, either to a configured fingerprint or to the key
+// first seen, and fail the exchange on any other.
+
+var (
+	ErrKeyExchange = errors.New("invalid end-to-end key exchange")
+	ErrDecrypt     = errors.New("end-to-end decryption failed")
+)
+
+// KeyExchange is one side's half of the key exchange of an encrypted tunnel
+type KeyExchange struct {
+	PublicKey   []byte // Ephemeral X25519 key
+	Signature   []byte // Identity signature over the exchange
+	IdentityKey []byte // ed25519 identity key of the signer, set by the cloud
+	AgentID     string // Agent ID of the signer, set by the cloud
+}
+
+// Fingerprint returns the fingerprint of the signer's identity key
+func (k *KeyExchange) Fingerprint() string {
+	return KeyFingerprint(k.IdentityKey)
+}
+
+// KeyFingerprint returns a short digest of an identity key, as agents log it
+func KeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k *KeyExchange) verify(msg []byte) error {
+	if k == nil || len(k.IdentityKey) != ed25519.PublicKeySize || !ed25519.Verify(k.IdentityKey, msg, k.Signature) {
+		return ErrKeyExchange
+	}
+	return nil
+}
+
+// e2eSigningMessage returns the bytes a side signs. The source signs its
+// own key, the target both keys, binding its answer to the offer.
+func e2eSigningMessage(role, targetHost string, targetPort uint16, keys ...[]byte) []byte {
+	msg := []byte(fmt.Sprintf("natsvr-e2e-%s\n%s:%d\n", role, targetHost, targetPort))
+	for _, key := range keys {
+		msg = append(msg, key...)
+	}
+	return msg
+}
+
+// E2EOffer is the source side of a key exchange waiting for the answer
+type E2EOffer struct {
+	Exchange   *KeyExchange
+	private    *ecdh.PrivateKey
+	targetHost string
+	targetPort uint16
+}
+
+// NewE2EOffer starts the key exchange of a tunnel to the destination
+func NewE2EOffer(identity ed25519.PrivateKey, targetHost string, targetPort uint16) (*E2EOffer, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	public := private.PublicKey().Bytes()
+	return &E2EOffer{
+		Exchange: &KeyExchange{
+			PublicKey: public,
+			Signature: ed25519.Sign(identity, e2eSigningMessage("source", targetHost, targetPort, public)),
+		},
+		private:    private,
+		targetHost: targetHost,
+		targetPort: targetPort,
+	}, nil
+}
+
+// Finish verifies the target's answer and returns the source's cipher
+func (o *E2EOffer) Finish(answer *KeyExchange) (*E2ECipher, error) {
+	if answer == nil {
+		return nil, ErrKeyExchange
+	}
+	msg := e2eSigningMessage("target", o.targetHost, o.targetPort, o.Exchange.PublicKey, answer.PublicKey)
+	if err := answer.verify(msg); err != nil {
+		return nil, err
+	}
+	return newE2ECipher(o.private, o.Exchange.PublicKey, answer.PublicKey, true)
+}
+
+// AnswerE2E verifies the source's offer for a tunnel to the destination and
+// returns the answer and the target's cipher
+func AnswerE2E(identity ed25519.PrivateKey, offer *KeyExchange, targetHost string, targetPort uint16) (*KeyExchange, *E2ECipher, error) {
+	if offer == nil {
+		return nil, nil, ErrKeyExchange
+	}
+	if err := offer.verify(e2eSigningMessage("source", targetHost, targetPort, offer.PublicKey)); err != nil {
+		return nil, nil, err
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	public := private.PublicKey().Bytes()
+	c, err := newE2ECipher(private, offer.PublicKey, public, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	answer := &KeyExchange{
+		PublicKey: public,
+		Signature: ed25519.Sign(identity, e2eSigningMessage("target", targetHost, targetPort, offer.PublicKey, public)),
+	}
+	return answer, c, nil
+}
+
+func newE2ECipher(private *ecdh.PrivateKey, sourceKey, targetKey []byte, source bool) (*E2ECipher, error) {
+	peerKey := targetKey
+	if !source {
+		peerKey = sourceKey
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, ErrKeyExchange
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, ErrKeyExchange
+	}
+
+	salt := append(append([]byte{}, sourceKey...), targetKey...)
+	toTarget, err := e2eAEAD(secret, salt, "natsvr-e2e source to target")
+	if err != nil {
+		return nil, err
+	}
+	toSource, err := e2eAEAD(secret, salt, "natsvr-e2e target to source")
+	if err != nil {
+		return nil, err
+	}
+
+	if source {
+		return &E2ECipher{send: toTarget, recv: toSource}, nil
+	}
+	return &E2ECipher{send: toSource, recv: toTarget}, nil
+}
+
+func e2eAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// E2ECipher seals and opens the data messages of an encrypted tunnel. Each
+// direction counts its messages, so they must be opened in the order they
+// were sealed.
+type E2ECipher struct {
+	sendMu  sync.Mutex
+	send    cipher.AEAD
+	sendSeq uint64
+
+	recvMu  sync.Mutex
+	recv    cipher.AEAD
+	recvSeq uint64
+}
+
+// Seal encrypts the payload of the next outgoing data message
+func (c *E2ECipher) Seal(p []byte) []byte {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	out := c.send.Seal(nil, e2eNonce(c.sendSeq), p, nil)
+	c.sendSeq++
+	return out
+}
+
+// Open decrypts the payload of the next incoming data message
+func (c *E2ECipher) Open(payload []byte) ([]byte, error) {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+
+	out, err := c.recv.Open(nil, e2eNonce(c.recvSeq), payload, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	c.recvSeq++
+	return out, nil
+}
+
+func e2eNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], seq)
+	return nonce
+}
+
+// appendKeyExchange appends a key exchange as length-prefixed fields,
+// nothing if k is nil
+func appendKeyExchange(buf []byte, k *KeyExchange) []byte {
+	if k == nil {
+		return buf
+	}
+	for _, field := range [][]byte{k.PublicKey, k.Signature, k.IdentityKey} {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+// readKeyExchange reads a key exchange at offset, returning the offset after
+// it. The key exchange is nil if data ends before it or it is empty.
+func readKeyExchange(data []byte, offset int) (*KeyExchange, int) {
+	var fields [3][]byte
+	for i := range fields {
+		s, next, ok := readString(data, offset)
+		if !ok {
+			return nil, len(data)
+		}
+		fields[i] = []byte(s)
+		offset = next
+	}
+	if len(fields[0]) == 0 {
+		return nil, offset
+	}
+	return &KeyExchange{PublicKey: fields[0], Signature: fields[1], IdentityKey: fields[2]}, offset
+}
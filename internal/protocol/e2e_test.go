@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func newIdentity(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// exchange runs a key exchange the way the cloud relays it, adding the
+// enrolled identity key of each side
+func exchange(t *testing.T) (source, target *E2ECipher) {
+	t.Helper()
+	sourcePub, sourcePriv := newIdentity(t)
+	targetPub, targetPriv := newIdentity(t)
+
+	offer, err := NewE2EOffer(sourcePriv, "10.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer.Exchange.IdentityKey = sourcePub
+	answer, target, err := AnswerE2E(targetPriv, offer.Exchange, "10.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer.IdentityKey = targetPub
+	source, err = offer.Finish(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source, target
+}
+
+func TestE2ERoundTrip(t *testing.T) {
+	source, target := exchange(t)
+
+	for i, msg := range []string{"hello", "", "world", string(make([]byte, 64<<10))} {
+		sealed := source.Seal([]byte(msg))
+		if len(msg) > 0 && bytes.Contains(sealed, []byte(msg)) {
+			t.Fatalf("message %d sealed in the clear", i)
+		}
+		opened, err := target.Open(sealed)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if string(opened) != msg {
+			t.Fatalf("message %d opened as %q", i, opened)
+		}
+	}
+
+	// The other direction has keys and a counter of its own
+	opened, err := source.Open(target.Seal([]byte("reply")))
+	if err != nil || string(opened) != "reply" {
+		t.Fatalf("reply: %q, %v", opened, err)
+	}
+}
+
+func TestE2ESequence(t *testing.T) {
+	source, target := exchange(t)
+
+	// The same plaintext seals differently each time
+	first := source.Seal([]byte("same"))
+	second := source.Seal([]byte("same"))
+	third := source.Seal([]byte("same"))
+	if bytes.Equal(first, second) {
+		t.Fatal("nonce reused")
+	}
+
+	// Out of order fails, and doesn't advance the counter
+	if _, err := target.Open(second); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("reordered message: %v, want ErrDecrypt", err)
+	}
+	if _, err := target.Open(first); err != nil {
+		t.Fatalf("first message after a failed one: %v", err)
+	}
+	// A replay fails
+	if _, err := target.Open(first); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("replayed message: %v, want ErrDecrypt", err)
+	}
+	if _, err := target.Open(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Open(third); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message reflected back to its sender fails
+	if _, err := source.Open(source.Seal([]byte("echo"))); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("reflected message: %v, want ErrDecrypt", err)
+	}
+}
+
+func TestE2ETampered(t *testing.T) {
+	source, target := exchange(t)
+	sealed := source.Seal([]byte("transfer 100"))
+
+	for name, payload := range map[string][]byte{
+		"flipped bit": func() []byte { p := bytes.Clone(sealed); p[3] ^= 1; return p }(),
+		"flipped tag": func() []byte { p := bytes.Clone(sealed); p[len(p)-1] ^= 0x80; return p }(),
+		"truncated":   sealed[:len(sealed)-1],
+		"tag only":    sealed[len(sealed)-16:],
+		"empty":       nil,
+		"extended":    append(bytes.Clone(sealed), 0),
+	} {
+		if _, err := target.Open(payload); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: %v, want ErrDecrypt", name, err)
+		}
+	}
+	if opened, err := target.Open(sealed); err != nil || string(opened) != "transfer 100" {
+		t.Fatalf("untouched message: %q, %v", opened, err)
+	}
+
+	// A tunnel's keys don't open another's messages
+	_, other := exchange(t)
+	if _, err := other.Open(source.Seal([]byte("x"))); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("other tunnel: %v, want ErrDecrypt", err)
+	}
+}
+
+func TestE2EKeyExchangeRejected(t *testing.T) {
+	sourcePub, sourcePriv := newIdentity(t)
+	targetPub, targetPriv := newIdentity(t)
+	otherPub, otherPriv := newIdentity(t)
+
+	newOffer := func() *E2EOffer {
+		offer, err := NewE2EOffer(sourcePriv, "10.0.0.1", 22)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offer.Exchange.IdentityKey = sourcePub
+		return offer
+	}
+
+	// Offers the target must refuse
+	offer := newOffer()
+	if _, _, err := AnswerE2E(targetPriv, offer.Exchange, "10.0.0.1", 23); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("offer for another port: %v", err)
+	}
+	if _, _, err := AnswerE2E(targetPriv, offer.Exchange, "10.0.0.2", 22); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("offer for another host: %v", err)
+	}
+	swapped := *offer.Exchange
+	swapped.IdentityKey = otherPub
+	if _, _, err := AnswerE2E(targetPriv, &swapped, "10.0.0.1", 22); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("offer under another identity: %v", err)
+	}
+	unsigned := *offer.Exchange
+	unsigned.Signature = nil
+	if _, _, err := AnswerE2E(targetPriv, &unsigned, "10.0.0.1", 22); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("unsigned offer: %v", err)
+	}
+	anonymous := *offer.Exchange
+	anonymous.IdentityKey = nil
+	if _, _, err := AnswerE2E(targetPriv, &anonymous, "10.0.0.1", 22); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("offer without identity key: %v", err)
+	}
+	if _, _, err := AnswerE2E(targetPriv, nil, "10.0.0.1", 22); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("no offer: %v", err)
+	}
+	badKey := *offer.Exchange
+	badKey.PublicKey = []byte("short")
+	badKey.Signature = ed25519.Sign(sourcePriv, e2eSigningMessage("source", "10.0.0.1", 22, badKey.PublicKey))
+	if _, _, err := AnswerE2E(targetPriv, &badKey, "10.0.0.1", 22); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("offer of an invalid X25519 key: %v", err)
+	}
+
+	// Answers the source must refuse
+	answer, _, err := AnswerE2E(targetPriv, offer.Exchange, "10.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer.IdentityKey = targetPub
+
+	// A target that never answers, e.g. one without end-to-end support
+	if _, err := offer.Finish(nil); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("no answer: %v", err)
+	}
+	// An answer to another offer, such as a replayed one
+	if _, err := newOffer().Finish(answer); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("answer to another offer: %v", err)
+	}
+	// An answer signed by someone other than the enrolled target
+	forged, _, err := AnswerE2E(otherPriv, offer.Exchange, "10.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.IdentityKey = targetPub
+	if _, err := offer.Finish(forged); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("forged answer: %v", err)
+	}
+	tampered := *answer
+	tampered.PublicKey = bytes.Clone(answer.PublicKey)
+	tampered.PublicKey[0] ^= 1
+	if _, err := offer.Finish(&tampered); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("answer with a replaced key: %v", err)
+	}
+
+	if _, err := offer.Finish(answer); err != nil {
+		t.Errorf("genuine answer: %v", err)
+	}
+}
+
+func TestKeyExchangeEncoding(t *testing.T) {
+	k := &KeyExchange{PublicKey: []byte("public"), Signature: []byte("signature"), IdentityKey: []byte("identity")}
+	buf := appendKeyExchange([]byte("head"), k)
+	got, offset := readKeyExchange(buf, 4)
+	if offset != len(buf) || got == nil || string(got.PublicKey) != "public" || string(got.Signature) != "signature" || string(got.IdentityKey) != "identity" {
+		t.Fatalf("read %+v at %d", got, offset)
+	}
+
+	// Without the identity key, as the source sends it
+	k.IdentityKey = nil
+	buf = appendKeyExchange(nil, k)
+	if got, _ := readKeyExchange(buf, 0); got == nil || len(got.IdentityKey) != 0 {
+		t.Fatalf("read %+v", got)
+	}
+
+	if buf := appendKeyExchange(nil, nil); len(buf) != 0 {
+		t.Fatalf("nil key exchange encoded as %d bytes", len(buf))
+	}
+	if got, offset := readKeyExchange(buf[:5], 0); got != nil || offset != 5 {
+		t.Fatalf("truncated key exchange read as %+v", got)
+	}
+}
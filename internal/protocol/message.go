@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -22,7 +23,8 @@ const (
 	MsgTypeClose      MessageType = 12
 
 	// Data transfer
-	MsgTypeData MessageType = 20
+	MsgTypeData         MessageType = 20
+	MsgTypeWindowUpdate MessageType = 21 // Returns flow control credit for a tunnel
 
 	// UDP specific
 	MsgTypeUDPData MessageType = 30
@@ -48,6 +50,11 @@ const (
 	MsgTypeRuleAuth         MessageType = 70 // Agent authenticates a rule-specific connection
 	MsgTypeRuleAuthResponse MessageType = 71 // Cloud responds to rule auth
 
+	// Direct agent-to-agent connectivity (rendezvous and hole punching)
+	MsgTypeRendezvous   MessageType = 80 // Cloud tells an agent where to register its UDP endpoint
+	MsgTypePunchRequest MessageType = 81 // Source agent asks for a direct path to a rule's target
+	MsgTypePunch        MessageType = 82 // Cloud introduces two agents to punch towards each other
+
 	// Error
 	MsgTypeError MessageType = 255
 )
@@ -55,7 +62,7 @@ const (
 // Protocol constants
 const (
 	MaxPayloadSize = 65535
-	HeaderSize     = 9 // 1 (type) + 4 (tunnel ID) + 4 (payload length)
+	HeaderSize     = 9          // 1 (type) + 4 (tunnel ID) + 4 (payload length)
 	MagicNumber    = 0x4E415453 // "NATS"
 )
 
@@ -71,6 +78,22 @@ type AuthPayload struct {
 	Token     string
 	AgentName string
 	AgentID   string
+	Version   string            // Agent build version
+	OS        string            // runtime.GOOS of the agent
+	Arch      string            // runtime.GOARCH of the agent
+	Labels    map[string]string // Free-form agent labels
+	PublicKey []byte            // ed25519 public key of the agent identity
+	Signature []byte            // Signature over AuthSigningMessage
+	Timestamp int64             // Unix time the signature was made
+	// Protocol version and capabilities of the agent
+	ProtocolVersion uint16
+	Capabilities    Capabilities
+}
+
+// AuthSigningMessage returns the bytes an agent signs with its identity key
+// to prove it owns the agent ID it authenticates as
+func AuthSigningMessage(agentID, agentName string, timestamp int64) []byte {
+	return []byte(fmt.Sprintf("natsvr-auth\n%s\n%s\n%d", agentID, agentName, timestamp))
 }
 
 // AuthResponsePayload is the authentication response payload
@@ -78,6 +101,15 @@ type AuthResponsePayload struct {
 	Success bool
 	AgentID string
 	Error   string
+	// Protocol version and capabilities of the cloud
+	ProtocolVersion uint16
+	Capabilities    Capabilities
+	// ClientCertificate is a DER certificate the cloud issued for the
+	// agent's identity key, to present on later connections
+	ClientCertificate []byte
+	// RuleAuthNonce is issued for this connection; the agent signs it on
+	// its rule connections to prove they come from the same identity
+	RuleAuthNonce []byte
 }
 
 // ConnectPayload is the tunnel connect request payload
@@ -87,6 +119,19 @@ type ConnectPayload struct {
 	TargetPort uint16
 	SourceHost string
 	SourcePort uint16
+	Window     uint32 // Receive window the requester grants, 0 = no flow control
+	// Compression the requester wants for the tunnel's data
+	Compression Compression
+	// Source half of the key exchange of an end-to-end encrypted tunnel
+	KeyExchange *KeyExchange
+	// The tunnel's data goes over the direct path between the agents
+	Direct bool
+	// Identity key of the source agent, the only peer whose direct path
+	// may claim the tunnel. Set by the cloud for the target.
+	DirectPeerKey []byte
+	// PROXY protocol header to start the target connection with, carrying
+	// SourceHost and SourcePort
+	ProxyProtocol ProxyProtocol
 }
 
 // ConnectAckPayload is the tunnel connect response payload
@@ -94,6 +139,13 @@ type ConnectAckPayload struct {
 	Success  bool
 	TunnelID uint32
 	Error    string
+	Window   uint32 // Receive window the responder grants, 0 = no flow control
+	// Compression the tunnel's data uses, as accepted by the responder
+	Compression Compression
+	// Target half of the key exchange of an end-to-end encrypted tunnel
+	KeyExchange *KeyExchange
+	// The responder accepted the tunnel on the direct path
+	Direct bool
 }
 
 // UDPDataPayload contains UDP packet data with addressing info
@@ -127,6 +179,7 @@ type LocalProxyStartPayload struct {
 	TargetAgentID string
 	TargetHost    string
 	TargetPort    uint16
+	Encrypted     bool // Encrypt tunnels end to end with the target agent
 }
 
 // LocalProxyStopPayload tells agent to stop a local proxy
@@ -141,6 +194,14 @@ type P2PConnectPayload struct {
 	TargetHost    string
 	TargetPort    uint16
 	RuleID        string // Rule ID for per-rule connection isolation
+	Window        uint32 // Receive window the source agent grants, 0 = no flow control
+	// Source half of the key exchange of an end-to-end encrypted tunnel
+	KeyExchange *KeyExchange
+	// The source has a direct path to the target agent and offers to use it
+	Direct bool
+	// Client address of the connection accepted by the source agent
+	SourceHost string
+	SourcePort uint16
 }
 
 // P2PDataPayload wraps data between source and target agents
@@ -169,6 +230,10 @@ type AgentCloudConnectPayload struct {
 	TargetHost string
 	TargetPort uint16
 	RuleID     string // Rule ID for per-rule connection isolation
+	Window     uint32 // Receive window the agent grants, 0 = no flow control
+	// Client address of the connection accepted by the agent
+	SourceHost string
+	SourcePort uint16
 }
 
 // RuleAuthPayload is the rule-specific connection authentication payload
@@ -176,6 +241,16 @@ type RuleAuthPayload struct {
 	Token   string // Agent auth token
 	AgentID string // Agent ID (from main connection)
 	RuleID  string // The rule this connection is dedicated to
+	// Signature of RuleAuthSigningMessage with the agent's identity key,
+	// empty for agents without one
+	Timestamp int64
+	Signature []byte
+}
+
+// RuleAuthSigningMessage returns the bytes an agent signs to open a rule
+// connection, bound to the nonce of its main connection
+func RuleAuthSigningMessage(agentID, ruleID string, nonce []byte, timestamp int64) []byte {
+	return []byte(fmt.Sprintf("natsvr-rule-auth\n%s\n%s\n%x\n%d", agentID, ruleID, nonce, timestamp))
 }
 
 // RuleAuthResponsePayload is the response to rule auth
@@ -187,11 +262,11 @@ type RuleAuthResponsePayload struct {
 
 // Error codes
 const (
-	ErrCodeUnknown      uint16 = 0
-	ErrCodeAuthFailed   uint16 = 1
+	ErrCodeUnknown       uint16 = 0
+	ErrCodeAuthFailed    uint16 = 1
 	ErrCodeConnectFailed uint16 = 2
-	ErrCodeTunnelClosed uint16 = 3
-	ErrCodeInvalidMsg   uint16 = 4
+	ErrCodeTunnelClosed  uint16 = 3
+	ErrCodeInvalidMsg    uint16 = 4
 )
 
 var (
@@ -210,13 +285,8 @@ func NewMessage(msgType MessageType, tunnelID uint32, payload []byte) *Message {
 }
 
 // NewAuthMessage creates an authentication message
-func NewAuthMessage(token, agentName, agentID string) *Message {
-	payload := EncodeAuthPayload(&AuthPayload{
-		Token:     token,
-		AgentName: agentName,
-		AgentID:   agentID,
-	})
-	return NewMessage(MsgTypeAuth, 0, payload)
+func NewAuthMessage(p *AuthPayload) *Message {
+	return NewMessage(MsgTypeAuth, 0, EncodeAuthPayload(p))
 }
 
 // NewHeartbeatMessage creates a heartbeat message
@@ -230,11 +300,13 @@ func NewHeartbeatAckMessage() *Message {
 }
 
 // NewConnectMessage creates a tunnel connect message
-func NewConnectMessage(tunnelID uint32, protocol, targetHost string, targetPort uint16) *Message {
+func NewConnectMessage(tunnelID uint32, protocol, targetHost string, targetPort uint16, window uint32, compression Compression) *Message {
 	payload := EncodeConnectPayload(&ConnectPayload{
-		Protocol:   protocol,
-		TargetHost: targetHost,
-		TargetPort: targetPort,
+		Protocol:    protocol,
+		TargetHost:  targetHost,
+		TargetPort:  targetPort,
+		Window:      window,
+		Compression: compression,
 	})
 	return NewMessage(MsgTypeConnect, tunnelID, payload)
 }
@@ -349,6 +421,8 @@ func (t MessageType) String() string {
 		return "Close"
 	case MsgTypeData:
 		return "Data"
+	case MsgTypeWindowUpdate:
+		return "WindowUpdate"
 	case MsgTypeUDPData:
 		return "UDPData"
 	case MsgTypeICMPData:
@@ -377,10 +451,15 @@ func (t MessageType) String() string {
 		return "RuleAuth"
 	case MsgTypeRuleAuthResponse:
 		return "RuleAuthResponse"
+	case MsgTypeRendezvous:
+		return "Rendezvous"
+	case MsgTypePunchRequest:
+		return "PunchRequest"
+	case MsgTypePunch:
+		return "Punch"
 	case MsgTypeError:
 		return "Error"
 	default:
 		return "Unknown"
 	}
 }
-
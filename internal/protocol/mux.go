@@ -0,0 +1,352 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Flow control
+//
+// Every TCP tunnel is a stream with its own receive window, so tunnels
+// sharing a WebSocket cannot stall each other. Each side advertises the
+// window it grants in the connect request or ack. A sender keeps at most
+// the peer's window in flight. The receiver queues incoming data, writes it
+// to the destination from a goroutine of its own and returns credit with
+// MsgTypeWindowUpdate as the destination drains. A peer that advertises no
+// window predates flow control: the stream then sends without limit and
+// writes incoming data synchronously, as before.
+//
+// A stream may also compress its data messages and encrypt them end to end.
+// Windows count data before compression.
+
+// DefaultWindowSize is the receive window granted to peers per tunnel
+const DefaultWindowSize = 256 * 1024
+
+// drainTimeout bounds how long a finished stream keeps writing queued data
+// to a destination that stopped reading
+const drainTimeout = 30 * time.Second
+
+var (
+	ErrStreamClosed   = errors.New("stream closed")
+	ErrWindowExceeded = errors.New("peer exceeded flow control window")
+)
+
+// NewWindowUpdateMessage creates a message returning increment bytes of
+// credit for a tunnel
+func NewWindowUpdateMessage(tunnelID, increment uint32) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, increment)
+	return NewMessage(MsgTypeWindowUpdate, tunnelID, payload)
+}
+
+// DecodeWindowUpdatePayload decodes the increment of a window update
+func DecodeWindowUpdatePayload(data []byte) (uint32, error) {
+	if len(data) < 4 {
+		return 0, ErrInvalidPayload
+	}
+	return binary.BigEndian.Uint32(data[0:4]), nil
+}
+
+// Mux tracks the streams of an endpoint by tunnel ID so window updates
+// read from any connection reach their stream
+type Mux struct {
+	streams map[uint32]*Stream
+	mu      sync.RWMutex
+}
+
+// NewMux creates an empty mux
+func NewMux() *Mux {
+	return &Mux{streams: make(map[uint32]*Stream)}
+}
+
+// StreamConfig describes a stream to open
+type StreamConfig struct {
+	TunnelID   uint32
+	DataType   MessageType          // Type of the data messages the stream sends
+	PeerWindow uint32               // Window the peer advertised, 0 = no flow control
+	Dst        io.WriteCloser       // Destination of the data the peer sends
+	Send       func(*Message) error // Sends a message to the peer
+
+	Compression Compression       // Compression of data messages, both ways
+	Stats       *CompressionStats // Counts compressed data, may be nil
+	Cipher      *E2ECipher        // Encrypts data messages end to end, may be nil
+}
+
+// Open creates the stream of a tunnel. Flow-controlled streams are
+// registered for window updates, replacing any previous one.
+func (m *Mux) Open(cfg StreamConfig) *Stream {
+	s := &Stream{
+		mux:    m,
+		id:     cfg.TunnelID,
+		typ:    cfg.DataType,
+		dst:    cfg.Dst,
+		send:   cfg.Send,
+		flow:   cfg.PeerWindow > 0,
+		credit: int64(cfg.PeerWindow),
+
+		compression: cfg.Compression,
+		stats:       cfg.Stats,
+		cipher:      cfg.Cipher,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if !s.flow {
+		return s
+	}
+
+	m.mu.Lock()
+	old := m.streams[cfg.TunnelID]
+	m.streams[cfg.TunnelID] = s
+	m.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	go s.writeLoop()
+	return s
+}
+
+// Get returns the stream of a tunnel, or nil
+func (m *Mux) Get(tunnelID uint32) *Stream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.streams[tunnelID]
+}
+
+// HandleWindowUpdate credits the stream a window update is addressed to.
+// It reports whether the stream exists.
+func (m *Mux) HandleWindowUpdate(msg *Message) bool {
+	s := m.Get(msg.TunnelID)
+	if s == nil {
+		return false
+	}
+	if increment, err := DecodeWindowUpdatePayload(msg.Payload); err == nil {
+		s.grant(increment)
+	}
+	return true
+}
+
+// CloseAll closes every stream
+func (m *Mux) CloseAll() {
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.Close()
+	}
+}
+
+func (m *Mux) remove(s *Stream) {
+	m.mu.Lock()
+	if m.streams[s.id] == s {
+		delete(m.streams, s.id)
+	}
+	m.mu.Unlock()
+}
+
+// Stream is the flow-controlled data path of one tunnel
+type Stream struct {
+	mux  *Mux
+	id   uint32
+	typ  MessageType
+	dst  io.WriteCloser
+	send func(*Message) error
+	flow bool
+
+	compression Compression
+	stats       *CompressionStats
+	cipher      *E2ECipher
+
+	mu       sync.Mutex
+	cond     *sync.Cond // Signalled on credit, queued data and close
+	credit   int64      // Bytes that may still be sent
+	queue    [][]byte   // Received data not yet written to dst
+	queued   int
+	closed   bool
+	drained  bool   // The write loop has exited
+	finished func() // Run once the queue is drained after close
+}
+
+// Write sends p to the peer in data messages, blocking while the peer's
+// window is exhausted
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		want := len(p)
+		if (s.compression != CompressionNone || s.cipher != nil) && want > maxCompressChunk {
+			want = maxCompressChunk
+		}
+		n, err := s.acquire(want)
+		if err != nil {
+			return written, err
+		}
+		payload := p[:n]
+		if s.compression != CompressionNone {
+			payload = s.compression.compress(payload)
+			s.stats.add(n, len(payload))
+		}
+		if s.cipher != nil {
+			payload = s.cipher.Seal(payload)
+		}
+		if err := s.send(NewMessage(s.typ, s.id, payload)); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// acquire waits for send credit and takes up to n bytes of it
+func (s *Stream) acquire(n int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.flow {
+		if s.closed {
+			return 0, ErrStreamClosed
+		}
+		return n, nil
+	}
+	for s.credit <= 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	if int64(n) > s.credit {
+		n = int(s.credit)
+	}
+	s.credit -= int64(n)
+	return n, nil
+}
+
+func (s *Stream) grant(increment uint32) {
+	s.mu.Lock()
+	s.credit += int64(increment)
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// Deliver hands data received from the peer to the destination. With flow
+// control it is queued and written asynchronously, so Deliver never blocks
+// on the destination.
+func (s *Stream) Deliver(payload []byte) error {
+	if s.cipher != nil {
+		var err error
+		if payload, err = s.cipher.Open(payload); err != nil {
+			return err
+		}
+	}
+	data, err := s.compression.decompress(payload)
+	if err != nil {
+		return err
+	}
+	if s.compression != CompressionNone {
+		s.stats.add(len(data), len(payload))
+	}
+
+	if !s.flow {
+		_, err := s.dst.Write(data)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	if s.queued+len(data) > DefaultWindowSize {
+		return ErrWindowExceeded
+	}
+	s.queue = append(s.queue, data)
+	s.queued += len(data)
+	s.cond.Broadcast()
+	return nil
+}
+
+// writeLoop writes queued data to the destination and returns credit to
+// the peer as it drains
+func (s *Stream) writeLoop() {
+	var consumed uint32
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			done := s.finished
+			s.finished = nil
+			s.drained = true
+			s.mu.Unlock()
+			if done != nil {
+				done()
+			}
+			return
+		}
+		data := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		closed := s.closed
+		s.mu.Unlock()
+
+		if closed {
+			if d, ok := s.dst.(interface{ SetWriteDeadline(time.Time) error }); ok {
+				d.SetWriteDeadline(time.Now().Add(drainTimeout))
+			}
+		}
+		if _, err := s.dst.Write(data); err != nil {
+			s.dst.Close()
+			s.mu.Lock()
+			s.queue = nil
+			s.mu.Unlock()
+			s.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		s.queued -= len(data)
+		s.mu.Unlock()
+
+		// Batch credit so small writes don't each cost a message
+		consumed += uint32(len(data))
+		if !closed && consumed >= DefaultWindowSize/4 {
+			s.send(NewWindowUpdateMessage(s.id, consumed))
+			consumed = 0
+		}
+	}
+}
+
+// Close ends the stream. Blocked writers return ErrStreamClosed; data
+// already received is still written to the destination.
+func (s *Stream) Close() {
+	s.Finish(nil)
+}
+
+// Finish closes the stream and calls done once data already received has
+// been written to the destination, e.g. to close it after the peer closed
+// the tunnel
+func (s *Stream) Finish(done func()) {
+	s.mux.remove(s)
+
+	s.mu.Lock()
+	s.closed = true
+	if s.flow && !s.drained && done != nil {
+		if prev := s.finished; prev != nil {
+			next := done
+			done = func() { prev(); next() }
+		}
+		s.finished = done
+		done = nil
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+
+	if done != nil {
+		done()
+	}
+}
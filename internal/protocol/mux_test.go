@@ -0,0 +1,308 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// peer records the messages a stream sends
+type peer struct {
+	mu   sync.Mutex
+	msgs []*Message
+}
+
+func (p *peer) send(msg *Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+// sent returns the payload bytes of data messages and the increments of
+// window updates sent so far
+func (p *peer) sent() (data int, updates []uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, msg := range p.msgs {
+		switch msg.Type {
+		case MsgTypeData:
+			data += len(msg.Payload)
+		case MsgTypeWindowUpdate:
+			increment, _ := DecodeWindowUpdatePayload(msg.Payload)
+			updates = append(updates, increment)
+		}
+	}
+	return data, updates
+}
+
+// sink is a destination that blocks writes until it is opened
+type sink struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	gate   chan struct{}
+	closed bool
+}
+
+func newSink(open bool) *sink {
+	s := &sink{gate: make(chan struct{})}
+	if open {
+		close(s.gate)
+	}
+	return s
+}
+
+func (s *sink) Write(p []byte) (int, error) {
+	<-s.gate
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *sink) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Len()
+}
+
+// eventually polls cond for up to a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamWriteWaitsForCredit(t *testing.T) {
+	mux := NewMux()
+	p := &peer{}
+	s := mux.Open(StreamConfig{TunnelID: 1, DataType: MsgTypeData, PeerWindow: 10, Dst: newSink(true), Send: p.send})
+	defer s.Close()
+
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := s.Write(make([]byte, 25))
+		done <- result{n, err}
+	}()
+
+	// The window is used up, the writer blocks at zero credit
+	eventually(t, "the first 10 bytes", func() bool { data, _ := p.sent(); return data == 10 })
+	time.Sleep(20 * time.Millisecond)
+	if data, _ := p.sent(); data != 10 {
+		t.Fatalf("sent %d bytes with a window of 10", data)
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("Write returned %d, %v without credit", r.n, r.err)
+	default:
+	}
+
+	// Window updates release it, a little at a time
+	if !mux.HandleWindowUpdate(NewWindowUpdateMessage(1, 4)) {
+		t.Fatal("window update for the stream not handled")
+	}
+	eventually(t, "4 more bytes", func() bool { data, _ := p.sent(); return data == 14 })
+	mux.HandleWindowUpdate(NewWindowUpdateMessage(1, 100))
+	r := <-done
+	if r.n != 25 || r.err != nil {
+		t.Fatalf("Write = %d, %v, want 25", r.n, r.err)
+	}
+	if data, _ := p.sent(); data != 25 {
+		t.Fatalf("sent %d bytes, want 25", data)
+	}
+	// The rest of the credit remains
+	if n, err := s.acquire(1000); n != 89 || err != nil {
+		t.Fatalf("remaining credit %d, %v, want 89", n, err)
+	}
+}
+
+func TestStreamCloseReleasesWriter(t *testing.T) {
+	mux := NewMux()
+	s := mux.Open(StreamConfig{TunnelID: 1, DataType: MsgTypeData, PeerWindow: 1, Dst: newSink(true), Send: (&peer{}).send})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, 2))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	if err := <-done; !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("blocked Write returned %v, want ErrStreamClosed", err)
+	}
+	if mux.HandleWindowUpdate(NewWindowUpdateMessage(1, 10)) {
+		t.Error("closed stream still receives window updates")
+	}
+	if _, err := s.Write([]byte{1}); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("Write after Close: %v", err)
+	}
+}
+
+func TestStreamDeliverWindowExceeded(t *testing.T) {
+	mux := NewMux()
+	dst := newSink(false) // Not reading
+	s := mux.Open(StreamConfig{TunnelID: 1, DataType: MsgTypeData, PeerWindow: DefaultWindowSize, Dst: dst, Send: (&peer{}).send})
+	defer s.Close()
+
+	chunk := make([]byte, DefaultWindowSize/8)
+	for i := range 8 {
+		if err := s.Deliver(chunk); err != nil {
+			t.Fatalf("chunk %d within the window: %v", i, err)
+		}
+	}
+	// The peer sends more than it was granted
+	if err := s.Deliver([]byte{1}); !errors.Is(err, ErrWindowExceeded) {
+		t.Fatalf("Deliver beyond the window: %v, want ErrWindowExceeded", err)
+	}
+
+	// Once the destination drains there is room again
+	close(dst.gate)
+	eventually(t, "the queue to drain", func() bool { return dst.len() == DefaultWindowSize })
+	eventually(t, "room in the window", func() bool { return s.Deliver([]byte{1}) == nil })
+}
+
+func TestStreamWindowUpdatesBatched(t *testing.T) {
+	mux := NewMux()
+	p := &peer{}
+	dst := newSink(true)
+	s := mux.Open(StreamConfig{TunnelID: 1, DataType: MsgTypeData, PeerWindow: DefaultWindowSize, Dst: dst, Send: p.send})
+	defer s.Close()
+
+	// 200 KiB in 1 KiB messages
+	for range 200 {
+		if err := s.Deliver(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+		// Stay within the window as a real peer would
+		eventually(t, "the message to be written", func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.queued == 0
+		})
+	}
+	eventually(t, "all data written", func() bool { return dst.len() == 200*1024 })
+
+	// Credit is returned each window/4, the last 8 KiB not yet
+	_, updates := p.sent()
+	if len(updates) != 3 {
+		t.Fatalf("%d window updates %v, want 3", len(updates), updates)
+	}
+	for _, increment := range updates {
+		if increment != DefaultWindowSize/4 {
+			t.Errorf("window update of %d, want %d", increment, DefaultWindowSize/4)
+		}
+	}
+}
+
+func TestStreamFinishDrains(t *testing.T) {
+	mux := NewMux()
+	p := &peer{}
+	dst := newSink(false)
+	s := mux.Open(StreamConfig{TunnelID: 1, DataType: MsgTypeData, PeerWindow: DefaultWindowSize, Dst: dst, Send: p.send})
+
+	data := bytes.Repeat([]byte("x"), DefaultWindowSize/2)
+	if err := s.Deliver(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(data); err != nil {
+		t.Fatal(err)
+	}
+
+	finished := make(chan struct{})
+	s.Finish(func() { close(finished) })
+	select {
+	case <-finished:
+		t.Fatal("finished before the queued data was written")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// Data arriving after the close is refused
+	if err := s.Deliver([]byte{1}); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("Deliver after Finish: %v, want ErrStreamClosed", err)
+	}
+
+	close(dst.gate)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never finished")
+	}
+	if dst.len() != 2*len(data) {
+		t.Fatalf("%d bytes written before done, want %d", dst.len(), 2*len(data))
+	}
+	// No credit is returned for a closed stream
+	if _, updates := p.sent(); len(updates) != 0 {
+		t.Errorf("window updates %v after close", updates)
+	}
+
+	// Finishing a drained stream is done right away
+	again := false
+	s.Finish(func() { again = true })
+	if !again {
+		t.Error("Finish of a drained stream didn't call done")
+	}
+}
+
+func TestStreamWithoutFlowControl(t *testing.T) {
+	mux := NewMux()
+	p := &peer{}
+	dst := newSink(true)
+	s := mux.Open(StreamConfig{TunnelID: 1, DataType: MsgTypeData, Dst: dst, Send: p.send})
+
+	// Peers that advertise no window get everything, and data is written
+	// before Deliver returns
+	if n, err := s.Write(make([]byte, 4*DefaultWindowSize)); n != 4*DefaultWindowSize || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if err := s.Deliver(make([]byte, 2*DefaultWindowSize)); err != nil {
+		t.Fatal(err)
+	}
+	if dst.len() != 2*DefaultWindowSize {
+		t.Fatalf("%d bytes written", dst.len())
+	}
+	if mux.Get(1) != nil {
+		t.Error("stream without flow control registered for window updates")
+	}
+
+	finished := false
+	s.Finish(func() { finished = true })
+	if !finished {
+		t.Error("Finish without flow control didn't call done")
+	}
+}
+
+func TestMuxOpenReplaces(t *testing.T) {
+	mux := NewMux()
+	old := mux.Open(StreamConfig{TunnelID: 1, DataType: MsgTypeData, PeerWindow: 1, Dst: newSink(true), Send: (&peer{}).send})
+	s := mux.Open(StreamConfig{TunnelID: 1, DataType: MsgTypeData, PeerWindow: 1, Dst: newSink(true), Send: (&peer{}).send})
+	if mux.Get(1) != s {
+		t.Fatal("new stream not registered")
+	}
+	if _, err := old.Write([]byte{1, 2}); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("replaced stream: %v, want ErrStreamClosed", err)
+	}
+	if mux.HandleWindowUpdate(NewWindowUpdateMessage(2, 1)) {
+		t.Error("window update for an unknown tunnel handled")
+	}
+
+	mux.CloseAll()
+	if mux.Get(1) != nil {
+		t.Error("stream left after CloseAll")
+	}
+}
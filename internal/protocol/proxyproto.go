@@ -0,0 +1,223 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol headers tell a server behind a proxy the address of the
+// client a connection comes from, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+// ProxyProtocol is the PROXY protocol version a rule's tunnels start their
+// target connections with
+type ProxyProtocol uint8
+
+const (
+	ProxyProtocolNone ProxyProtocol = 0
+	ProxyProtocolV1   ProxyProtocol = 1 // Text header
+	ProxyProtocolV2   ProxyProtocol = 2 // Binary header
+)
+
+// proxyV2Signature starts every version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Len is the longest version 1 header, CRLF included
+const maxProxyV1Len = 107
+
+var ErrNoProxyHeader = errors.New("no PROXY protocol header")
+
+// ParseProxyProtocol parses a PROXY protocol version as used in forwarding
+// rules. The empty string and "none" mean no header.
+func ParseProxyProtocol(name string) (ProxyProtocol, error) {
+	switch name {
+	case "", "none":
+		return ProxyProtocolNone, nil
+	case "v1":
+		return ProxyProtocolV1, nil
+	case "v2":
+		return ProxyProtocolV2, nil
+	}
+	return ProxyProtocolNone, fmt.Errorf("unknown PROXY protocol version %q", name)
+}
+
+func (v ProxyProtocol) String() string {
+	switch v {
+	case ProxyProtocolNone:
+		return "none"
+	case ProxyProtocolV1:
+		return "v1"
+	case ProxyProtocolV2:
+		return "v2"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(v))
+}
+
+// ProxyHeader returns the header telling that a TCP connection from src to
+// dst is proxied. Without a valid src the header says the address is
+// unknown. Addresses of different families are both sent as IPv6.
+func ProxyHeader(version ProxyProtocol, src, dst netip.AddrPort) []byte {
+	srcIP, dstIP := src.Addr().Unmap().WithZone(""), dst.Addr().Unmap().WithZone("")
+	known := srcIP.IsValid()
+	switch {
+	case !known:
+	case !dstIP.IsValid() && srcIP.Is4():
+		dstIP = netip.IPv4Unspecified()
+	case !dstIP.IsValid():
+		dstIP = netip.IPv6Unspecified()
+	case srcIP.Is4() != dstIP.Is4():
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if srcIP.Is6() {
+			family = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, src.Port(), dst.Port())
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	switch {
+	case !known:
+		// LOCAL command, the receiver uses the connection's own addresses
+		return append(header, 0x20, 0x00, 0, 0)
+	case srcIP.Is4():
+		header = append(header, 0x21, 0x11, 0, 12)
+	default:
+		header = append(header, 0x21, 0x21, 0, 36)
+	}
+	header = append(header, srcIP.AsSlice()...)
+	header = append(header, dstIP.AsSlice()...)
+	header = binary.BigEndian.AppendUint16(header, src.Port())
+	return binary.BigEndian.AppendUint16(header, dst.Port())
+}
+
+// ReadProxyHeader reads the version 1 or 2 PROXY header a connection
+// starts with. The addresses are invalid if the header doesn't carry them,
+// as with an UNKNOWN or LOCAL header or a non-TCP/UDP family.
+func ReadProxyHeader(r *bufio.Reader) (src, dst netip.AddrPort, err error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return src, dst, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return src, dst, ErrNoProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (src, dst netip.AddrPort, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > maxProxyV1Len || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return src, dst, fmt.Errorf("invalid PROXY v1 header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return src, dst, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return src, dst, fmt.Errorf("invalid PROXY v1 header")
+	}
+
+	srcIP, err1 := netip.ParseAddr(fields[2])
+	dstIP, err2 := netip.ParseAddr(fields[3])
+	srcPort, err3 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err4 := strconv.ParseUint(fields[5], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return src, dst, fmt.Errorf("invalid PROXY v1 header: %w", err)
+	}
+	if srcIP.Is4() != (fields[1] == "TCP4") || dstIP.Is4() != (fields[1] == "TCP4") || srcIP.Zone() != "" || dstIP.Zone() != "" {
+		return src, dst, fmt.Errorf("invalid PROXY v1 header: addresses don't match %s", fields[1])
+	}
+	return netip.AddrPortFrom(srcIP, uint16(srcPort)), netip.AddrPortFrom(dstIP, uint16(dstPort)), nil
+}
+
+func readProxyV2(r *bufio.Reader) (src, dst netip.AddrPort, err error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return src, dst, err
+	}
+	if fixed[12]>>4 != 2 {
+		return src, dst, fmt.Errorf("invalid PROXY v2 version %d", fixed[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return src, dst, err
+	}
+
+	// LOCAL connections, such as health checks, carry no client
+	switch command := fixed[12] & 0x0f; command {
+	case 0x0:
+		return src, dst, nil
+	case 0x1: // PROXY
+	default:
+		return src, dst, fmt.Errorf("invalid PROXY v2 command %d", command)
+	}
+	var size int
+	switch fixed[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		size = 4
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		size = 16
+	default:
+		return src, dst, nil
+	}
+	if len(body) < 2*size+4 {
+		return src, dst, fmt.Errorf("short PROXY v2 address block")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	ports := body[2*size:]
+	return netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(ports[0:2])),
+		netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(ports[2:4])), nil
+}
+
+// AddrPortOf returns the IP address and port of a TCP or UDP address,
+// invalid for other addresses
+func AddrPortOf(addr net.Addr) netip.AddrPort {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort()
+	case *net.UDPAddr:
+		return a.AddrPort()
+	case nil:
+		return netip.AddrPort{}
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort
+}
+
+// SourceHostPort splits a client address into the SourceHost and
+// SourcePort of connect payloads, empty if it has no IP address
+func SourceHostPort(addr net.Addr) (string, uint16) {
+	addrPort := AddrPortOf(addr)
+	if !addrPort.IsValid() {
+		return "", 0
+	}
+	return addrPort.Addr().Unmap().String(), addrPort.Port()
+}
+
+// SourceAddrPort parses the SourceHost and SourcePort of a connect
+// payload, invalid if the client address is unknown
+func SourceAddrPort(host string, port uint16) netip.AddrPort {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(ip, port)
+}
@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// v2Header builds a version 2 header by hand
+func v2Header(verCmd, family byte, body []byte) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, verCmd, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return append(h, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4Body := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0x9c, 0x40, 0x01, 0xbb} // 40000 -> 443
+	v6Body := append(append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...), 0x9c, 0x40, 0x01, 0xbb)
+
+	tests := []struct {
+		name     string
+		input    string
+		src, dst string // Empty for invalid addresses
+		err      bool
+	}{
+		{name: "v1 TCP4", input: "PROXY TCP4 192.0.2.1 198.51.100.2 40000 443\r\n", src: "192.0.2.1:40000", dst: "198.51.100.2:443"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\n", src: "[2001:db8::1]:40000", dst: "[2001:db8::2]:443"},
+		{name: "v1 TCP6 mapped", input: "PROXY TCP6 ::ffff:192.0.2.1 ::1 1 2\r\n", src: "[::ffff:192.0.2.1]:1", dst: "[::1]:2"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN ::1 ::1 1 2\r\n"},
+		{name: "v1 longest", input: "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+			src: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", dst: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"},
+		{name: "v1 overlong", input: "PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n", err: true},
+		{name: "v1 without end", input: "PROXY TCP4 192.0.2.1 198.51.100.2 40000 443" + strings.Repeat(" ", 5000), err: true},
+		{name: "v1 truncated", input: "PROXY TCP4 192.0.2.1 198.51", err: true},
+		{name: "v1 bare LF", input: "PROXY TCP4 192.0.2.1 198.51.100.2 40000 443\n", err: true},
+		{name: "v1 missing port", input: "PROXY TCP4 192.0.2.1 198.51.100.2 40000\r\n", err: true},
+		{name: "v1 bad address", input: "PROXY TCP4 192.0.2.300 198.51.100.2 40000 443\r\n", err: true},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.2 70000 443\r\n", err: true},
+		{name: "v1 TCP4 with IPv6", input: "PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n", err: true},
+		{name: "v1 TCP6 with IPv4", input: "PROXY TCP6 192.0.2.1 198.51.100.2 1 2\r\n", err: true},
+		{name: "v1 zone", input: "PROXY TCP6 fe80::1%eth0 ::1 1 2\r\n", err: true},
+		{name: "v1 UDP4", input: "PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n", err: true},
+		{name: "v2 PROXY TCP4", input: string(v2Header(0x21, 0x11, v4Body)), src: "192.0.2.1:40000", dst: "198.51.100.2:443"},
+		{name: "v2 PROXY UDP4", input: string(v2Header(0x21, 0x12, v4Body)), src: "192.0.2.1:40000", dst: "198.51.100.2:443"},
+		{name: "v2 PROXY TCP6", input: string(v2Header(0x21, 0x21, v6Body)), src: "[2001:db8::1]:40000", dst: "[2001:db8::2]:443"},
+		{name: "v2 with TLVs", input: string(v2Header(0x21, 0x11, append(v4Body, 0x04, 0x00, 0x01, 0xff))), src: "192.0.2.1:40000", dst: "198.51.100.2:443"},
+		{name: "v2 LOCAL", input: string(v2Header(0x20, 0x00, nil))},
+		{name: "v2 LOCAL with addresses", input: string(v2Header(0x20, 0x11, v4Body))},
+		{name: "v2 AF_UNSPEC", input: string(v2Header(0x21, 0x00, nil))},
+		{name: "v2 AF_UNIX", input: string(v2Header(0x21, 0x31, make([]byte, 216)))},
+		{name: "v2 short IPv4 block", input: string(v2Header(0x21, 0x11, v4Body[:11])), err: true},
+		{name: "v2 short IPv6 block", input: string(v2Header(0x21, 0x21, v4Body)), err: true},
+		{name: "v2 unknown command", input: string(v2Header(0x22, 0x11, v4Body)), err: true},
+		{name: "v2 command 15", input: string(v2Header(0x2f, 0x11, v4Body)), err: true},
+		{name: "v2 version 1", input: string(v2Header(0x11, 0x11, v4Body)), err: true},
+		{name: "v2 truncated body", input: string(v2Header(0x21, 0x11, v4Body)[:20]), err: true},
+		{name: "v2 truncated header", input: string(proxyV2Signature) + "\x21", err: true},
+		{name: "no header", input: "GET / HTTP/1.1\r\n\r\n", err: true},
+		{name: "short input", input: "PRO", err: true},
+	}
+	for _, tt := range tests {
+		const rest = "payload"
+		r := bufio.NewReader(strings.NewReader(tt.input + rest))
+		src, dst, err := ReadProxyHeader(r)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: accepted as %s -> %s", tt.name, src, dst)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := addrString(src); got != tt.src {
+			t.Errorf("%s: src %s, want %s", tt.name, got, tt.src)
+		}
+		if got := addrString(dst); got != tt.dst {
+			t.Errorf("%s: dst %s, want %s", tt.name, got, tt.dst)
+		}
+		// The connection's own data follows untouched
+		if after, _ := io.ReadAll(r); string(after) != rest {
+			t.Errorf("%s: %q after the header, want %q", tt.name, after, rest)
+		}
+	}
+
+	// Data that isn't a header is left to be read
+	r := bufio.NewReader(strings.NewReader("SSH-2.0-OpenSSH_9.6\r\n"))
+	if _, _, err := ReadProxyHeader(r); !errors.Is(err, ErrNoProxyHeader) {
+		t.Fatalf("no header: %v, want ErrNoProxyHeader", err)
+	}
+	if line, _ := r.ReadString('\n'); line != "SSH-2.0-OpenSSH_9.6\r\n" {
+		t.Fatalf("read %q after no header", line)
+	}
+}
+
+func addrString(a netip.AddrPort) string {
+	if !a.IsValid() {
+		return ""
+	}
+	return a.String()
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst         string
+		wantSrc, wantDst string
+	}{
+		{"192.0.2.1:40000", "198.51.100.2:443", "192.0.2.1:40000", "198.51.100.2:443"},
+		{"[2001:db8::1]:40000", "[2001:db8::2]:443", "[2001:db8::1]:40000", "[2001:db8::2]:443"},
+		// Mapped addresses are sent as IPv4
+		{"[::ffff:192.0.2.1]:1", "[::ffff:198.51.100.2]:2", "192.0.2.1:1", "198.51.100.2:2"},
+		// Mixed families are both sent as IPv6
+		{"192.0.2.1:1", "[2001:db8::2]:2", "[::ffff:192.0.2.1]:1", "[2001:db8::2]:2"},
+		// Zones are dropped
+		{"[fe80::1%eth0]:1", "[fe80::2%eth0]:2", "[fe80::1]:1", "[fe80::2]:2"},
+		// An unknown destination is sent as unspecified
+		{"192.0.2.1:1", "", "192.0.2.1:1", "0.0.0.0:0"},
+		{"[2001:db8::1]:1", "", "[2001:db8::1]:1", "[::]:0"},
+		// An unknown client is sent as UNKNOWN or LOCAL
+		{"", "198.51.100.2:443", "", ""},
+	}
+	for _, version := range []ProxyProtocol{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, tt := range tests {
+			var src, dst netip.AddrPort
+			if tt.src != "" {
+				src = netip.MustParseAddrPort(tt.src)
+			}
+			if tt.dst != "" {
+				dst = netip.MustParseAddrPort(tt.dst)
+			}
+			header := ProxyHeader(version, src, dst)
+			if version == ProxyProtocolV1 && len(header) > maxProxyV1Len {
+				t.Errorf("%s %s: header of %d bytes", version, tt.src, len(header))
+			}
+			gotSrc, gotDst, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+			if err != nil {
+				t.Errorf("%s %s -> %s: %v", version, tt.src, tt.dst, err)
+				continue
+			}
+			if addrString(gotSrc) != tt.wantSrc || addrString(gotDst) != tt.wantDst {
+				t.Errorf("%s %s -> %s: read %s -> %s, want %s -> %s", version, tt.src, tt.dst,
+					addrString(gotSrc), addrString(gotDst), tt.wantSrc, tt.wantDst)
+			}
+		}
+	}
+}
+
+func TestParseProxyProtocol(t *testing.T) {
+	for name, want := range map[string]ProxyProtocol{"": ProxyProtocolNone, "none": ProxyProtocolNone, "v1": ProxyProtocolV1, "v2": ProxyProtocolV2} {
+		got, err := ParseProxyProtocol(name)
+		if err != nil || got != want {
+			t.Errorf("ParseProxyProtocol(%q) = %v, %v", name, got, err)
+		}
+		if name != "" && got.String() != name {
+			t.Errorf("%v.String() = %q", got, got.String())
+		}
+	}
+	if _, err := ParseProxyProtocol("v3"); err == nil {
+		t.Error("v3 accepted")
+	}
+}
@@ -0,0 +1,34 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+
+	"github.com/natsvr/natsvr/internal/kcp"
+)
+
+// kcpTransport carries messages over TLS on a KCP conversation, which
+// retransmits lost UDP packets far sooner than TCP
+type kcpTransport struct{}
+
+func (kcpTransport) Dial(ctx context.Context, u *url.URL, tlsConfig *tls.Config) (Conn, error) {
+	raw, err := kcp.Dial(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, agentTLSConfig(tlsConfig))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return newStreamConn(conn), nil
+}
+
+func (kcpTransport) Listen(addr string, tlsConfig *tls.Config) (Listener, error) {
+	listener, err := kcp.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamListener(listener, tlsConfig), nil
+}
@@ -0,0 +1,561 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/natsvr/natsvr/internal/protocol"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// streamIdleTimeout closes tunnel streams that saw no message for a
+	// while, such as those of tunnels that failed to connect. A later
+	// message opens a new one.
+	streamIdleTimeout = 2 * time.Minute
+	// pathCheckInterval is how often a client checks whether its route to
+	// the cloud moved to another local address
+	pathCheckInterval = 5 * time.Second
+	// closeGracePeriod is how long a closed connection waits for the peer
+	// to read what was sent before
+	closeGracePeriod = time.Second
+)
+
+var quicConfig = &quic.Config{
+	HandshakeIdleTimeout:           dialTimeout,
+	MaxIdleTimeout:                 90 * time.Second,
+	KeepAlivePeriod:                15 * time.Second,
+	MaxIncomingStreams:             16,
+	MaxIncomingUniStreams:          10000,
+	InitialStreamReceiveWindow:     1 << 20,
+	MaxStreamReceiveWindow:         4 << 20,
+	InitialConnectionReceiveWindow: 4 << 20,
+	MaxConnectionReceiveWindow:     64 << 20,
+}
+
+// QUICConn carries messages over a QUIC connection. Messages without a
+// tunnel go on a control stream the client opens. Each tunnel's messages
+// go on a unidirectional stream of their own, so tunnels don't wait for
+// each other's lost packets; a close message ends its stream.
+type QUICConn struct {
+	conn *quic.Conn
+
+	control   *quic.Stream
+	controlMu sync.Mutex
+
+	streams   map[uint32]*tunnelStream // Outgoing, by tunnel ID
+	streamsMu sync.Mutex
+
+	incoming chan []byte
+	done     chan struct{} // Closed once the connection failed
+	err      error
+	failOnce sync.Once
+
+	deadline   time.Time
+	deadlineMu sync.Mutex
+
+	// Client only: the sockets of the paths the connection used
+	client       bool
+	transports   []*quic.Transport
+	transportsMu sync.Mutex
+}
+
+type tunnelStream struct {
+	mu       sync.Mutex
+	stream   *quic.SendStream
+	lastUsed time.Time
+	closed   bool
+}
+
+// DialQUIC connects to a cloud QUIC listener. The connection moves to a
+// new local address when the route to the cloud changes.
+func DialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config) (*QUICConn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udpConn}
+
+	conn, err := tr.Dial(ctx, remote, agentTLSConfig(tlsConfig), quicConfig)
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return nil, err
+	}
+	control, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		tr.Close()
+		udpConn.Close()
+		return nil, err
+	}
+
+	c := newQUICConn(conn, control)
+	c.client = true
+	c.transports = []*quic.Transport{tr}
+	go c.followPath(remote)
+	return c, nil
+}
+
+func newQUICConn(conn *quic.Conn, control *quic.Stream) *QUICConn {
+	c := &QUICConn{
+		conn:     conn,
+		control:  control,
+		streams:  make(map[uint32]*tunnelStream),
+		incoming: make(chan []byte, 256),
+		done:     make(chan struct{}),
+	}
+	go c.readStream(control, true)
+	go c.acceptStreams()
+	go c.closeIdleStreams()
+	go func() {
+		<-conn.Context().Done()
+		c.fail(context.Cause(conn.Context()))
+		c.closeTransports()
+	}()
+	return c
+}
+
+// ReadMessage returns the next message from any stream
+func (c *QUICConn) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-c.incoming:
+		return websocket.BinaryMessage, data, nil
+	default:
+	}
+
+	c.deadlineMu.Lock()
+	deadline := c.deadline
+	c.deadlineMu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-c.incoming:
+		return websocket.BinaryMessage, data, nil
+	case <-c.done:
+		return 0, nil, c.err
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteMessage sends an encoded message on the stream of its tunnel, or
+// on the control stream
+func (c *QUICConn) WriteMessage(_ int, data []byte) error {
+	if len(data) < protocol.HeaderSize {
+		return protocol.ErrInvalidMessage
+	}
+	tunnelID := streamTunnelID(data)
+	if tunnelID == 0 {
+		c.controlMu.Lock()
+		defer c.controlMu.Unlock()
+		_, err := c.control.Write(data)
+		return err
+	}
+
+	for {
+		c.streamsMu.Lock()
+		ts := c.streams[tunnelID]
+		if ts == nil {
+			ts = &tunnelStream{}
+			c.streams[tunnelID] = ts
+		}
+		c.streamsMu.Unlock()
+
+		ts.mu.Lock()
+		if ts.closed {
+			// Closed since we looked it up, the next lookup opens a new one
+			ts.mu.Unlock()
+			continue
+		}
+		err := c.writeTunnelStream(tunnelID, ts, data)
+		ts.mu.Unlock()
+		return err
+	}
+}
+
+// writeTunnelStream writes to a tunnel stream, opening it first if needed.
+// The caller holds ts.mu.
+func (c *QUICConn) writeTunnelStream(tunnelID uint32, ts *tunnelStream, data []byte) error {
+	if ts.stream == nil {
+		stream, err := c.conn.OpenUniStreamSync(c.conn.Context())
+		if err != nil {
+			c.closeTunnelStream(tunnelID, ts)
+			return err
+		}
+		ts.stream = stream
+	}
+	ts.lastUsed = time.Now()
+
+	_, err := ts.stream.Write(data)
+	if err != nil || protocol.MessageType(data[0]) == protocol.MsgTypeClose {
+		c.closeTunnelStream(tunnelID, ts)
+	}
+	return err
+}
+
+// closeTunnelStream ends a tunnel stream. The caller holds ts.mu.
+func (c *QUICConn) closeTunnelStream(tunnelID uint32, ts *tunnelStream) {
+	ts.closed = true
+	if ts.stream != nil {
+		ts.stream.Close()
+	}
+	c.streamsMu.Lock()
+	if c.streams[tunnelID] == ts {
+		delete(c.streams, tunnelID)
+	}
+	c.streamsMu.Unlock()
+}
+
+// streamTunnelID returns the tunnel whose stream carries a message. Connect
+// acks to a P2P or agent-to-cloud source are addressed by its local tunnel
+// ID but go on the stream of the tunnel they assign, ahead of its data.
+func streamTunnelID(data []byte) uint32 {
+	tunnelID := binary.BigEndian.Uint32(data[1:5])
+	switch protocol.MessageType(data[0]) {
+	case protocol.MsgTypeP2PConnectAck, protocol.MsgTypeAgentCloudConnectAck:
+		if ack, err := protocol.DecodeConnectAckPayload(data[protocol.HeaderSize:]); err == nil && ack.TunnelID != 0 {
+			return ack.TunnelID
+		}
+	}
+	return tunnelID
+}
+
+// SetReadDeadline sets the deadline for ReadMessage
+func (c *QUICConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.deadline = t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+// Close ends the control stream, which makes the peer close the
+// connection once it read everything sent before. The connection is torn
+// down after a grace period in any case. A client waits for that, as it
+// is usually about to exit; the cloud doesn't.
+func (c *QUICConn) Close() error {
+	c.fail(net.ErrClosed)
+	if !c.controlMu.TryLock() {
+		// A write is stuck, the peer isn't reading
+		return c.conn.CloseWithError(0, "")
+	}
+	c.control.Close()
+	c.controlMu.Unlock()
+
+	linger := func() {
+		select {
+		case <-c.conn.Context().Done():
+		case <-time.After(closeGracePeriod):
+			c.conn.CloseWithError(0, "")
+		}
+	}
+	if c.client {
+		linger()
+	} else {
+		go linger()
+	}
+	return nil
+}
+
+// RemoteAddr returns the peer's current address
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ConnectionState returns the state of the connection's TLS session
+func (c *QUICConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+func (c *QUICConn) fail(err error) {
+	c.failOnce.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		c.err = err
+		close(c.done)
+	})
+}
+
+// readStream delivers the messages of a stream
+func (c *QUICConn) readStream(r io.Reader, control bool) {
+	for {
+		data, err := readFrame(r)
+		if err != nil {
+			if control {
+				// The peer closed the connection
+				c.fail(err)
+				c.conn.CloseWithError(0, "")
+			}
+			return
+		}
+		select {
+		case c.incoming <- data:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *QUICConn) acceptStreams() {
+	for {
+		stream, err := c.conn.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go c.readStream(stream, false)
+	}
+}
+
+func (c *QUICConn) closeIdleStreams() {
+	ticker := time.NewTicker(streamIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.closeStreamsIdleSince(time.Now().Add(-streamIdleTimeout))
+	}
+}
+
+// closeStreamsIdleSince closes the tunnel streams last used before t
+func (c *QUICConn) closeStreamsIdleSince(t time.Time) {
+	c.streamsMu.Lock()
+	streams := make(map[uint32]*tunnelStream, len(c.streams))
+	for id, ts := range c.streams {
+		streams[id] = ts
+	}
+	c.streamsMu.Unlock()
+
+	for id, ts := range streams {
+		ts.mu.Lock()
+		if !ts.closed && ts.lastUsed.Before(t) {
+			c.closeTunnelStream(id, ts)
+		}
+		ts.mu.Unlock()
+	}
+}
+
+// readFrame reads one encoded message
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, protocol.HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > protocol.MaxPayloadSize {
+		return nil, protocol.ErrPayloadTooLarge
+	}
+	data := make([]byte, protocol.HeaderSize+int(length))
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[protocol.HeaderSize:]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// followPath moves the connection to a new socket when the local address
+// the route to the cloud leaves from changes, e.g. after switching
+// networks, instead of waiting for the old path to time out
+func (c *QUICConn) followPath(remote *net.UDPAddr) {
+	current := localAddrFor(remote)
+	ticker := time.NewTicker(pathCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		local := localAddrFor(remote)
+		if local == nil || local.Equal(current) {
+			continue
+		}
+		if err := c.migrate(); err != nil {
+			log.Printf("QUIC: local address changed to %s, migration failed: %v", local, err)
+			continue
+		}
+		log.Printf("QUIC: local address changed from %s to %s, connection migrated", current, local)
+		current = local
+	}
+}
+
+// migrate probes a path from a new socket and switches to it
+func (c *QUICConn) migrate() error {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	path, err := c.conn.AddPath(tr)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(c.conn.Context(), dialTimeout)
+		err = path.Probe(ctx)
+		cancel()
+		if err == nil {
+			err = path.Switch()
+		}
+		if err != nil {
+			path.Close()
+		}
+	}
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return err
+	}
+
+	// Old sockets stay open until the connection ends, closing their
+	// transport would close the connection with it
+	c.transportsMu.Lock()
+	c.transports = append(c.transports, tr)
+	c.transportsMu.Unlock()
+	return nil
+}
+
+func (c *QUICConn) closeTransports() {
+	c.transportsMu.Lock()
+	transports := c.transports
+	c.transports = nil
+	c.transportsMu.Unlock()
+	for _, tr := range transports {
+		tr.Close()
+		tr.Conn.Close()
+	}
+}
+
+// localAddrFor returns the local address packets to remote leave from,
+// nil if there is no route
+func localAddrFor(remote *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// QUICListener accepts agent connections over QUIC
+type QUICListener struct {
+	listener *quic.Listener
+	conns    chan *QUICConn
+	done     chan struct{}
+	doneOnce sync.Once
+	// Accepted connections, closed with the listener
+	active   map[*QUICConn]struct{}
+	activeMu sync.Mutex
+}
+
+// ListenQUIC listens for agents on a UDP address
+func ListenQUIC(addr string, tlsConfig *tls.Config) (*QUICListener, error) {
+	listener, err := quic.ListenAddr(addr, tlsConfig, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	l := &QUICListener{
+		listener: listener,
+		conns:    make(chan *QUICConn),
+		done:     make(chan struct{}),
+		active:   make(map[*QUICConn]struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func (l *QUICListener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			// The client opens the control stream with its auth message
+			ctx, cancel := context.WithTimeout(conn.Context(), 30*time.Second)
+			control, err := conn.AcceptStream(ctx)
+			cancel()
+			if err != nil {
+				conn.CloseWithError(0, "no control stream")
+				return
+			}
+			c := newQUICConn(conn, control)
+			l.activeMu.Lock()
+			l.active[c] = struct{}{}
+			l.activeMu.Unlock()
+			go func() {
+				<-c.done
+				l.activeMu.Lock()
+				delete(l.active, c)
+				l.activeMu.Unlock()
+			}()
+
+			select {
+			case l.conns <- c:
+			case <-l.done:
+				conn.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+// Accept returns the next agent connection
+func (l *QUICListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the listener's address
+func (l *QUICListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stops accepting connections and closes the accepted ones, so
+// agents reconnect right away
+func (l *QUICListener) Close() error {
+	l.doneOnce.Do(func() { close(l.done) })
+
+	l.activeMu.Lock()
+	for c := range l.active {
+		c.conn.CloseWithError(0, "shutting down")
+	}
+	l.activeMu.Unlock()
+	return l.listener.Close()
+}
+
+// quicTransport carries messages over QUIC
+type quicTransport struct{}
+
+func (quicTransport) Dial(ctx context.Context, u *url.URL, tlsConfig *tls.Config) (Conn, error) {
+	return DialQUIC(ctx, u.Host, tlsConfig)
+}
+
+func (quicTransport) Listen(addr string, tlsConfig *tls.Config) (Listener, error) {
+	return ListenQUIC(addr, tlsConfig)
+}
+
+var _ Conn = (*QUICConn)(nil)
+var _ Listener = (*QUICListener)(nil)
@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/natsvr/natsvr/internal/protocol"
+)
+
+// quicPair connects a client to a QUIC listener on the loopback address
+func quicPair(t *testing.T) (client, server *QUICConn) {
+	t.Helper()
+	dir := t.TempDir()
+	cert, err := LoadOrCreateCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := Listen("quic://127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	conn, err := Dial("quic://"+listener.Addr().String(), &DialOptions{Fingerprint: Fingerprint(cert.Certificate[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = conn.(*QUICConn)
+	t.Cleanup(func() { client.conn.CloseWithError(0, "") })
+
+	// The listener hands out a connection once its control stream carried
+	// a message
+	writeMessage(t, client, protocol.NewHeartbeatMessage())
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = accepted.(*QUICConn)
+	if msg := readMessage(t, server); msg.Type != protocol.MsgTypeHeartbeat {
+		t.Fatalf("first message %v, want a heartbeat", msg.Type)
+	}
+	return client, server
+}
+
+func writeMessage(t *testing.T, c Conn, msg *protocol.Message) {
+	t.Helper()
+	data, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteMessage(0, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readMessage(t *testing.T, c Conn) *protocol.Message {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.DecodeFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// openStreams returns the tunnels with an outgoing stream
+func openStreams(c *QUICConn) map[uint32]bool {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	open := make(map[uint32]bool)
+	for id := range c.streams {
+		open[id] = true
+	}
+	return open
+}
+
+func TestQUICTunnels(t *testing.T) {
+	client, server := quicPair(t)
+
+	// Tunnels send in parallel, each on a stream of its own
+	const tunnels, messages = 8, 100
+	var wg sync.WaitGroup
+	errs := make(chan error, tunnels)
+	for id := uint32(1); id <= tunnels; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range messages {
+				data, _ := protocol.NewMessage(protocol.MsgTypeData, id, []byte(fmt.Sprint(i))).Encode()
+				if err := client.WriteMessage(0, data); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if got := len(openStreams(client)); got != tunnels {
+		t.Fatalf("%d streams open, want %d", got, tunnels)
+	}
+
+	// Each tunnel's messages arrive in order
+	next := make(map[uint32]int)
+	for range tunnels * messages {
+		msg := readMessage(t, server)
+		if msg.Type != protocol.MsgTypeData {
+			t.Fatalf("message %v", msg.Type)
+		}
+		if want := fmt.Sprint(next[msg.TunnelID]); string(msg.Payload) != want {
+			t.Fatalf("tunnel %d: message %q, want %q", msg.TunnelID, msg.Payload, want)
+		}
+		next[msg.TunnelID]++
+	}
+
+	// A close message ends its tunnel's stream
+	writeMessage(t, client, protocol.NewMessage(protocol.MsgTypeClose, 3, nil))
+	if openStreams(client)[3] {
+		t.Fatal("stream of a closed tunnel still open")
+	}
+	if msg := readMessage(t, server); msg.Type != protocol.MsgTypeClose || msg.TunnelID != 3 {
+		t.Fatalf("message %v on tunnel %d, want the close of tunnel 3", msg.Type, msg.TunnelID)
+	}
+
+	// The cloud sends on streams of its own
+	writeMessage(t, server, protocol.NewMessage(protocol.MsgTypeData, 5, []byte("reply")))
+	if msg := readMessage(t, client); msg.TunnelID != 5 || string(msg.Payload) != "reply" {
+		t.Fatalf("reply %q on tunnel %d", msg.Payload, msg.TunnelID)
+	}
+}
+
+func TestQUICIdleStreams(t *testing.T) {
+	client, server := quicPair(t)
+
+	writeMessage(t, client, protocol.NewMessage(protocol.MsgTypeData, 1, []byte("a")))
+	writeMessage(t, client, protocol.NewMessage(protocol.MsgTypeData, 2, []byte("b")))
+	readMessage(t, server)
+	readMessage(t, server)
+
+	// Streams idle for longer than the timeout are closed, others stay
+	client.streamsMu.Lock()
+	client.streams[1].lastUsed = time.Now().Add(-streamIdleTimeout - time.Second)
+	client.streamsMu.Unlock()
+	client.closeStreamsIdleSince(time.Now().Add(-streamIdleTimeout))
+	if open := openStreams(client); open[1] || !open[2] {
+		t.Fatalf("streams open after closing idle ones: %v", open)
+	}
+
+	// A later message opens a new stream
+	writeMessage(t, client, protocol.NewMessage(protocol.MsgTypeData, 1, []byte("c")))
+	if msg := readMessage(t, server); msg.TunnelID != 1 || string(msg.Payload) != "c" {
+		t.Fatalf("message %q on tunnel %d after the idle close", msg.Payload, msg.TunnelID)
+	}
+	if !openStreams(client)[1] {
+		t.Fatal("no stream for the tunnel after a new message")
+	}
+}
+
+func TestQUICMigration(t *testing.T) {
+	client, server := quicPair(t)
+	before := server.RemoteAddr().String()
+
+	if err := client.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	writeMessage(t, client, protocol.NewMessage(protocol.MsgTypeData, 1, []byte("moved")))
+	if msg := readMessage(t, server); string(msg.Payload) != "moved" {
+		t.Fatalf("message %q after migrating", msg.Payload)
+	}
+	if after := server.RemoteAddr().String(); after == before {
+		t.Fatalf("cloud still sees the client at %s", before)
+	}
+
+	// Both ways keep working on the new path
+	writeMessage(t, server, protocol.NewHeartbeatMessage())
+	if msg := readMessage(t, client); msg.Type != protocol.MsgTypeHeartbeat {
+		t.Fatalf("message %v after migrating", msg.Type)
+	}
+	client.transportsMu.Lock()
+	paths := len(client.transports)
+	client.transportsMu.Unlock()
+	if paths != 2 {
+		t.Fatalf("%d sockets kept, want 2", paths)
+	}
+}
@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamConn carries messages over a reliable byte stream, such as TLS
+// over TCP or KCP. Messages are framed by their own headers.
+type streamConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	onClose   func() // Set by the listener that accepted the connection
+}
+
+func newStreamConn(conn net.Conn) *streamConn {
+	return &streamConn{
+		conn:   conn,
+		reader: bufio.NewReaderSize(conn, 64<<10),
+	}
+}
+
+// ReadMessage returns the next message
+func (c *streamConn) ReadMessage() (int, []byte, error) {
+	data, err := readFrame(c.reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, data, nil
+}
+
+// WriteMessage sends an encoded message
+func (c *streamConn) WriteMessage(_ int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// SetReadDeadline sets the deadline for ReadMessage
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the peer's address
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ConnectionState returns the state of the connection's TLS session
+func (c *streamConn) ConnectionState() tls.ConnectionState {
+	if conn, ok := c.conn.(*tls.Conn); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// Close closes the connection; TLS tells the peer first
+func (c *streamConn) Close() error {
+	err := c.conn.Close()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
+
+// streamListener accepts agent connections over TLS on a stream listener
+type streamListener struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	conns     chan *streamConn
+	done      chan struct{}
+	doneOnce  sync.Once
+	// Accepted connections, closed with the listener
+	active   map[*streamConn]struct{}
+	activeMu sync.Mutex
+}
+
+func newStreamListener(listener net.Listener, tlsConfig *tls.Config) *streamListener {
+	l := &streamListener{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		conns:     make(chan *streamConn),
+		done:      make(chan struct{}),
+		active:    make(map[*streamConn]struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *streamListener) acceptLoop() {
+	for {
+		raw, err := l.listener.Accept()
+		if err != nil {
+			l.doneOnce.Do(func() { close(l.done) })
+			return
+		}
+		go l.handshake(raw)
+	}
+}
+
+// handshake runs the TLS handshake off the accept loop, so a slow client
+// doesn't hold up others
+func (l *streamListener) handshake(raw net.Conn) {
+	conn := tls.Server(raw, l.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		raw.Close()
+		return
+	}
+
+	c := newStreamConn(conn)
+	c.onClose = func() {
+		l.activeMu.Lock()
+		delete(l.active, c)
+		l.activeMu.Unlock()
+	}
+	l.activeMu.Lock()
+	l.active[c] = struct{}{}
+	l.activeMu.Unlock()
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// Accept returns the next agent connection
+func (l *streamListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the listener's address
+func (l *streamListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stops accepting connections and closes the accepted ones, so
+// agents reconnect right away
+func (l *streamListener) Close() error {
+	l.doneOnce.Do(func() { close(l.done) })
+
+	l.activeMu.Lock()
+	active := make([]*streamConn, 0, len(l.active))
+	for c := range l.active {
+		active = append(active, c)
+	}
+	l.activeMu.Unlock()
+
+	// Each close may wait for its close notification to be acknowledged,
+	// which a KCP listener's socket must still be open for
+	var wg sync.WaitGroup
+	for _, c := range active {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	return l.listener.Close()
+}
@@ -0,0 +1,31 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+)
+
+// tlsTransport carries messages over TLS on a plain TCP connection
+type tlsTransport struct{}
+
+func (tlsTransport) Dial(ctx context.Context, u *url.URL, tlsConfig *tls.Config) (Conn, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{},
+		Config:    agentTLSConfig(tlsConfig),
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamConn(conn), nil
+}
+
+func (tlsTransport) Listen(addr string, tlsConfig *tls.Config) (Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamListener(listener, tlsConfig), nil
+}
@@ -0,0 +1,216 @@
+// Package transport carries protocol messages between agents and the cloud.
+//
+// The URL scheme selects the transport:
+//   - ws://, wss://: WebSocket, served by the cloud's HTTP server
+//   - quic://: QUIC. Every tunnel gets a stream of its own, so a lost
+//     packet only stalls the tunnel it belongs to, and the connection
+//     survives network changes.
+//   - tls://: TLS over TCP, for networks that only pass plain TLS
+//   - kcp://: TLS over KCP, a reliable UDP protocol that holds up on lossy
+//     links
+//
+// All of them carry the same protocol.Message frames.
+package transport
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ALPN is the ALPN protocol of agent connections over QUIC, TLS and KCP
+const ALPN = "natsvr"
+
+// Conn is a message connection between an agent and the cloud. Every
+// message is one encoded protocol.Message. *websocket.Conn implements it;
+// the message type is always websocket.BinaryMessage.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Listener accepts agent connections on one transport
+type Listener interface {
+	Accept() (Conn, error)
+	Addr() net.Addr
+	// Close stops accepting connections and closes the accepted ones, so
+	// agents reconnect right away
+	Close() error
+}
+
+// Transport connects agents and the cloud over one kind of link
+type Transport interface {
+	// Dial connects to the cloud at u. tlsConfig verifies the cloud.
+	Dial(ctx context.Context, u *url.URL, tlsConfig *tls.Config) (Conn, error)
+	// Listen accepts agents on addr, a host:port, with tlsConfig
+	// identifying the cloud
+	Listen(addr string, tlsConfig *tls.Config) (Listener, error)
+}
+
+var (
+	transports = map[string]Transport{
+		"ws":   websocketTransport{},
+		"wss":  websocketTransport{},
+		"quic": quicTransport{},
+		"tls":  tlsTransport{},
+		"kcp":  kcpTransport{},
+	}
+	transportsMu sync.RWMutex
+)
+
+// Register makes a transport available under a URL scheme, replacing any
+// registered before
+func Register(scheme string, t Transport) {
+	transportsMu.Lock()
+	transports[scheme] = t
+	transportsMu.Unlock()
+}
+
+func lookup(scheme string) (Transport, error) {
+	transportsMu.RLock()
+	t, ok := transports[scheme]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported transport %q", scheme)
+	}
+	return t, nil
+}
+
+// DialOptions configures how an agent connects to the cloud
+type DialOptions struct {
+	// Fingerprint is the hex SHA-256 of the cloud's certificate. If set,
+	// that certificate is accepted instead of verifying the chain.
+	Fingerprint string
+	// RootCAs verifies the cloud's certificate chain instead of the
+	// system roots, for a cloud with a certificate from a private CA
+	RootCAs *x509.CertPool
+	// Certificate is the agent's client certificate, if it has one
+	Certificate *tls.Certificate
+}
+
+const (
+	dialTimeout      = 10 * time.Second
+	handshakeTimeout = 30 * time.Second
+)
+
+// Dial connects to the cloud at serverURL, with the transport its scheme
+// selects
+func Dial(serverURL string, opts *DialOptions) (Conn, error) {
+	if opts == nil {
+		opts = &DialOptions{}
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	t, err := lookup(u.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" && u.Port() == "" {
+		return nil, fmt.Errorf("%s server URL %q needs a port", u.Scheme, serverURL)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	tlsConfig := clientTLSConfig(u.Hostname(), opts.Fingerprint)
+	tlsConfig.RootCAs = opts.RootCAs
+	if opts.Certificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*opts.Certificate}
+	}
+	return t.Dial(ctx, u, tlsConfig)
+}
+
+// Listen accepts agents on listenURL, e.g. kcp://:8445, with the transport
+// its scheme selects. tlsConfig holds the cloud's certificate, and the
+// client CAs if agents may present certificates.
+func Listen(listenURL string, tlsConfig *tls.Config) (Listener, error) {
+	u, err := url.Parse(listenURL)
+	if err != nil {
+		return nil, err
+	}
+	t, err := lookup(u.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("listen URL %q needs a port", listenURL)
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{ALPN}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	return t.Listen(u.Host, tlsConfig)
+}
+
+// PeerCertificate returns the verified client certificate the peer of a
+// cloud connection presented, or nil if it presented none
+func PeerCertificate(conn Conn) *x509.Certificate {
+	var state tls.ConnectionState
+	switch c := conn.(type) {
+	case interface{ ConnectionState() tls.ConnectionState }:
+		state = c.ConnectionState()
+	case interface{ UnderlyingConn() net.Conn }:
+		// A WebSocket connection served over TLS
+		tlsConn, ok := c.UnderlyingConn().(*tls.Conn)
+		if !ok {
+			return nil
+		}
+		state = tlsConn.ConnectionState()
+	default:
+		return nil
+	}
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// clientTLSConfig verifies the server's certificate chain, or only its
+// fingerprint if one is pinned
+func clientTLSConfig(serverName, fingerprint string) *tls.Config {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if fingerprint == "" {
+		return config
+	}
+	want := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	config.InsecureSkipVerify = true // The pinned fingerprint is checked instead
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server sent no certificate")
+		}
+		if got := Fingerprint(rawCerts[0]); got != want {
+			return fmt.Errorf("server certificate fingerprint %s does not match the pinned %s", got, want)
+		}
+		return nil
+	}
+	return config
+}
+
+// agentTLSConfig is a client TLS config for the transports that speak
+// the natsvr ALPN protocol
+func agentTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{ALPN}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	return tlsConfig
+}
+
+// Fingerprint returns the hex SHA-256 of a DER encoded certificate
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
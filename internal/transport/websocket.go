@@ -0,0 +1,32 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketTransport dials ws:// and wss:// servers. Agents connect to the
+// cloud's HTTP server, which upgrades /ws itself.
+type websocketTransport struct{}
+
+func (websocketTransport) Dial(ctx context.Context, u *url.URL, tlsConfig *tls.Config) (Conn, error) {
+	dialer := websocket.Dialer{
+		HandshakeTimeout: dialTimeout,
+		TLSClientConfig:  tlsConfig,
+	}
+	conn, _, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (websocketTransport) Listen(string, *tls.Config) (Listener, error) {
+	return nil, fmt.Errorf("WebSocket agents connect to the HTTP server's /ws endpoint")
+}
+
+var _ Conn = (*websocket.Conn)(nil)
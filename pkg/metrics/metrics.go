@@ -0,0 +1,371 @@
+// Package metrics implements the small subset of Prometheus instrumentation
+// natsvr needs: counters, gauges, histograms and families collected at
+// scrape time, written in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefLatencyBuckets are histogram buckets in seconds suited to network round trips
+var DefLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Registry holds metric families in registration order
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+}
+
+// Write writes all families in the text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns an HTTP handler serving the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// desc describes a metric family
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// writeSample writes one sample line. extra is an additional preformatted
+// label pair such as le="0.5", or "".
+func (d *desc) writeSample(w *bufio.Writer, suffix string, values []string, extra string, v float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	if len(values) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, name := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(name)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(values[i]))
+			w.WriteByte('"')
+		}
+		if extra != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func (d *desc) checkLabels(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// atomicFloat is a float64 updated with compare-and-swap
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+// series maps joined label values to the child metric of a vector
+type series[T any] struct {
+	mu       sync.Mutex
+	children map[string]*T
+	values   map[string][]string
+}
+
+func (s *series[T]) get(values []string, create func() *T) *T {
+	key := strings.Join(values, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.children[key]; ok {
+		return c
+	}
+	if s.children == nil {
+		s.children = make(map[string]*T)
+		s.values = make(map[string][]string)
+	}
+	c := create()
+	s.children[key] = c
+	s.values[key] = append([]string(nil), values...)
+	return c
+}
+
+// each calls fn for every child in label order
+func (s *series[T]) each(fn func(values []string, c *T)) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.children))
+	for k := range s.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		children[i], values[i] = s.children[k], s.values[k]
+	}
+	s.mu.Unlock()
+
+	for i := range keys {
+		fn(values[i], children[i])
+	}
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v atomicFloat
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add adds v, which must not be negative, to the counter
+func (c *Counter) Add(v float64) { c.v.Add(v) }
+
+// CounterVec is a counter family partitioned by labels
+type CounterVec struct {
+	desc
+	series series[Counter]
+}
+
+// NewCounterVec registers a counter family
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{desc: desc{name: name, help: help, typ: "counter", labels: labels}}
+	r.register(v)
+	return v
+}
+
+// With returns the counter for the given label values
+func (v *CounterVec) With(values ...string) *Counter {
+	v.checkLabels(values)
+	return v.series.get(values, func() *Counter { return &Counter{} })
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.series.each(func(values []string, c *Counter) {
+		v.writeSample(w, "", values, "", c.v.Load())
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v atomicFloat
+}
+
+// Set sets the gauge
+func (g *Gauge) Set(v float64) { g.v.Set(v) }
+
+// Add adds v, which may be negative, to the gauge
+func (g *Gauge) Add(v float64) { g.v.Add(v) }
+
+// GaugeVec is a gauge family partitioned by labels
+type GaugeVec struct {
+	desc
+	series series[Gauge]
+}
+
+// NewGaugeVec registers a gauge family
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{desc: desc{name: name, help: help, typ: "gauge", labels: labels}}
+	r.register(v)
+	return v
+}
+
+// With returns the gauge for the given label values
+func (v *GaugeVec) With(values ...string) *Gauge {
+	v.checkLabels(values)
+	return v.series.get(values, func() *Gauge { return &Gauge{} })
+}
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.series.each(func(values []string, g *Gauge) {
+		v.writeSample(w, "", values, "", g.v.Load())
+	})
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	upper  []float64
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Observe records one observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// HistogramVec is a histogram family partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	series  series[Histogram]
+}
+
+// NewHistogramVec registers a histogram family with the given upper
+// bucket bounds, which must be sorted in increasing order
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+	}
+	r.register(v)
+	return v
+}
+
+// With returns the histogram for the given label values
+func (v *HistogramVec) With(values ...string) *Histogram {
+	v.checkLabels(values)
+	return v.series.get(values, func() *Histogram {
+		return &Histogram{upper: v.buckets, counts: make([]uint64, len(v.buckets))}
+	})
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.series.each(func(values []string, h *Histogram) {
+		h.mu.Lock()
+		counts := append([]uint64(nil), h.counts...)
+		sum, count := h.sum, h.count
+		h.mu.Unlock()
+
+		var cumulative uint64
+		for i, upper := range v.buckets {
+			cumulative += counts[i]
+			v.writeSample(w, "_bucket", values, `le="`+formatFloat(upper)+`"`, float64(cumulative))
+		}
+		v.writeSample(w, "_bucket", values, `le="+Inf"`, float64(count))
+		v.writeSample(w, "_sum", values, "", sum)
+		v.writeSample(w, "_count", values, "", float64(count))
+	})
+}
+
+// Sample is one series of a family collected at scrape time
+type Sample struct {
+	Labels []string // label values, in the family's label order
+	Value  float64
+}
+
+// funcFamily reads its samples from a callback on every scrape
+type funcFamily struct {
+	desc
+	collect func() []Sample
+}
+
+// NewCounterFunc registers a counter family whose samples are read from
+// collect on every scrape. Use it for totals the application already keeps.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(&funcFamily{desc: desc{name: name, help: help, typ: "counter", labels: labels}, collect: collect})
+}
+
+// NewGaugeFunc registers a gauge family whose samples are read from
+// collect on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(&funcFamily{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, collect: collect})
+}
+
+func (f *funcFamily) write(w *bufio.Writer) {
+	samples := f.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+	f.writeHeader(w)
+	for _, s := range samples {
+		f.checkLabels(s.Labels)
+		f.writeSample(w, "", s.Labels, "", s.Value)
+	}
+}
@@ -2,14 +2,20 @@ import { Tabs, TabsContent, TabsList, TabsTrigger } from '@/components/ui/tabs'
 import { AgentsPage } from '@/pages/AgentsPage'
 import { ForwardingPage } from '@/pages/ForwardingPage'
 import { SettingsPage } from '@/pages/SettingsPage'
+import { AuditPage } from '@/pages/AuditPage'
+import { LoginPage } from '@/pages/LoginPage'
 import { Button } from '@/components/ui/button'
 import { useTheme } from '@/hooks/useTheme'
-import { useQuery } from '@tanstack/react-query'
-import { api } from '@/api/client'
-import { Network, ArrowRightLeft, Settings, Activity, Sun, Moon } from 'lucide-react'
+import { useLiveEvents } from '@/hooks/useLiveEvents'
+import { useEffect, useState } from 'react'
+import { useQuery, useQueryClient } from '@tanstack/react-query'
+import { api, auth, UNAUTHORIZED_EVENT } from '@/api/client'
+import { Network, ArrowRightLeft, Settings, Activity, Sun, Moon, LogOut, ScrollText } from 'lucide-react'
 
 function App() {
   const { theme, toggleTheme } = useTheme()
+  const queryClient = useQueryClient()
+  const [authenticated, setAuthenticated] = useState(() => auth.getToken() !== null)
   
   const { data: version } = useQuery({
     queryKey: ['version'],
@@ -17,6 +23,42 @@ function App() {
     staleTime: Infinity, // Version doesn't change during runtime
   })
 
+  const { data: me } = useQuery({
+    queryKey: ['me'],
+    queryFn: api.getMe,
+    enabled: authenticated,
+  })
+
+  // Push updates for agents, rules and stats
+  useLiveEvents(authenticated)
+
+  // Any 401 from the API drops back to the login screen
+  useEffect(() => {
+    const onUnauthorized = () => {
+      setAuthenticated(false)
+      queryClient.clear()
+    }
+    window.addEventListener(UNAUTHORIZED_EVENT, onUnauthorized)
+    return () => window.removeEventListener(UNAUTHORIZED_EVENT, onUnauthorized)
+  }, [queryClient])
+
+  const handleLogout = async () => {
+    try {
+      await api.logout()
+    } finally {
+      auth.clearToken()
+      setAuthenticated(false)
+      queryClient.clear()
+    }
+  }
+
+  // Settings (tokens) and the audit log are admin-only on the server as well
+  const isAdmin = me?.role === 'admin'
+
+  if (!authenticated) {
+    return <LoginPage onLogin={() => setAuthenticated(true)} />
+  }
+
   return (
     <div className="min-h-screen bg-background grid-background flex flex-col">
       {/* Header */}
@@ -50,6 +92,15 @@ function App() {
                   <Moon className="w-5 h-5 text-slate-600" />
                 )}
               </Button>
+              <Button
+                variant="ghost"
+                size="icon"
+                onClick={handleLogout}
+                className="rounded-full"
+                title={me?.username ? `退出登录 (${me.username})` : '退出登录'}
+              >
+                <LogOut className="w-5 h-5" />
+              </Button>
             </div>
           </div>
         </div>
@@ -67,10 +118,18 @@ function App() {
               <ArrowRightLeft className="w-4 h-4" />
               端口转发
             </TabsTrigger>
-            <TabsTrigger value="settings" className="gap-2 data-[state=active]:bg-primary data-[state=active]:text-primary-foreground">
-              <Settings className="w-4 h-4" />
-              设置
-            </TabsTrigger>
+            {isAdmin && (
+              <TabsTrigger value="settings" className="gap-2 data-[state=active]:bg-primary data-[state=active]:text-primary-foreground">
+                <Settings className="w-4 h-4" />
+                设置
+              </TabsTrigger>
+            )}
+            {isAdmin && (
+              <TabsTrigger value="audit" className="gap-2 data-[state=active]:bg-primary data-[state=active]:text-primary-foreground">
+                <ScrollText className="w-4 h-4" />
+                审计日志
+              </TabsTrigger>
+            )}
           </TabsList>
 
           <TabsContent value="agents" className="animate-fade-in">
@@ -81,9 +140,17 @@ function App() {
             <ForwardingPage />
           </TabsContent>
           
-          <TabsContent value="settings" className="animate-fade-in">
-            <SettingsPage />
-          </TabsContent>
+          {isAdmin && (
+            <TabsContent value="settings" className="animate-fade-in">
+              <SettingsPage />
+            </TabsContent>
+          )}
+
+          {isAdmin && (
+            <TabsContent value="audit" className="animate-fade-in">
+              <AuditPage />
+            </TabsContent>
+          )}
         </Tabs>
       </main>
 
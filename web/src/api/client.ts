@@ -5,9 +5,14 @@ export interface Agent {
   name: string
   ip: string
   online: boolean
+  version?: string
+  os?: string
+  arch?: string
+  labels?: Record<string, string>
+  firstSeen: string
   lastSeen: string
   activeTunnels: number
-  txBytes: number
+  txBytes: number // cumulative across connections
   rxBytes: number
 }
 
@@ -25,7 +30,7 @@ export interface ForwardRule {
   id: string
   name: string
   type: ForwardType
-  protocol: 'tcp' | 'udp'
+  protocol: 'tcp' | 'udp' | 'http' | 'tls-sni'  // http / tls-sni: cloud-agent rules routed by host, no listen port
   sourceAgentId?: string
   listenPort: number
   targetAgentId?: string
@@ -35,9 +40,47 @@ export interface ForwardRule {
   rateLimit: number     // bytes per second, 0 = unlimited
   trafficLimit: number  // max total bytes, 0 = unlimited
   trafficUsed: number   // current traffic used
+  compression?: '' | 'zstd' | 'snappy'
+  compressionRatio?: number  // uncompressed / compressed bytes
+  encrypted?: boolean        // end-to-end between the agents
+  domains?: string[]         // http / tls-sni rules: hosts, "*.example.com" matches any subdomain
+  pathPrefix?: string        // http rules: path the rule is limited to
+  proxyProtocol?: '' | 'v1' | 'v2'  // tcp / tls-sni rules: PROXY header sent to the target
+  allowCidrs?: string[]      // cloud-agent / cloud-direct rules: clients allowed, denies win
+  denyCidrs?: string[]
+  allowCountries?: string[]  // ISO country codes, need the cloud's GeoIP database
+  denyCountries?: string[]
+  rejected?: number          // clients (udp: packets) rejected by the source filters or connection limits
+  maxConns?: number          // cloud-agent / cloud-direct tcp and tls-sni rules: open connections, 0 = unlimited
+  maxConnRate?: number       // new connections per second
+  maxConnsPerIp?: number     // open connections per client address
+  basicAuthUser?: string     // http rules: basic auth in front of the target
+  bearerAuth?: boolean       // http rules: a bearer token is accepted
+  hostRewrite?: string       // http rules: Host sent to the target
+  requestHeaders?: Record<string, string>  // http rules: set on requests, '' removes the header
+  forwardedFor?: boolean     // http rules: add X-Forwarded-For
+  accessLog?: boolean        // http rules: log requests
   createdAt: string
 }
 
+// Secrets of a new http rule, never returned
+export interface ForwardRuleSecrets {
+  basicAuthPassword?: string
+  bearerToken?: string
+}
+
+// An open tunnel. Agent-to-agent tunnels carry their data either through the
+// cloud (relay) or over a direct path between the agents.
+export interface Tunnel {
+  id: number
+  ruleId?: string
+  agentId: string
+  sourceAgentId?: string
+  protocol: string
+  target: string
+  path?: 'direct' | 'relay'
+}
+
 export interface Stats {
   txBytes: number
   rxBytes: number
@@ -45,16 +88,42 @@ export interface Stats {
   rxSpeed: number
   onlineCount: number
   totalRules: number
+  compressionRatio?: number
 }
 
 export interface Token {
   id: string
   name: string
-  token: string
+  token?: string          // only returned once, at creation or rotation
+  prefix: string
   usageCount: number
+  agentName?: string      // only this agent name may use the token
+  agentId?: string        // only this agent ID may use the token
+  expiresAt?: string
+  allowedRules?: string[] // rule IDs the agent may serve, empty = all
+  previousExpiresAt?: string // old secret still accepted until then
   createdAt: string
 }
 
+// A client certificate the cloud issued to an agent (agent mTLS)
+export interface AgentCertificate {
+  serial: string
+  agentId: string
+  agentName?: string
+  notBefore: string
+  notAfter: string
+  revokedAt?: string
+  live: boolean  // neither revoked nor expired
+  inUse: boolean // the agent is connected with it
+}
+
+export interface CreateTokenOptions {
+  agentName?: string
+  agentId?: string
+  expiresAt?: string
+  allowedRules?: string[]
+}
+
 export interface Version {
   version: string
   commit: string
@@ -62,15 +131,123 @@ export interface Version {
   buildTime: string
 }
 
+// Roles, from least to most privileged:
+// - viewer: read stats, agents and forward rules
+// - operator: viewer + enable/disable forward rules
+// - admin: everything, including tokens, users and API keys
+export type Role = 'viewer' | 'operator' | 'admin'
+
+export interface LoginResponse {
+  token: string
+  username: string
+  role: Role
+  expiresAt: string
+}
+
+export interface Me {
+  username: string
+  role: Role
+  kind: 'server-token' | 'session' | 'api-key'
+  agentScope?: string
+}
+
+export interface User {
+  id: string
+  username: string
+  role: Role
+  createdAt: string
+}
+
+export interface APIKey {
+  id: string
+  name: string
+  key?: string        // only returned once, at creation
+  prefix: string
+  role: Role
+  agentScope?: string // restricts the key to one agent (name or ID)
+  lastUsedAt?: string
+  createdAt: string
+}
+
+export interface AuditEvent {
+  id: number
+  time: string
+  actor: string
+  actorKind: string   // session, api-key, server-token, agent or system
+  action: string      // e.g. rule.create, agent.connect
+  targetType?: string
+  targetId?: string
+  clientIp?: string
+  before?: unknown    // snapshot before the change
+  after?: unknown     // snapshot after the change, or event details
+}
+
+export interface AuditEventsPage {
+  events: AuditEvent[]
+  total: number
+  page: number
+  pageSize: number
+}
+
+export type LiveEventType =
+  | 'agent.connect' | 'agent.disconnect'
+  | 'rule.start' | 'rule.stop' | 'rule.traffic_limit'
+  | 'tunnel.open' | 'tunnel.close'
+  | 'stats'
+
+export interface LiveEvent {
+  type: LiveEventType
+  time: string
+  data: unknown // Agent, ForwardRule, Stats or a tunnel description, by type
+}
+
+export interface AuditFilter {
+  actor?: string
+  action?: string     // exact action, or a prefix such as "rule"
+  targetType?: string
+  targetId?: string
+  since?: string      // RFC 3339
+  until?: string
+  page?: number
+  pageSize?: number
+}
+
+// Auth token storage. The server answers 401 with {"code": "unauthorized"}
+// when the token is missing, invalid or expired; the client then drops the
+// stored token and notifies listeners so the UI can show the login screen.
+const TOKEN_KEY = 'natsvr_token'
+export const UNAUTHORIZED_EVENT = 'natsvr:unauthorized'
+
+export class UnauthorizedError extends Error {
+  constructor(message = 'Unauthorized') {
+    super(message)
+    this.name = 'UnauthorizedError'
+  }
+}
+
+export const auth = {
+  getToken: () => localStorage.getItem(TOKEN_KEY),
+  setToken: (token: string) => localStorage.setItem(TOKEN_KEY, token),
+  clearToken: () => localStorage.removeItem(TOKEN_KEY),
+}
+
 async function request<T>(path: string, options?: RequestInit): Promise<T> {
+  const token = auth.getToken()
   const response = await fetch(`${API_BASE}${path}`, {
     ...options,
     headers: {
       'Content-Type': 'application/json',
+      ...(token ? { Authorization: `Bearer ${token}` } : {}),
       ...options?.headers,
     },
   })
   
+  if (response.status === 401) {
+    auth.clearToken()
+    window.dispatchEvent(new Event(UNAUTHORIZED_EVENT))
+    throw new UnauthorizedError()
+  }
+
   if (!response.ok) {
     const error = await response.text()
     throw new Error(error || `HTTP ${response.status}`)
@@ -83,16 +260,33 @@ export const api = {
   // Version
   getVersion: () => request<Version>('/version'),
   
+  // Auth
+  login: (username: string, password: string) =>
+    request<LoginResponse>('/auth/login', {
+      method: 'POST',
+      body: JSON.stringify({ username, password }),
+    }),
+  logout: () => request<void>('/auth/logout', { method: 'POST' }),
+  getMe: () => request<Me>('/auth/me'),
+  
   // Stats
   getStats: () => request<Stats>('/stats'),
   
   // Agents
   getAgents: () => request<Agent[]>('/agents'),
   getAgent: (id: string) => request<Agent>(`/agents/${id}`),
+  getAgentCertificates: (id: string) =>
+    request<AgentCertificate[]>(`/agents/${id}/certificates`),
+  // Revokes one certificate, or all of the agent's if serial is omitted
+  revokeAgentCertificates: (id: string, serial?: string) =>
+    request<{ revoked: number; disconnected: boolean }>(`/agents/${id}/certificates/revoke`, {
+      method: 'POST',
+      body: JSON.stringify({ serial }),
+    }),
   
   // Forward Rules
   getForwardRules: () => request<ForwardRule[]>('/forward-rules'),
-  createForwardRule: (rule: Omit<ForwardRule, 'id' | 'enabled' | 'createdAt' | 'trafficUsed'>) =>
+  createForwardRule: (rule: Omit<ForwardRule, 'id' | 'enabled' | 'createdAt' | 'trafficUsed'> & ForwardRuleSecrets) =>
     request<ForwardRule>('/forward-rules', {
       method: 'POST',
       body: JSON.stringify(rule),
@@ -104,15 +298,95 @@ export const api = {
     }),
   deleteForwardRule: (id: string) =>
     request<void>(`/forward-rules/${id}`, { method: 'DELETE' }),
+
+  // Tunnels
+  getTunnels: () => request<Tunnel[]>('/tunnels'),
   
   // Tokens
   getTokens: () => request<Token[]>('/tokens'),
-  createToken: (name: string) =>
+  createToken: (name: string, options?: CreateTokenOptions) =>
     request<Token>('/tokens', {
       method: 'POST',
-      body: JSON.stringify({ name }),
+      body: JSON.stringify({ name, ...options }),
+    }),
+  rotateToken: (id: string, gracePeriod?: string) =>
+    request<Token>(`/tokens/${id}/rotate`, {
+      method: 'POST',
+      body: JSON.stringify({ gracePeriod }),
     }),
   deleteToken: (id: string) =>
     request<void>(`/tokens/${id}`, { method: 'DELETE' }),
+  
+  // Users
+  getUsers: () => request<User[]>('/users'),
+  createUser: (user: { username: string; password: string; role: Role }) =>
+    request<User>('/users', {
+      method: 'POST',
+      body: JSON.stringify(user),
+    }),
+  updateUser: (id: string, updates: { password?: string; role?: Role }) =>
+    request<User>(`/users/${id}`, {
+      method: 'PATCH',
+      body: JSON.stringify(updates),
+    }),
+  deleteUser: (id: string) =>
+    request<void>(`/users/${id}`, { method: 'DELETE' }),
+  
+  // API Keys
+  getAPIKeys: () => request<APIKey[]>('/api-keys'),
+  createAPIKey: (key: { name: string; role: Role; agentScope?: string }) =>
+    request<APIKey>('/api-keys', {
+      method: 'POST',
+      body: JSON.stringify(key),
+    }),
+  deleteAPIKey: (id: string) =>
+    request<void>(`/api-keys/${id}`, { method: 'DELETE' }),
+
+  // Audit log
+  getAuditEvents: (filter: AuditFilter = {}) => {
+    const params = new URLSearchParams()
+    Object.entries(filter).forEach(([k, v]) => {
+      if (v !== undefined && v !== '') params.set(k, String(v))
+    })
+    return request<AuditEventsPage>(`/audit?${params}`)
+  },
+}
+
+// subscribeEvents streams /api/events (Server-Sent Events) and calls onEvent
+// for each event. EventSource cannot send the Authorization header, so the
+// stream is read with fetch. Returns a function that closes the stream.
+export function subscribeEvents(onEvent: (event: LiveEvent) => void, types: string[] = []): () => void {
+  const controller = new AbortController()
+  const token = auth.getToken()
+  const query = types.length > 0 ? `?types=${encodeURIComponent(types.join(','))}` : ''
+
+  const run = async () => {
+    const response = await fetch(`${API_BASE}/events${query}`, {
+      headers: token ? { Authorization: `Bearer ${token}` } : {},
+      signal: controller.signal,
+    })
+    if (!response.ok || !response.body) {
+      throw new Error(`HTTP ${response.status}`)
+    }
+
+    const reader = response.body.pipeThrough(new TextDecoderStream()).getReader()
+    let buffer = ''
+    for (;;) {
+      const { value, done } = await reader.read()
+      if (done) return
+      buffer += value
+      const frames = buffer.split('\n\n')
+      buffer = frames.pop() || ''
+      for (const frame of frames) {
+        const data = frame.split('\n').find((line) => line.startsWith('data:'))
+        if (data) onEvent(JSON.parse(data.slice(5)))
+      }
+    }
+  }
+
+  run().catch(() => {
+    // Stream ended or failed; pages keep polling as a fallback
+  })
+  return () => controller.abort()
 }
 
@@ -0,0 +1,35 @@
+import { useEffect } from 'react'
+import { useQueryClient } from '@tanstack/react-query'
+import { subscribeEvents, Stats } from '@/api/client'
+
+// useLiveEvents keeps the dashboard queries fresh from the server event
+// stream instead of waiting for the next poll
+export function useLiveEvents(enabled: boolean) {
+  const queryClient = useQueryClient()
+
+  useEffect(() => {
+    if (!enabled) return
+
+    return subscribeEvents((event) => {
+      switch (event.type) {
+        case 'stats':
+          queryClient.setQueryData(['stats'], event.data as Stats)
+          break
+        case 'agent.connect':
+        case 'agent.disconnect':
+          queryClient.invalidateQueries({ queryKey: ['agents'] })
+          break
+        case 'tunnel.open':
+        case 'tunnel.close':
+          queryClient.invalidateQueries({ queryKey: ['agents'] })
+          queryClient.invalidateQueries({ queryKey: ['tunnels'] })
+          break
+        case 'rule.start':
+        case 'rule.stop':
+        case 'rule.traffic_limit':
+          queryClient.invalidateQueries({ queryKey: ['forward-rules'] })
+          break
+      }
+    })
+  }, [enabled, queryClient])
+}
@@ -10,7 +10,7 @@ export function AgentsPage() {
   const { data: agents, isLoading, refetch } = useQuery({
     queryKey: ['agents'],
     queryFn: api.getAgents,
-    refetchInterval: 5000,
+    refetchInterval: 30000, // Fallback, updates arrive on the event stream
   })
 
   const { data: stats } = useQuery({
@@ -122,7 +122,7 @@ export function AgentsPage() {
           ) : (
             <div className="text-center py-12 text-muted-foreground">
               <Server className="w-12 h-12 mx-auto mb-4 opacity-50" />
-              <p>暂无 Agent 连接</p>
+              <p>暂无 Agent</p>
               <p className="text-sm mt-2">运行 Agent 客户端连接到此服务器</p>
             </div>
           )}
@@ -159,6 +159,19 @@ function AgentCard({ agent }: { agent: Agent }) {
               <span>最后活动: {timeAgo(new Date(agent.lastSeen))}</span>
             )}
           </div>
+          {(agent.version || agent.os || agent.labels) && (
+            <div className="flex flex-wrap items-center gap-2 mt-2">
+              {agent.version && (
+                <Badge variant="outline" className="text-xs">{agent.version}</Badge>
+              )}
+              {agent.os && (
+                <Badge variant="outline" className="text-xs">{agent.os}/{agent.arch}</Badge>
+              )}
+              {Object.entries(agent.labels || {}).map(([k, v]) => (
+                <Badge key={k} variant="secondary" className="text-xs">{k}={v}</Badge>
+              ))}
+            </div>
+          )}
         </div>
       </div>
       <div className="flex items-center gap-4">
@@ -0,0 +1,141 @@
+import { useState } from 'react'
+import { useQuery } from '@tanstack/react-query'
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/components/ui/card'
+import { Button } from '@/components/ui/button'
+import { Input } from '@/components/ui/input'
+import { Badge } from '@/components/ui/badge'
+import { api, AuditEvent } from '@/api/client'
+import { ScrollText, RefreshCw, ChevronLeft, ChevronRight } from 'lucide-react'
+
+const PAGE_SIZE = 50
+
+export function AuditPage() {
+  const [page, setPage] = useState(1)
+  const [action, setAction] = useState('')
+  const [actor, setActor] = useState('')
+
+  const { data, isLoading, refetch } = useQuery({
+    queryKey: ['audit', page, action, actor],
+    queryFn: () => api.getAuditEvents({ page, pageSize: PAGE_SIZE, action, actor }),
+  })
+
+  const totalPages = data ? Math.max(1, Math.ceil(data.total / PAGE_SIZE)) : 1
+
+  return (
+    <Card className="bg-card/50 border-border/50">
+      <CardHeader className="flex flex-row items-center justify-between">
+        <div>
+          <CardTitle className="text-lg flex items-center gap-2">
+            <ScrollText className="w-5 h-5" />
+            审计日志
+          </CardTitle>
+          <CardDescription>
+            管理操作与 Agent 连接事件记录
+          </CardDescription>
+        </div>
+        <Button variant="outline" size="sm" onClick={() => refetch()}>
+          <RefreshCw className="w-4 h-4 mr-2" />
+          刷新
+        </Button>
+      </CardHeader>
+      <CardContent className="space-y-4">
+        {/* Filters */}
+        <div className="flex gap-2">
+          <Input
+            placeholder="操作 (例如: rule 或 agent.connect)"
+            value={action}
+            onChange={(e) => { setAction(e.target.value); setPage(1) }}
+          />
+          <Input
+            placeholder="操作者"
+            value={actor}
+            onChange={(e) => { setActor(e.target.value); setPage(1) }}
+          />
+        </div>
+
+        {isLoading ? (
+          <div className="flex items-center justify-center py-8">
+            <RefreshCw className="w-6 h-6 animate-spin text-muted-foreground" />
+          </div>
+        ) : data && data.events.length > 0 ? (
+          <div className="space-y-2">
+            {data.events.map((event) => (
+              <AuditRow key={event.id} event={event} />
+            ))}
+          </div>
+        ) : (
+          <div className="text-center py-8 text-muted-foreground">
+            <ScrollText className="w-12 h-12 mx-auto mb-4 opacity-50" />
+            <p>暂无审计记录</p>
+          </div>
+        )}
+
+        {/* Pagination */}
+        <div className="flex items-center justify-between text-sm text-muted-foreground">
+          <span>共 {data?.total || 0} 条</span>
+          <div className="flex items-center gap-2">
+            <Button
+              variant="ghost"
+              size="icon"
+              onClick={() => setPage(page - 1)}
+              disabled={page <= 1}
+            >
+              <ChevronLeft className="w-4 h-4" />
+            </Button>
+            <span>{page} / {totalPages}</span>
+            <Button
+              variant="ghost"
+              size="icon"
+              onClick={() => setPage(page + 1)}
+              disabled={page >= totalPages}
+            >
+              <ChevronRight className="w-4 h-4" />
+            </Button>
+          </div>
+        </div>
+      </CardContent>
+    </Card>
+  )
+}
+
+function AuditRow({ event }: { event: AuditEvent }) {
+  const [expanded, setExpanded] = useState(false)
+  const hasDetails = event.before !== undefined || event.after !== undefined
+
+  return (
+    <div className="p-3 rounded-lg border border-border/50 bg-background/50">
+      <div
+        className={`flex items-center justify-between gap-3 ${hasDetails ? 'cursor-pointer' : ''}`}
+        onClick={() => hasDetails && setExpanded(!expanded)}
+      >
+        <div className="flex items-center gap-3 min-w-0">
+          <Badge variant="outline" className="font-mono text-xs">{event.action}</Badge>
+          <span className="font-medium truncate">{event.actor || '-'}</span>
+          {event.targetId && (
+            <span className="text-xs text-muted-foreground font-mono truncate">
+              {event.targetType} {event.targetId.slice(0, 8)}
+            </span>
+          )}
+        </div>
+        <div className="flex items-center gap-3 text-xs text-muted-foreground flex-shrink-0">
+          {event.clientIp && <span>{event.clientIp}</span>}
+          <span>{new Date(event.time).toLocaleString()}</span>
+        </div>
+      </div>
+      {expanded && (
+        <div className="grid grid-cols-1 md:grid-cols-2 gap-2 mt-3">
+          {event.before !== undefined && (
+            <pre className="p-2 rounded bg-background border border-border/50 text-xs overflow-auto">
+              {JSON.stringify(event.before, null, 2)}
+            </pre>
+          )}
+          {event.after !== undefined && (
+            <pre className="p-2 rounded bg-background border border-border/50 text-xs overflow-auto">
+              {JSON.stringify(event.after, null, 2)}
+            </pre>
+          )}
+        </div>
+      )}
+    </div>
+  )
+}
@@ -22,9 +22,9 @@ import {
   SelectTrigger,
   SelectValue,
 } from '@/components/ui/select'
-import { api, ForwardRule, ForwardType, Agent } from '@/api/client'
+import { api, ForwardRule, ForwardRuleSecrets, ForwardType, Agent, Tunnel } from '@/api/client'
 import { formatBytes, formatSpeed } from '@/lib/utils'
-import { Plus, Trash2, ArrowRight, RefreshCw, Gauge } from 'lucide-react'
+import { Plus, Trash2, ArrowRight, RefreshCw, Gauge, Lock, ShieldCheck } from 'lucide-react'
 
 export function ForwardingPage() {
   const queryClient = useQueryClient()
@@ -41,6 +41,12 @@ export function ForwardingPage() {
     queryFn: api.getAgents,
   })
 
+  const { data: tunnels } = useQuery({
+    queryKey: ['tunnels'],
+    queryFn: api.getTunnels,
+    refetchInterval: 5000,
+  })
+
   const createMutation = useMutation({
     mutationFn: api.createForwardRule,
     onSuccess: () => {
@@ -101,6 +107,7 @@ export function ForwardingPage() {
                   key={rule.id}
                   rule={rule}
                   agents={agents || []}
+                  tunnels={(tunnels || []).filter(t => t.ruleId === rule.id)}
                   onToggle={(enabled) => toggleMutation.mutate({ id: rule.id, enabled })}
                   onDelete={() => deleteMutation.mutate(rule.id)}
                 />
@@ -122,16 +129,20 @@ export function ForwardingPage() {
 function RuleCard({
   rule,
   agents,
+  tunnels,
   onToggle,
   onDelete,
 }: {
   rule: ForwardRule
   agents: Agent[]
+  tunnels: Tunnel[]
   onToggle: (enabled: boolean) => void
   onDelete: () => void
 }) {
   const sourceAgent = agents.find(a => a.id === rule.sourceAgentId)
   const targetAgent = agents.find(a => a.id === rule.targetAgentId)
+  const directTunnels = tunnels.filter(t => t.path === 'direct').length
+  const relayTunnels = tunnels.filter(t => t.path === 'relay').length
 
   // Determine display based on forward type
   const getTypeLabel = () => {
@@ -155,6 +166,9 @@ function RuleCard({
 
   // Determine the listen side display
   const getListenSide = () => {
+    if (rule.protocol === 'http' || rule.protocol === 'tls-sni') {
+      return `${(rule.domains || []).join(', ')}${rule.pathPrefix || ''}`
+    }
     switch (rule.type) {
       case 'cloud-direct':
       case 'cloud-self':
@@ -203,6 +217,16 @@ function RuleCard({
           <Badge variant="outline" className="text-xs">
             {getTypeLabel()}
           </Badge>
+          {rule.encrypted && (
+            <span title="端到端加密">
+              <Lock className="w-3 h-3 text-muted-foreground" />
+            </span>
+          )}
+          {(rule.basicAuthUser || rule.bearerAuth) && (
+            <span title="需要认证">
+              <ShieldCheck className="w-3 h-3 text-muted-foreground" />
+            </span>
+          )}
           <span className="text-sm font-mono">
             {getListenSide()}
           </span>
@@ -226,6 +250,29 @@ function RuleCard({
               <span>限速: {formatSpeed(rule.rateLimit)}</span>
             </div>
           )}
+          {rule.compression && (
+            <div>
+              压缩: {rule.compression}
+              {rule.compressionRatio ? ` (${rule.compressionRatio}x)` : ''}
+            </div>
+          )}
+          {rule.proxyProtocol && <div>PROXY 协议: {rule.proxyProtocol}</div>}
+          {(rule.maxConns ?? 0) > 0 && <div>连接上限: {rule.maxConns}</div>}
+          {(rule.rejected ?? 0) > 0 && <div>已拒绝: {rule.rejected}</div>}
+          {directTunnels + relayTunnels > 0 && (
+            <div className="flex items-center justify-end gap-1">
+              {directTunnels > 0 && (
+                <Badge variant="success" className="text-xs" title="客户端之间直接传输">
+                  直连 {directTunnels}
+                </Badge>
+              )}
+              {relayTunnels > 0 && (
+                <Badge variant="outline" className="text-xs" title="经云端中转">
+                  中继 {relayTunnels}
+                </Badge>
+              )}
+            </div>
+          )}
         </div>
         <Badge variant={rule.enabled ? 'success' : 'outline'}>
           {rule.enabled ? '运行中' : '已停止'}
@@ -241,14 +288,45 @@ function RuleCard({
 interface CreateRuleForm {
   name: string
   type: ForwardType
-  protocol: 'tcp' | 'udp'
+  protocol: 'tcp' | 'udp' | 'http' | 'tls-sni'
   sourceAgentId: string
   listenPort: string
+  domains: string        // http and tls-sni rules, comma separated
+  pathPrefix: string
   targetAgentId: string
   targetHost: string
   targetPort: string
   rateLimit: string      // MB/s, empty = unlimited
   trafficLimit: string   // GB, empty = unlimited
+  compression: '' | 'zstd' | 'snappy'
+  encrypted: boolean
+  proxyProtocol: '' | 'v1' | 'v2'  // tcp and tls-sni rules
+  allowCidrs: string     // cloud-agent and cloud-direct rules, comma separated
+  denyCidrs: string
+  allowCountries: string
+  denyCountries: string
+  maxConns: string       // cloud-agent and cloud-direct tcp and tls-sni rules, empty = unlimited
+  maxConnRate: string
+  maxConnsPerIp: string
+  basicAuthUser: string  // http rules
+  basicAuthPassword: string
+  bearerToken: string
+  hostRewrite: string
+  requestHeaders: string // one "Name: value" per line
+  forwardedFor: boolean
+  accessLog: boolean
+}
+
+// parseHeaders parses "Name: value" lines, an empty value removes the header
+function parseHeaders(text: string): Record<string, string> | undefined {
+  const headers: Record<string, string> = {}
+  for (const line of text.split('\n')) {
+    const i = line.indexOf(':')
+    if (i > 0) {
+      headers[line.slice(0, i).trim()] = line.slice(i + 1).trim()
+    }
+  }
+  return Object.keys(headers).length > 0 ? headers : undefined
 }
 
 function CreateRuleDialog({
@@ -257,7 +335,7 @@ function CreateRuleDialog({
   isLoading,
 }: {
   agents: Agent[]
-  onSubmit: (rule: Omit<ForwardRule, 'id' | 'enabled' | 'createdAt' | 'trafficUsed'>) => void
+  onSubmit: (rule: Omit<ForwardRule, 'id' | 'enabled' | 'createdAt' | 'trafficUsed'> & ForwardRuleSecrets) => void
   isLoading: boolean
 }) {
   const [form, setForm] = useState<CreateRuleForm>({
@@ -266,11 +344,30 @@ function CreateRuleDialog({
     protocol: 'tcp',
     sourceAgentId: '',
     listenPort: '',
+    domains: '',
+    pathPrefix: '',
     targetAgentId: '',
     targetHost: '127.0.0.1',
     targetPort: '',
     rateLimit: '',
     trafficLimit: '',
+    compression: '',
+    encrypted: false,
+    proxyProtocol: '',
+    allowCidrs: '',
+    denyCidrs: '',
+    allowCountries: '',
+    denyCountries: '',
+    maxConns: '',
+    maxConnRate: '',
+    maxConnsPerIp: '',
+    basicAuthUser: '',
+    basicAuthPassword: '',
+    bearerToken: '',
+    hostRewrite: '',
+    requestHeaders: '',
+    forwardedFor: false,
+    accessLog: false,
   })
 
   const handleSubmit = (e: React.FormEvent) => {
@@ -282,18 +379,47 @@ function CreateRuleDialog({
     // Determine which fields to include based on type
     const needsSourceAgent = form.type === 'agent-cloud' || form.type === 'agent-agent'
     const needsTargetAgent = form.type === 'cloud-agent' || form.type === 'agent-agent'
+    const isHTTP = form.protocol === 'http'
+    const routedByHost = isHTTP || form.protocol === 'tls-sni'
+    const cloudListens = form.type === 'cloud-agent' || form.type === 'cloud-direct'
+    const list = (text: string) => text.split(',').map((s) => s.trim()).filter(Boolean)
     
     onSubmit({
       name: form.name,
       type: form.type,
       protocol: form.protocol,
       sourceAgentId: needsSourceAgent ? form.sourceAgentId : undefined,
-      listenPort: parseInt(form.listenPort),
+      listenPort: routedByHost ? 0 : parseInt(form.listenPort),
+      domains: routedByHost ? form.domains.split(',').map((d) => d.trim()).filter(Boolean) : undefined,
+      pathPrefix: isHTTP ? form.pathPrefix : undefined,
       targetAgentId: needsTargetAgent ? form.targetAgentId : undefined,
       targetHost: form.targetHost,
       targetPort: parseInt(form.targetPort),
       rateLimit: rateLimitBytes,
       trafficLimit: trafficLimitBytes,
+      compression: form.protocol === 'tcp' || isHTTP ? form.compression : '',
+      encrypted: form.type === 'agent-agent' && form.protocol === 'tcp' && form.encrypted,
+      proxyProtocol: form.protocol === 'tcp' || form.protocol === 'tls-sni' ? form.proxyProtocol : '',
+      ...(cloudListens && {
+        allowCidrs: list(form.allowCidrs),
+        denyCidrs: list(form.denyCidrs),
+        allowCountries: list(form.allowCountries),
+        denyCountries: list(form.denyCountries),
+      }),
+      ...(cloudListens && (form.protocol === 'tcp' || form.protocol === 'tls-sni') && {
+        maxConns: parseInt(form.maxConns) || 0,
+        maxConnRate: parseInt(form.maxConnRate) || 0,
+        maxConnsPerIp: parseInt(form.maxConnsPerIp) || 0,
+      }),
+      ...(isHTTP && {
+        basicAuthUser: form.basicAuthUser || undefined,
+        basicAuthPassword: form.basicAuthPassword || undefined,
+        bearerToken: form.bearerToken || undefined,
+        hostRewrite: form.hostRewrite || undefined,
+        requestHeaders: parseHeaders(form.requestHeaders),
+        forwardedFor: form.forwardedFor,
+        accessLog: form.accessLog,
+      }),
     })
   }
 
@@ -317,7 +443,15 @@ function CreateRuleDialog({
         <div className="grid grid-cols-2 gap-4">
           <div className="grid gap-2">
             <Label>转发类型</Label>
-            <Select value={form.type} onValueChange={(v) => setForm({ ...form, type: v as ForwardType })}>
+            <Select
+              value={form.type}
+              onValueChange={(v) => setForm({
+                ...form,
+                type: v as ForwardType,
+                // Only cloud-agent rules are routed by host
+                protocol: (form.protocol === 'http' || form.protocol === 'tls-sni') && v !== 'cloud-agent' ? 'tcp' : form.protocol,
+              })}
+            >
               <SelectTrigger>
                 <SelectValue />
               </SelectTrigger>
@@ -331,13 +465,19 @@ function CreateRuleDialog({
           </div>
           <div className="grid gap-2">
             <Label>协议</Label>
-            <Select value={form.protocol} onValueChange={(v) => setForm({ ...form, protocol: v as 'tcp' | 'udp' })}>
+            <Select value={form.protocol} onValueChange={(v) => setForm({ ...form, protocol: v as CreateRuleForm['protocol'] })}>
               <SelectTrigger>
                 <SelectValue />
               </SelectTrigger>
               <SelectContent>
                 <SelectItem value="tcp">TCP</SelectItem>
                 <SelectItem value="udp">UDP</SelectItem>
+                {form.type === 'cloud-agent' && (
+                  <SelectItem value="http">HTTP（按域名路由）</SelectItem>
+                )}
+                {form.type === 'cloud-agent' && (
+                  <SelectItem value="tls-sni">TLS（按 SNI 路由，不解密）</SelectItem>
+                )}
               </SelectContent>
             </Select>
           </div>
@@ -350,22 +490,47 @@ function CreateRuleDialog({
                 <SelectValue placeholder="选择源 Agent" />
               </SelectTrigger>
               <SelectContent>
-                {agents.filter(a => a.online).map((agent) => (
-                  <SelectItem key={agent.id} value={agent.id}>{agent.name}</SelectItem>
+                {agents.map((agent) => (
+                  <SelectItem key={agent.id} value={agent.id}>
+                    {agent.name}{!agent.online && '（离线）'}
+                  </SelectItem>
                 ))}
               </SelectContent>
             </Select>
           </div>
         )}
-        <div className="grid gap-2">
-          <Label>监听端口</Label>
-          <Input
-            type="number"
-            placeholder="8080"
-            value={form.listenPort}
-            onChange={(e) => setForm({ ...form, listenPort: e.target.value })}
-          />
-        </div>
+        {form.protocol === 'http' || form.protocol === 'tls-sni' ? (
+          <div className="grid grid-cols-2 gap-4">
+            <div className={form.protocol === 'http' ? 'grid gap-2' : 'grid gap-2 col-span-2'}>
+              <Label>域名</Label>
+              <Input
+                placeholder="app.example.com, *.example.com"
+                value={form.domains}
+                onChange={(e) => setForm({ ...form, domains: e.target.value })}
+              />
+            </div>
+            {form.protocol === 'http' && (
+              <div className="grid gap-2">
+                <Label>路径前缀</Label>
+                <Input
+                  placeholder="全部路径"
+                  value={form.pathPrefix}
+                  onChange={(e) => setForm({ ...form, pathPrefix: e.target.value })}
+                />
+              </div>
+            )}
+          </div>
+        ) : (
+          <div className="grid gap-2">
+            <Label>监听端口</Label>
+            <Input
+              type="number"
+              placeholder="8080"
+              value={form.listenPort}
+              onChange={(e) => setForm({ ...form, listenPort: e.target.value })}
+            />
+          </div>
+        )}
         {(form.type === 'cloud-agent' || form.type === 'agent-agent') && (
           <div className="grid gap-2">
             <Label>目标 Agent（转发端）</Label>
@@ -374,8 +539,10 @@ function CreateRuleDialog({
                 <SelectValue placeholder="选择目标 Agent" />
               </SelectTrigger>
               <SelectContent>
-                {agents.filter(a => a.online).map((agent) => (
-                  <SelectItem key={agent.id} value={agent.id}>{agent.name}</SelectItem>
+                {agents.map((agent) => (
+                  <SelectItem key={agent.id} value={agent.id}>
+                    {agent.name}{!agent.online && '（离线）'}
+                  </SelectItem>
                 ))}
               </SelectContent>
             </Select>
@@ -400,6 +567,77 @@ function CreateRuleDialog({
             />
           </div>
         </div>
+        {(form.type === 'cloud-agent' || form.type === 'cloud-direct') && (
+          <>
+            <div className="grid grid-cols-2 gap-4">
+              <div className="grid gap-2">
+                <Label>允许的 IP/CIDR</Label>
+                <Input
+                  placeholder="全部"
+                  value={form.allowCidrs}
+                  onChange={(e) => setForm({ ...form, allowCidrs: e.target.value })}
+                />
+              </div>
+              <div className="grid gap-2">
+                <Label>拒绝的 IP/CIDR</Label>
+                <Input
+                  placeholder="10.0.0.0/8, 203.0.113.7"
+                  value={form.denyCidrs}
+                  onChange={(e) => setForm({ ...form, denyCidrs: e.target.value })}
+                />
+              </div>
+            </div>
+            <div className="grid grid-cols-2 gap-4">
+              <div className="grid gap-2">
+                <Label>允许的国家</Label>
+                <Input
+                  placeholder="CN, HK"
+                  value={form.allowCountries}
+                  onChange={(e) => setForm({ ...form, allowCountries: e.target.value })}
+                />
+              </div>
+              <div className="grid gap-2">
+                <Label>拒绝的国家</Label>
+                <Input
+                  placeholder="需要 GeoIP 数据库"
+                  value={form.denyCountries}
+                  onChange={(e) => setForm({ ...form, denyCountries: e.target.value })}
+                />
+              </div>
+            </div>
+            {(form.protocol === 'tcp' || form.protocol === 'tls-sni') && (
+              <div className="grid grid-cols-3 gap-4">
+                <div className="grid gap-2">
+                  <Label>最大连接数</Label>
+                  <Input
+                    type="number"
+                    placeholder="不限制"
+                    value={form.maxConns}
+                    onChange={(e) => setForm({ ...form, maxConns: e.target.value })}
+                  />
+                </div>
+                <div className="grid gap-2">
+                  <Label>每秒新建连接</Label>
+                  <Input
+                    type="number"
+                    placeholder="不限制"
+                    value={form.maxConnRate}
+                    onChange={(e) => setForm({ ...form, maxConnRate: e.target.value })}
+                  />
+                </div>
+                <div className="grid gap-2">
+                  <Label>单 IP 连接数</Label>
+                  <Input
+                    type="number"
+                    placeholder="不限制"
+                    value={form.maxConnsPerIp}
+                    onChange={(e) => setForm({ ...form, maxConnsPerIp: e.target.value })}
+                  />
+                </div>
+              </div>
+            )}
+          </>
+        )}
         <div className="grid grid-cols-2 gap-4">
           <div className="grid gap-2">
             <Label>速率限制 (MB/s)</Label>
@@ -420,6 +658,126 @@ function CreateRuleDialog({
             />
           </div>
         </div>
+        {(form.protocol === 'tcp' || form.protocol === 'http') && form.type !== 'cloud-direct' && (
+          <div className="grid gap-2">
+            <Label>压缩</Label>
+            <Select
+              value={form.compression || 'none'}
+              onValueChange={(v) => setForm({ ...form, compression: v === 'none' ? '' : v as 'zstd' | 'snappy' })}
+            >
+              <SelectTrigger>
+                <SelectValue />
+              </SelectTrigger>
+              <SelectContent>
+                <SelectItem value="none">不压缩</SelectItem>
+                <SelectItem value="zstd">zstd（压缩率高）</SelectItem>
+                <SelectItem value="snappy">snappy（CPU 开销低）</SelectItem>
+              </SelectContent>
+            </Select>
+          </div>
+        )}
+        {(form.protocol === 'tcp' || form.protocol === 'tls-sni') && (
+          <div className="grid gap-2">
+            <Label>PROXY 协议</Label>
+            <Select
+              value={form.proxyProtocol || 'none'}
+              onValueChange={(v) => setForm({ ...form, proxyProtocol: v === 'none' ? '' : v as 'v1' | 'v2' })}
+            >
+              <SelectTrigger>
+                <SelectValue />
+              </SelectTrigger>
+              <SelectContent>
+                <SelectItem value="none">不发送</SelectItem>
+                <SelectItem value="v1">v1（文本）</SelectItem>
+                <SelectItem value="v2">v2（二进制）</SelectItem>
+              </SelectContent>
+            </Select>
+            <span className="text-xs text-muted-foreground">向目标服务传递客户端的真实地址，目标服务需支持 PROXY 协议</span>
+          </div>
+        )}
+        {form.type === 'agent-agent' && form.protocol === 'tcp' && (
+          <div className="flex items-center justify-between">
+            <div className="grid gap-1">
+              <Label>端到端加密</Label>
+              <span className="text-xs text-muted-foreground">数据在两个 Agent 之间加密，Cloud 只负责转发</span>
+            </div>
+            <Switch
+              checked={form.encrypted}
+              onCheckedChange={(checked) => setForm({ ...form, encrypted: checked })}
+            />
+          </div>
+        )}
+        {form.protocol === 'http' && (
+          <>
+            <div className="grid grid-cols-2 gap-4">
+              <div className="grid gap-2">
+                <Label>Basic 认证用户名</Label>
+                <Input
+                  placeholder="不认证"
+                  value={form.basicAuthUser}
+                  onChange={(e) => setForm({ ...form, basicAuthUser: e.target.value })}
+                />
+              </div>
+              <div className="grid gap-2">
+                <Label>Basic 认证密码</Label>
+                <Input
+                  type="password"
+                  value={form.basicAuthPassword}
+                  onChange={(e) => setForm({ ...form, basicAuthPassword: e.target.value })}
+                />
+              </div>
+            </div>
+            <div className="grid grid-cols-2 gap-4">
+              <div className="grid gap-2">
+                <Label>Bearer Token</Label>
+                <Input
+                  type="password"
+                  placeholder="不认证"
+                  value={form.bearerToken}
+                  onChange={(e) => setForm({ ...form, bearerToken: e.target.value })}
+                />
+              </div>
+              <div className="grid gap-2">
+                <Label>改写 Host</Label>
+                <Input
+                  placeholder="保持请求的域名"
+                  value={form.hostRewrite}
+                  onChange={(e) => setForm({ ...form, hostRewrite: e.target.value })}
+                />
+              </div>
+            </div>
+            <div className="grid gap-2">
+              <Label>请求头</Label>
+              <textarea
+                className="flex min-h-[72px] w-full rounded-md border border-input bg-background px-3 py-2 text-sm font-mono ring-offset-background placeholder:text-muted-foreground focus-visible:outline-none focus-visible:ring-2 focus-visible:ring-ring focus-visible:ring-offset-2"
+                placeholder={'X-Api-Key: secret\nCookie:'}
+                value={form.requestHeaders}
+                onChange={(e) => setForm({ ...form, requestHeaders: e.target.value })}
+              />
+              <span className="text-xs text-muted-foreground">每行一个 “名称: 值”，值为空则删除该请求头</span>
+            </div>
+            <div className="flex items-center justify-between">
+              <div className="grid gap-1">
+                <Label>X-Forwarded-For</Label>
+                <span className="text-xs text-muted-foreground">告诉目标服务访问者的 IP、域名和协议</span>
+              </div>
+              <Switch
+                checked={form.forwardedFor}
+                onCheckedChange={(checked) => setForm({ ...form, forwardedFor: checked })}
+              />
+            </div>
+            <div className="flex items-center justify-between">
+              <div className="grid gap-1">
+                <Label>访问日志</Label>
+                <span className="text-xs text-muted-foreground">记录每个请求的方法、路径、状态码、耗时和字节数</span>
+              </div>
+              <Switch
+                checked={form.accessLog}
+                onCheckedChange={(checked) => setForm({ ...form, accessLog: checked })}
+              />
+            </div>
+          </>
+        )}
       </div>
       <DialogFooter>
         <Button type="submit" disabled={isLoading}>
@@ -0,0 +1,91 @@
+import { useState } from 'react'
+import { useMutation } from '@tanstack/react-query'
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/components/ui/card'
+import { Button } from '@/components/ui/button'
+import { Input } from '@/components/ui/input'
+import { Label } from '@/components/ui/label'
+import { api, auth, UnauthorizedError } from '@/api/client'
+import { Network, LogIn } from 'lucide-react'
+
+interface LoginPageProps {
+  onLogin: (username: string) => void
+}
+
+export function LoginPage({ onLogin }: LoginPageProps) {
+  const [username, setUsername] = useState('')
+  const [password, setPassword] = useState('')
+
+  const loginMutation = useMutation({
+    mutationFn: () => api.login(username, password),
+    onSuccess: (resp) => {
+      auth.setToken(resp.token)
+      setPassword('')
+      onLogin(resp.username)
+    },
+  })
+
+  const errorMessage = loginMutation.error
+    ? loginMutation.error instanceof UnauthorizedError
+      ? '用户名或密码错误'
+      : loginMutation.error.message
+    : null
+
+  return (
+    <div className="min-h-screen bg-background grid-background flex items-center justify-center px-6">
+      <Card className="w-full max-w-sm bg-card/50 border-border/50">
+        <CardHeader>
+          <div className="w-10 h-10 rounded-lg bg-gradient-to-br from-primary to-accent flex items-center justify-center mb-2">
+            <Network className="w-5 h-5 text-white dark:text-background" />
+          </div>
+          <CardTitle className="text-lg">登录 natsvr</CardTitle>
+          <CardDescription>
+            使用管理员账号或服务器 Token 登录
+          </CardDescription>
+        </CardHeader>
+        <CardContent>
+          <form
+            className="space-y-4"
+            onSubmit={(e) => {
+              e.preventDefault()
+              if (password) {
+                loginMutation.mutate()
+              }
+            }}
+          >
+            <div className="space-y-2">
+              <Label htmlFor="username">用户名</Label>
+              <Input
+                id="username"
+                placeholder="admin"
+                autoComplete="username"
+                value={username}
+                onChange={(e) => setUsername(e.target.value)}
+              />
+            </div>
+            <div className="space-y-2">
+              <Label htmlFor="password">密码 / Token</Label>
+              <Input
+                id="password"
+                type="password"
+                autoComplete="current-password"
+                value={password}
+                onChange={(e) => setPassword(e.target.value)}
+              />
+            </div>
+            {errorMessage && (
+              <p className="text-sm text-destructive">{errorMessage}</p>
+            )}
+            <Button
+              type="submit"
+              className="w-full"
+              disabled={!password || loginMutation.isPending}
+            >
+              <LogIn className="w-4 h-4 mr-2" />
+              登录
+            </Button>
+          </form>
+        </CardContent>
+      </Card>
+    </div>
+  )
+}
@@ -5,8 +5,8 @@ import { Button } from '@/components/ui/button'
 import { Input } from '@/components/ui/input'
 import { Label } from '@/components/ui/label'
 import { Badge } from '@/components/ui/badge'
-import { api } from '@/api/client'
-import { Copy, Plus, Trash2, Key, RefreshCw, Info, Eye, EyeOff, Check } from 'lucide-react'
+import { api, type Token } from '@/api/client'
+import { Copy, Plus, Trash2, Key, RefreshCw, Info, Eye, EyeOff, Check, RotateCw } from 'lucide-react'
 
 export function SettingsPage() {
   const queryClient = useQueryClient()
@@ -14,6 +14,8 @@ export function SettingsPage() {
   const [copiedId, setCopiedId] = useState<string | null>(null)
   const [expandedTokens, setExpandedTokens] = useState<Set<string>>(new Set())
   const [newlyCreatedTokenId, setNewlyCreatedTokenId] = useState<string | null>(null)
+  // 完整 Token 只在创建或轮换时返回一次
+  const [secrets, setSecrets] = useState<Record<string, string>>({})
 
   const { data: tokens, isLoading } = useQuery({
     queryKey: ['tokens'],
@@ -31,11 +33,15 @@ export function SettingsPage() {
     onSuccess: (newToken) => {
       queryClient.invalidateQueries({ queryKey: ['tokens'] })
       setNewTokenName('')
-      // 自动展开新创建的 token
-      setExpandedTokens(prev => new Set([...prev, newToken.id]))
-      setNewlyCreatedTokenId(newToken.id)
-      // 5秒后移除高亮
-      setTimeout(() => setNewlyCreatedTokenId(null), 5000)
+      showSecret(newToken)
+    },
+  })
+
+  const rotateMutation = useMutation({
+    mutationFn: (id: string) => api.rotateToken(id),
+    onSuccess: (rotated) => {
+      queryClient.invalidateQueries({ queryKey: ['tokens'] })
+      showSecret(rotated)
     },
   })
 
@@ -46,6 +52,17 @@ export function SettingsPage() {
     },
   })
 
+  const showSecret = (token: Token) => {
+    if (token.token) {
+      setSecrets(prev => ({ ...prev, [token.id]: token.token! }))
+    }
+    // 自动展开新创建的 token
+    setExpandedTokens(prev => new Set([...prev, token.id]))
+    setNewlyCreatedTokenId(token.id)
+    // 5秒后移除高亮
+    setTimeout(() => setNewlyCreatedTokenId(null), 5000)
+  }
+
   const copyToClipboard = async (text: string, id: string) => {
     try {
       await navigator.clipboard.writeText(text)
@@ -114,6 +131,7 @@ export function SettingsPage() {
                 const isExpanded = expandedTokens.has(token.id)
                 const isCopied = copiedId === token.id
                 const isNewlyCreated = newlyCreatedTokenId === token.id
+                const secret = secrets[token.id]
                 
                 return (
                   <div
@@ -132,15 +150,18 @@ export function SettingsPage() {
                         <div className="flex-1 min-w-0">
                           <p className="font-medium mb-1">{token.name}</p>
                           <div className="space-y-1">
-                            {isExpanded ? (
+                            {secret && isExpanded ? (
                               <div className="space-y-2">
                                 <div 
                                   className="p-2 rounded bg-background border border-border/50 font-mono text-xs break-all cursor-pointer hover:bg-accent/50 transition-colors"
-                                  onClick={() => copyToClipboard(token.token, token.id)}
+                                  onClick={() => copyToClipboard(secret, token.id)}
                                   title="点击复制完整 Token"
                                 >
-                                  {token.token}
+                                  {secret}
                                 </div>
+                                <p className="text-xs text-muted-foreground">
+                                  请立即保存，Token 只显示这一次
+                                </p>
                                 {isCopied && (
                                   <p className="text-xs text-primary flex items-center gap-1">
                                     <Check className="w-3 h-3" />
@@ -150,7 +171,12 @@ export function SettingsPage() {
                               </div>
                             ) : (
                               <p className="text-xs text-muted-foreground font-mono">
-                                {token.token.slice(0, 8)}...{token.token.slice(-8)}
+                                {token.prefix}...
+                              </p>
+                            )}
+                            {token.previousExpiresAt && (
+                              <p className="text-xs text-muted-foreground">
+                                旧 Token 有效至 {new Date(token.previousExpiresAt).toLocaleString()}
                               </p>
                             )}
                           </div>
@@ -160,29 +186,42 @@ export function SettingsPage() {
                         <Badge variant="outline" className="text-xs">
                           {token.usageCount} 次使用
                         </Badge>
+                        {secret && (
+                          <>
+                            <Button
+                              variant="ghost"
+                              size="icon"
+                              onClick={() => toggleTokenExpansion(token.id)}
+                              title={isExpanded ? "隐藏完整 Token" : "显示完整 Token"}
+                            >
+                              {isExpanded ? (
+                                <EyeOff className="w-4 h-4" />
+                              ) : (
+                                <Eye className="w-4 h-4" />
+                              )}
+                            </Button>
+                            <Button
+                              variant="ghost"
+                              size="icon"
+                              onClick={() => copyToClipboard(secret, token.id)}
+                              title="复制 Token"
+                            >
+                              {isCopied ? (
+                                <Check className="w-4 h-4 text-primary" />
+                              ) : (
+                                <Copy className="w-4 h-4" />
+                              )}
+                            </Button>
+                          </>
+                        )}
                         <Button
                           variant="ghost"
                           size="icon"
-                          onClick={() => toggleTokenExpansion(token.id)}
-                          title={isExpanded ? "隐藏完整 Token" : "显示完整 Token"}
-                        >
-                          {isExpanded ? (
-                            <EyeOff className="w-4 h-4" />
-                          ) : (
-                            <Eye className="w-4 h-4" />
-                          )}
-                        </Button>
-                        <Button
-                          variant="ghost"
-                          size="icon"
-                          onClick={() => copyToClipboard(token.token, token.id)}
-                          title="复制 Token"
+                          onClick={() => rotateMutation.mutate(token.id)}
+                          disabled={rotateMutation.isPending}
+                          title="轮换 Token（旧 Token 24 小时内仍有效）"
                         >
-                          {isCopied ? (
-                            <Check className="w-4 h-4 text-primary" />
-                          ) : (
-                            <Copy className="w-4 h-4" />
-                          )}
+                          <RotateCw className="w-4 h-4" />
                         </Button>
                         <Button
                           variant="ghost"